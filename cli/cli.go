@@ -15,42 +15,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"kunaio"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const (
-	USAGE = "Usage:\n" +
-		"\t%s -h|--help                show this memo;\n" +
-		"\t%s time                     show current server time;\n" +
-		"\t%s [options] stats          show latest trade statistics;\n" +
-		"\t%s [options] [--uah] sell LIMIT\n" +
-		"\t                            show order book - asks;\n" +
-		"\t%s [options] [--uah] buy LIMIT\n" +
-		"\t                            show order book - bids;\n" +
-		"\t%s [options] history        show trade history;\n" +
-		"\t%s [options] userinfo       show user info and assets;\n" +
-		"\t%s [options] userorders     show current orders for user;\n" +
-		"\t%s [options] usertrades     show history of user trades;\n" +
-		"\t%s [options] [--uah] addorder SIDE VOLUME PRICE\n" +
-		"\t                            create new order. SIDE - buy or sell;\n" +
-		"\t                            VOLUME - in ICO; PRICE - price for 1 ICO;\n" +
-		"\t%s [options] delorder ORDER_ID\n" +
-		"\t                            delete existing order;\n" +
-		"\t%s [options] delall         delete all existing orders;\n" +
-		"Options are:\n" +
-		"\t--unix                      print date/time as Unix timestamp.\n" +
-		"\t--market MARKET             set market type. Default is btcuah.\n" +
-		"\t--akey ACCESS_KEY           set API access key.\n" +
-		"\t--skey SECRET_KEY           set API secret key.\n" +
-		"Environment variables:\n" +
-		"\tKUNAIO_MARKET               market type. Default is btcuah.\n" +
-		"\tKUNAIO_ACCESS_KEY           API access key.\n" +
-		"\tKUNAIO_SECRET_KEY           API secret key.\n"
+	// Default DCA journal file name
+	DCA_JOURNAL = "kunaio-dca.journal"
+	// Default conditional orders file name
+	CONDITIONS = "kunaio-conditions.json"
 )
 
 // Configurations
@@ -61,6 +42,133 @@ var (
 	gSKey       string
 	gUAH        bool
 	gUnix       bool
+	gConds      = CONDITIONS
+	gRecordDir  string
+	gReplayDir  string
+	gMaxSkew    = kunaio.DefaultMaxClockSkew
+	gMetrics    *kunaio.Metrics
+	gTrace      string
+	gOTLP       *kunaio.OTLPExporter
+	gProfile    string
+	gConfigPath = defaultConfigPath()
+	gCreds      string
+	gCredStore  = defaultCredStorePath()
+	// Settings given with options or environment variables. They
+	// take precedence over the profile ones.
+	gExplicit = map[string]bool{}
+)
+
+// Table layouts of command results
+var (
+	sellTable = table{
+		head: "SELL:%10s %15s %15s %15s %15s %15s\n",
+		titles: []interface{}{"PRICE", "VOLUME", "FUNDS",
+			"AVG_PRICE", "SUM_VOLUME", "SUM_FUNDS"},
+		row:  "%15.7f %15.7f %15.7f %15.7f %15.7f %15.7f\n",
+		item: kunaio.Order{},
+	}
+	buyTable = table{
+		head:   "BUY:%11s %15s %15s %15s %15s %15s\n",
+		titles: sellTable.titles,
+		row:    sellTable.row,
+		item:   sellTable.item,
+	}
+	historyTable = table{
+		head:   "%24s %15s %15s %15s\n",
+		titles: []interface{}{"WHEN", "PRICE", "VOLUME", "FUNDS"},
+		row:    "%15s %15.7f %15.7f %15.7f\n",
+		item:   kunaio.HistoryEntry{},
+	}
+	userOrdersTable = table{
+		head: "%24s %8s %4s %8s %15s %15s %15s %15s %15s %15s %15s %15s %6s\n",
+		titles: []interface{}{"WHEN", "MARKET", "SIDE", "ID", "PRICE",
+			"AVG_PRICE", "VOLUME", "FUNDS", "REMAINING", "REM_FUNDS",
+			"EXECUTED", "EXEC_FUNDS", "TRADES"},
+		row: "%6s %8s %4s %8d %15.7f %15.7f %15.7f %15.7f " +
+			"%15.7f %15.7f %15.7f %15.7f %6d\n",
+		item: kunaio.Order{},
+	}
+	userTradesTable = table{
+		head: "%24s %4s %15s %15s %15s %15s %15s %15s\n",
+		titles: []interface{}{"WHEN", "SIDE", "PRICE", "VOLUME", "FUNDS",
+			"AVG_PRICE", "SUM_VOLUME", "SUM_FUNDS"},
+		row:  "%24s %4s %15.7f %15.7f %15.7f %15.7f %15.7f %15.7f\n",
+		item: kunaio.Trade{},
+	}
+	appendTable = table{
+		row:  "%s %s: %d new trades\n",
+		item: appendResult{},
+	}
+	snapshotTable = table{
+		head: "%24s %8s %15s %15s %15s %15s %15s %15s\n",
+		titles: []interface{}{"WHEN", "MARKET", "LAST", "BID", "ASK",
+			"SPREAD", "BID_VOLUME", "ASK_VOLUME"},
+		row:  "%24s %8s %15.7f %15.7f %15.7f %15.7f %15.7f %15.7f\n",
+		item: kunaio.Snapshot{},
+	}
+	orderEventTable = table{
+		row:  "%s order %d %s: executed %.7f of %.7f\n",
+		item: orderEventResult{},
+	}
+	dcaTable = table{
+		head: "%24s %12s %4s %8s %10s %15s %15s %15s %15s %s\n",
+		titles: []interface{}{"WHEN", "PLAN", "SIDE", "MARKET", "STATUS",
+			"AMOUNT", "PRICE", "LIMIT_VOLUME", "MARKET_VOLUME", "ERROR"},
+		row:  "%24s %12s %4s %8s %10s %15.7f %15.7f %15.7f %15.7f %s\n",
+		item: kunaio.DCARecord{},
+	}
+	condTable = table{
+		head: "%4s %13s %10s %4s %8s %15s %15s %15s %24s %8s %s\n",
+		titles: []interface{}{"ID", "TYPE", "STATE", "SIDE", "MARKET",
+			"VOLUME", "STOP_PRICE", "LIMIT", "TRIGGERED", "ORDER_ID",
+			"ERROR"},
+		row:  "%4d %13s %10s %4s %8s %15.7f %s %15.7f %24s %8d %s\n",
+		item: kunaio.Condition{},
+	}
+	groupEventTable = table{
+		row:  "%s %4d %12s %10s -> %-10s %s\n",
+		item: groupEventResult{},
+	}
+	executionTable = table{
+		head: "%24s %9s %15s %15s %15s %15s %10s %6s\n",
+		titles: []interface{}{"WHEN", "STATE", "EXECUTED", "VOLUME",
+			"AVG_PRICE", "ARRIVAL", "SLIPPAGE", "ORDERS"},
+		row:  "%24s %9s %15.7f %15.7f %15.7f %15.7f %9.3f%% %6d\n",
+		item: kunaio.ExecutionProgress{},
+	}
+	// Accounts of user info in CSV format
+	accountTable = table{
+		item: accountResult{},
+	}
+)
+
+// Command results which are not library types
+type (
+	timeResult struct {
+		Time time.Time `json:"time"`
+	}
+	skewResult struct {
+		// Server clock minus local clock, in seconds
+		Skew float64 `json:"skew"`
+	}
+	appendResult struct {
+		Time   time.Time `json:"time"`
+		Market string    `json:"market"`
+		Count  int       `json:"count"`
+	}
+	orderEventResult struct {
+		kunaio.OrderEvent
+		Error string `json:"error,omitempty"`
+	}
+	groupEventResult struct {
+		Group int `json:"group"`
+		kunaio.GroupEvent
+	}
+	accountResult struct {
+		Email     string `json:"email"`
+		Activated bool   `json:"activated"`
+		kunaio.Account
+	}
 )
 
 // Entry point.
@@ -68,319 +176,543 @@ func main() {
 	// read environment variables
 	if s, ok := os.LookupEnv("KUNAIO_MARKET"); ok {
 		gMarket = s
+		gExplicit["market"] = true
 	}
 	if s, ok := os.LookupEnv("KUNAIO_ACCESS_KEY"); ok {
 		gAKey = s
+		gExplicit["akey"] = true
 	}
 	if s, ok := os.LookupEnv("KUNAIO_SECRET_KEY"); ok {
 		gSKey = s
+		gExplicit["skey"] = true
+	}
+	if s, ok := os.LookupEnv("KUNAIO_URL"); ok {
+		kunaio.SetBaseURL(s)
+		gExplicit["url"] = true
+	}
+	if s, ok := os.LookupEnv("KUNAIO_PROFILE"); ok {
+		gProfile = s
+	}
+	if s, ok := os.LookupEnv("KUNAIO_CONFIG"); ok {
+		gConfigPath = s
+	}
+	if s, ok := os.LookupEnv("KUNAIO_CREDS"); ok {
+		gCreds = s
+		gExplicit["creds"] = true
+	}
+	if s, ok := os.LookupEnv("KUNAIO_CREDSTORE"); ok {
+		gCredStore = s
+	}
+	if s, ok := os.LookupEnv("KUNAIO_NONCE"); ok {
+		kunaio.SetNonceSource(kunaio.NewFileNonce(s))
+	}
+	cmd, args := parseCommandLine(os.Args[1:])
+	applyProfile()
+	setupTransport()
+	cmd.run(args)
+	flushTraces()
+}
+
+func parseSideVolume(sideArg, volumeArg string) (string, float64) {
+	side := strings.Trim(strings.ToLower(sideArg), " \t\n\r")
+	if side != "sell" && side != "buy" {
+		fatalf("invalid SIDE arg (%s). Valid values are: sell, buy", side)
+	}
+	volume, err := strconv.ParseFloat(volumeArg, 64)
+	if err != nil {
+		fatalf("invalid VOLUME arg (%s): %s", volumeArg, err)
+	}
+	return side, volume
+}
+
+func parsePrice(arg string) float64 {
+	price, err := strconv.ParseFloat(arg, 64)
+	if err != nil || price < 0 {
+		fatalf("invalid price arg (%s): %s", arg, err)
 	}
-	// parse command line args
-	args := os.Args[1:]
-	for 0 < len(args) && strings.HasPrefix(args[0], "-") {
-		arg := args[0]
-		args = args[1:]
-		switch arg {
-		case "-h":
-			usage()
-			os.Exit(0)
-		case "--help":
-			usage()
-			os.Exit(0)
-		case "--market":
-			gMarket = args[0]
-			valid := false
-			for _, v := range kunaio.SupportedMarkets() {
-				if v == gMarket {
-					valid = true
-					break
+	return price
+}
+
+func parseDuration(arg string) time.Duration {
+	d, err := time.ParseDuration(arg)
+	if err != nil || d <= 0 {
+		fatalf("invalid DURATION arg (%s): %s", arg, err)
+	}
+	return d
+}
+
+// Run execution algorithm until finished or interrupted.
+func execute(params kunaio.ExecutionParams) {
+	if gUAH {
+		price := params.LimitPrice
+		if price == 0 {
+			stats, err := kunaio.GetLatestStats(gMarket)
+			if err != nil {
+				fatalf("get stats: %s", err)
+			}
+			price = stats.Last
+		}
+		params.Volume /= price
+		params.VisibleVolume /= price
+	}
+	gOut.stream(&executionTable)
+	printProgress := func(p kunaio.ExecutionProgress) {
+		gOut.row(p, p.Updated, p.State, p.Executed, p.Volume, p.AvgPrice,
+			p.ArrivalPrice, p.Slippage*100, p.ChildOrders)
+		if gMetrics != nil {
+			gMetrics.ObserveExecution(p)
+		}
+	}
+	exec, err := kunaio.StartExecution(interruptContext(),
+		newClient(), params, printProgress)
+	if err != nil {
+		fatalf("start execution: %s", err)
+	}
+	p := exec.Wait()
+	if p.State == kunaio.ExecFailed {
+		fatalf("execution failed: %s", p.Error)
+	}
+}
+
+// Parse SIDE VOLUME PRICE... arguments of order placing commands.
+// At least minPrices prices are required.
+func parseOrderArgs(args []string, minPrices int) (string, float64, []float64) {
+	side, volume := parseSideVolume(args[0], args[1])
+	var prices []float64
+	for _, arg := range args[2:] {
+		prices = append(prices, parsePrice(arg))
+	}
+	if len(prices) < minPrices {
+		fatalf("bad args count: %d", len(args))
+	}
+	if gUAH {
+		price := prices[0]
+		if price == 0 {
+			stats, err := kunaio.GetLatestStats(gMarket)
+			if err != nil {
+				fatalf("get stats: %s", err)
+			}
+			price = stats.Last
+		}
+		volume /= price
+	}
+	return side, volume, prices
+}
+
+func newOCOTracker() *kunaio.OCOTracker {
+	tracker := kunaio.NewOCOTracker(newClient())
+	tracker.OnEvent = func(group int, ev kunaio.GroupEvent) {
+		what := "group"
+		if ev.Leg != "" {
+			what = ev.Leg
+		}
+		gOut.row(groupEventResult{group, ev}, ev.Time,
+			group, what, ev.From, ev.To, ev.Note)
+		if gMetrics != nil {
+			gMetrics.ObserveGroupEvent(group, ev)
+		}
+	}
+	gOut.stream(&groupEventTable)
+	return tracker
+}
+
+// Watch order group until it is finished. The group is cancelled
+// on interrupt because nobody will watch it afterwards.
+func watchGroup(tracker *kunaio.OCOTracker, id int) {
+	ctx, cancel := context.WithCancel(interruptContext())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		tracker.Run(ctx)
+		close(done)
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			if g, _ := tracker.Group(id); !g.Finished() {
+				gOut.note("interrupted, cancelling group %d\n", id)
+				if err := tracker.Cancel(id); err != nil {
+					fatalf("cancel group: %s", err)
 				}
 			}
-			if !valid {
-				fatalf("invalid market: %#v. Valid are: %v\n",
-					gMarket, kunaio.SupportedMarkets())
+			return
+		case <-ticker.C:
+			if g, _ := tracker.Group(id); g.Finished() {
+				cancel()
 			}
-			args = args[1:]
-		case "--akey":
-			gAKey = args[0]
-			args = args[1:]
-		case "--skey":
-			gSKey = args[0]
-			args = args[1:]
-		case "--uah":
-			gUAH = true
-		case "--unix":
-			gUnix = true
-		case "--":
-			break
-		default:
-			fatalf("unknown option: %v", arg)
 		}
 	}
-	if len(args) == 0 {
-		usage()
-		os.Exit(1)
+}
+
+// Parse condadd command arguments.
+func parseCondition(args []string) kunaio.Condition {
+	cond := kunaio.Condition{
+		Type:   args[0],
+		Side:   strings.ToLower(args[1]),
+		Market: gMarket,
+	}
+	volume, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		fatalf("invalid VOLUME arg (%s): %s", args[2], err)
 	}
-	cmd := args[0]
-	args = args[1:]
-	switch cmd {
-	case "time":
-		t, err := kunaio.GetServerTime()
+	cond.Volume = volume
+	if cond.Type == kunaio.TrailingStop {
+		s := args[3]
+		k := float64(1)
+		if strings.HasSuffix(s, "%") {
+			s = strings.TrimSuffix(s, "%")
+			k = 100
+		}
+		delta, err := strconv.ParseFloat(s, 64)
 		if err != nil {
-			fatalf("get server time: %s", err)
+			fatalf("invalid PRICE arg (%s): %s", args[3], err)
 		}
-		fmt.Printf("%s\n", tts(t))
-	case "stats":
-		stats, err := kunaio.GetLatestStats(gMarket)
+		cond.TrailDelta = delta / k
+	} else {
+		price, err := strconv.ParseFloat(args[3], 64)
 		if err != nil {
-			fatalf("get stats: %s", err)
-		}
-		fmt.Printf("%#v\n", stats)
-	case "sell":
-		var limit float64
-		if len(args) == 1 {
-			f, err := strconv.ParseFloat(args[0], 64)
-			if err != nil || f < 0 {
-				fatalf("invalid limit (%s): %s", args[0], err)
-			}
-			limit = f
+			fatalf("invalid PRICE arg (%s): %s", args[3], err)
 		}
-		obook, err := kunaio.GetOrderBook(gMarket)
+		cond.TriggerPrice = price
+	}
+	if len(args) == 5 {
+		limit, err := strconv.ParseFloat(args[4], 64)
 		if err != nil {
-			fatalf("get order book: %s", err)
-		}
-		fmt.Printf("SELL:%10s %15s %15s %15s %15s %15s\n",
-			"PRICE", "VOLUME", "FUNDS",
-			"AVG_PRICE", "SUM_VOLUME", "SUM_FUNDS")
-		var (
-			sumVolume float64
-			sumFunds  float64
-		)
-		needBreak := false
-		for _, e := range obook.Asks {
-			if 0 < limit {
-				if !gUAH && limit <= sumVolume+e.RemainingVolume {
-					e.RemainingVolume = limit - sumVolume
-					needBreak = true
-				} else if gUAH && limit <= (sumFunds+e.RemainingVolume*e.Price) {
-					e.RemainingVolume = (limit - sumFunds) / e.Price
-					needBreak = true
-				}
-			}
-			sumVolume += e.RemainingVolume
-			sumFunds += e.RemainingVolume * e.Price
-			fmt.Printf("%15.7f %15.7f %15.7f %15.7f %15.7f %15.7f\n",
-				e.Price, e.RemainingVolume,
-				e.RemainingVolume*e.Price,
-				sumFunds/sumVolume,
-				sumVolume, sumFunds)
-			if needBreak {
-				break
-			}
+			fatalf("invalid LIMIT arg (%s): %s", args[4], err)
 		}
-	case "buy":
-		var limit float64
-		if len(args) == 1 {
-			f, err := strconv.ParseFloat(args[0], 64)
-			if err != nil || f < 0 {
-				fatalf("invalid limit (%s): %s", args[0], err)
-			}
-			limit = f
+		cond.LimitPrice = limit
+	}
+	if gUAH {
+		price := cond.LimitPrice
+		if price == 0 {
+			price = cond.TriggerPrice
 		}
-		obook, err := kunaio.GetOrderBook(gMarket)
-		if err != nil {
-			fatalf("get order book: %s\n", err)
-		}
-		fmt.Printf("BUY:%11s %15s %15s %15s %15s %15s\n",
-			"PRICE", "VOLUME", "FUNDS",
-			"AVG_PRICE", "SUM_VOLUME", "SUM_FUNDS")
-		var (
-			sumVolume float64
-			sumFunds  float64
-		)
-		needBreak := false
-		for _, e := range obook.Bids {
-			if 0 < limit {
-				if !gUAH && limit <= sumVolume+e.RemainingVolume {
-					e.RemainingVolume = limit - sumVolume
-					needBreak = true
-				} else if gUAH && limit <= (sumFunds+e.RemainingVolume*e.Price) {
-					e.RemainingVolume = (limit - sumFunds) / e.Price
-					needBreak = true
-				}
+		if price == 0 {
+			stats, err := kunaio.GetLatestStats(gMarket)
+			if err != nil {
+				fatalf("get stats: %s", err)
 			}
-			sumVolume += e.RemainingVolume
-			sumFunds += e.RemainingVolume * e.Price
-			fmt.Printf("%15.7f %15.7f %15.7f %15.7f %15.7f %15.7f\n",
-				e.Price, e.RemainingVolume,
-				e.RemainingVolume*e.Price,
-				sumFunds/sumVolume,
-				sumVolume, sumFunds)
-			if needBreak {
-				break
+			price = stats.Last
+		}
+		cond.Volume /= price
+	}
+	return cond
+}
+
+// Print list of conditional orders.
+func printConditions(conds ...kunaio.Condition) {
+	gOut.begin(&condTable)
+	for _, c := range conds {
+		printCondition(c)
+	}
+	gOut.end()
+}
+
+func printCondition(c kunaio.Condition) {
+	triggered := "-"
+	if !c.TriggeredAt.IsZero() {
+		triggered = tts(c.TriggeredAt)
+	}
+	stop := fmt.Sprintf("%15.7f", c.StopPrice())
+	if c.Type == kunaio.TrailingStop && c.Extreme == 0 {
+		stop = fmt.Sprintf("%14.2f%%", c.TrailDelta*100)
+	}
+	gOut.row(c, c.ID, c.Type, c.State, c.Side, c.Market, c.Volume, stop,
+		c.LimitPrice, triggered, c.OrderID, c.Error)
+}
+
+// Return context which is cancelled on SIGINT or SIGTERM.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+	return ctx
+}
+
+// Print order events until all the orders are finished.
+func watchOrders(ids []int) {
+	tracker := kunaio.NewOrderTracker(newClient())
+	gOut.stream(&orderEventTable)
+	tracker.OnEvent = func(ev kunaio.OrderEvent) {
+		res := orderEventResult{OrderEvent: ev}
+		if ev.Err != nil {
+			res.Error = ev.Err.Error()
+		}
+		gOut.row(res, ev.Time, ev.Order.ID, ev.Type,
+			ev.Order.ExecutedVolume, ev.Order.Volume)
+		if gMetrics != nil {
+			gMetrics.ObserveOrderEvent(ev)
+		}
+		for _, t := range ev.Fills {
+			gOut.text("  fill %d: %s %.7f at %.7f\n",
+				t.ID, tts(t.CreatedAt), t.Volume, t.Price)
+		}
+	}
+	tracker.Watch(ids...)
+	ctx, cancel := context.WithCancel(interruptContext())
+	defer cancel()
+	go tracker.Run(ctx)
+	for _, id := range ids {
+		_, err := tracker.WaitForFill(ctx, id)
+		if err == context.Canceled {
+			return
+		}
+	}
+}
+
+// Print trade history table with totals.
+func printHistory(hist kunaio.History) {
+	gOut.begin(&historyTable)
+	for _, e := range hist {
+		gOut.row(e, e.CreatedAt, e.Price, e.Volume, e.Funds)
+	}
+	gOut.text("TOTAL%51.7f %15.7f\n",
+		hist.SumVolume(), hist.SumFunds())
+	gOut.text("MIN%37.7f %15.7f %15.7f\n",
+		hist.MinPrice(), hist.MinVolume(), hist.MinFunds())
+	gOut.text("AVG%37.7f %15.7f %15.7f\n",
+		hist.AvgPrice(), hist.AvgVolume(), hist.AvgFunds())
+	gOut.text("MAX%37.7f %15.7f %15.7f\n",
+		hist.MaxPrice(), hist.MaxVolume(), hist.MaxFunds())
+	gOut.end()
+}
+
+// Print order book side limited to the volume (or funds with
+// --uah) if not zero, with running totals.
+func printBookSide(t *table, orders kunaio.Orders, limit float64) {
+	gOut.begin(t)
+	var (
+		sumVolume float64
+		sumFunds  float64
+	)
+	for _, e := range orders {
+		last := false
+		if 0 < limit {
+			if !gUAH && limit <= sumVolume+e.RemainingVolume {
+				e.RemainingVolume = limit - sumVolume
+				last = true
+			} else if gUAH && limit <= (sumFunds+e.RemainingVolume*e.Price) {
+				e.RemainingVolume = (limit - sumFunds) / e.Price
+				last = true
 			}
 		}
-	case "history":
-		hist, err := kunaio.GetTradeHistory(gMarket)
-		if err != nil {
-			fatalf("get trade history: %s", err)
-		}
-		fmt.Printf("%24s %15s %15s %15s\n",
-			"WHEN", "PRICE", "VOLUME", "FUNDS")
-		for _, e := range hist {
-			fmt.Printf("%15s %15.7f %15.7f %15.7f\n",
-				tts(e.CreatedAt),
-				e.Price, e.Volume, e.Funds)
-		}
-		fmt.Printf("TOTAL%51.7f %15.7f\n",
-			hist.SumVolume(), hist.SumFunds())
-		fmt.Printf("MIN%37.7f %15.7f %15.7f\n",
-			hist.MinPrice(), hist.MinVolume(), hist.MinFunds())
-		fmt.Printf("AVG%37.7f %15.7f %15.7f\n",
-			hist.AvgPrice(), hist.AvgVolume(), hist.AvgFunds())
-		fmt.Printf("MAX%37.7f %15.7f %15.7f\n",
-			hist.MaxPrice(), hist.MaxVolume(), hist.MaxFunds())
-	case "userinfo":
-		checkReqs()
-		info, err := kunaio.GetUserInfo(gAKey, gSKey)
-		if err != nil {
-			fatalf("get user info: %s", err)
-		}
-		fmt.Printf("email:\t%s\nactive:\t%v\n"+
-			"Accounts: %6s %15s %15s\n",
-			info.Email, info.Activated,
-			"CURRENCY", "BALANCE", "LOCKED")
-		for _, a := range info.Accounts {
-			fmt.Printf("%18s %15.7f %15.7f\n",
-				a.Currency, a.Balance, a.Locked)
-		}
-	case "userorders":
-		checkReqs()
-		orders, err := kunaio.GetUserOrders(gAKey, gSKey, gMarket)
-		if err != nil {
-			fatalf("get user orders: %s", err)
+		sumVolume += e.RemainingVolume
+		sumFunds += e.RemainingVolume * e.Price
+		gOut.row(e, e.Price, e.RemainingVolume,
+			e.RemainingVolume*e.Price,
+			sumFunds/sumVolume,
+			sumVolume, sumFunds)
+		if last {
+			break
 		}
-		fmt.Printf("%24s %8s %4s %8s %15s %15s %15s %15s %15s %15s %15s %15s %6s\n",
-			"WHEN", "MARKET", "SIDE", "ID", "PRICE",
-			"AVG_PRICE", "VOLUME", "FUNDS", "REMAINING", "REM_FUNDS",
-			"EXECUTED", "EXEC_FUNDS", "TRADES")
-		for _, e := range orders {
-			fmt.Printf("%6s %8s %4s %8d %15.7f %15.7f %15.7f %15.7f "+
-				"%15.7f %15.7f %15.7f %15.7f %6d\n",
-				tts(e.CreatedAt),
-				e.Market, e.Side, e.ID, e.Price,
-				e.AvgPrice,
-				e.Volume, e.Volume*e.Price,
-				e.RemainingVolume, e.RemainingVolume*e.Price,
-				e.ExecutedVolume, e.ExecutedVolume*e.Price,
-				e.TradesCount)
-		}
-	case "usertrades":
-		checkReqs()
-		trades, err := kunaio.GetUserTrades(gAKey, gSKey, gMarket)
-		if err != nil {
-			fatalf("get user trades: %s", err)
-		}
-		fmt.Printf("%24s %4s %15s %15s %15s %15s %15s %15s\n",
-			"WHEN", "SIDE", "PRICE", "VOLUME", "FUNDS",
-			"AVG_PRICE", "SUM_VOLUME", "SUM_FUNDS")
-		var (
-			sumVolume float64
-			sumFunds  float64
-		)
-		for _, e := range trades {
-			sumVolume += e.Volume
-			sumFunds += e.Funds
-			fmt.Printf("%24s %4s %15.7f %15.7f %15.7f %15.7f %15.7f %15.7f\n",
-				tts(e.CreatedAt), e.Side,
-				e.Price, e.Volume, e.Funds,
-				sumFunds/sumVolume,
-				sumVolume, sumFunds)
-		}
-		fmt.Printf("AVERAGE%38.7f %15.7f %15.7f\n",
-			trades.AvgPrice(), trades.AvgVolume(), trades.AvgFunds())
-	case "addorder":
-		checkReqs()
-		if len(args) != 3 {
-			fatalf("bad args count: %d (expected 3)", len(args))
-		}
-		side := strings.Trim(strings.ToLower(args[0]), " \t\n\r")
-		if side != "sell" && side != "buy" {
-			fatalf("invalid SIDE arg (%s). Valid values are: sell, buy", side)
-		}
-		volume, err := strconv.ParseFloat(args[1], 64)
-		if err != nil {
-			fatalf("invalid VOLUME arg (%s): %s", args[1], err)
+	}
+	gOut.end()
+}
+
+func printSnapshot(snap kunaio.Snapshot) {
+	var bid, ask, bidVolume, askVolume float64
+	if 0 < len(snap.Bids) {
+		bid = snap.Bids[0].Price
+	}
+	if 0 < len(snap.Asks) {
+		ask = snap.Asks[0].Price
+	}
+	for _, l := range snap.Bids {
+		bidVolume += l.Volume
+	}
+	for _, l := range snap.Asks {
+		askVolume += l.Volume
+	}
+	gOut.row(snap, snap.Time, snap.Market, snap.Stats.Last, bid, ask,
+		snap.Spread(), bidVolume, askVolume)
+}
+
+// Parse date/time argument: Unix timestamp, date or date/time in
+// the output format.
+func parseTime(arg string) time.Time {
+	if i, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return time.Unix(i, 0)
+	}
+	for _, layout := range []string{gTimeLayout, "2006-01-02"} {
+		if t, err := time.Parse(layout, arg); err == nil {
+			return t
+		}
+	}
+	fatalf("invalid date/time: %s", arg)
+	return time.Time{}
+}
+
+// Run DCA scheduler until interrupted.
+func runDCA(planPath, journalPath string) {
+	f, err := os.Open(planPath)
+	if err != nil {
+		fatalf("open plan file: %s", err)
+	}
+	plans, err := kunaio.ReadDCAPlans(f)
+	f.Close()
+	if err != nil {
+		fatalf("read plan file %s: %s", planPath, err)
+	}
+	journal, err := kunaio.OpenDCAJournal(journalPath)
+	if err != nil {
+		fatalf("open DCA journal: %s", err)
+	}
+	defer journal.Close()
+	dca, err := kunaio.NewDCA(newClient(), journal, plans)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	dca.OnRecord = func(rec kunaio.DCARecord) {
+		printDCARecord(rec)
+		if gMetrics != nil {
+			gMetrics.ObserveDCA(rec)
 		}
-		price, err := strconv.ParseFloat(args[2], 64)
+	}
+	for _, p := range dca.Plans() {
+		gOut.note("plan %s: %s %s %.2f on \"%s\"\n",
+			p.Name, p.Side, p.Market, p.Amount, p.Schedule)
+	}
+	gOut.stream(&dcaTable)
+	dca.Run(interruptContext())
+}
+
+func printDCARecord(rec kunaio.DCARecord) {
+	gOut.row(rec, rec.Time, rec.Plan, rec.Side, rec.Market, rec.Status,
+		rec.Amount, rec.Price, rec.LimitVolume, rec.MarketVolume,
+		rec.Error)
+}
+
+// Install recording or replaying HTTP transport if requested,
+// tracing, metrics and server clock synchronization.
+func setupTransport() {
+	if gReplayDir != "" {
+		t, err := kunaio.NewReplayTransport(gReplayDir)
 		if err != nil {
-			fatalf("invalid PRICE arg (%s): %s", args[2], err)
+			fatalf("replay: %s", err)
 		}
-		if gUAH {
-			volume /= price
+		kunaio.SetTransport(t)
+		if gAKey == "" && gSKey == "" {
+			// recorded requests have the keys redacted anyway
+			gAKey, gSKey = "replay", "replay"
 		}
-		order, err := kunaio.NewOrder(gAKey, gSKey, gMarket,
-			side, volume, price)
-		if err != nil {
-			fatalf("new order: %s", err)
+	}
+	if gTrace != "" {
+		var exporter kunaio.SpanExporter
+		if gTrace == "stdout" {
+			exporter = kunaio.NewStdoutExporter(os.Stdout)
+		} else {
+			gOTLP = kunaio.NewOTLPExporter(gTrace)
+			exporter = gOTLP
 		}
-		fmt.Printf("Order created:\n%s", formatOrder(order))
-	case "delorder":
-		checkReqs()
-		if len(args) != 1 {
-			fatalf("bad args count: %d (expected 1)", len(args))
+		tracer := kunaio.NewTracer(exporter)
+		kunaio.SetTracer(tracer)
+		kunaio.Use(tracer.Middleware())
+	}
+	if gMetrics != nil {
+		kunaio.Use(gMetrics.Middleware())
+	}
+	if gReplayDir == "" {
+		// recorded responses are not related to the current time
+		clock := kunaio.NewServerClock(nil)
+		clock.MaxSkew = gMaxSkew
+		if gMetrics != nil {
+			clock.OnMeasure = gMetrics.ObserveClock
 		}
-		i, err := strconv.ParseInt(args[0], 10, 64)
+		kunaio.Use(clock.Middleware())
+	}
+	if gRecordDir != "" {
+		t, err := kunaio.NewRecordingTransport(gRecordDir,
+			kunaio.Transport())
 		if err != nil {
-			fatalf("invalid order ID %s: %s", args[0], err)
+			fatalf("record: %s", err)
 		}
-		order, err := kunaio.CancelOrder(gAKey, gSKey, int(i))
-		if err != nil {
-			fatalf("cancel order: %s", err)
+		kunaio.SetTransport(t)
+	}
+}
+
+// Apply settings of the selected profile which are not given with
+// options or environment variables.
+func applyProfile() {
+	conf, err := readConfig(gConfigPath)
+	if err != nil {
+		fatalf("read config: %s", err)
+	}
+	name := gProfile
+	if conf == nil {
+		if name != "" {
+			fatalf("profile %s: config file %s not found", name, gConfigPath)
 		}
-		fmt.Printf("Order deleted:\n%s", formatOrder(order))
-	case "delall":
-		checkReqs()
-		orders, err := kunaio.GetUserOrders(gAKey, gSKey, gMarket)
-		if err != nil {
-			fatalf("get user orders: %s", err)
+		return
+	}
+	if name == "" {
+		name = conf.DefaultProfile
+	}
+	if name == "" {
+		name = "default"
+		if conf.Profiles[name] == nil {
+			return
 		}
-		for _, order := range orders {
-			order, err := kunaio.CancelOrder(gAKey, gSKey, order.ID)
-			if err != nil {
-				fatalf("cancel order: %s", err)
-			}
-			fmt.Printf("Order deleted:\n%s", formatOrder(order))
+	}
+	p := conf.Profiles[name]
+	if p == nil {
+		fatalf("profile %s not found in %s", name, gConfigPath)
+	}
+	if p.AccessKey != "" && !gExplicit["akey"] {
+		gAKey = p.AccessKey
+	}
+	if p.SecretKey != "" && !gExplicit["skey"] {
+		gSKey = p.SecretKey
+	}
+	if p.Credentials != "" && !gExplicit["creds"] {
+		gCreds = p.Credentials
+	}
+	if p.Market != "" && !gExplicit["market"] {
+		gMarket = p.Market
+		checkMarket()
+	}
+	if p.URL != "" && !gExplicit["url"] {
+		kunaio.SetBaseURL(p.URL)
+	}
+	if p.Output != "" && !gExplicit["output"] {
+		if !validFormat(p.Output) {
+			fatalf("profile %s: invalid output: %s", name, p.Output)
+		}
+		gOut = newPrinter(p.Output, os.Stdout)
+	}
+	if p.TimeFormat != "" && !gExplicit["time"] {
+		if p.TimeFormat == "unix" {
+			gUnix = true
+		} else {
+			gTimeLayout = p.TimeFormat
 		}
-	default:
-		usage()
-		os.Exit(1)
 	}
 }
 
-func formatOrder(order kunaio.Order) string {
-	return fmt.Sprintf(""+
-		"  ID             : %d\n"+
-		"  Side           : %s\n"+
-		"  OrdType        : %s\n"+
-		"  Price          : %16.8f\n"+
-		"  AvgPrice       : %16.8f\n"+
-		"  State          : %s\n"+
-		"  Market         : %s\n"+
-		"  CreatedAt      : %s\n"+
-		"  Volume         : %16.8f\n"+
-		"  RemainingVolume: %16.8f\n"+
-		"  ExecutedVolume : %16.8f\n"+
-		"  TradesCount    : %d\n",
-		order.ID, order.Side, order.OrdType, order.Price,
-		order.AvgPrice, order.State, order.Market,
-		tts(order.CreatedAt),
-		order.Volume, order.RemainingVolume,
-		order.ExecutedVolume, order.TradesCount)
+// Check market type is supported.
+func checkMarket() {
+	for _, v := range kunaio.SupportedMarkets() {
+		if v == gMarket {
+			return
+		}
+	}
+	fatalf("invalid market: %#v. Valid are: %v\n",
+		gMarket, kunaio.SupportedMarkets())
 }
 
 // Check access requisites.
 func checkReqs() {
+	if gCreds != "" {
+		loadCredentials()
+		if gCredentials != nil {
+			return
+		}
+	}
 	if gAKey == "" {
 		fatalf("--akey option is required")
 	}
@@ -389,18 +721,41 @@ func checkReqs() {
 	}
 }
 
-// Show usage info.
-func usage() {
-	s := os.Args[0]
-	fmt.Printf(USAGE, s, s, s, s, s, s, s, s, s, s, s, s)
+// Create API client with keys checked by checkReqs.
+func newClient() *kunaio.Client {
+	if gCredentials != nil {
+		return kunaio.NewClientWithCredentials(gCredentials)
+	}
+	return kunaio.NewClient(gAKey, gSKey)
+}
+
+// Serve metrics on the address in background.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", gMetrics)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fatalf("serve metrics: %s", err)
+		}
+	}()
 }
 
 // Print error report and terminate with exit code 1.
 func fatalf(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	flushTraces()
 	os.Exit(1)
 }
 
+// Send queued tracing spans to the collector.
+func flushTraces() {
+	if gOTLP != nil {
+		if err := gOTLP.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: export spans: %s\n", err)
+		}
+	}
+}
+
 // Format date/time to string.
 func tts(t time.Time) string {
 	if gUnix {
@@ -0,0 +1,424 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"kunaio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CLI command.
+type command struct {
+	name string
+	// Synopsis of arguments, e.g. "SIDE VOLUME PRICE"
+	args    string
+	summary string
+	// Detailed description. Paragraphs are separated by empty lines.
+	help     string
+	examples []string
+	// Allowed number of arguments. Negative maxArgs means unlimited.
+	minArgs int
+	maxArgs int
+	// Registrars of command-specific flags
+	flags []func(fs *flag.FlagSet)
+	run   func(args []string)
+}
+
+// Width of wrapped help text
+const helpWidth = 72
+
+// Program name shown in help.
+var gProgName = filepath.Base(os.Args[0])
+
+// Environment variables part of help.
+const ENV_USAGE = "Environment variables:\n" +
+	"\tKUNAIO_MARKET               market type. Default is btcuah.\n" +
+	"\tKUNAIO_ACCESS_KEY           API access key.\n" +
+	"\tKUNAIO_SECRET_KEY           API secret key.\n" +
+	"\tKUNAIO_URL                  API base URL.\n" +
+	"\tKUNAIO_NONCE                tonce counter file.\n" +
+	"\tKUNAIO_PROFILE              config file profile.\n" +
+	"\tKUNAIO_CONFIG               config file.\n" +
+	"\tKUNAIO_CREDS                name of API keys in the credential store.\n" +
+	"\tKUNAIO_CREDSTORE            credential store file.\n" +
+	"\tKUNAIO_PASSPHRASE           credential store passphrase. It is asked\n" +
+	"\t                            for, if not set.\n"
+
+// Register options accepted by all the commands.
+func globalFlags(fs *flag.FlagSet) {
+	fs.BoolFunc("unix", "print date/time as Unix timestamp.",
+		func(string) error {
+			gUnix = true
+			gExplicit["time"] = true
+			return nil
+		})
+	fs.Func("market", "use `MARKET`, e.g. ethuah. Default is btcuah.",
+		func(s string) error {
+			gMarket = s
+			gExplicit["market"] = true
+			checkMarket()
+			return nil
+		})
+	fs.Func("akey", "set API `ACCESS_KEY`.", func(s string) error {
+		gAKey = s
+		gExplicit["akey"] = true
+		return nil
+	})
+	fs.Func("skey", "set API `SECRET_KEY`.", func(s string) error {
+		gSKey = s
+		gExplicit["skey"] = true
+		return nil
+	})
+	fs.Func("creds", "use API keys `NAME` from the credential store.",
+		func(s string) error {
+			gCreds = s
+			gExplicit["creds"] = true
+			return nil
+		})
+	fs.StringVar(&gCredStore, "credstore", gCredStore,
+		"set credential store `FILE`. Default is "+
+			"~/.config/kunaio/credentials.json.")
+	fs.StringVar(&gProfile, "profile", gProfile,
+		"use settings of profile `NAME` from the config file. Options "+
+			"and environment variables take precedence over them.")
+	fs.StringVar(&gConfigPath, "config", gConfigPath,
+		"set config `FILE`. Default is ~/.config/kunaio/config.toml.")
+	fs.Func("url", "set API base `URL`, e.g. of kunaio-fakeserver. "+
+		"Default is https://kuna.io.",
+		func(s string) error {
+			kunaio.SetBaseURL(s)
+			gExplicit["url"] = true
+			return nil
+		})
+	fs.DurationVar(&gMaxSkew, "max-skew", gMaxSkew,
+		"fail private requests when local clock differs from server "+
+			"clock more than `DURATION`. Default is 30s, negative "+
+			"disables the check.")
+	fs.Func("output", "print results in `FORMAT`: \"table\" (default), "+
+		"\"json\", \"csv\" or \"yaml\".",
+		func(s string) error {
+			if !validFormat(s) {
+				return errors.New("unknown format")
+			}
+			gOut = newPrinter(s, os.Stdout)
+			gExplicit["output"] = true
+			return nil
+		})
+	fs.Func("decode", "decode responses in `MODE`: \"strict\" fails on "+
+		"unknown fields, \"lenient\" ignores invalid "+
+		"fields. Warnings are logged when KUNAIO_DEBUG is set.",
+		func(s string) error {
+			switch s {
+			case "strict":
+				kunaio.SetDecodeMode(kunaio.DecodeStrict)
+			case "lenient":
+				kunaio.SetDecodeMode(kunaio.DecodeLenient)
+			default:
+				return errors.New("unknown mode")
+			}
+			return nil
+		})
+	fs.StringVar(&gTrace, "trace", gTrace,
+		"export tracing spans to `DEST`: \"stdout\" or OTLP/HTTP "+
+			"collector URL, e.g. http://localhost:4318/v1/traces.")
+	fs.Func("metrics", "serve Prometheus metrics on `ADDR`/metrics.",
+		func(s string) error {
+			gMetrics = kunaio.NewMetrics()
+			serveMetrics(s)
+			return nil
+		})
+	fs.Func("nonce", "share tonce counter with other processes using "+
+		"the same keys via `FILE`.",
+		func(s string) error {
+			kunaio.SetNonceSource(kunaio.NewFileNonce(s))
+			return nil
+		})
+	fs.StringVar(&gRecordDir, "record", gRecordDir,
+		"save API requests and responses to `DIR`.")
+	fs.StringVar(&gReplayDir, "replay", gReplayDir,
+		"serve API responses from `DIR`, offline.")
+}
+
+// Register --uah flag.
+func uahFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&gUAH, "uah", gUAH,
+		"volumes and limits are in UAH instead of ICO.")
+}
+
+// Register --conds flag.
+func condsFlag(fs *flag.FlagSet) {
+	fs.StringVar(&gConds, "conds", gConds,
+		"set conditional orders `FILE`. Default is "+CONDITIONS+".")
+}
+
+// Parse command line: global options, command name, then command
+// options and arguments. Global options are accepted after the
+// command name too. Shows help and exits on -h, --help and errors.
+func parseCommandLine(args []string) (*command, []string) {
+	if 0 < len(args) && args[0] == completeCommand {
+		complete(args[1:])
+		os.Exit(0)
+	}
+	// command options are accepted before the command name too,
+	// as they used to be, if the command has them
+	fs := newFlagSet()
+	globalFlags(fs)
+	for _, c := range gCommands {
+		addFlags(fs, c.flags)
+	}
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		usage()
+		os.Exit(0)
+	} else if err != nil {
+		usageError(nil, "%s", flagError(err))
+	}
+	before := fs
+	args = fs.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+	if args[0] == "help" {
+		help(args[1:])
+		os.Exit(0)
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		usageError(nil, "unknown command: %s", args[0])
+	}
+	fs = newFlagSet()
+	globalFlags(fs)
+	addFlags(fs, cmd.flags)
+	before.Visit(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			usageError(cmd, "%s has no --%s option", cmd.name, f.Name)
+		}
+	})
+	args, err = parseInterleaved(fs, args[1:])
+	if err == flag.ErrHelp {
+		cmd.usage(os.Stdout)
+		os.Exit(0)
+	} else if err != nil {
+		usageError(cmd, "%s", flagError(err))
+	}
+	if len(args) < cmd.minArgs || 0 <= cmd.maxArgs && cmd.maxArgs < len(args) {
+		usageError(cmd, "bad args count: %d (expected %s)",
+			len(args), cmd.argsCount())
+	}
+	return cmd, args
+}
+
+// Parse flags mixed with positional arguments. All the arguments
+// after "--" are positional.
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	var res []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if n := len(args) - len(rest); 0 < n && args[n-1] == "--" {
+			return append(res, rest...), nil
+		}
+		if len(rest) == 0 {
+			return res, nil
+		}
+		res = append(res, rest[0])
+		args = rest[1:]
+	}
+}
+
+// Register flags, skipping ones already defined in the set.
+func addFlags(fs *flag.FlagSet, registrars []func(fs *flag.FlagSet)) {
+	for _, r := range registrars {
+		tmp := newFlagSet()
+		r(tmp)
+		tmp.VisitAll(func(f *flag.Flag) {
+			if fs.Lookup(f.Name) == nil {
+				fs.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+	}
+}
+
+// Return flag parsing error message with options spelled
+// as they are documented, i.e. with two dashes.
+func flagError(err error) string {
+	msg := err.Error()
+	for _, prefix := range []string{"flag: -", "flag -", "argument: -", "defined: -"} {
+		msg = strings.Replace(msg, prefix, prefix[:len(prefix)-1]+"--", 1)
+	}
+	return msg
+}
+
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(gProgName, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// Return command by name or nil if there is no such command.
+func findCommand(name string) *command {
+	for _, c := range gCommands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Show help on the command or, without args, on all the commands.
+func help(args []string) {
+	if len(args) == 0 {
+		usage()
+		return
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		usageError(nil, "unknown command: %s", args[0])
+	}
+	cmd.usage(os.Stdout)
+}
+
+// Show usage info.
+func usage() {
+	w := os.Stdout
+	fmt.Fprintf(w, "Usage:\n"+
+		"\t%s [options] COMMAND [command options] [ARGS]\n"+
+		"\t%s help [COMMAND]\n"+
+		"Commands:\n", gProgName, gProgName)
+	for _, c := range gCommands {
+		fmt.Fprintf(w, "\t%-12s%s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "Options, accepted before and after COMMAND:\n")
+	fs := newFlagSet()
+	globalFlags(fs)
+	printFlags(w, fs)
+	fmt.Fprint(w, ENV_USAGE)
+	fmt.Fprintf(w, "Run '%s help COMMAND' for command options and examples.\n",
+		gProgName)
+}
+
+// Show command usage info.
+func (c *command) usage(w io.Writer) {
+	synopsis := c.name
+	if 0 < len(c.flags) {
+		synopsis += " [command options]"
+	}
+	if c.args != "" {
+		synopsis += " " + c.args
+	}
+	fmt.Fprintf(w, "Usage:\n\t%s [options] %s\n\n", gProgName, synopsis)
+	text := c.help
+	if text == "" {
+		text = strings.ToUpper(c.summary[:1]) + c.summary[1:] + "."
+	}
+	for i, par := range strings.Split(text, "\n\n") {
+		if 0 < i {
+			fmt.Fprintln(w)
+		}
+		for _, line := range wrapText(par, helpWidth) {
+			fmt.Fprintln(w, line)
+		}
+	}
+	fmt.Fprintln(w)
+	if 0 < len(c.flags) {
+		fs := newFlagSet()
+		addFlags(fs, c.flags)
+		fmt.Fprintf(w, "Command options:\n")
+		printFlags(w, fs)
+	}
+	if 0 < len(c.examples) {
+		fmt.Fprintf(w, "Examples:\n")
+		for _, e := range c.examples {
+			fmt.Fprintf(w, "\t%s %s\n", gProgName, e)
+		}
+	}
+	fmt.Fprintf(w, "Run '%s help' for global options.\n", gProgName)
+}
+
+// Return description of allowed number of arguments.
+func (c *command) argsCount() string {
+	switch {
+	case c.maxArgs < 0:
+		return fmt.Sprintf("at least %d", c.minArgs)
+	case c.minArgs == c.maxArgs:
+		return fmt.Sprint(c.minArgs)
+	case c.minArgs+1 == c.maxArgs:
+		return fmt.Sprintf("%d or %d", c.minArgs, c.maxArgs)
+	}
+	return fmt.Sprintf("%d to %d", c.minArgs, c.maxArgs)
+}
+
+// Print flags of the set, sorted by name, with wrapped descriptions.
+func printFlags(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		name, text := flag.UnquoteUsage(f)
+		spec := "--" + f.Name
+		if name != "" {
+			spec += " " + strings.ToUpper(name)
+		}
+		lines := wrapText(text, 44)
+		if 27 < len(spec) {
+			fmt.Fprintf(w, "\t%s\n", spec)
+			spec = ""
+		}
+		for _, line := range lines {
+			fmt.Fprintf(w, "\t%-28s%s\n", spec, line)
+			spec = ""
+		}
+	})
+}
+
+// Split text to lines not longer than width, unless a word is longer.
+func wrapText(text string, width int) []string {
+	var (
+		lines []string
+		line  string
+	)
+	for _, word := range strings.Fields(text) {
+		if line != "" && width < len(line)+1+len(word) {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Report command line error and exit.
+func usageError(cmd *command, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	if cmd != nil {
+		fmt.Fprintf(os.Stderr, "Run '%s help %s' for usage.\n",
+			gProgName, cmd.name)
+	} else {
+		fmt.Fprintf(os.Stderr, "Run '%s help' for usage.\n", gProgName)
+	}
+	os.Exit(1)
+}
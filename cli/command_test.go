@@ -0,0 +1,93 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestParseInterleaved(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want []string
+		uah  bool
+	}{
+		{[]string{"buy", "1", "100"}, []string{"buy", "1", "100"}, false},
+		{[]string{"--uah", "buy", "1", "100"}, []string{"buy", "1", "100"}, true},
+		{[]string{"buy", "1", "--uah", "100"}, []string{"buy", "1", "100"}, true},
+		{[]string{"buy", "--", "--uah", "100"}, []string{"buy", "--uah", "100"}, false},
+		{[]string{"--", "--"}, []string{"--"}, false},
+		{nil, nil, false},
+	} {
+		fs := newFlagSet()
+		uah := fs.Bool("uah", false, "")
+		got, err := parseInterleaved(fs, c.args)
+		if err != nil {
+			t.Errorf("%q: %s", c.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) || *uah != c.uah {
+			t.Errorf("%q: %q, uah=%v", c.args, got, *uah)
+		}
+	}
+	fs := newFlagSet()
+	fs.String("market", "", "")
+	if _, err := parseInterleaved(fs, []string{"stats", "--market"}); err == nil {
+		t.Error("missing value accepted")
+	} else if msg := flagError(err); msg != "flag needs an argument: --market" {
+		t.Errorf("error: %s", msg)
+	}
+	if _, err := parseInterleaved(fs, []string{"buy", "-uah"}); err == nil {
+		t.Error("unknown flag accepted")
+	} else if msg := flagError(err); msg != "flag provided but not defined: --uah" {
+		t.Errorf("error: %s", msg)
+	}
+	if _, err := parseInterleaved(fs, []string{"-h"}); err != flag.ErrHelp {
+		t.Errorf("help: %v", err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	seen := map[string]bool{}
+	for _, c := range gCommands {
+		if seen[c.name] {
+			t.Errorf("%s: duplicate command", c.name)
+		}
+		seen[c.name] = true
+		if c.summary == "" || c.run == nil {
+			t.Errorf("%s: no summary or run function", c.name)
+		}
+		if 0 <= c.maxArgs && c.maxArgs < c.minArgs {
+			t.Errorf("%s: bad args count range", c.name)
+		}
+		// command flags must not clash with global ones
+		fs := newFlagSet()
+		globalFlags(fs)
+		for _, f := range c.flags {
+			tmp := newFlagSet()
+			f(tmp)
+			tmp.VisitAll(func(f *flag.Flag) {
+				if fs.Lookup(f.Name) != nil {
+					t.Errorf("%s: --%s is a global option", c.name, f.Name)
+				}
+			})
+		}
+	}
+	if got := (&command{minArgs: 1, maxArgs: 3}).argsCount(); got != "1 to 3" {
+		t.Errorf("args count: %s", got)
+	}
+}
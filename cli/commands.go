@@ -0,0 +1,836 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"kunaio"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commands in the order they are listed in help
+var gCommands = []*command{
+	{
+		name:    "time",
+		summary: "show current server time",
+		run:     cmdTime,
+	},
+	{
+		name:    "skew",
+		summary: "show local clock offset from server clock",
+		run:     cmdSkew,
+	},
+	{
+		name:     "stats",
+		summary:  "show latest trade statistics",
+		examples: []string{"--market ethuah stats"},
+		run:      cmdStats,
+	},
+	{
+		name:    "sell",
+		args:    "[LIMIT]",
+		summary: "show order book - asks",
+		help: "Show asks of the order book with cumulative volume, " +
+			"funds and average price. With LIMIT only the asks " +
+			"needed to fill LIMIT volume (funds with --uah) are shown.",
+		examples: []string{"sell 0.5", "sell --uah 10000"},
+		maxArgs:  1,
+		flags:    []func(*flag.FlagSet){uahFlag},
+		run:      func(args []string) { cmdBookSide("sell", args) },
+	},
+	{
+		name:    "buy",
+		args:    "[LIMIT]",
+		summary: "show order book - bids",
+		help: "Show bids of the order book with cumulative volume, " +
+			"funds and average price. With LIMIT only the bids " +
+			"needed to fill LIMIT volume (funds with --uah) are shown.",
+		examples: []string{"buy 0.5", "buy --uah 10000"},
+		maxArgs:  1,
+		flags:    []func(*flag.FlagSet){uahFlag},
+		run:      func(args []string) { cmdBookSide("buy", args) },
+	},
+	{
+		name:    "history",
+		summary: "show trade history",
+		run:     cmdHistory,
+	},
+	{
+		name:    "collect",
+		args:    "DIR",
+		summary: "collect public trades to the archive",
+		help: "Collect public trades of all markets to the archive " +
+			"in DIR until interrupted. See cli/README.md for the " +
+			"archive layout.",
+		examples: []string{"collect /var/lib/kunaio/archive"},
+		minArgs:  1,
+		maxArgs:  1,
+		run:      cmdCollect,
+	},
+	{
+		name:    "archive",
+		args:    "DIR FROM TO",
+		summary: "show archived trades",
+		help: "Show trades from the archive in DIR. FROM and TO are " +
+			"dates, date/times or Unix timestamps.",
+		examples: []string{"--market ethuah archive ./archive " +
+			"2018-01-01 2018-01-02T12:00:00Z"},
+		minArgs: 3,
+		maxArgs: 3,
+		run:     cmdArchive,
+	},
+	{
+		name:    "compact",
+		args:    "DIR",
+		summary: "compact archive partitions of past days",
+		minArgs: 1,
+		maxArgs: 1,
+		run:     cmdCompact,
+	},
+	{
+		name:    "record",
+		args:    "DIR [SCHEDULE [DEPTH]]",
+		summary: "record market snapshots",
+		help: "Record stats and top DEPTH order book levels of all " +
+			"markets to DIR on SCHEDULE until interrupted. SCHEDULE " +
+			"is a crontab line, default is \"@every 1m\".",
+		examples: []string{"record ./snapshots", "record ./snapshots " +
+			"'*/5 * * * *' 20"},
+		minArgs: 1,
+		maxArgs: 3,
+		run:     cmdRecord,
+	},
+	{
+		name:    "snapshots",
+		args:    "DIR FROM TO",
+		summary: "show recorded snapshots",
+		help: "Show market snapshots recorded to DIR. FROM and TO are " +
+			"dates, date/times or Unix timestamps.",
+		examples: []string{"snapshots ./snapshots 2018-01-01 2018-01-02"},
+		minArgs:  3,
+		maxArgs:  3,
+		run:      cmdSnapshots,
+	},
+	{
+		name:    "userinfo",
+		summary: "show user info and assets",
+		run:     cmdUserInfo,
+	},
+	{
+		name:    "userorders",
+		summary: "show current orders for user",
+		run:     cmdUserOrders,
+	},
+	{
+		name:    "usertrades",
+		summary: "show history of user trades",
+		run:     cmdUserTrades,
+	},
+	{
+		name:    "addorder",
+		args:    "SIDE VOLUME PRICE",
+		summary: "create new order",
+		help: "Create new limit order. SIDE is buy or sell, VOLUME is " +
+			"in ICO and PRICE is price for 1 ICO.",
+		examples: []string{"addorder buy 0.01 250000",
+			"addorder --uah buy 1000 250000"},
+		minArgs: 3,
+		maxArgs: 3,
+		flags:   []func(*flag.FlagSet){uahFlag},
+		run:     cmdAddOrder,
+	},
+	{
+		name:     "delorder",
+		args:     "ORDER_ID",
+		summary:  "delete existing order",
+		examples: []string{"delorder 12345"},
+		minArgs:  1,
+		maxArgs:  1,
+		run:      cmdDelOrder,
+	},
+	{
+		name:    "delall",
+		summary: "delete all existing orders",
+		run:     cmdDelAll,
+	},
+	{
+		name:    "watch",
+		args:    "ORDER_ID...",
+		summary: "watch orders and show fills",
+		help: "Watch orders until they are finished and show fills " +
+			"as they happen.",
+		examples: []string{"watch 12345 12346"},
+		minArgs:  1,
+		maxArgs:  -1,
+		run:      cmdWatch,
+	},
+	{
+		name:    "dca",
+		args:    "PLANFILE [JOURNAL]",
+		summary: "run dollar-cost-averaging scheduler",
+		help: "Run dollar-cost-averaging scheduler placing orders " +
+			"described in PLANFILE until interrupted. Executions " +
+			"are written to JOURNAL, default is " + DCA_JOURNAL +
+			". See PLANFILE format in cli/README.md.",
+		examples: []string{"dca plans.txt"},
+		minArgs:  1,
+		maxArgs:  2,
+		run:      cmdDCA,
+	},
+	{
+		name:    "dcalog",
+		args:    "[JOURNAL]",
+		summary: "show DCA execution journal",
+		maxArgs: 1,
+		run:     cmdDCALog,
+	},
+	{
+		name:    "condadd",
+		args:    "TYPE SIDE VOLUME PRICE [LIMIT]",
+		summary: "add conditional order",
+		help: "Add conditional order submitted by condwatch. TYPE is " +
+			"stop-loss, take-profit or trailing-stop; PRICE is " +
+			"trigger price or trailing distance (e.g. 5%); LIMIT is " +
+			"order price, market order is submitted if omitted.",
+		examples: []string{"condadd stop-loss sell 0.5 240000",
+			"condadd trailing-stop sell 0.5 5% 230000"},
+		minArgs: 4,
+		maxArgs: 5,
+		flags:   []func(*flag.FlagSet){uahFlag, condsFlag},
+		run:     cmdCondAdd,
+	},
+	{
+		name:    "conds",
+		summary: "show conditional orders",
+		flags:   []func(*flag.FlagSet){condsFlag},
+		run:     cmdConds,
+	},
+	{
+		name:    "conddel",
+		args:    "ID",
+		summary: "cancel pending conditional order",
+		minArgs: 1,
+		maxArgs: 1,
+		flags:   []func(*flag.FlagSet){condsFlag},
+		run:     cmdCondDel,
+	},
+	{
+		name:    "condwatch",
+		summary: "watch prices and submit conditional orders",
+		flags:   []func(*flag.FlagSet){condsFlag},
+		run:     cmdCondWatch,
+	},
+	{
+		name:    "oco",
+		args:    "SIDE VOLUME PRICE STOP [STOP_LIMIT]",
+		summary: "place one-cancels-other order pair",
+		help: "Place limit order and client-side stop order. When one " +
+			"of them is executed, the other one is cancelled. Stop " +
+			"order is a market one unless STOP_LIMIT price is given.",
+		examples: []string{"oco sell 0.5 270000 240000"},
+		minArgs:  4,
+		maxArgs:  5,
+		flags:    []func(*flag.FlagSet){uahFlag},
+		run:      cmdOCO,
+	},
+	{
+		name:    "bracket",
+		args:    "SIDE VOLUME PRICE TAKE_PROFIT STOP [STOP_LIMIT]",
+		summary: "place entry order with take-profit and stop orders",
+		help: "Place entry order (market one if PRICE is 0), then " +
+			"take-profit and stop orders as OCO pair.",
+		examples: []string{"bracket buy 0.5 0 270000 240000"},
+		minArgs:  5,
+		maxArgs:  6,
+		flags:    []func(*flag.FlagSet){uahFlag},
+		run:      cmdBracket,
+	},
+	{
+		name:    "twap",
+		args:    "SIDE VOLUME DURATION SLICES [LIMIT]",
+		summary: "execute large order in equal slices over time",
+		help: "Execute large order in SLICES equal child orders over " +
+			"DURATION (e.g. 2h). Child orders are not placed above " +
+			"(below for sell) LIMIT price.",
+		examples: []string{"twap buy 2 2h 24"},
+		minArgs:  4,
+		maxArgs:  5,
+		flags:    []func(*flag.FlagSet){uahFlag},
+		run:      func(args []string) { cmdAlgo("twap", args) },
+	},
+	{
+		name:    "vwap",
+		args:    "SIDE VOLUME DURATION SLICES [LIMIT]",
+		summary: "execute large order following traded volumes",
+		help: "Execute large order in SLICES child orders over " +
+			"DURATION (e.g. 2h) with slice volumes following trade " +
+			"history volumes. Child orders are not placed above " +
+			"(below for sell) LIMIT price.",
+		examples: []string{"vwap sell 2 4h 48 240000"},
+		minArgs:  4,
+		maxArgs:  5,
+		flags:    []func(*flag.FlagSet){uahFlag},
+		run:      func(args []string) { cmdAlgo("vwap", args) },
+	},
+	{
+		name:    "iceberg",
+		args:    "SIDE VOLUME VISIBLE LIMIT [DURATION]",
+		summary: "execute large order showing only part of it",
+		help: "Execute large order showing only VISIBLE volume in the " +
+			"order book at a time, giving up after DURATION.",
+		examples: []string{"iceberg sell 5 0.5 260000 1h"},
+		minArgs:  4,
+		maxArgs:  5,
+		flags:    []func(*flag.FlagSet){uahFlag},
+		run:      cmdIceberg,
+	},
+	{
+		name:    "credadd",
+		args:    "NAME",
+		summary: "add API keys to the credential store",
+		help: "Add API keys to the credential store. Passphrase and " +
+			"keys are asked for on the terminal, so they never " +
+			"appear in the command line.",
+		examples: []string{"credadd main",
+			"--credstore /secure/keys.json credadd bot"},
+		minArgs: 1,
+		maxArgs: 1,
+		run:     func(args []string) { cmdCredSet("credadd", args) },
+	},
+	{
+		name:    "creds",
+		summary: "show names of stored API keys",
+		run:     cmdCreds,
+	},
+	{
+		name:    "creddel",
+		args:    "NAME",
+		summary: "remove API keys from the credential store",
+		minArgs: 1,
+		maxArgs: 1,
+		run:     cmdCredDel,
+	},
+	{
+		name:    "credrotate",
+		args:    "NAME",
+		summary: "replace stored API keys with new ones",
+		help: "Replace stored API keys with new ones, e.g. after " +
+			"regenerating them at the exchange.",
+		minArgs: 1,
+		maxArgs: 1,
+		run:     func(args []string) { cmdCredSet("credrotate", args) },
+	},
+	{
+		name:    "completion",
+		args:    "SHELL",
+		summary: "print shell completion script",
+		help: "Print completion script for SHELL: bash, zsh or fish. " +
+			"Besides commands and options, it completes market " +
+			"names, profile names, open order IDs of delorder and " +
+			"watch, and pending conditional order IDs of conddel. " +
+			"Names of stored API keys are completed only if " +
+			"KUNAIO_PASSPHRASE is set.",
+		examples: []string{"completion bash > /etc/bash_completion.d/kunaio-cli",
+			"completion fish > ~/.config/fish/completions/kunaio-cli.fish",
+			"completion zsh > \"${fpath[1]}/_kunaio-cli\""},
+		minArgs: 1,
+		maxArgs: 1,
+		run:     cmdCompletion,
+	},
+}
+
+func cmdTime(args []string) {
+	t, err := kunaio.GetServerTime()
+	if err != nil {
+		fatalf("get server time: %s", err)
+	}
+	gOut.value(timeResult{t}, func(w io.Writer) {
+		fmt.Fprintf(w, "%s\n", tts(t))
+	})
+}
+
+func cmdSkew(args []string) {
+	clock := kunaio.NewServerClock(nil)
+	clock.MaxSkew = -1
+	skew, err := clock.Measure()
+	if err != nil {
+		fatalf("measure clock skew: %s", err)
+	}
+	gOut.value(skewResult{skew.Seconds()}, func(w io.Writer) {
+		fmt.Fprintf(w, "%s\n", skew)
+	})
+}
+
+func cmdStats(args []string) {
+	stats, err := kunaio.GetLatestStats(gMarket)
+	if err != nil {
+		fatalf("get stats: %s", err)
+	}
+	gOut.value(stats, nil)
+}
+
+func cmdBookSide(side string, args []string) {
+	var limit float64
+	if len(args) == 1 {
+		f, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || f < 0 {
+			fatalf("invalid limit (%s): %s", args[0], err)
+		}
+		limit = f
+	}
+	obook, err := kunaio.GetOrderBook(gMarket)
+	if err != nil {
+		fatalf("get order book: %s", err)
+	}
+	if side == "sell" {
+		printBookSide(&sellTable, obook.Asks, limit)
+	} else {
+		printBookSide(&buyTable, obook.Bids, limit)
+	}
+}
+
+func cmdHistory(args []string) {
+	hist, err := kunaio.GetTradeHistory(gMarket)
+	if err != nil {
+		fatalf("get trade history: %s", err)
+	}
+	printHistory(hist)
+}
+
+func cmdCollect(args []string) {
+	archive, err := kunaio.OpenArchive(args[0])
+	if err != nil {
+		fatalf("open archive: %s", err)
+	}
+	collector := &kunaio.Collector{
+		Client:  newClient(),
+		Archive: archive,
+		OnAppend: func(market string, count int) {
+			now := time.Now()
+			gOut.row(appendResult{now, market, count},
+				now, market, count)
+			if gMetrics != nil {
+				gMetrics.ObserveAppend(market, count)
+			}
+		},
+	}
+	gOut.stream(&appendTable)
+	collector.Run(interruptContext())
+}
+
+func cmdArchive(args []string) {
+	archive, err := kunaio.OpenArchive(args[0])
+	if err != nil {
+		fatalf("open archive: %s", err)
+	}
+	hist, err := archive.Query(gMarket, parseTime(args[1]),
+		parseTime(args[2]))
+	if err != nil {
+		fatalf("query archive: %s", err)
+	}
+	printHistory(hist)
+}
+
+func cmdCompact(args []string) {
+	archive, err := kunaio.OpenArchive(args[0])
+	if err != nil {
+		fatalf("open archive: %s", err)
+	}
+	y, m, d := time.Now().UTC().Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	if err := archive.CompactBefore(today); err != nil {
+		fatalf("compact archive: %s", err)
+	}
+}
+
+func cmdRecord(args []string) {
+	recorder := kunaio.NewRecorder(newClient(), args[0])
+	if 1 < len(args) {
+		schedule, err := kunaio.ParseSchedule(args[1])
+		if err != nil {
+			fatalf("invalid SCHEDULE arg: %s", err)
+		}
+		recorder.Schedule = schedule
+	}
+	if 2 < len(args) {
+		depth, err := strconv.Atoi(args[2])
+		if err != nil || depth <= 0 {
+			fatalf("invalid DEPTH arg (%s)", args[2])
+		}
+		recorder.Depth = depth
+	}
+	gOut.stream(&snapshotTable)
+	recorder.OnSnapshot = func(snap kunaio.Snapshot) {
+		printSnapshot(snap)
+		if gMetrics != nil {
+			gMetrics.ObserveSnapshot(snap)
+		}
+	}
+	recorder.Run(interruptContext())
+}
+
+func cmdSnapshots(args []string) {
+	it, err := kunaio.OpenSnapshots(args[0], gMarket,
+		parseTime(args[1]), parseTime(args[2]))
+	if err != nil {
+		fatalf("open snapshots: %s", err)
+	}
+	gOut.begin(&snapshotTable)
+	for it.Next() {
+		printSnapshot(it.Snapshot())
+	}
+	gOut.end()
+	it.Close()
+	if err := it.Err(); err != nil {
+		fatalf("read snapshots: %s", err)
+	}
+	if n := it.Skipped(); 0 < n {
+		fmt.Fprintf(os.Stderr, "warning: %d corrupted snapshots skipped\n", n)
+	}
+}
+
+func cmdUserInfo(args []string) {
+	checkReqs()
+	info, err := newClient().GetUserInfo()
+	if err != nil {
+		fatalf("get user info: %s", err)
+	}
+	printUserInfo(info)
+}
+
+// Print user info. CSV has one row per account.
+func printUserInfo(info *kunaio.UserInfo) {
+	if gOut.format == formatCSV {
+		gOut.begin(&accountTable)
+		for _, a := range info.Accounts {
+			gOut.row(accountResult{info.Email, info.Activated, a})
+		}
+		gOut.end()
+		return
+	}
+	gOut.value(info, func(w io.Writer) {
+		fmt.Fprintf(w, "email:\t%s\nactive:\t%v\n"+
+			"Accounts: %6s %15s %15s\n",
+			info.Email, info.Activated,
+			"CURRENCY", "BALANCE", "LOCKED")
+		for _, a := range info.Accounts {
+			fmt.Fprintf(w, "%18s %15.7f %15.7f\n",
+				a.Currency, a.Balance, a.Locked)
+		}
+	})
+}
+
+func cmdUserOrders(args []string) {
+	checkReqs()
+	orders, err := newClient().GetUserOrders(gMarket)
+	if err != nil {
+		fatalf("get user orders: %s", err)
+	}
+	gOut.begin(&userOrdersTable)
+	for _, e := range orders {
+		printUserOrder(e)
+	}
+	gOut.end()
+}
+
+// Print row of userOrdersTable.
+func printUserOrder(e kunaio.Order) {
+	gOut.row(e, e.CreatedAt,
+		e.Market, e.Side, e.ID, e.Price,
+		e.AvgPrice,
+		e.Volume, e.Volume*e.Price,
+		e.RemainingVolume, e.RemainingVolume*e.Price,
+		e.ExecutedVolume, e.ExecutedVolume*e.Price,
+		e.TradesCount)
+}
+
+func cmdUserTrades(args []string) {
+	checkReqs()
+	trades, err := newClient().GetUserTrades(gMarket)
+	if err != nil {
+		fatalf("get user trades: %s", err)
+	}
+	gOut.begin(&userTradesTable)
+	var (
+		sumVolume float64
+		sumFunds  float64
+	)
+	for _, e := range trades {
+		sumVolume += e.Volume
+		sumFunds += e.Funds
+		gOut.row(e, e.CreatedAt, e.Side,
+			e.Price, e.Volume, e.Funds,
+			sumFunds/sumVolume,
+			sumVolume, sumFunds)
+	}
+	gOut.text("AVERAGE%38.7f %15.7f %15.7f\n",
+		trades.AvgPrice(), trades.AvgVolume(), trades.AvgFunds())
+	gOut.end()
+}
+
+func cmdAddOrder(args []string) {
+	checkReqs()
+	side := strings.Trim(strings.ToLower(args[0]), " \t\n\r")
+	if side != "sell" && side != "buy" {
+		fatalf("invalid SIDE arg (%s). Valid values are: sell, buy", side)
+	}
+	volume, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		fatalf("invalid VOLUME arg (%s): %s", args[1], err)
+	}
+	price, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		fatalf("invalid PRICE arg (%s): %s", args[2], err)
+	}
+	if gUAH {
+		volume /= price
+	}
+	order, err := newClient().NewOrder(gMarket,
+		side, volume, price)
+	if err != nil {
+		fatalf("new order: %s", err)
+	}
+	gOut.text("Order created:\n")
+	gOut.value(order, nil)
+}
+
+func cmdDelOrder(args []string) {
+	checkReqs()
+	i, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fatalf("invalid order ID %s: %s", args[0], err)
+	}
+	order, err := newClient().CancelOrder(int(i))
+	if err != nil {
+		fatalf("cancel order: %s", err)
+	}
+	gOut.text("Order deleted:\n")
+	gOut.value(order, nil)
+}
+
+func cmdDelAll(args []string) {
+	checkReqs()
+	orders, err := newClient().GetUserOrders(gMarket)
+	if err != nil {
+		fatalf("get user orders: %s", err)
+	}
+	gOut.begin(&userOrdersTable)
+	for _, order := range orders {
+		order, err := newClient().CancelOrder(order.ID)
+		if err != nil {
+			fatalf("cancel order: %s", err)
+		}
+		printUserOrder(order)
+	}
+	gOut.end()
+}
+
+func cmdWatch(args []string) {
+	checkReqs()
+	var ids []int
+	for _, arg := range args {
+		i, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			fatalf("invalid order ID %s: %s", arg, err)
+		}
+		ids = append(ids, int(i))
+	}
+	watchOrders(ids)
+}
+
+func cmdDCA(args []string) {
+	checkReqs()
+	journalPath := DCA_JOURNAL
+	if len(args) == 2 {
+		journalPath = args[1]
+	}
+	runDCA(args[0], journalPath)
+}
+
+func cmdDCALog(args []string) {
+	journalPath := DCA_JOURNAL
+	if len(args) == 1 {
+		journalPath = args[0]
+	}
+	records, err := kunaio.ReadDCAJournal(journalPath)
+	if err != nil {
+		fatalf("read DCA journal: %s", err)
+	}
+	gOut.begin(&dcaTable)
+	for _, rec := range records {
+		printDCARecord(rec)
+	}
+	gOut.end()
+}
+
+func cmdCondAdd(args []string) {
+	cond := parseCondition(args)
+	cond, err := kunaio.NewConditionStore(gConds).Add(cond)
+	if err != nil {
+		fatalf("add conditional order: %s", err)
+	}
+	gOut.text("Conditional order created:\n")
+	printConditions(cond)
+}
+
+func cmdConds(args []string) {
+	conds, err := kunaio.NewConditionStore(gConds).Load()
+	if err != nil {
+		fatalf("load conditional orders: %s", err)
+	}
+	printConditions(conds...)
+}
+
+func cmdCondDel(args []string) {
+	i, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fatalf("invalid conditional order ID %s: %s", args[0], err)
+	}
+	cond, err := kunaio.NewConditionStore(gConds).Cancel(int(i))
+	if err != nil {
+		fatalf("cancel conditional order: %s", err)
+	}
+	gOut.text("Conditional order cancelled:\n")
+	printConditions(cond)
+}
+
+func cmdCondWatch(args []string) {
+	checkReqs()
+	engine := kunaio.NewConditionEngine(
+		newClient(),
+		kunaio.NewConditionStore(gConds))
+	engine.OnTrigger = func(c kunaio.Condition) {
+		printCondition(c)
+		if gMetrics != nil {
+			gMetrics.ObserveCondition(c)
+		}
+	}
+	gOut.stream(&condTable)
+	if err := engine.Run(interruptContext()); err != context.Canceled {
+		fatalf("conditional orders: %s", err)
+	}
+}
+
+func cmdOCO(args []string) {
+	checkReqs()
+	side, volume, prices := parseOrderArgs(args, 2)
+	limit := kunaio.OrderLeg{Side: side, Volume: volume, Price: prices[0]}
+	stop := kunaio.OrderLeg{Side: side, Volume: volume, StopPrice: prices[1]}
+	if len(prices) == 3 {
+		stop.Price = prices[2]
+	}
+	tracker := newOCOTracker()
+	group, err := tracker.PlaceOCO(gMarket, limit, stop)
+	if err != nil {
+		fatalf("place OCO: %s", err)
+	}
+	watchGroup(tracker, group.ID)
+}
+
+func cmdBracket(args []string) {
+	checkReqs()
+	side, volume, prices := parseOrderArgs(args, 3)
+	entry := kunaio.OrderLeg{Side: side, Volume: volume, Price: prices[0]}
+	takeProfit := kunaio.OrderLeg{Price: prices[1]}
+	stop := kunaio.OrderLeg{StopPrice: prices[2]}
+	if len(prices) == 4 {
+		stop.Price = prices[3]
+	}
+	tracker := newOCOTracker()
+	group, err := tracker.PlaceBracket(gMarket, entry, takeProfit, stop)
+	if err != nil {
+		fatalf("place bracket: %s", err)
+	}
+	watchGroup(tracker, group.ID)
+}
+
+// Run TWAP or VWAP execution.
+func cmdAlgo(algo string, args []string) {
+	checkReqs()
+	params := kunaio.ExecutionParams{Algo: algo, Market: gMarket}
+	params.Side, params.Volume = parseSideVolume(args[0], args[1])
+	params.Duration = parseDuration(args[2])
+	slices, err := strconv.Atoi(args[3])
+	if err != nil || slices <= 0 {
+		fatalf("invalid SLICES arg (%s)", args[3])
+	}
+	params.Slices = slices
+	if len(args) == 5 {
+		params.LimitPrice = parsePrice(args[4])
+	}
+	execute(params)
+}
+
+func cmdIceberg(args []string) {
+	checkReqs()
+	params := kunaio.ExecutionParams{Algo: "iceberg", Market: gMarket}
+	params.Side, params.Volume = parseSideVolume(args[0], args[1])
+	visible, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		fatalf("invalid VISIBLE arg (%s): %s", args[2], err)
+	}
+	params.VisibleVolume = visible
+	params.LimitPrice = parsePrice(args[3])
+	if len(args) == 5 {
+		params.Duration = parseDuration(args[4])
+	}
+	execute(params)
+}
+
+// Add or rotate stored API keys.
+func cmdCredSet(cmd string, args []string) {
+	store := openCredStore()
+	if cmd == "credadd" {
+		if err := store.Add(args[0], readCredentials()); err != nil {
+			fatalf("add credentials: %s", err)
+		}
+	} else {
+		if _, err := store.Get(args[0]); err != nil {
+			fatalf("rotate credentials: %s", err)
+		}
+		if err := store.Rotate(args[0], readCredentials()); err != nil {
+			fatalf("rotate credentials: %s", err)
+		}
+	}
+	list, err := store.List()
+	if err != nil {
+		fatalf("list credentials: %s", err)
+	}
+	for _, c := range list {
+		if c.Name == args[0] {
+			printCredentials([]kunaio.StoredCredentials{c})
+		}
+	}
+}
+
+func cmdCreds(args []string) {
+	list, err := openCredStore().List()
+	if err != nil {
+		fatalf("list credentials: %s", err)
+	}
+	printCredentials(list)
+}
+
+func cmdCredDel(args []string) {
+	if err := openCredStore().Remove(args[0]); err != nil {
+		fatalf("remove credentials: %s", err)
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"kunaio"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hidden command printing completion candidates. It is called by
+// the completion scripts.
+const completeCommand = "__complete"
+
+// Open orders are not completed if the exchange doesn't answer
+// within this time.
+const completeTimeout = 3 * time.Second
+
+// Completion scripts. Arguments are program name and shell
+// function name.
+const (
+	bashCompletion = `# bash completion for %[1]s. Load it with
+#	source <(%[1]s completion bash)
+%[2]s() {
+	local IFS=$'\n' out
+	out=$("${COMP_WORDS[0]}" ` + completeCommand + ` "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null) || return
+	COMPREPLY=($(printf '%%s\n' "$out" | cut -f1))
+}
+complete -o default -F %[2]s %[1]s
+`
+	zshCompletion = `#compdef %[1]s
+# zsh completion for %[1]s. Load it with
+#	source <(%[1]s completion zsh)
+# or save it as _%[1]s to a directory in $fpath.
+%[2]s() {
+	local -a candidates
+	local line name
+	for line in "${(@f)$(${words[1]} ` + completeCommand + ` "${(@)words[2,CURRENT]}" 2>/dev/null)}"; do
+		[[ -z $line ]] && continue
+		name=${line%%%%$'\t'*}
+		name=${name//:/\\:}
+		if [[ $line == *$'\t'* ]]; then
+			candidates+=("$name:${line#*$'\t'}")
+		else
+			candidates+=("$name")
+		fi
+	done
+	if (( ${#candidates} )); then
+		_describe -t values '%[1]s' candidates
+	else
+		_files
+	fi
+}
+if [[ $funcstack[1] == _%[1]s ]]; then
+	%[2]s "$@"
+else
+	compdef %[2]s %[1]s
+fi
+`
+	fishCompletion = `# fish completion for %[1]s. Load it with
+#	%[1]s completion fish | source
+function %[2]s
+	set -l tokens (commandline -opc) (commandline -ct)
+	set -l out ($tokens[1] ` + completeCommand + ` $tokens[2..-1] 2>/dev/null)
+	if test (count $out) -eq 0
+		__fish_complete_path (commandline -ct)
+	else
+		printf '%%s\n' $out
+	end
+end
+complete -c %[1]s -f -a '(%[2]s)'
+`
+)
+
+// Print completion script for the shell.
+func cmdCompletion(args []string) {
+	var script string
+	switch args[0] {
+	case "bash":
+		script = bashCompletion
+	case "zsh":
+		script = zshCompletion
+	case "fish":
+		script = fishCompletion
+	default:
+		fatalf("unsupported shell: %s (expected bash, zsh or fish)", args[0])
+	}
+	fn := "__" + regexp.MustCompile(`\W`).ReplaceAllString(gProgName, "_") +
+		"_complete"
+	fmt.Printf(script, gProgName, fn)
+}
+
+// Print completion candidates for the last of the words, one per
+// line, optionally followed by tab and description. Nothing is
+// printed when file names are expected.
+func complete(words []string) {
+	for _, c := range completions(words) {
+		fmt.Println(c)
+	}
+}
+
+// Return completion candidates for the last of the words.
+func completions(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur := words[len(words)-1]
+	words = words[:len(words)-1]
+	fs := newFlagSet()
+	globalFlags(fs)
+	for _, c := range gCommands {
+		addFlags(fs, c.flags)
+	}
+	var (
+		name     string
+		pos      []string
+		prev     *flag.Flag
+		dashdash bool
+	)
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		switch {
+		case prev != nil:
+			completeFlag(fs, prev.Name, w)
+			prev = nil
+		case !dashdash && w == "--":
+			dashdash = true
+		case !dashdash && strings.HasPrefix(w, "-") && w != "-":
+			flagName := strings.TrimLeft(w, "-")
+			if j := strings.Index(flagName, "="); 0 <= j {
+				completeFlag(fs, flagName[:j], flagName[j+1:])
+				break
+			}
+			f := fs.Lookup(flagName)
+			if f == nil || isBoolFlag(f) {
+				break
+			}
+			// bash splits --flag=value to three words
+			if i+1 < len(words) && words[i+1] == "=" {
+				i++
+			}
+			prev = f
+		case name == "":
+			name = w
+		default:
+			pos = append(pos, w)
+		}
+	}
+	var (
+		candidates []string
+		prefix     string
+	)
+	switch {
+	case prev != nil:
+		if cur == "=" {
+			prefix, cur = "=", ""
+		}
+		candidates = flagValues(prev.Name)
+	case !dashdash && strings.HasPrefix(cur, "-"):
+		if j := strings.Index(cur, "="); 0 <= j {
+			prefix = cur[:j+1]
+			candidates = flagValues(strings.TrimLeft(cur[:j], "-"))
+			cur = cur[j+1:]
+			break
+		}
+		cmdFlags := newFlagSet()
+		globalFlags(cmdFlags)
+		if cmd := findCommand(name); cmd != nil {
+			addFlags(cmdFlags, cmd.flags)
+		}
+		cmdFlags.VisitAll(func(f *flag.Flag) {
+			_, text := flag.UnquoteUsage(f)
+			candidates = append(candidates, "--"+f.Name+"\t"+text)
+		})
+	case name == "":
+		candidates = commandNames()
+	default:
+		candidates = argValues(name, len(pos))
+	}
+	var res []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, cur) {
+			res = append(res, prefix+c)
+		}
+	}
+	return res
+}
+
+// Apply option value given in the command line being completed, if
+// it affects the candidates.
+func completeFlag(fs *flag.FlagSet, name, value string) {
+	switch name {
+	case "market", "akey", "skey", "url", "profile", "config",
+		"creds", "credstore", "conds":
+		fs.Set(name, value)
+	}
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// Return names of the commands with descriptions.
+func commandNames() []string {
+	res := []string{"help\tshow help on command"}
+	for _, c := range gCommands {
+		res = append(res, c.name+"\t"+c.summary)
+	}
+	return res
+}
+
+// Return candidates for value of the option.
+func flagValues(name string) []string {
+	switch name {
+	case "market":
+		return kunaio.SupportedMarkets()
+	case "output":
+		return []string{formatTable, formatJSON, formatCSV, formatYAML}
+	case "decode":
+		return []string{"strict", "lenient"}
+	case "profile":
+		return profileNames()
+	case "creds":
+		return storedCredentials()
+	}
+	return nil
+}
+
+// Return candidates for i-th argument of the command.
+func argValues(cmd string, i int) []string {
+	switch cmd {
+	case "help":
+		if i == 0 {
+			return commandNames()[1:]
+		}
+	case "completion":
+		if i == 0 {
+			return []string{"bash", "zsh", "fish"}
+		}
+	case "addorder", "oco", "bracket", "twap", "vwap", "iceberg":
+		if i == 0 {
+			return []string{"buy", "sell"}
+		}
+	case "condadd":
+		switch i {
+		case 0:
+			return []string{kunaio.StopLoss, kunaio.TakeProfit,
+				kunaio.TrailingStop}
+		case 1:
+			return []string{"buy", "sell"}
+		}
+	case "delorder":
+		if i == 0 {
+			return openOrders()
+		}
+	case "watch":
+		return openOrders()
+	case "conddel":
+		if i == 0 {
+			return pendingConditions()
+		}
+	case "creddel", "credrotate":
+		if i == 0 {
+			return storedCredentials()
+		}
+	}
+	return nil
+}
+
+// Return names of the config file profiles.
+func profileNames() []string {
+	conf, err := readConfig(gConfigPath)
+	if err != nil || conf == nil {
+		return nil
+	}
+	var res []string
+	for name := range conf.Profiles {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Return names of stored API keys. The store is read only when
+// the passphrase is in the environment, so completion never asks
+// for it.
+func storedCredentials() []string {
+	passphrase, ok := os.LookupEnv("KUNAIO_PASSPHRASE")
+	if !ok {
+		return nil
+	}
+	store, err := kunaio.OpenCredentialStore(gCredStore, []byte(passphrase))
+	if err != nil {
+		return nil
+	}
+	list, err := store.List()
+	if err != nil {
+		return nil
+	}
+	var res []string
+	for _, c := range list {
+		res = append(res, c.Name)
+	}
+	return res
+}
+
+// Return IDs of open orders with descriptions.
+func openOrders() []string {
+	applyProfile()
+	if gCreds != "" {
+		if _, ok := os.LookupEnv("KUNAIO_PASSPHRASE"); !ok {
+			return nil
+		}
+		loadCredentials()
+	}
+	if gCredentials == nil && (gAKey == "" || gSKey == "") {
+		return nil
+	}
+	done := make(chan []kunaio.Order, 1)
+	go func() {
+		orders, _ := newClient().GetUserOrders(gMarket)
+		done <- orders
+	}()
+	var orders []kunaio.Order
+	select {
+	case orders = <-done:
+	case <-time.After(completeTimeout):
+	}
+	var res []string
+	for _, o := range orders {
+		res = append(res, fmt.Sprintf("%d\t%s %s %g at %g", o.ID,
+			o.Side, o.Market, o.RemainingVolume, o.Price))
+	}
+	return res
+}
+
+// Return IDs of pending conditional orders with descriptions.
+func pendingConditions() []string {
+	conds, err := kunaio.NewConditionStore(gConds).Load()
+	if err != nil {
+		return nil
+	}
+	var res []string
+	for _, c := range conds {
+		if c.State == kunaio.CondPending {
+			res = append(res, fmt.Sprintf("%d\t%s %s %s %g at %g",
+				c.ID, c.Type, c.Side, c.Market, c.Volume,
+				c.TriggerPrice))
+		}
+	}
+	return res
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompletions(t *testing.T) {
+	for _, c := range []struct {
+		words []string
+		want  []string
+	}{
+		{[]string{"userin"}, []string{"userinfo\tshow user info and assets"}},
+		{[]string{"--market", "e"}, []string{"ethuah"}},
+		{[]string{"--market", "="}, []string{"=btcuah", "=ethuah"}},
+		{[]string{"--market=b"}, []string{"--market=btcuah"}},
+		{[]string{"--unix", "--output", "j"}, []string{"json"}},
+		{[]string{"addorder", "--ua"}, []string{
+			"--uah\tvolumes and limits are in UAH instead of ICO."}},
+		{[]string{"--market", "ethuah", "addorder", "s"}, []string{"sell"}},
+		{[]string{"condadd", "--uah", "stop-loss", "b"}, []string{"buy"}},
+		{[]string{"help", "iceb"}, []string{
+			"iceberg\texecute large order showing only part of it"}},
+		{[]string{"completion", "f"}, []string{"fish"}},
+		{[]string{"delall", "--", "-"}, nil},
+		{[]string{"dca", ""}, nil},
+	} {
+		got := completions(c.words)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: %q", c.words, got)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Named set of CLI settings in the configuration file.
+type profile struct {
+	AccessKey string
+	SecretKey string
+	// Name of API keys in the credential store
+	Credentials string
+	Market      string
+	// Output format, see --output option
+	Output string
+	// Go time layout or "unix"
+	TimeFormat string
+	URL        string
+}
+
+// CLI configuration file. It is a TOML file with profiles in
+// [profiles.NAME] tables:
+//
+//	default_profile = "main"
+//
+//	[profiles.main]
+//	access_key = "..."
+//	secret_key = "..."
+//	credentials = "main"
+//	market = "btcuah"
+//	output = "table"
+//	time_format = "2006-01-02 15:04:05"
+//	url = "https://kuna.io"
+type config struct {
+	// Profile used when none is selected with --profile option.
+	// If not set, profile named "default" is used, if any.
+	DefaultProfile string
+	Profiles       map[string]*profile
+}
+
+// Return default configuration file path,
+// e.g. ~/.config/kunaio/config.toml.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kunaio", "config.toml")
+}
+
+// Read configuration file. Returns nil config if the file does not
+// exist. Warns if the file is accessible by other users.
+func readConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && runtime.GOOS != "windows" &&
+		fi.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(os.Stderr, "warning: config file %s is accessible"+
+			" by other users (mode %s), run: chmod 600 %s\n",
+			path, fi.Mode().Perm(), path)
+	}
+	conf, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s", path, err)
+	}
+	return conf, nil
+}
+
+// Parse configuration file. Supports the subset of TOML used by
+// the configuration: tables, comments, strings and key/value pairs.
+func parseConfig(r io.Reader) (*config, error) {
+	conf := &config{Profiles: map[string]*profile{}}
+	var cur *profile
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		p := &tomlLine{s: strings.TrimSpace(scanner.Text())}
+		if p.end() {
+			continue
+		}
+		if strings.HasPrefix(p.s, "[") {
+			p.s = p.s[1:]
+			keys, err := p.keys("]")
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s", n, err)
+			}
+			if len(keys) != 2 || keys[0] != "profiles" {
+				return nil, fmt.Errorf("%d: unknown table [%s]", n,
+					strings.Join(keys, "."))
+			}
+			cur = conf.Profiles[keys[1]]
+			if cur == nil {
+				cur = &profile{}
+				conf.Profiles[keys[1]] = cur
+			}
+			continue
+		}
+		keys, err := p.keys("=")
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", n, err)
+		}
+		// values may be secret, so they are not reported
+		key := strings.Join(keys, ".")
+		value, err := p.str()
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s: %s", n, key, err)
+		}
+		if !p.end() {
+			return nil, fmt.Errorf("%d: %s: unexpected data after value", n, key)
+		}
+		if cur == nil {
+			if key != "default_profile" {
+				return nil, fmt.Errorf("%d: unknown key %q", n, key)
+			}
+			conf.DefaultProfile = value
+			continue
+		}
+		switch key {
+		case "access_key":
+			cur.AccessKey = value
+		case "secret_key":
+			cur.SecretKey = value
+		case "credentials":
+			cur.Credentials = value
+		case "market":
+			cur.Market = value
+		case "output":
+			cur.Output = value
+		case "time_format":
+			cur.TimeFormat = value
+		case "url":
+			cur.URL = value
+		default:
+			return nil, fmt.Errorf("%d: unknown key %q", n, key)
+		}
+	}
+	return conf, scanner.Err()
+}
+
+// Rest of TOML line being parsed.
+type tomlLine struct {
+	s string
+}
+
+// Return true if only white space or comment is left.
+func (p *tomlLine) end() bool {
+	p.s = strings.TrimSpace(p.s)
+	return p.s == "" || strings.HasPrefix(p.s, "#")
+}
+
+// Parse dotted key terminated by the separator.
+func (p *tomlLine) keys(sep string) ([]string, error) {
+	var keys []string
+	for {
+		p.s = strings.TrimSpace(p.s)
+		var key string
+		if strings.HasPrefix(p.s, `"`) || strings.HasPrefix(p.s, "'") {
+			k, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			key = k
+		} else {
+			i := strings.IndexFunc(p.s, func(c rune) bool {
+				return !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+					'0' <= c && c <= '9' || c == '_' || c == '-')
+			})
+			if i < 0 {
+				i = len(p.s)
+			}
+			if i == 0 {
+				return nil, errors.New("key expected")
+			}
+			key, p.s = p.s[:i], p.s[i:]
+		}
+		keys = append(keys, key)
+		p.s = strings.TrimSpace(p.s)
+		switch {
+		case strings.HasPrefix(p.s, "."):
+			p.s = p.s[1:]
+		case strings.HasPrefix(p.s, sep):
+			p.s = p.s[len(sep):]
+			return keys, nil
+		default:
+			return nil, fmt.Errorf("%q expected after key", sep)
+		}
+	}
+}
+
+// Parse basic ("...") or literal ('...') string.
+func (p *tomlLine) str() (string, error) {
+	p.s = strings.TrimSpace(p.s)
+	switch {
+	case strings.HasPrefix(p.s, "'"):
+		i := strings.Index(p.s[1:], "'")
+		if i < 0 {
+			return "", errors.New("unterminated string")
+		}
+		v := p.s[1 : i+1]
+		p.s = p.s[i+2:]
+		return v, nil
+	case strings.HasPrefix(p.s, `"`):
+		// find closing quote skipping escaped characters
+		i := 1
+		for ; i < len(p.s) && p.s[i] != '"'; i++ {
+			if p.s[i] == '\\' {
+				i++
+			}
+		}
+		if len(p.s) <= i {
+			return "", errors.New("unterminated string")
+		}
+		v, err := strconv.Unquote(p.s[:i+1])
+		if err != nil {
+			return "", errors.New("invalid string")
+		}
+		p.s = p.s[i+1:]
+		return v, nil
+	}
+	return "", errors.New("string expected")
+}
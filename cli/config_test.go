@@ -0,0 +1,69 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	conf, err := parseConfig(strings.NewReader(`
+# comment
+default_profile = "main" # trailing comment
+
+[profiles.main]
+access_key = "a\"k#"
+secret_key = 'C:\sk'
+
+[ profiles . "with.dot" ]
+market = "ethuah"
+time_format = "2006-01-02 15:04"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DefaultProfile != "main" {
+		t.Errorf("default profile %q", conf.DefaultProfile)
+	}
+	if p := conf.Profiles["main"]; p == nil ||
+		p.AccessKey != `a"k#` || p.SecretKey != `C:\sk` {
+		t.Errorf("main profile %+v", p)
+	}
+	if p := conf.Profiles["with.dot"]; p == nil ||
+		p.Market != "ethuah" || p.TimeFormat != "2006-01-02 15:04" {
+		t.Errorf("with.dot profile %+v", p)
+	}
+	for _, test := range []struct {
+		conf string
+		err  string
+	}{
+		{"key = \"v\"\n", `1: unknown key "key"`},
+		{"[profiles]\n", "1: unknown table [profiles]"},
+		{"[profiles.a\n", `1: "]" expected after key`},
+		{"[profiles.a]\nmarket = btcuah\n", "2: market: string expected"},
+		{"[profiles.a]\nmarket = \"btcuah\n", "2: market: unterminated string"},
+		// secrets are not leaked to error messages
+		{"[profiles.a]\nsecret_key = \"s3cr\\et\"\n", "2: secret_key: invalid string"},
+		{"[profiles.a]\nsecret_key = 's3cret' x\n",
+			"2: secret_key: unexpected data after value"},
+		{"[profiles.a]\nsecret_key 's3cret'\n", `2: "=" expected after key`},
+	} {
+		_, err := parseConfig(strings.NewReader(test.conf))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: got error %v, want %s", test.conf, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"kunaio"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Table layout of stored credentials
+var credTable = table{
+	head:   "%-16s %-12s %24s %24s\n",
+	titles: []interface{}{"NAME", "ACCESS_KEY", "ADDED", "ROTATED"},
+	row:    "%-16s %-12s %24s %24s\n",
+	item:   credResult{},
+}
+
+// Stored credentials without the secret key.
+type credResult struct {
+	Name      string     `json:"name"`
+	AccessKey string     `json:"access_key"`
+	Added     time.Time  `json:"added"`
+	Rotated   *time.Time `json:"rotated,omitempty"`
+}
+
+// Standard input shared by all the prompts.
+var gStdin = bufio.NewReader(os.Stdin)
+
+// Return default credential store path,
+// e.g. ~/.config/kunaio/credentials.json.
+func defaultCredStorePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kunaio", "credentials.json")
+}
+
+// Open credential store, asking for passphrase unless it is set
+// with KUNAIO_PASSPHRASE. Passphrase of a new store is asked twice.
+func openCredStore() *kunaio.CredentialStore {
+	if gCredStore == "" {
+		fatalf("credential store path is not set")
+	}
+	passphrase, ok := os.LookupEnv("KUNAIO_PASSPHRASE")
+	if !ok {
+		passphrase = readSecret("Passphrase: ", false)
+		if _, err := os.Stat(gCredStore); os.IsNotExist(err) && isTerminal() {
+			if readSecret("Repeat passphrase: ", false) != passphrase {
+				fatalf("passphrases do not match")
+			}
+		}
+	}
+	if passphrase == "" {
+		fatalf("empty passphrase")
+	}
+	if err := os.MkdirAll(filepath.Dir(gCredStore), 0700); err != nil {
+		fatalf("create credential store directory: %s", err)
+	}
+	store, err := kunaio.OpenCredentialStore(gCredStore, []byte(passphrase))
+	if err != nil {
+		fatalf("open credential store: %s", err)
+	}
+	return store
+}
+
+// Ask for new key pair.
+func readCredentials() kunaio.Credentials {
+	c := kunaio.Credentials{
+		AccessKey: readSecret("Access key: ", true),
+		SecretKey: readSecret("Secret key: ", false),
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		fatalf("empty access or secret key")
+	}
+	return c
+}
+
+// Credentials of the API clients, set by loadCredentials.
+var gCredentials kunaio.CredentialProvider
+
+// Take API keys from the credential store, unless they are set
+// with options or environment variables. The keys are read from
+// the store on every call, so rotation takes effect right away.
+func loadCredentials() {
+	if gExplicit["akey"] && gExplicit["skey"] {
+		return
+	}
+	p := explicitKeys{openCredStore().Provider(gCreds)}
+	if _, err := p.Credentials(); err != nil {
+		fatalf("get credentials: %s", err)
+	}
+	gCredentials = p
+}
+
+// Credential provider overriding stored keys with the ones set
+// explicitly.
+type explicitKeys struct {
+	kunaio.CredentialProvider
+}
+
+func (p explicitKeys) Credentials() (kunaio.Credentials, error) {
+	c, err := p.CredentialProvider.Credentials()
+	if err != nil {
+		return c, err
+	}
+	if gExplicit["akey"] {
+		c.AccessKey = gAKey
+	}
+	if gExplicit["skey"] {
+		c.SecretKey = gSKey
+	}
+	return c, nil
+}
+
+// Print stored credentials, hiding most of the access key.
+func printCredentials(list []kunaio.StoredCredentials) {
+	gOut.begin(&credTable)
+	for _, c := range list {
+		res := credResult{
+			Name:      c.Name,
+			AccessKey: c.AccessKey,
+			Added:     c.Added,
+		}
+		if 4 < len(res.AccessKey) {
+			res.AccessKey = res.AccessKey[:4] + "..."
+		}
+		rotated := "-"
+		if !c.Rotated.IsZero() {
+			t := c.Rotated
+			res.Rotated = &t
+			rotated = tts(c.Rotated)
+		}
+		gOut.row(res, res.Name, res.AccessKey, res.Added, rotated)
+	}
+	gOut.end()
+}
+
+// Return true if standard input is a terminal.
+func isTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Read line from standard input. Prompt is shown and, unless echo
+// is set, the input is hidden only when the input is a terminal.
+func readSecret(prompt string, echo bool) string {
+	if isTerminal() {
+		fmt.Fprint(os.Stderr, prompt)
+		if !echo {
+			// echo must be restored when interrupted too
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+			done := make(chan struct{})
+			defer func() {
+				signal.Stop(sigs)
+				close(done)
+			}()
+			go func() {
+				select {
+				case <-sigs:
+					stty("echo")
+					fmt.Fprintln(os.Stderr)
+					os.Exit(130)
+				case <-done:
+				}
+			}()
+			if stty("-echo") == nil {
+				defer func() {
+					stty("echo")
+					fmt.Fprintln(os.Stderr)
+				}()
+			}
+		}
+	}
+	line, err := gStdin.ReadString('\n')
+	if err != nil && line == "" {
+		fatalf("read input: %s", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Change terminal settings of standard input.
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,567 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+	formatYAML  = "yaml"
+)
+
+// Human readable table layout: Printf formats of the header line
+// and rows. Header is not printed when empty.
+type table struct {
+	head   string
+	titles []interface{}
+	row    string
+	// Zero value of the row type. CSV header is made of its fields,
+	// so it is printed even if there are no rows.
+	item interface{}
+}
+
+// Printer writes command results in the selected output format.
+// Results are library values: JSON and YAML keep their JSON field
+// names, CSV flattens struct fields to columns named the same way
+// with nested names joined by dots; lists and maps are put in one
+// column as JSON. Table format prints table cells
+// with the human readable layout. Safe for concurrent use.
+type printer struct {
+	format string
+	w      io.Writer
+	lock   sync.Mutex
+	table  *table
+	// Rows are items of list started with begin, not a stream
+	listing bool
+	// Collected list items in JSON format
+	list []interface{}
+	// Rows printed since begin
+	rows int
+	// CSV writer and its columns, set by the table or the first row
+	csv     *csv.Writer
+	columns []string
+	// YAML documents written
+	docs int
+}
+
+// Printer of command results, set with --output option
+var gOut = newPrinter(formatTable, os.Stdout)
+
+func newPrinter(format string, w io.Writer) *printer {
+	return &printer{format: format, w: w, csv: csv.NewWriter(w)}
+}
+
+// Return true if the format is known.
+func validFormat(format string) bool {
+	switch format {
+	case formatTable, formatJSON, formatCSV, formatYAML:
+		return true
+	}
+	return false
+}
+
+// Start list of rows printed with the table layout. In JSON format
+// the rows are printed as array by end.
+func (p *printer) begin(t *table) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.start(t)
+	p.listing = true
+	p.list = []interface{}{}
+	p.rows = 0
+}
+
+// Finish list started with begin.
+func (p *printer) end() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch {
+	case p.format == formatJSON && p.listing:
+		p.writeJSON(p.list, true)
+	case p.format == formatYAML && p.listing && p.rows == 0:
+		p.writeYAML([]interface{}{}, false)
+	}
+	p.listing = false
+	p.list = nil
+}
+
+// Start stream of rows printed with the table layout as they come,
+// e.g. events of long-running commands. In JSON format each row is
+// printed on its own line, in YAML as separate document.
+func (p *printer) stream(t *table) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.start(t)
+	p.listing = false
+}
+
+func (p *printer) start(t *table) {
+	p.table = t
+	switch {
+	case p.format == formatTable && t.head != "":
+		fmt.Fprintf(p.w, t.head, t.titles...)
+	case p.format == formatCSV && t.item != nil && p.columns == nil:
+		p.writeCSVHeader(reflect.TypeOf(t.item))
+	}
+}
+
+// Print row: v in structured formats, table cells with the current
+// table layout. Time cells are formatted with tts.
+func (p *printer) row(v interface{}, cells ...interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rows++
+	switch p.format {
+	case formatTable:
+		for i, c := range cells {
+			if t, ok := c.(time.Time); ok {
+				cells[i] = tts(t)
+			}
+		}
+		fmt.Fprintf(p.w, p.table.row, cells...)
+	case formatJSON:
+		if p.listing {
+			p.list = append(p.list, v)
+		} else {
+			p.writeJSON(v, false)
+		}
+	case formatYAML:
+		p.writeYAML(v, p.listing)
+	case formatCSV:
+		p.writeCSV(v)
+	}
+}
+
+// Print single value. Table format prints it with layout function
+// or, if nil, field by field.
+func (p *printer) value(v interface{}, layout func(w io.Writer)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch p.format {
+	case formatTable:
+		if layout != nil {
+			layout(p.w)
+		} else {
+			writeFields(p.w, v)
+		}
+	case formatJSON:
+		p.writeJSON(v, true)
+	case formatYAML:
+		p.writeYAML(v, false)
+	case formatCSV:
+		p.writeCSV(v)
+	}
+}
+
+// Print text, e.g. titles and totals, in table format only.
+func (p *printer) text(format string, args ...interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.format == formatTable {
+		fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+// Print notice. It goes to stderr in structured formats to keep the
+// output parsable.
+func (p *printer) note(format string, args ...interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.format == formatTable {
+		fmt.Fprintf(p.w, format, args...)
+	} else {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+func (p *printer) writeJSON(v interface{}, indent bool) {
+	var data []byte
+	var err error
+	if indent {
+		data, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		fatalf("encode JSON: %s", err)
+	}
+	p.w.Write(append(data, '\n'))
+}
+
+func (p *printer) writeYAML(v interface{}, item bool) {
+	tree := orderedJSON(v)
+	var b bytes.Buffer
+	// list items make one document
+	if !item || p.rows == 1 {
+		if 0 < p.docs {
+			b.WriteString("---\n")
+		}
+		p.docs++
+	}
+	if item {
+		yamlSequence(&b, []interface{}{tree}, "")
+	} else {
+		yamlDocument(&b, tree)
+	}
+	p.w.Write(b.Bytes())
+}
+
+func (p *printer) writeCSVHeader(t reflect.Type) {
+	p.columns = columns(t, "")
+	p.csv.Write(p.columns)
+	p.csv.Flush()
+}
+
+func (p *printer) writeCSV(v interface{}) {
+	if p.columns == nil {
+		p.writeCSVHeader(reflect.TypeOf(v))
+	}
+	tree := orderedJSON(v)
+	record := make([]string, len(p.columns))
+	for i, c := range p.columns {
+		record[i] = csvCell(lookup(tree, c))
+	}
+	p.csv.Write(record)
+	p.csv.Flush()
+}
+
+var (
+	jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Return CSV columns of the type: names of JSON fields of structs,
+// including embedded ones, with nested names joined by dots.
+// Values of other types, like times, lists and maps, take one
+// column.
+func columns(t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct ||
+		reflect.PtrTo(t).Implements(jsonMarshaler) ||
+		reflect.PtrTo(t).Implements(textMarshaler) {
+		return []string{prefix}
+	}
+	var res []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				res = append(res, columns(ft, prefix)...)
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		res = append(res, columns(f.Type, name)...)
+	}
+	return res
+}
+
+// Return value of JSON tree at the dot separated path, or nil.
+func lookup(tree interface{}, path string) interface{} {
+	if path == "" {
+		return tree
+	}
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := tree.(orderedObject)
+		if !ok {
+			return nil
+		}
+		tree = nil
+		for _, kv := range obj {
+			if kv.key == key {
+				tree = kv.value
+				break
+			}
+		}
+	}
+	return tree
+}
+
+// Print struct fields one per line: name and value.
+func writeFields(w io.Writer, v interface{}) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	rt := rv.Type()
+	width := 0
+	for i := 0; i < rt.NumField(); i++ {
+		if n := len(rt.Field(i).Name); width < n {
+			width = n
+		}
+	}
+	for i := 0; i < rt.NumField(); i++ {
+		f := rv.Field(i)
+		if !rt.Field(i).IsExported() ||
+			f.Kind() == reflect.Map && f.Len() == 0 {
+			continue
+		}
+		var s string
+		switch x := f.Interface().(type) {
+		case float64:
+			s = fmt.Sprintf("%16.8f", x)
+		case time.Time:
+			s = tts(x)
+		default:
+			s = fmt.Sprintf("%v", x)
+		}
+		fmt.Fprintf(w, "  %-*s: %s\n", width, rt.Field(i).Name, s)
+	}
+}
+
+// JSON object with keys in the original order
+type orderedObject []keyValue
+
+type keyValue struct {
+	key   string
+	value interface{}
+}
+
+// Convert value to JSON tree with ordered objects, json.Number
+// numbers, strings, bools and nils.
+func orderedJSON(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fatalf("encode JSON: %s", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	tree, err := readOrdered(decoder)
+	if err != nil {
+		fatalf("decode JSON: %s", err)
+	}
+	return tree
+}
+
+func readOrdered(decoder *json.Decoder) (interface{}, error) {
+	tok, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := orderedObject{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := readOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, keyValue{key.(string), v})
+		}
+		_, err = decoder.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for decoder.More() {
+			v, err := readOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err = decoder.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+// Encode JSON tree compactly.
+func encodeOrdered(b *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case orderedObject:
+		b.WriteByte('{')
+		for i, kv := range x {
+			if 0 < i {
+				b.WriteByte(',')
+			}
+			key, _ := json.Marshal(kv.key)
+			b.Write(key)
+			b.WriteByte(':')
+			encodeOrdered(b, kv.value)
+		}
+		b.WriteByte('}')
+	case []interface{}:
+		b.WriteByte('[')
+		for i, e := range x {
+			if 0 < i {
+				b.WriteByte(',')
+			}
+			encodeOrdered(b, e)
+		}
+		b.WriteByte(']')
+	default:
+		data, _ := json.Marshal(x)
+		b.Write(data)
+	}
+}
+
+func csvCell(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case json.Number:
+		return x.String()
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	var b bytes.Buffer
+	encodeOrdered(&b, v)
+	return b.String()
+}
+
+// Write YAML document for JSON tree.
+func yamlDocument(b *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case orderedObject:
+		if len(x) == 0 {
+			b.WriteString("{}\n")
+		} else {
+			yamlMapping(b, x, "", false)
+		}
+	case []interface{}:
+		if len(x) == 0 {
+			b.WriteString("[]\n")
+		} else {
+			yamlSequence(b, x, "")
+		}
+	default:
+		b.WriteString(yamlScalar(v) + "\n")
+	}
+}
+
+// Write value after mapping key or sequence dash.
+func yamlValue(b *bytes.Buffer, v interface{}, indent string) {
+	switch x := v.(type) {
+	case orderedObject:
+		if len(x) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+		b.WriteString("\n")
+		yamlMapping(b, x, indent, false)
+	case []interface{}:
+		if len(x) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+		b.WriteString("\n")
+		yamlSequence(b, x, indent)
+	default:
+		b.WriteString(" " + yamlScalar(v) + "\n")
+	}
+}
+
+// Write mapping entries. The first one is not indented if inline.
+func yamlMapping(b *bytes.Buffer, obj orderedObject, indent string, inline bool) {
+	for i, kv := range obj {
+		if 0 < i || !inline {
+			b.WriteString(indent)
+		}
+		b.WriteString(yamlScalar(kv.key) + ":")
+		yamlValue(b, kv.value, indent+"  ")
+	}
+}
+
+func yamlSequence(b *bytes.Buffer, list []interface{}, indent string) {
+	for _, e := range list {
+		if obj, ok := e.(orderedObject); ok && 0 < len(obj) {
+			b.WriteString(indent + "- ")
+			yamlMapping(b, obj, indent+"  ", true)
+			continue
+		}
+		b.WriteString(indent + "-")
+		yamlValue(b, e, indent+"  ")
+	}
+}
+
+// Format scalar, quoting strings which are not plain YAML strings.
+func yamlScalar(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(x)
+	case json.Number:
+		return x.String()
+	case string:
+		if yamlPlain(x) {
+			return x
+		}
+		data, _ := json.Marshal(x)
+		return string(data)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// Return true if the string needs no quotes in YAML.
+func yamlPlain(s string) bool {
+	if s == "" || strings.HasSuffix(s, " ") || strings.HasSuffix(s, ":") ||
+		strings.Contains(s, ": ") || strings.Contains(s, " #") {
+		return false
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "null", "yes", "no", "on", "off", "y", "n", "~":
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', c == '_':
+		case i == 0:
+			return false
+		case '0' <= c && c <= '9', strings.ContainsRune(" ./:@+-", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kunaio"
+)
+
+// Update with:
+//
+//	go test -run Output -update
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// Print sample results of several commands in the format with the
+// command printing functions. Output of each command starts with
+// "== NAME" line.
+func printSamples(format string) string {
+	var buf bytes.Buffer
+	old := gOut
+	defer func() { gOut = old }()
+	command := func(name string, f func()) {
+		buf.WriteString("== " + name + "\n")
+		gOut = newPrinter(format, &buf)
+		f()
+	}
+	created := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	command("book", func() {
+		printBookSide(&sellTable, kunaio.Orders{
+			{ID: 11, Side: "sell", OrdType: "limit", Price: 41000,
+				State: kunaio.OrderWait, Market: kunaio.BTCUAH,
+				CreatedAt: created, Volume: 0.5,
+				RemainingVolume: 0.5},
+			{ID: 12, Side: "sell", OrdType: "limit", Price: 41500,
+				State: kunaio.OrderWait, Market: kunaio.BTCUAH,
+				CreatedAt: created.Add(time.Minute), Volume: 1,
+				RemainingVolume: 0.25,
+				Extra: map[string]json.RawMessage{
+					"fee": []byte(`"0.1"`)}},
+		}, 0)
+		printBookSide(&buyTable, nil, 0)
+	})
+	command("creds", func() { printCredentials(nil) })
+	command("record", func() {
+		gOut.stream(&snapshotTable)
+		printSnapshot(kunaio.Snapshot{Time: created,
+			Market: kunaio.BTCUAH,
+			Stats:  kunaio.Stats{Time: created, Last: 41200},
+			Asks:   []kunaio.BookLevel{{Price: 41300, Volume: 0.5}},
+			Bids:   []kunaio.BookLevel{{Price: 41100, Volume: 1.5}}})
+		printSnapshot(kunaio.Snapshot{Time: created.Add(time.Minute),
+			Market: kunaio.BTCUAH})
+	})
+	command("delall", func() {
+		gOut.begin(&userOrdersTable)
+		printUserOrder(kunaio.Order{ID: 13, Side: "buy",
+			OrdType: "limit", Price: 40000, AvgPrice: 40000,
+			State: kunaio.OrderCancel, Market: kunaio.BTCUAH,
+			CreatedAt: created, Volume: 0.5, RemainingVolume: 0.2,
+			ExecutedVolume: 0.3, TradesCount: 1})
+		gOut.end()
+	})
+	command("userinfo", func() {
+		printUserInfo(&kunaio.UserInfo{Email: "user@example.com",
+			Activated: true, Accounts: []kunaio.Account{
+				{Currency: "uah", Balance: 1000.5, Locked: 200},
+				{Currency: "btc", Balance: 0.75}}})
+	})
+	return buf.String()
+}
+
+func TestOutputFormats(t *testing.T) {
+	for _, format := range []string{formatTable, formatJSON, formatCSV, formatYAML} {
+		t.Run(format, func(t *testing.T) {
+			got := printSamples(format)
+			path := filepath.Join("testdata", "output."+format)
+			if *update {
+				if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCSVHeader(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		t    *table
+		want string
+	}{
+		{"history", &historyTable,
+			"id,price,volume,funds,market,created_at,extra\n"},
+		{"credentials", &credTable, "name,access_key,added,rotated\n"},
+		{"order events", &orderEventTable, "type,order.id,order.side," +
+			"order.ord_type,order.price,order.avg_price,order.state," +
+			"order.market,order.created_at,order.volume," +
+			"order.remaining_volume,order.executed_volume," +
+			"order.trades_count,order.extra,fills,time,error\n"},
+		{"group events", &groupEventTable,
+			"group,time,leg,from,to,note\n"},
+	} {
+		var buf bytes.Buffer
+		p := newPrinter(formatCSV, &buf)
+		p.begin(c.t)
+		p.end()
+		if buf.String() != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, buf.String(), c.want)
+		}
+	}
+}
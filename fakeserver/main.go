@@ -0,0 +1,183 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Fake Kuna.io API server for integration testing.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"kunaio/fakeserver"
+)
+
+// Repeatable flag value.
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *list) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// Entry point.
+func main() {
+	var (
+		accounts list
+		orders   list
+		faults   fakeserver.Faults
+	)
+	listen := flag.String("listen", "127.0.0.1:8080", "listen address")
+	flag.Var(&accounts, "account",
+		"add account ACCESS_KEY:SECRET_KEY[:CURRENCY=AMOUNT,...] (repeatable)")
+	flag.Var(&orders, "order",
+		"seed order MARKET:SIDE:VOLUME:PRICE (repeatable)")
+	flag.DurationVar(&faults.Latency, "latency", 0, "response delay")
+	flag.DurationVar(&faults.Jitter, "jitter", 0, "random extra response delay")
+	flag.Float64Var(&faults.ErrorRate, "error-rate", 0,
+		"probability of 5xx response")
+	flag.Float64Var(&faults.MalformedRate, "malformed-rate", 0,
+		"probability of malformed JSON response")
+	flag.IntVar(&faults.RateLimit, "rate-limit", 0,
+		"max requests per second, 0 is unlimited")
+	seed := flag.Int64("seed", time.Now().UnixNano(),
+		"random seed for fault injection")
+	skew := flag.Duration("skew", 0, "server clock offset from local clock")
+	noTonce := flag.Bool("no-tonce-check", false,
+		"do not check tonce freshness and uniqueness")
+	flag.Parse()
+
+	s := fakeserver.New()
+	s.CheckTonce = !*noTonce
+	if *skew != 0 {
+		s.Now = func() time.Time { return time.Now().Add(*skew) }
+	}
+	s.Seed(*seed)
+	s.SetFaults(faults)
+	for _, a := range accounts {
+		if err := addAccount(s, a); err != nil {
+			log.Fatalf("account %#v: %s", a, err)
+		}
+	}
+	for _, o := range orders {
+		if err := seedOrder(s, o); err != nil {
+			log.Fatalf("order %#v: %s", o, err)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", s)
+	mux.HandleFunc("/v1/traces", collectTraces)
+	log.Printf("listening on %s", *listen)
+	if err := http.ListenAndServe(*listen, logRequests(mux)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Parse ACCESS_KEY:SECRET_KEY[:CURRENCY=AMOUNT,...] and add account.
+func addAccount(s *fakeserver.Server, spec string) error {
+	fields := strings.SplitN(spec, ":", 3)
+	if len(fields) < 2 {
+		return fmt.Errorf("expected ACCESS_KEY:SECRET_KEY")
+	}
+	balances := map[string]float64{}
+	if len(fields) == 3 && fields[2] != "" {
+		for _, b := range strings.Split(fields[2], ",") {
+			kv := strings.SplitN(b, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("bad balance %#v", b)
+			}
+			amount, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return fmt.Errorf("bad balance %#v: %s", b, err)
+			}
+			balances[kv[0]] = amount
+		}
+	}
+	s.AddAccount(fields[0], fields[1], fields[0]+"@fakeserver", balances)
+	return nil
+}
+
+// Parse MARKET:SIDE:VOLUME:PRICE and place maker order.
+func seedOrder(s *fakeserver.Server, spec string) error {
+	fields := strings.Split(spec, ":")
+	if len(fields) != 4 {
+		return fmt.Errorf("expected MARKET:SIDE:VOLUME:PRICE")
+	}
+	volume, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return err
+	}
+	price, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return err
+	}
+	_, err = s.SeedOrder(fields[0], fields[1], volume, price)
+	return err
+}
+
+// Log every request.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL.Path)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Stand-in for OpenTelemetry collector: log spans received with
+// OTLP/HTTP JSON protocol.
+func collectTraces(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID           string `json:"traceId"`
+					SpanID            string `json:"spanId"`
+					ParentSpanID      string `json:"parentSpanId"`
+					Name              string `json:"name"`
+					StartTimeUnixNano string `json:"startTimeUnixNano"`
+					EndTimeUnixNano   string `json:"endTimeUnixNano"`
+					Status            struct {
+						Message string `json:"message"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				start, _ := strconv.ParseInt(s.StartTimeUnixNano, 10, 64)
+				end, _ := strconv.ParseInt(s.EndTimeUnixNano, 10, 64)
+				log.Printf("span %s/%s parent=%s %s %s %s", s.TraceID,
+					s.SpanID, s.ParentSpanID, s.Name,
+					time.Duration(end-start), s.Status.Message)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
@@ -15,19 +15,26 @@
 package kunaio
 
 import (
-	"fmt"
+	"encoding/json"
+	"strings"
 	"time"
 )
 
 const (
 	// Kuna.io base URL
-	gBaseURL = "https://kuna.io"
+	DefaultBaseURL = "https://kuna.io"
 	// Supported market type names
 	BTCUAH = "btcuah"
 	ETHUAH = "ethuah"
+	// Order states
+	OrderWait   = "wait"
+	OrderDone   = "done"
+	OrderCancel = "cancel"
 )
 
 var (
+	// API base URL
+	gBaseURL = DefaultBaseURL
 	// List of supported market types
 	supportedMarkets = []string{
 		BTCUAH,
@@ -37,107 +44,135 @@ var (
 
 type Stats struct {
 	// Server time
-	Time time.Time
+	Time time.Time `json:"time"`
 	// Current ICO buy price
-	Buy float64
+	Buy float64 `json:"buy"`
 	// Current ICO sell price
-	Sell float64
+	Sell float64 `json:"sell"`
 	// Lowest deal price for last 24 hours
-	Low float64
+	Low float64 `json:"low"`
 	// Highest deal price for last 24 hours
-	High float64
+	High float64 `json:"high"`
 	// Last deal price
-	Last float64
+	Last float64 `json:"last"`
 	// Trade volume in base currency for last 24 hours
-	Vol float64
+	Vol float64 `json:"vol"`
 	// Total trade price for last 24 hours
-	Amount float64
+	Amount float64 `json:"amount"`
+	// Response fields not known to the library, undecoded
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
 }
 
 type OrderBook struct {
-	Asks Orders
-	Bids Orders
+	Asks Orders `json:"asks"`
+	Bids Orders `json:"bids"`
+	// Response fields not known to the library, undecoded
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
 }
 
 type Order struct {
 	// Order ID
-	ID int
+	ID int `json:"id"`
 	// For asks always "sell", for bids always "buy"
-	Side string
+	Side string `json:"side"`
 	// Order type: "limit" or "market"
-	OrdType string
+	OrdType string `json:"ord_type"`
 	// Price for one ICO
-	Price float64
+	Price float64 `json:"price"`
 	// Average order price
-	AvgPrice float64
-	// Order state: wait
-	State string
+	AvgPrice float64 `json:"avg_price"`
+	// Order state: wait, done or cancel
+	State string `json:"state"`
 	// Market identifier
-	Market string
+	Market string `json:"market"`
 	// Order creation time
-	CreatedAt time.Time
+	CreatedAt time.Time `json:"created_at"`
 	// Order volume, in ICO
-	Volume float64
+	Volume float64 `json:"volume"`
 	// ICO amount left
-	RemainingVolume float64
+	RemainingVolume float64 `json:"remaining_volume"`
 	// ICO amount sold (for asks) or bought (for bids)
-	ExecutedVolume float64
+	ExecutedVolume float64 `json:"executed_volume"`
 	// Deals count for this order
-	TradesCount int
+	TradesCount int `json:"trades_count"`
+	// Response fields not known to the library, undecoded
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
 }
 
 type Orders []Order
 
 type HistoryEntry struct {
 	// Order ID
-	ID int
+	ID int `json:"id"`
 	// Price for one ICO
-	Price float64
+	Price float64 `json:"price"`
 	// Volume of ICO
-	Volume float64
+	Volume float64 `json:"volume"`
 	// Volume of UAH
-	Funds float64
+	Funds float64 `json:"funds"`
 	// Market identifier
-	Market string
+	Market string `json:"market"`
 	// Deal time
-	CreatedAt time.Time
+	CreatedAt time.Time `json:"created_at"`
+	// Response fields not known to the library, undecoded
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
 }
 
 type History []HistoryEntry
 
 type UserInfo struct {
 	// Kuna.io user email
-	Email string
+	Email string `json:"email"`
 	// If user account activated or not
-	Activated bool
+	Activated bool `json:"activated"`
 	// List of user assets
-	Accounts []Account
+	Accounts []Account `json:"accounts"`
+	// Response fields not known to the library, undecoded
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
 }
 
 type Account struct {
 	// Currency type
-	Currency string
+	Currency string `json:"currency"`
 	// Asset balance
-	Balance float64
+	Balance float64 `json:"balance"`
 	// Locked funds
-	Locked float64
+	Locked float64 `json:"locked"`
+	// Response fields not known to the library, undecoded
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
 }
 
 type Trade struct {
 	// Order ID
-	ID int
+	ID int `json:"id"`
 	// Price per one ICO
-	Price float64
+	Price float64 `json:"price"`
 	// ICO amount
-	Volume float64
+	Volume float64 `json:"volume"`
 	// UAH amount
-	Funds float64
+	Funds float64 `json:"funds"`
 	// Market type
-	Market string
+	Market string `json:"market"`
 	// Deal date and time
-	CreatedAt time.Time
+	CreatedAt time.Time `json:"created_at"`
 	// "bid" or "ask"
-	Side string
+	Side string `json:"side"`
+	// ID of the user order the deal belongs to. Zero if not
+	// reported by the server.
+	OrderID int `json:"order_id"`
+	// Response fields not known to the library, undecoded
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
+}
+
+// Set API base URL, e.g. to use a test server instead of the real
+// exchange.
+func SetBaseURL(url string) {
+	gBaseURL = strings.TrimRight(url, "/")
+}
+
+// Return API base URL.
+func BaseURL() string {
+	return gBaseURL
 }
 
 // Return list of supported markets.
@@ -147,102 +182,60 @@ func SupportedMarkets() []string {
 
 // Return server time.
 func GetServerTime() (time.Time, error) {
-	j, err := doGet(fmt.Sprintf(
-		"%s/api/v2/timestamp", gBaseURL))
-	if err != nil {
-		return time.Time{}, err
-	}
-	return jsonGetTime(j)
+	return NewClient("", "").GetServerTime()
 }
 
 // Return latest market stats.
-func GetLatestStats(market string) (s Stats, err error) {
-	j, err := gClient.Get(fmt.Sprintf(
-		"%s/api/v2/tickers/%s", gBaseURL, market))
-	if err != nil {
-		return s, err
-	}
-	return decodeLatestStats(j)
+func GetLatestStats(market string) (Stats, error) {
+	return NewClient("", "").GetLatestStats(market)
 }
 
 // Return order book (lists of current asks and bids).
 func GetOrderBook(market string) (OrderBook, error) {
-	j, err := doGet(fmt.Sprintf("%s/api/v2/order_book?market=%s",
-		gBaseURL, market))
-	if err != nil {
-		return OrderBook{}, err
-	}
-	return decodeOrderBook(j)
+	return NewClient("", "").GetOrderBook(market)
 }
 
 // Return trade history.
 func GetTradeHistory(market string) (History, error) {
-	j, err := doGet(fmt.Sprintf("%s/api/v2/trades?market=%s",
-		gBaseURL, market))
-	if err != nil {
-		return nil, err
-	}
-	return decodeHistory(j)
+	return NewClient("", "").GetTradeHistory(market)
 }
 
 // Return user info and his assets.
 func GetUserInfo(access_key, secret_key string) (*UserInfo, error) {
-	url := privURL("GET", "/api/v2/members/me",
-		access_key, secret_key, nil)
-	j, err := doGet(url)
-	if err != nil {
-		return nil, err
-	}
-	return decodeUserInfo(j)
+	return NewClient(access_key, secret_key).GetUserInfo()
 }
 
 // Return list of active user orders.
 func GetUserOrders(access_key, secret_key, market string) ([]Order, error) {
-	url := privURL("GET", "/api/v2/orders",
-		access_key, secret_key, Args{{"market", market}})
-	j, err := doGet(url)
-	if err != nil {
-		return nil, err
-	}
-	return decodeOrders(j)
+	return NewClient(access_key, secret_key).GetUserOrders(market)
+}
+
+// Return user order, identified by order ID. Unlike GetUserOrders,
+// works for executed and cancelled orders too.
+func GetOrder(access_key, secret_key string, id int) (Order, error) {
+	return NewClient(access_key, secret_key).GetOrder(id)
 }
 
 // Return list of user deals.
 func GetUserTrades(access_key, secret_key, market string) (Trades, error) {
-	url := privURL("GET", "/api/v2/trades/my",
-		access_key, secret_key, Args{{"market", market}})
-	j, err := doGet(url)
-	if err != nil {
-		return nil, err
-	}
-	return decodeUserTrades(j)
+	return NewClient(access_key, secret_key).GetUserTrades(market)
 }
 
 // Create new order.
 func NewOrder(access_key, secret_key, market, side string, volume, price float64) (Order, error) {
-	url := privURL("POST", "/api/v2/orders",
-		access_key, secret_key,
-		Args{
-			{"market", market},
-			{"price", fmt.Sprintf("%f", price)},
-			{"side", side},
-			{"volume", fmt.Sprintf("%f", volume)},
-		})
-	j, err := doPost(url)
-	if err != nil {
-		return Order{}, err
-	}
-	return decodeOrder(j)
+	return NewClient(access_key, secret_key).NewOrder(
+		market, side, volume, price)
+}
+
+// Create new market order. Unlike limit orders created with NewOrder,
+// market order has no price and is executed immediately against
+// the order book.
+func NewMarketOrder(access_key, secret_key, market, side string, volume float64) (Order, error) {
+	return NewClient(access_key, secret_key).NewMarketOrder(
+		market, side, volume)
 }
 
 // Cancel user order, identified by order ID.
 func CancelOrder(access_key, secret_key string, id int) (Order, error) {
-	url := privURL("POST", "/api/v2/order/delete",
-		access_key, secret_key,
-		Args{{"id", fmt.Sprintf("%d", id)}})
-	j, err := doPost(url)
-	if err != nil {
-		return Order{}, err
-	}
-	return decodeOrder(j)
+	return NewClient(access_key, secret_key).CancelOrder(id)
 }
@@ -0,0 +1,565 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default segment size limit. When exceeded, new segment
+	// file is started.
+	DefaultSegmentSize = 4 << 20
+	// Default interval between trade history requests
+	DefaultCollectInterval = time.Minute
+	// Layout of the day partition directory names
+	archiveDayLayout = "2006-01-02"
+	// Segment file name suffix
+	segmentSuffix = ".seg"
+	// Number of day partitions with trade IDs kept in memory
+	archiveKnownPartitions = 8
+)
+
+// On-disk archive of public trades. Trades are stored in
+// append-only segment files partitioned by market and day (UTC):
+//
+//	DIR/MARKET/YYYY-MM-DD/NNNNNN.seg
+//
+// Every segment line is "CRC32 JSON", so a record torn by a crash
+// is detected and skipped on read.
+type Archive struct {
+	// Segment size limit. Zero means DefaultSegmentSize.
+	SegmentSize int64
+	dir         string
+	lock        sync.Mutex
+	// known trade IDs of the loaded day partitions
+	known map[string]map[int]bool
+	// loaded day partitions, least recently used first
+	recent []string
+}
+
+// Trade record as stored in segment files.
+type archiveRecord struct {
+	ID        int       `json:"id"`
+	Price     float64   `json:"price"`
+	Volume    float64   `json:"volume"`
+	Funds     float64   `json:"funds"`
+	Market    string    `json:"market"`
+	CreatedAt time.Time `json:"created_at"`
+	// Fields unknown to the library
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
+}
+
+// Open archive in the directory. The directory is created if not
+// exists.
+func OpenArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Archive{
+		dir:   dir,
+		known: map[string]map[int]bool{},
+	}, nil
+}
+
+func (a *Archive) dayDir(market string, day time.Time) string {
+	return filepath.Join(a.dir, market, day.UTC().Format(archiveDayLayout))
+}
+
+// Return sorted segment file names of the day partition.
+func segments(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), segmentSuffix) {
+			res = append(res, filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Append trades not stored yet. Returns number of new trades.
+func (a *Archive) Append(entries History) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// group entries by partition
+	parts := map[string]History{}
+	var keys []string
+	for _, e := range entries {
+		dir := a.dayDir(e.Market, e.CreatedAt)
+		if _, ok := parts[dir]; !ok {
+			keys = append(keys, dir)
+		}
+		parts[dir] = append(parts[dir], e)
+	}
+	count := 0
+	for _, dir := range keys {
+		known, err := a.loadKnown(dir)
+		if err != nil {
+			return count, err
+		}
+		var fresh History
+		for _, e := range parts[dir] {
+			if !known[e.ID] {
+				known[e.ID] = true
+				fresh = append(fresh, e)
+			}
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+		if err := a.appendPartition(dir, fresh); err != nil {
+			// forget the IDs, so the trades will be retried
+			for _, e := range fresh {
+				delete(known, e.ID)
+			}
+			return count, err
+		}
+		count += len(fresh)
+	}
+	return count, nil
+}
+
+// Return IDs of trades stored in the day partition.
+func (a *Archive) loadKnown(dir string) (map[int]bool, error) {
+	for i, d := range a.recent {
+		if d == dir {
+			copy(a.recent[i:], a.recent[i+1:])
+			a.recent[len(a.recent)-1] = dir
+			return a.known[dir], nil
+		}
+	}
+	known := map[int]bool{}
+	err := scanPartition(dir, func(r archiveRecord) error {
+		known[r.ID] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// keep only few recently used partitions in memory
+	if archiveKnownPartitions <= len(a.recent) {
+		delete(a.known, a.recent[0])
+		a.recent = a.recent[1:]
+	}
+	a.known[dir] = known
+	a.recent = append(a.recent, dir)
+	return known, nil
+}
+
+// Write trades to the last segment of the partition, starting
+// new segment if the last one is full. The partition is locked
+// against other processes compacting or appending to it.
+func (a *Archive) appendPartition(dir string, entries History) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(filepath.Join(dir, ".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	segs, err := segments(dir)
+	if err != nil {
+		return err
+	}
+	limit := a.SegmentSize
+	if limit <= 0 {
+		limit = DefaultSegmentSize
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%06d%s", 1, segmentSuffix))
+	if 0 < len(segs) {
+		path = segs[len(segs)-1]
+		if fi, err := os.Stat(path); err == nil && limit <= fi.Size() {
+			path = nextSegment(path)
+		}
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := encodeRecord(archiveRecord(e))
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := repairTail(f); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Cut off torn record left by a crash at the end of the segment
+// and seek to the end, so new records are not glued to it.
+func repairTail(f *os.File) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil || size == 0 {
+		return err
+	}
+	// find the last newline
+	buf := make([]byte, 4096)
+	end := size
+	for 0 < end {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == size {
+		return nil
+	}
+	debugLog("archive: %s: torn record removed", f.Name())
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+	_, err = f.Seek(end, io.SeekStart)
+	return err
+}
+
+// Return name of the segment following the given one.
+func nextSegment(path string) string {
+	var n int
+	fmt.Sscanf(strings.TrimSuffix(filepath.Base(path), segmentSuffix), "%d", &n)
+	return filepath.Join(filepath.Dir(path),
+		fmt.Sprintf("%06d%s", n+1, segmentSuffix))
+}
+
+func encodeRecord(r archiveRecord) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+// Decode segment line. Returns false for corrupted lines.
+func decodeRecord(line []byte) (archiveRecord, bool) {
+	var r archiveRecord
+	line = bytes.TrimRight(line, "\n")
+	if len(line) < 10 || line[8] != ' ' {
+		return r, false
+	}
+	var sum uint32
+	if _, err := fmt.Sscanf(string(line[:8]), "%08x", &sum); err != nil {
+		return r, false
+	}
+	data := line[9:]
+	if crc32.ChecksumIEEE(data) != sum {
+		return r, false
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, false
+	}
+	return r, true
+}
+
+// Call the function for every valid record of the partition.
+// Records may be duplicated and unordered.
+func scanPartition(dir string, f func(archiveRecord) error) error {
+	segs, err := segments(dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range segs {
+		if err := scanSegment(path, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanSegment(path string, f func(archiveRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// incomplete last line is a torn write
+			return nil
+		} else if err != nil {
+			return err
+		}
+		r, ok := decodeRecord(line)
+		if !ok {
+			debugLog("archive: %s: corrupted record skipped", path)
+			continue
+		}
+		if err := f(r); err != nil {
+			return err
+		}
+	}
+}
+
+// Read one day partition: deduplicated trades sorted by time.
+func readPartition(dir string) (History, error) {
+	seen := map[int]bool{}
+	var res History
+	err := scanPartition(dir, func(r archiveRecord) error {
+		if !seen[r.ID] {
+			seen[r.ID] = true
+			res = append(res, HistoryEntry(r))
+		}
+		return nil
+	})
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].CreatedAt.Equal(res[j].CreatedAt) {
+			return res[i].ID < res[j].ID
+		}
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	return res, err
+}
+
+// Call the function for every trade of the market made in the
+// [from, to) time range, in time order. Days are read one by one,
+// so the whole range is never loaded in memory.
+func (a *Archive) Scan(market string, from, to time.Time, f func(HistoryEntry) error) error {
+	y, m, d := from.UTC().Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC); day.Before(to); day = day.AddDate(0, 0, 1) {
+		entries, err := readPartition(a.dayDir(market, day))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.CreatedAt.Before(from) || !e.CreatedAt.Before(to) {
+				continue
+			}
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return trades of the market made in the [from, to) time range.
+func (a *Archive) Query(market string, from, to time.Time) (History, error) {
+	res := History{}
+	err := a.Scan(market, from, to, func(e HistoryEntry) error {
+		res = append(res, e)
+		return nil
+	})
+	return res, err
+}
+
+// Return list of archived markets.
+func (a *Archive) Markets() ([]string, error) {
+	files, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, f := range files {
+		if f.IsDir() {
+			res = append(res, f.Name())
+		}
+	}
+	return res, nil
+}
+
+// Return days archived for the market, in ascending order.
+func (a *Archive) Days(market string) ([]time.Time, error) {
+	files, err := ioutil.ReadDir(filepath.Join(a.dir, market))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var res []time.Time
+	for _, f := range files {
+		day, err := time.Parse(archiveDayLayout, f.Name())
+		if err == nil && f.IsDir() {
+			res = append(res, day)
+		}
+	}
+	return res, nil
+}
+
+// Merge all segments of the day partition into one segment with
+// sorted and deduplicated trades. The new segment is written
+// completely before the old ones are removed, so the data is not
+// lost if the process is interrupted.
+func (a *Archive) Compact(market string, day time.Time) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	dir := a.dayDir(market, day)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	unlock, err := lockFile(filepath.Join(dir, ".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	segs, err := segments(dir)
+	if err != nil || len(segs) == 0 {
+		return err
+	}
+	entries, err := readPartition(dir)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := encodeRecord(archiveRecord(e))
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+	path := nextSegment(segs[len(segs)-1])
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return err
+	}
+	for _, seg := range segs {
+		if err := os.Remove(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact all partitions of all markets for days before the given
+// time. The current day partition is normally left alone since
+// it is still being written.
+func (a *Archive) CompactBefore(before time.Time) error {
+	markets, err := a.Markets()
+	if err != nil {
+		return err
+	}
+	for _, market := range markets {
+		days, err := a.Days(market)
+		if err != nil {
+			return err
+		}
+		for _, day := range days {
+			if !day.AddDate(0, 0, 1).After(before) {
+				if err := a.Compact(market, day); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Polls public trades of the markets and stores new ones in the
+// archive.
+type Collector struct {
+	// API client
+	Client *Client
+	// Target archive
+	Archive *Archive
+	// Markets to collect. Default is all supported markets.
+	Markets []string
+	// Interval between requests. Zero means DefaultCollectInterval.
+	Interval time.Duration
+	// Optional hook called after new trades are stored
+	OnAppend func(market string, count int)
+}
+
+// Collect trades until the context is cancelled.
+func (c *Collector) Run(ctx context.Context) error {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultCollectInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Collect(); err != nil {
+			debugLog("collector: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Request trade history of every market once and store new trades.
+func (c *Collector) Collect() error {
+	markets := c.Markets
+	if len(markets) == 0 {
+		markets = SupportedMarkets()
+	}
+	var lastErr error
+	for _, market := range markets {
+		history, err := c.Client.GetTradeHistory(market)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: get trade history: %s", market, err)
+			debugLog("collector: %s", lastErr)
+			continue
+		}
+		for i := range history {
+			if history[i].Market == "" {
+				history[i].Market = market
+			}
+		}
+		n, err := c.Archive.Append(history)
+		if err != nil {
+			return fmt.Errorf("%s: %s", market, err)
+		}
+		if 0 < n && c.OnAppend != nil {
+			c.OnAppend(market, n)
+		}
+	}
+	return lastErr
+}
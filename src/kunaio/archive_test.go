@@ -0,0 +1,238 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var archiveDay = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// Return n trades made at the day starting with ID first.
+func archiveTrades(day time.Time, first, n int) History {
+	var res History
+	for i := 0; i < n; i++ {
+		res = append(res, HistoryEntry{ID: first + i, Price: 40,
+			Volume: 0.5, Funds: 20, Market: BTCUAH,
+			CreatedAt: day.Add(time.Duration(first+i) * time.Minute)})
+	}
+	return res
+}
+
+func openTestArchive(t *testing.T) (*Archive, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := OpenArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, dir
+}
+
+func appendTrades(t *testing.T, a *Archive, entries History, want int) {
+	t.Helper()
+	n, err := a.Append(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != want {
+		t.Fatalf("%d trades appended, want %d", n, want)
+	}
+}
+
+// Check the archived trades of the day and return their IDs.
+func archivedIDs(t *testing.T, a *Archive, day time.Time) []int {
+	t.Helper()
+	history, err := a.Query(BTCUAH, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, e := range history {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func seq(first, n int) []int {
+	res := []int{}
+	for i := 0; i < n; i++ {
+		res = append(res, first+i)
+	}
+	return res
+}
+
+func TestArchiveTornRecord(t *testing.T) {
+	a, dir := openTestArchive(t)
+	defer os.RemoveAll(dir)
+	appendTrades(t, a, archiveTrades(archiveDay, 1, 3), 3)
+	seg := filepath.Join(a.dayDir(BTCUAH, archiveDay), "000001.seg")
+	data, err := ioutil.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// crash in the middle of the last record
+	last := bytes.LastIndexByte(data[:len(data)-1], '\n') + 1
+	torn := last + (len(data)-last)/2
+	if err := os.Truncate(seg, int64(torn)); err != nil {
+		t.Fatal(err)
+	}
+	// the archive is opened again after the crash
+	if a, err = OpenArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := archivedIDs(t, a, archiveDay); !reflect.DeepEqual(got, seq(1, 2)) {
+		t.Fatalf("after crash: %v", got)
+	}
+	// the lost trade is appended again with the new ones
+	appendTrades(t, a, archiveTrades(archiveDay, 1, 5), 3)
+	if got := archivedIDs(t, a, archiveDay); !reflect.DeepEqual(got, seq(1, 5)) {
+		t.Errorf("after append: %v", got)
+	}
+	data, err = ioutil.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) != 6 || len(lines[5]) != 0 {
+		t.Fatalf("segment:\n%s", data)
+	}
+	for _, line := range lines[:5] {
+		if _, ok := decodeRecord(line); !ok {
+			t.Errorf("corrupted record: %q", line)
+		}
+	}
+}
+
+func TestArchiveCompact(t *testing.T) {
+	a, dir := openTestArchive(t)
+	defer os.RemoveAll(dir)
+	a.SegmentSize = 300
+	for i := 0; i < 4; i++ {
+		appendTrades(t, a, archiveTrades(archiveDay, 1+i*3, 3), 3)
+	}
+	part := a.dayDir(BTCUAH, archiveDay)
+	segs, err := segments(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) < 2 {
+		t.Fatalf("segments: %v", segs)
+	}
+	old := map[string][]byte{}
+	for _, seg := range segs {
+		if old[seg], err = ioutil.ReadFile(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Compact(BTCUAH, archiveDay); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := segments(part); len(got) != 1 {
+		t.Fatalf("after compaction: %v", got)
+	}
+	if got := archivedIDs(t, a, archiveDay); !reflect.DeepEqual(got, seq(1, 12)) {
+		t.Fatalf("after compaction: %v", got)
+	}
+	// compaction interrupted before the old segments are removed
+	for seg, data := range old {
+		if err := ioutil.WriteFile(seg, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := archivedIDs(t, a, archiveDay); !reflect.DeepEqual(got, seq(1, 12)) {
+		t.Errorf("after interrupted compaction: %v", got)
+	}
+	if a, err = OpenArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	appendTrades(t, a, archiveTrades(archiveDay, 10, 5), 2)
+	if err := a.CompactBefore(archiveDay.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := segments(part); len(got) != 1 {
+		t.Errorf("after second compaction: %v", got)
+	}
+	if got := archivedIDs(t, a, archiveDay); !reflect.DeepEqual(got, seq(1, 14)) {
+		t.Errorf("after second compaction: %v", got)
+	}
+}
+
+// Compaction waits for other processes appending to the partition.
+func TestArchiveCompactLocked(t *testing.T) {
+	a, dir := openTestArchive(t)
+	defer os.RemoveAll(dir)
+	appendTrades(t, a, archiveTrades(archiveDay, 1, 3), 3)
+	lock := filepath.Join(a.dayDir(BTCUAH, archiveDay), ".lock")
+	if err := ioutil.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- a.Compact(BTCUAH, archiveDay) }()
+	select {
+	case err := <-done:
+		t.Fatalf("compacted locked partition: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	os.Remove(lock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := archivedIDs(t, a, archiveDay); !reflect.DeepEqual(got, seq(1, 3)) {
+		t.Errorf("after compaction: %v", got)
+	}
+}
+
+func TestArchiveManyPartitions(t *testing.T) {
+	a, dir := openTestArchive(t)
+	defer os.RemoveAll(dir)
+	// more partitions than trade ID sets kept in memory
+	days := archiveKnownPartitions + 3
+	var batch History
+	for i := 0; i < days; i++ {
+		batch = append(batch, archiveTrades(archiveDay.AddDate(0, 0, i), 1, 2)...)
+	}
+	// trades of the first day repeated at the end of the batch
+	batch = append(batch, archiveTrades(archiveDay, 1, 3)...)
+	appendTrades(t, a, batch, days*2+1)
+	appendTrades(t, a, batch, 0)
+	for i := 0; i < days; i++ {
+		part := a.dayDir(BTCUAH, archiveDay.AddDate(0, 0, i))
+		var n int
+		scanPartition(part, func(archiveRecord) error {
+			n++
+			return nil
+		})
+		want := 2
+		if i == 0 {
+			want = 3
+		}
+		if n != want {
+			t.Errorf("day %d: %d records, want %d", i, n, want)
+		}
+	}
+	if len(a.known) != archiveKnownPartitions {
+		t.Errorf("%d partitions in memory", len(a.known))
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults of CircuitBreaker
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// States of circuit
+type CircuitState int
+
+const (
+	// Calls pass through
+	CircuitClosed CircuitState = iota
+	// Calls fail immediately with CircuitOpenError
+	CircuitOpen
+	// One probe call passes through, others fail
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// Error matched by errors.Is for calls rejected by open circuit.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// Error returned for calls rejected by open circuit.
+type CircuitOpenError struct {
+	// Endpoint group
+	Group string
+	// Time of the next probe call
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit %q open until %s", e.Group,
+		e.Until.Format(time.RFC3339))
+}
+
+// Report whether target is ErrCircuitOpen.
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// CircuitBreaker stops calls to endpoint group after Threshold
+// consecutive failures. After Cooldown one probe call is let
+// through: the circuit closes when it succeeds and opens again when
+// it fails. Transport errors and 5xx responses are failures, other
+// responses are successes. Calls cancelled by the caller and clock
+// skew errors are neither. Usage:
+//
+//	breaker := NewCircuitBreaker()
+//	client.Use(breaker.Middleware())
+type CircuitBreaker struct {
+	// Consecutive failures opening the circuit. Default is
+	// DefaultBreakerThreshold.
+	Threshold int
+	// Time the circuit stays open before probe call. Default is
+	// DefaultBreakerCooldown.
+	Cooldown time.Duration
+	// Return endpoint group of call. Default is CallGroup.
+	Group func(*Call) string
+	// Called when circuit of group changes its state.
+	OnStateChange func(group string, from, to CircuitState)
+	lock          sync.Mutex
+	circuits      map[string]*circuit
+	// last generation given to a circuit
+	generation uint64
+}
+
+type circuit struct {
+	state    CircuitState
+	failures int
+	until    time.Time
+	probing  bool
+	// changed on every state change; results of calls allowed
+	// in another generation are ignored
+	generation uint64
+}
+
+// Return endpoint group of call: "public", "account" for private
+// GET calls or "trading" for other private calls.
+func CallGroup(call *Call) string {
+	switch {
+	case !call.Private:
+		return "public"
+	case call.Request.Method == "GET":
+		return "account"
+	}
+	return "trading"
+}
+
+// Create new circuit breaker with default settings.
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: DefaultBreakerThreshold,
+		Cooldown:  DefaultBreakerCooldown,
+		Group:     CallGroup,
+	}
+}
+
+// Return state of circuit of group.
+func (b *CircuitBreaker) State(group string) CircuitState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.circuits[group]
+	if c == nil {
+		return CircuitClosed
+	}
+	if c.state == CircuitOpen && !time.Now().Before(c.until) {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// Close circuit of group.
+func (b *CircuitBreaker) Reset(group string) {
+	b.lock.Lock()
+	c := b.circuits[group]
+	if c == nil {
+		b.lock.Unlock()
+		return
+	}
+	from := c.state
+	delete(b.circuits, group)
+	b.lock.Unlock()
+	if from != CircuitClosed {
+		b.changed(group, from, CircuitClosed)
+	}
+}
+
+// Return middleware applying circuit breaker to calls.
+func (b *CircuitBreaker) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			var group string
+			if b.Group != nil {
+				group = b.Group(call)
+			} else {
+				group = CallGroup(call)
+			}
+			generation, err := b.allow(group)
+			if err != nil {
+				debugLog("%s: %s", call.Operation, err)
+				return nil, err
+			}
+			resp, err := next(call)
+			if err != nil && !countFailure(call, err) {
+				b.release(group, generation)
+				return resp, err
+			}
+			b.done(group, generation,
+				err != nil || resp.StatusCode/100 == 5)
+			return resp, err
+		}
+	}
+}
+
+// Check whether call to group may be made. Return generation of
+// the circuit to be passed to done.
+func (b *CircuitBreaker) allow(group string) (uint64, error) {
+	b.lock.Lock()
+	if b.circuits == nil {
+		b.circuits = map[string]*circuit{}
+	}
+	c := b.circuits[group]
+	if c == nil {
+		c = &circuit{}
+		b.circuits[group] = c
+		b.advance(c)
+	}
+	generation := c.generation
+	switch c.state {
+	case CircuitClosed:
+		b.lock.Unlock()
+		return generation, nil
+	case CircuitOpen:
+		if time.Now().Before(c.until) {
+			until := c.until
+			b.lock.Unlock()
+			return 0, &CircuitOpenError{Group: group, Until: until}
+		}
+		c.state = CircuitHalfOpen
+		c.probing = true
+		b.advance(c)
+		generation = c.generation
+		b.lock.Unlock()
+		b.changed(group, CircuitOpen, CircuitHalfOpen)
+		return generation, nil
+	}
+	if c.probing {
+		b.lock.Unlock()
+		return 0, &CircuitOpenError{Group: group, Until: time.Now()}
+	}
+	c.probing = true
+	b.lock.Unlock()
+	return generation, nil
+}
+
+// Give new generation to circuit. Must be called with the lock held.
+func (b *CircuitBreaker) advance(c *circuit) {
+	b.generation++
+	c.generation = b.generation
+}
+
+// Record result of call to group allowed in generation.
+func (b *CircuitBreaker) done(group string, generation uint64, failed bool) {
+	b.lock.Lock()
+	c := b.circuits[group]
+	if c == nil || c.generation != generation {
+		// The call was made before reset or state change
+		b.lock.Unlock()
+		return
+	}
+	from := c.state
+	if !failed {
+		c.failures = 0
+		c.state = CircuitClosed
+		c.probing = false
+	} else {
+		c.failures++
+		threshold := b.Threshold
+		if threshold <= 0 {
+			threshold = DefaultBreakerThreshold
+		}
+		if from == CircuitHalfOpen || threshold <= c.failures {
+			cooldown := b.Cooldown
+			if cooldown <= 0 {
+				cooldown = DefaultBreakerCooldown
+			}
+			c.state = CircuitOpen
+			c.until = time.Now().Add(cooldown)
+			c.probing = false
+		}
+	}
+	to := c.state
+	if from != to {
+		b.advance(c)
+	}
+	b.lock.Unlock()
+	if from != to {
+		b.changed(group, from, to)
+	}
+}
+
+// Report whether error of call says anything about the endpoint.
+// Calls cancelled or timed out by the caller and calls rejected
+// locally because of clock skew are not counted.
+func countFailure(call *Call, err error) bool {
+	if _, ok := err.(*ClockSkewError); ok {
+		return false
+	}
+	if call.Request.Context().Err() != nil &&
+		(errors.Is(err, context.Canceled) ||
+			errors.Is(err, context.DeadlineExceeded)) {
+		return false
+	}
+	return true
+}
+
+// Forget call to group allowed in generation without recording
+// its result. A probe call can be made again.
+func (b *CircuitBreaker) release(group string, generation uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.circuits[group]
+	if c != nil && c.generation == generation {
+		c.probing = false
+	}
+}
+
+func (b *CircuitBreaker) changed(group string, from, to CircuitState) {
+	debugLog("circuit %q: %s -> %s", group, from, to)
+	if b.OnStateChange != nil {
+		b.OnStateChange(group, from, to)
+	}
+}
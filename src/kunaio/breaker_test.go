@@ -0,0 +1,264 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Handler returning response with status code read from channel.
+func statusHandler(codes <-chan int) Handler {
+	return func(call *Call) (*http.Response, error) {
+		return &http.Response{StatusCode: <-codes,
+			Body: http.NoBody}, nil
+	}
+}
+
+// Handler signalling on started before reading status code.
+func blockingHandler(started chan<- struct{}, codes <-chan int) Handler {
+	return func(call *Call) (*http.Response, error) {
+		started <- struct{}{}
+		return statusHandler(codes)(call)
+	}
+}
+
+func breakerCall() *Call {
+	return &Call{Operation: "GetOrderBook",
+		Request: httptest.NewRequest("GET", "/api/v2/order_book", nil)}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var lock sync.Mutex
+	var changes []string
+	b := NewCircuitBreaker()
+	b.Threshold = 2
+	b.Cooldown = 50 * time.Millisecond
+	b.OnStateChange = func(group string, from, to CircuitState) {
+		lock.Lock()
+		changes = append(changes, group+": "+from.String()+
+			" -> "+to.String())
+		lock.Unlock()
+	}
+	codes := make(chan int, 1)
+	h := b.Middleware()(statusHandler(codes))
+	call := func(code int) error {
+		codes <- code
+		_, err := h(breakerCall())
+		if err != nil {
+			// the handler was not called
+			<-codes
+		}
+		return err
+	}
+	state := func(want CircuitState) {
+		t.Helper()
+		if got := b.State("public"); got != want {
+			t.Fatalf("state %s, want %s", got, want)
+		}
+	}
+	for _, code := range []int{500, 200, 500} {
+		if err := call(code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state(CircuitClosed)
+	if err := call(502); err != nil {
+		t.Fatal(err)
+	}
+	state(CircuitOpen)
+	err := call(200)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.Group != "public" {
+		t.Fatalf("got %#v", err)
+	}
+	time.Sleep(b.Cooldown)
+	state(CircuitHalfOpen)
+	// failed probe opens the circuit again
+	if err := call(503); err != nil {
+		t.Fatal(err)
+	}
+	state(CircuitOpen)
+	time.Sleep(b.Cooldown)
+	if err := call(200); err != nil {
+		t.Fatal(err)
+	}
+	state(CircuitClosed)
+	want := []string{
+		"public: closed -> open",
+		"public: open -> half-open",
+		"public: half-open -> open",
+		"public: open -> half-open",
+		"public: half-open -> closed",
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes:\n%q\nwant:\n%q", changes, want)
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	b := NewCircuitBreaker()
+	b.Threshold = 1
+	b.Cooldown = time.Millisecond
+	codes := make(chan int, 1)
+	started := make(chan struct{}, 1)
+	h := b.Middleware()(blockingHandler(started, codes))
+	codes <- 500
+	h(breakerCall())
+	<-started
+	time.Sleep(2 * b.Cooldown)
+	done := make(chan struct{})
+	go func() {
+		h(breakerCall())
+		close(done)
+	}()
+	<-started
+	if _, err := h(breakerCall()); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("call during probe: got %v, want ErrCircuitOpen", err)
+	}
+	codes <- 200
+	<-done
+	if got := b.State("public"); got != CircuitClosed {
+		t.Fatalf("state %s, want closed", got)
+	}
+}
+
+func TestCircuitBreakerStaleResult(t *testing.T) {
+	b := NewCircuitBreaker()
+	b.Threshold = 1
+	b.Cooldown = time.Millisecond
+	slow := make(chan int)
+	started := make(chan struct{})
+	codes := make(chan int, 1)
+	mw := b.Middleware()
+	hSlow := mw(blockingHandler(started, slow))
+	h := mw(statusHandler(codes))
+	// slow call started while the circuit is closed
+	done := make(chan struct{})
+	go func() {
+		hSlow(breakerCall())
+		done <- struct{}{}
+	}()
+	<-started
+	codes <- 500
+	h(breakerCall())
+	time.Sleep(2 * b.Cooldown)
+	codes <- 200
+	if _, err := h(breakerCall()); err != nil {
+		t.Fatal(err)
+	}
+	// failure of the slow call must not open the closed circuit
+	slow <- 500
+	<-done
+	if got := b.State("public"); got != CircuitClosed {
+		t.Fatalf("state %s, want closed", got)
+	}
+	// nor should it count after reset
+	go func() {
+		hSlow(breakerCall())
+		done <- struct{}{}
+	}()
+	<-started
+	b.Reset("public")
+	slow <- 500
+	<-done
+	if got := b.State("public"); got != CircuitClosed {
+		t.Errorf("after reset: state %s, want closed", got)
+	}
+}
+
+func TestCircuitBreakerGroup(t *testing.T) {
+	b := NewCircuitBreaker()
+	b.Group = func(call *Call) string { return call.Operation }
+	codes := make(chan int, 1)
+	h := b.Middleware()(statusHandler(codes))
+	codes <- 200
+	// CallGroup would fail on call without request
+	if _, err := h(&Call{Operation: "X", Private: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.circuits["X"]; !ok {
+		t.Errorf("circuits: %v", b.circuits)
+	}
+}
+
+func TestCircuitBreakerIgnored(t *testing.T) {
+	var changes int
+	b := NewCircuitBreaker()
+	b.Threshold = 1
+	b.Cooldown = time.Millisecond
+	b.OnStateChange = func(group string, from, to CircuitState) {
+		changes++
+	}
+	var fail error
+	h := b.Middleware()(func(call *Call) (*http.Response, error) {
+		if fail != nil {
+			return nil, fail
+		}
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	canceled := func() *Call {
+		call := breakerCall()
+		call.Request = call.Request.WithContext(ctx)
+		return call
+	}
+	for _, test := range []struct {
+		call *Call
+		err  error
+	}{
+		{canceled(), context.Canceled},
+		{canceled(), &url.Error{Op: "Get", Err: context.DeadlineExceeded}},
+		{breakerCall(), &ClockSkewError{Skew: time.Minute}},
+	} {
+		fail = test.err
+		if _, err := h(test.call); err != fail {
+			t.Fatalf("got %v, want %v", err, fail)
+		}
+		if got := b.State("public"); got != CircuitClosed {
+			t.Fatalf("%v: state %s, want closed", fail, got)
+		}
+	}
+	// timeout not caused by the caller is a failure
+	fail = &url.Error{Op: "Get", Err: context.DeadlineExceeded}
+	h(breakerCall())
+	if got := b.State("public"); got != CircuitOpen {
+		t.Fatalf("state %s, want open", got)
+	}
+	// cancelled probe lets another probe through
+	time.Sleep(2 * b.Cooldown)
+	fail = context.Canceled
+	h(canceled())
+	fail = nil
+	if _, err := h(breakerCall()); errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("probe after cancelled probe: %v", err)
+	}
+	b.Reset("public")
+	b.Reset("public")
+	if changes != 3 {
+		t.Errorf("%d state changes, want 3", changes)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default TTLs of cached public calls. Other operations are not
+// cached.
+var DefaultCacheTTL = map[string]time.Duration{
+	"GetLatestStats":  time.Second,
+	"GetOrderBook":    500 * time.Millisecond,
+	"GetTradeHistory": 2 * time.Second,
+}
+
+// Cache statistics.
+type CacheStats struct {
+	// Calls served from the cache
+	Hits uint64
+	// Calls sent to the server
+	Misses uint64
+	// Calls which waited for identical call in progress and shared
+	// its response instead of sending own request
+	Coalesced uint64
+}
+
+// Cache keeps responses of public GET calls for a short time and
+// coalesces concurrent identical calls into one request. Private
+// and POST calls are never cached. Only responses decoded without
+// errors are cached. Usage:
+//
+//	cache := NewCache()
+//	client.Use(cache.Middleware())
+type Cache struct {
+	// TTL by operation name. Operations not listed are not cached,
+	// but still coalesced.
+	TTL      map[string]time.Duration
+	lock     sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*flight
+	stats    CacheStats
+}
+
+type cacheEntry struct {
+	resp    *cachedResponse
+	expires time.Time
+}
+
+type cachedResponse struct {
+	status     string
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// Call in progress.
+type flight struct {
+	done chan struct{}
+	resp *cachedResponse
+	err  error
+	// the call failed because its context was done
+	cancelled bool
+}
+
+// Create new cache with default TTLs.
+func NewCache() *Cache {
+	ttl := map[string]time.Duration{}
+	for k, v := range DefaultCacheTTL {
+		ttl[k] = v
+	}
+	return &Cache{
+		TTL:      ttl,
+		entries:  map[string]*cacheEntry{},
+		inflight: map[string]*flight{},
+	}
+}
+
+// Return cache statistics.
+func (c *Cache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Remove all cached responses.
+func (c *Cache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = map[string]*cacheEntry{}
+}
+
+// Return middleware serving public GET calls from the cache.
+func (c *Cache) Middleware() Middleware {
+	return func(next Handler) Handler {
+		var handle Handler
+		handle = func(call *Call) (*http.Response, error) {
+			if call.Private || call.Request.Method != "GET" {
+				return next(call)
+			}
+			key := call.Request.URL.String()
+			ttl := c.TTL[call.Operation]
+			c.lock.Lock()
+			if e, ok := c.entries[key]; ok {
+				if time.Now().Before(e.expires) {
+					c.stats.Hits++
+					c.lock.Unlock()
+					return e.resp.response(call.Request), nil
+				}
+				delete(c.entries, key)
+			}
+			if f, ok := c.inflight[key]; ok {
+				c.stats.Coalesced++
+				c.lock.Unlock()
+				resp, err := f.wait(call.Request)
+				if err != nil && f.cancelled &&
+					call.Request.Context().Err() == nil {
+					// the call was cancelled by its caller, not
+					// by this one: try again
+					return handle(call)
+				}
+				return resp, err
+			}
+			f := &flight{done: make(chan struct{})}
+			c.inflight[key] = f
+			c.stats.Misses++
+			c.lock.Unlock()
+
+			resp, err := next(call)
+			if err == nil {
+				f.resp, err = readCachedResponse(resp)
+			}
+			f.err = err
+			f.cancelled = err != nil && call.Request.Context().Err() != nil
+			c.lock.Lock()
+			delete(c.inflight, key)
+			c.lock.Unlock()
+			close(f.done)
+			if err != nil {
+				return nil, err
+			}
+			if 0 < ttl && f.resp.statusCode/100 == 2 {
+				call.OnDecoded(func(err error) {
+					if err != nil {
+						return
+					}
+					c.lock.Lock()
+					c.entries[key] = &cacheEntry{
+						resp:    f.resp,
+						expires: time.Now().Add(ttl),
+					}
+					c.lock.Unlock()
+				})
+			}
+			return f.resp.response(call.Request), nil
+		}
+		return handle
+	}
+}
+
+// Wait for the call in progress and return copy of its response.
+func (f *flight) wait(r *http.Request) (*http.Response, error) {
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.resp.response(r), nil
+}
+
+func readCachedResponse(resp *http.Response) (*cachedResponse, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedResponse{
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		header:     resp.Header,
+		body:       body,
+	}, nil
+}
+
+// Make new response with the cached data.
+func (c *cachedResponse) response(r *http.Request) *http.Response {
+	return &http.Response{
+		Status:        c.status,
+		StatusCode:    c.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+		Request:       r,
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Fake server with an account counting requests by path. Requests
+// block while the gate is closed.
+type countingServer struct {
+	*fakeserver.Server
+	gate    chan struct{}
+	arrived chan struct{}
+	lock    sync.Mutex
+	counts  map[string]int
+}
+
+// Start counting server and point the package at it.
+func startCounting(t *testing.T) (*countingServer, func()) {
+	t.Helper()
+	s := &countingServer{
+		Server:  fakeserver.New(),
+		arrived: make(chan struct{}, 100),
+		counts:  map[string]int{},
+	}
+	s.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"uah": 1000})
+	ts := httptest.NewServer(s)
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	return s, func() {
+		kunaio.SetBaseURL(old)
+		ts.Close()
+	}
+}
+
+func (s *countingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.counts[r.URL.Path]++
+	s.lock.Unlock()
+	s.arrived <- struct{}{}
+	if s.gate != nil {
+		select {
+		case <-s.gate:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	s.Server.ServeHTTP(w, r)
+}
+
+func (s *countingServer) count(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counts[path]
+}
+
+func cachedClient(cache *kunaio.Cache) *kunaio.Client {
+	client := kunaio.NewClient("ak", "sk")
+	client.Use(cache.Middleware())
+	return client
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	srv, stop := startCounting(t)
+	defer stop()
+	srv.gate = make(chan struct{})
+	cache := kunaio.NewCache()
+	client := cachedClient(cache)
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.GetOrderBook(kunaio.BTCUAH)
+			errs <- err
+		}()
+	}
+	<-srv.arrived
+	for cache.Stats().Coalesced < n-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(srv.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if got := srv.count("/api/v2/order_book"); got != 1 {
+		t.Errorf("expected 1 request, got %d", got)
+	}
+	if st := cache.Stats(); st != (kunaio.CacheStats{Misses: 1, Coalesced: n - 1}) {
+		t.Errorf("bad stats: %+v", st)
+	}
+}
+
+// Waiters retry when the call they waited for is cancelled by its
+// own caller.
+func TestCacheLeaderCancelled(t *testing.T) {
+	srv, stop := startCounting(t)
+	defer stop()
+	srv.gate = make(chan struct{})
+	cache := kunaio.NewCache()
+	client := cachedClient(cache)
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := client.WithContext(ctx).GetOrderBook(kunaio.BTCUAH)
+		leader <- err
+	}()
+	<-srv.arrived
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := client.GetOrderBook(kunaio.BTCUAH)
+		waiter <- err
+	}()
+	for cache.Stats().Coalesced < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-leader; err == nil {
+		t.Error("cancelled call succeeded")
+	}
+	select {
+	case <-srv.arrived:
+	case err := <-waiter:
+		t.Fatalf("waiter did not retry: %v", err)
+	}
+	close(srv.gate)
+	if err := <-waiter; err != nil {
+		t.Errorf("waiter: %s", err)
+	}
+	if got := srv.count("/api/v2/order_book"); got != 2 {
+		t.Errorf("expected 2 requests, got %d", got)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	srv, stop := startCounting(t)
+	defer stop()
+	cache := kunaio.NewCache()
+	cache.TTL["GetOrderBook"] = 50 * time.Millisecond
+	client := cachedClient(cache)
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetOrderBook(kunaio.BTCUAH); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.count("/api/v2/order_book"); got != 1 {
+		t.Errorf("expected 1 request, got %d", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := client.GetOrderBook(kunaio.BTCUAH); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.count("/api/v2/order_book"); got != 2 {
+		t.Errorf("expected 2 requests after TTL, got %d", got)
+	}
+	// other markets are cached separately
+	if _, err := client.GetOrderBook(kunaio.ETHUAH); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.count("/api/v2/order_book"); got != 3 {
+		t.Errorf("expected 3 requests, got %d", got)
+	}
+	if st := cache.Stats(); st != (kunaio.CacheStats{Hits: 2, Misses: 3}) {
+		t.Errorf("bad stats: %+v", st)
+	}
+}
+
+func TestCacheNotCached(t *testing.T) {
+	srv, stop := startCounting(t)
+	defer stop()
+	cache := kunaio.NewCache()
+	for k := range cache.TTL {
+		cache.TTL[k] = time.Hour
+	}
+	cache.TTL["GetUserInfo"] = time.Hour
+	cache.TTL["NewOrder"] = time.Hour
+	client := cachedClient(cache)
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetUserInfo(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.NewOrder(kunaio.BTCUAH, "buy", 1, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.count("/api/v2/members/me"); got != 2 {
+		t.Errorf("private call cached: %d requests", got)
+	}
+	if got := srv.count("/api/v2/orders"); got != 2 {
+		t.Errorf("POST call cached: %d requests", got)
+	}
+	// responses failed to decode are not cached
+	srv.SetFaults(fakeserver.Faults{MalformedRate: 1})
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetOrderBook(kunaio.BTCUAH); err == nil {
+			t.Error("malformed order book decoded")
+		}
+	}
+	if got := srv.count("/api/v2/order_book"); got != 2 {
+		t.Errorf("malformed response cached: %d requests", got)
+	}
+	srv.SetFaults(fakeserver.Faults{})
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetOrderBook(kunaio.BTCUAH); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.count("/api/v2/order_book"); got != 3 {
+		t.Errorf("expected 3 requests, got %d", got)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Values of secret and volatile request parameters in cassettes.
+const (
+	redactedValue   = "REDACTED"
+	normalizedTonce = "0"
+)
+
+// One recorded request/response pair.
+type cassetteEntry struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+type cassetteRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+type cassetteResponse struct {
+	Status     string      `json:"status"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+// Replace secret and volatile parameters (access_key, signature,
+// tonce) of the URL query or form body.
+func normalizeQuery(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+	for _, k := range []string{"access_key", "signature"} {
+		if _, ok := values[k]; ok {
+			values.Set(k, redactedValue)
+		}
+	}
+	if _, ok := values["tonce"]; ok {
+		values.Set("tonce", normalizedTonce)
+	}
+	return values.Encode()
+}
+
+// Return normalized request URL and body.
+func normalizeRequest(r *http.Request) (string, string, error) {
+	u := *r.URL
+	u.RawQuery = normalizeQuery(u.RawQuery)
+	var body string
+	if r.Body != nil {
+		data, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", "", err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		body = string(data)
+		if strings.HasPrefix(r.Header.Get("Content-Type"),
+			"application/x-www-form-urlencoded") {
+			body = normalizeQuery(body)
+		}
+	}
+	return u.String(), body, nil
+}
+
+// Request identity used to match replayed requests.
+func cassetteKey(method, rawurl, body string) string {
+	return method + " " + rawurl + " " + body
+}
+
+// HTTP transport which passes requests to the underlying transport
+// and saves request/response pairs to fixture files in the
+// directory. Secret and volatile request parameters are replaced,
+// so the fixtures can be shared.
+type RecordingTransport struct {
+	// Transport doing real requests. Default is
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+	dir       string
+	seq       int
+	lock      sync.Mutex
+}
+
+// Create recording transport writing fixtures to the directory.
+func NewRecordingTransport(dir string, next http.RoundTripper) (*RecordingTransport, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingTransport{
+		Transport: next,
+		dir:       dir,
+		seq:       len(files),
+	}, nil
+}
+
+func (t *RecordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u, body, err := normalizeRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	next := t.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	entry := cassetteEntry{
+		Request: cassetteRequest{
+			Method: r.Method,
+			URL:    u,
+			Body:   body,
+		},
+		Response: cassetteResponse{
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       string(data),
+		},
+	}
+	if err := t.save(entry, r.URL.Path); err != nil {
+		debugLog("recording transport: %s", err)
+	}
+	return resp, nil
+}
+
+func (t *RecordingTransport) save(entry cassetteEntry, path string) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(entry); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.seq++
+	name := fmt.Sprintf("%04d-%s%s.json", t.seq,
+		strings.ToLower(entry.Request.Method),
+		strings.Replace(path, "/", "_", -1))
+	return writeFileAtomic(filepath.Join(t.dir, name), buf.Bytes())
+}
+
+// Return sorted fixture file names of the directory.
+func cassetteFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	sort.Strings(files)
+	return files, err
+}
+
+// HTTP transport which serves responses from fixture files written
+// by RecordingTransport, without network access. Requests are
+// matched by method, normalized URL and body. If the same request
+// was recorded several times, responses are served in the recorded
+// order and the last one is repeated.
+type ReplayTransport struct {
+	entries map[string][]cassetteEntry
+	lock    sync.Mutex
+}
+
+// Load fixtures from the directory.
+func NewReplayTransport(dir string) (*ReplayTransport, error) {
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no fixtures found in %s", dir)
+	}
+	t := &ReplayTransport{entries: map[string][]cassetteEntry{}}
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var entry cassetteEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		key := cassetteKey(entry.Request.Method, entry.Request.URL,
+			entry.Request.Body)
+		t.entries[key] = append(t.entries[key], entry)
+	}
+	return t, nil
+}
+
+func (t *ReplayTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u, body, err := normalizeRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	key := cassetteKey(r.Method, u, body)
+	t.lock.Lock()
+	entries := t.entries[key]
+	if len(entries) == 0 {
+		t.lock.Unlock()
+		return nil, fmt.Errorf("no recorded response for %s %s", r.Method, u)
+	}
+	entry := entries[0]
+	if 1 < len(entries) {
+		t.entries[key] = entries[1:]
+	}
+	t.lock.Unlock()
+	return &http.Response{
+		Status:        entry.Response.Status,
+		StatusCode:    entry.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Response.Header,
+		Body:          ioutil.NopCloser(strings.NewReader(entry.Response.Body)),
+		ContentLength: int64(len(entry.Response.Body)),
+		Request:       r,
+	}, nil
+}
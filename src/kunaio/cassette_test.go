@@ -0,0 +1,260 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Re-record with:
+//
+//	go test kunaio -run Replay -record
+var record = flag.Bool("record", false,
+	"record cassettes in testdata from the fake server")
+
+const (
+	cassetteDir       = "testdata/cassettes"
+	cassetteAccessKey = "cassette-access-key"
+	cassetteSecretKey = "cassette-secret-key"
+)
+
+// Server time of the recorded sessions.
+var cassetteTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// Transport passing requests directly to the handler, whatever
+// the host is.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body == nil {
+		// as received by a server
+		r.Body = http.NoBody
+	}
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+// Run the session against cassettes in the directory. With -record,
+// the cassettes are recorded from a fake server first.
+func replay(t *testing.T, name string, session func(t *testing.T)) {
+	dir := filepath.Join(cassetteDir, name)
+	defer kunaio.SetTransport(kunaio.Transport())
+	defer kunaio.SetBaseURL(kunaio.BaseURL())
+	kunaio.SetBaseURL(kunaio.DefaultBaseURL)
+	if *record {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		s := fakeserver.New()
+		s.Now = func() time.Time { return cassetteTime }
+		// tonces are replaced in cassettes, so they are not checked
+		s.CheckTonce = false
+		s.AddAccount(cassetteAccessKey, cassetteSecretKey,
+			"user@example.com", map[string]float64{"uah": 100000, "btc": 1})
+		for _, o := range []struct {
+			side          string
+			volume, price float64
+		}{
+			{"sell", 1, 150000},
+			{"sell", 2, 151000},
+			{"buy", 1, 149000},
+		} {
+			if _, err := s.SeedOrder(kunaio.BTCUAH, o.side, o.volume, o.price); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rec, err := kunaio.NewRecordingTransport(dir, handlerTransport{s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		kunaio.SetTransport(rec)
+		session(t)
+	}
+	rt, err := kunaio.NewReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kunaio.SetTransport(rt)
+	session(t)
+}
+
+func TestReplayPublic(t *testing.T) {
+	replay(t, "public", func(t *testing.T) {
+		now, err := kunaio.GetServerTime()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !now.Equal(cassetteTime) {
+			t.Errorf("server time: expected %s, got %s", cassetteTime, now)
+		}
+		book, err := kunaio.GetOrderBook(kunaio.BTCUAH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(book.Asks) != 2 || len(book.Bids) != 1 {
+			t.Fatalf("bad order book: %+v", book)
+		}
+		if ask, _ := book.BestAsk(); ask != 150000 {
+			t.Errorf("best ask: expected 150000, got %v", ask)
+		}
+		if bid, _ := book.BestBid(); bid != 149000 {
+			t.Errorf("best bid: expected 149000, got %v", bid)
+		}
+		if book.Asks[1].Volume != 2 || book.Asks[1].State != kunaio.OrderWait {
+			t.Errorf("bad ask: %+v", book.Asks[1])
+		}
+		stats, err := kunaio.GetLatestStats(kunaio.BTCUAH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Buy != 149000 || stats.Sell != 150000 || !stats.Time.Equal(cassetteTime) {
+			t.Errorf("bad stats: %+v", stats)
+		}
+		if _, err := kunaio.GetTradeHistory(kunaio.BTCUAH); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kunaio.GetOrderBook("xxxuah"); err == nil {
+			t.Error("unknown market accepted")
+		}
+	})
+}
+
+func TestReplayPrivate(t *testing.T) {
+	const ak, sk = cassetteAccessKey, cassetteSecretKey
+	replay(t, "private", func(t *testing.T) {
+		info, err := kunaio.GetUserInfo(ak, sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Email != "user@example.com" || len(info.Accounts) == 0 {
+			t.Errorf("bad user info: %+v", info)
+		}
+		bought, err := kunaio.NewOrder(ak, sk, kunaio.BTCUAH, "buy", 0.5, 150000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bought.State != kunaio.OrderDone || bought.ExecutedVolume != 0.5 {
+			t.Errorf("expected executed order, got %+v", bought)
+		}
+		ask, err := kunaio.NewOrder(ak, sk, kunaio.BTCUAH, "sell", 0.3, 160000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ask.State != kunaio.OrderWait || ask.Price != 160000 {
+			t.Errorf("expected active order, got %+v", ask)
+		}
+		orders, err := kunaio.GetUserOrders(ak, sk, kunaio.BTCUAH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 1 || orders[0].ID != ask.ID {
+			t.Errorf("expected order %d, got %+v", ask.ID, orders)
+		}
+		cancelled, err := kunaio.CancelOrder(ak, sk, ask.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cancelled.State != kunaio.OrderCancel {
+			t.Errorf("expected cancelled order, got %+v", cancelled)
+		}
+		_, err = kunaio.CancelOrder(ak, sk, ask.ID)
+		if e, ok := err.(*kunaio.APIError); !ok || e.Code != 2003 {
+			t.Errorf("expected API error 2003, got %v", err)
+		}
+		order, err := kunaio.GetOrder(ak, sk, ask.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.State != kunaio.OrderCancel || order.Volume != 0.3 {
+			t.Errorf("bad order: %+v", order)
+		}
+		sold, err := kunaio.NewMarketOrder(ak, sk, kunaio.BTCUAH, "sell", 0.2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sold.State != kunaio.OrderDone || sold.OrdType != "market" {
+			t.Errorf("expected executed market order, got %+v", sold)
+		}
+		trades, err := kunaio.GetUserTrades(ak, sk, kunaio.BTCUAH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trades) != 2 {
+			t.Errorf("expected 2 trades, got %+v", trades)
+		}
+	})
+}
+
+// Cassettes are shared, so they must not leak the keys used to
+// record them or request signatures.
+func TestCassettesRedacted(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(cassetteDir, "*", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no cassettes found")
+	}
+	hexSignature := regexp.MustCompile(`[0-9a-fA-F]{64}`)
+	var private int
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := string(data)
+		for _, secret := range []string{cassetteAccessKey, cassetteSecretKey} {
+			if strings.Contains(s, secret) {
+				t.Errorf("%s: contains %s", path, secret)
+			}
+		}
+		if hexSignature.MatchString(s) {
+			t.Errorf("%s: contains signature", path)
+		}
+		if !strings.Contains(s, "access_key") {
+			continue
+		}
+		private++
+		for _, re := range []string{
+			`access_key=REDACTED\b`, `signature=REDACTED\b`, `tonce=0\b`,
+		} {
+			if !regexp.MustCompile(re).MatchString(s) {
+				t.Errorf("%s: %s not found", path, re)
+			}
+		}
+		if strings.Contains(s, url.QueryEscape(cassetteSecretKey)) {
+			t.Errorf("%s: contains secret key", path)
+		}
+	}
+	if private == 0 {
+		t.Error("no private calls recorded")
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Client binds API credentials to the API calls so long-running
+// services (DCA scheduler, order watchers and so on) don't need
+// to pass the keys around on every call. Every call passes through
+// the client's middleware chain, see Middleware.
+type Client struct {
+	AccessKey string
+	SecretKey string
+	// Source of API keys asked on each private call. If set, it
+	// is used instead of AccessKey and SecretKey.
+	Credentials CredentialProvider
+	// Signer of private calls. If nil, the calls are signed with
+	// the keys above by a signer with default clock and tonce
+	// source.
+	Signer *Signer
+	// Logger of API calls. Default is the one set with SetLogger.
+	Logger Logger
+	// Log access key, signature and account data instead of
+	// redacting them. Default is set with SetLogSensitive.
+	LogSensitive bool
+	// How to treat responses not matching the expected format.
+	// Default is the one set with SetDecodeMode.
+	DecodeMode DecodeMode
+	// Called for each problem ignored in DecodeLenient mode.
+	// Problems are logged on warning level too.
+	OnDecodeWarning func(op string, w *DecodeError)
+	middlewares     []Middleware
+	ctx             context.Context
+}
+
+// Create new API client. The client gets all the package-wide
+// middlewares added with Use and logging settings.
+func NewClient(access_key, secret_key string) *Client {
+	return &Client{
+		AccessKey:    access_key,
+		SecretKey:    secret_key,
+		Logger:       gLogger,
+		LogSensitive: gLogSensitive,
+		DecodeMode:   gDecodeMode,
+		middlewares:  append([]Middleware{}, gMiddlewares...),
+	}
+}
+
+// Create new API client taking API keys from the provider,
+// e.g. CredentialStore, instead of keeping them in the client.
+func NewClientWithCredentials(p CredentialProvider) *Client {
+	c := NewClient("", "")
+	c.Credentials = p
+	return c
+}
+
+// Append middlewares to the client's chain. Calls pass them in
+// the same order. Not safe to call concurrently with API calls.
+func (c *Client) Use(mw ...Middleware) *Client {
+	c.middlewares = append(c.middlewares, mw...)
+	return c
+}
+
+// Return shallow copy of the client making calls with the context.
+// The context carries tracing span (see Tracer) and cancels calls
+// in progress when done.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	res := *c
+	res.ctx = ctx
+	res.middlewares = append([]Middleware{}, c.middlewares...)
+	return &res
+}
+
+// Send API request through the middleware chain and decode
+// JSON response with decode function.
+func (c *Client) call(op string, private bool, method, path string, args Args, decode func(d *decoder, data []byte) error) error {
+	url := gBaseURL + path
+	if 0 < len(args) {
+		url += "?" + args.values().Encode()
+	}
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	signer, err := c.signer(private)
+	if err != nil {
+		return err
+	}
+	handler := Chain(c.middlewares...)(
+		signing(logging(c.Logger, c.LogSensitive)(send)))
+	call := &Call{
+		Operation: op,
+		Private:   private,
+		Request:   req,
+		signer:    signer,
+		state:     &callState{},
+	}
+	resp, err := handler(call)
+	if err != nil {
+		return err
+	}
+	success := resp.StatusCode/100 == 2
+	body, err := readResp(resp)
+	if !success {
+		return err
+	}
+	if err == nil {
+		d := &decoder{mode: c.DecodeMode}
+		err = decode(d, body)
+		for _, w := range d.warnings {
+			if c.OnDecodeWarning != nil {
+				c.OnDecodeWarning(op, w)
+			}
+			logDecodeWarning(ctx, c.Logger, c.LogSensitive, op, w)
+		}
+	}
+	call.decoded(err)
+	return err
+}
+
+func (c *Client) signer(private bool) (*Signer, error) {
+	if c.Signer != nil {
+		return c.Signer, nil
+	}
+	if !private || c.Credentials == nil {
+		return NewSigner(c.AccessKey, c.SecretKey), nil
+	}
+	creds, err := c.Credentials.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(creds.AccessKey, creds.SecretKey), nil
+}
+
+// Return server time.
+func (c *Client) GetServerTime() (t time.Time, err error) {
+	err = c.call("GetServerTime", false, "GET",
+		"/api/v2/timestamp", nil,
+		func(d *decoder, data []byte) (err error) {
+			t, err = decodeUnixTime(d, data)
+			return err
+		})
+	return t, err
+}
+
+// Return latest market stats.
+func (c *Client) GetLatestStats(market string) (s Stats, err error) {
+	err = c.call("GetLatestStats", false, "GET",
+		"/api/v2/tickers/"+market, nil,
+		func(d *decoder, data []byte) (err error) {
+			s, err = decodeLatestStats(d, data)
+			return err
+		})
+	return s, err
+}
+
+// Return order book (lists of current asks and bids).
+func (c *Client) GetOrderBook(market string) (book OrderBook, err error) {
+	err = c.call("GetOrderBook", false, "GET",
+		"/api/v2/order_book", Args{{"market", market}},
+		func(d *decoder, data []byte) (err error) {
+			book, err = decodeOrderBook(d, data)
+			return err
+		})
+	return book, err
+}
+
+// Return trade history.
+func (c *Client) GetTradeHistory(market string) (h History, err error) {
+	err = c.call("GetTradeHistory", false, "GET",
+		"/api/v2/trades", Args{{"market", market}},
+		func(d *decoder, data []byte) (err error) {
+			h, err = decodeHistory(d, data)
+			return err
+		})
+	return h, err
+}
+
+// Return user info and his assets.
+func (c *Client) GetUserInfo() (info *UserInfo, err error) {
+	err = c.call("GetUserInfo", true, "GET",
+		"/api/v2/members/me", nil,
+		func(d *decoder, data []byte) (err error) {
+			info, err = decodeUserInfo(d, data)
+			return err
+		})
+	return info, err
+}
+
+// Return list of active user orders.
+func (c *Client) GetUserOrders(market string) (orders []Order, err error) {
+	err = c.call("GetUserOrders", true, "GET",
+		"/api/v2/orders", Args{{"market", market}},
+		func(d *decoder, data []byte) (err error) {
+			orders, err = decodeOrders(d, data)
+			return err
+		})
+	return orders, err
+}
+
+// Return user order, identified by order ID. Unlike GetUserOrders,
+// works for executed and cancelled orders too.
+func (c *Client) GetOrder(id int) (order Order, err error) {
+	err = c.call("GetOrder", true, "GET",
+		"/api/v2/order", Args{{"id", fmt.Sprintf("%d", id)}},
+		func(d *decoder, data []byte) (err error) {
+			order, err = decodeOrder(d, data)
+			return err
+		})
+	return order, err
+}
+
+// Return list of user deals.
+func (c *Client) GetUserTrades(market string) (trades Trades, err error) {
+	err = c.call("GetUserTrades", true, "GET",
+		"/api/v2/trades/my", Args{{"market", market}},
+		func(d *decoder, data []byte) (err error) {
+			trades, err = decodeUserTrades(d, data)
+			return err
+		})
+	return trades, err
+}
+
+// Create new limit order.
+func (c *Client) NewOrder(market, side string, volume, price float64) (order Order, err error) {
+	err = c.call("NewOrder", true, "POST", "/api/v2/orders",
+		Args{
+			{"market", market},
+			{"price", fmt.Sprintf("%f", price)},
+			{"side", side},
+			{"volume", fmt.Sprintf("%f", volume)},
+		},
+		func(d *decoder, data []byte) (err error) {
+			order, err = decodeOrder(d, data)
+			return err
+		})
+	return order, err
+}
+
+// Create new market order.
+func (c *Client) NewMarketOrder(market, side string, volume float64) (order Order, err error) {
+	err = c.call("NewMarketOrder", true, "POST", "/api/v2/orders",
+		Args{
+			{"market", market},
+			{"ord_type", "market"},
+			{"side", side},
+			{"volume", fmt.Sprintf("%f", volume)},
+		},
+		func(d *decoder, data []byte) (err error) {
+			order, err = decodeOrder(d, data)
+			return err
+		})
+	return order, err
+}
+
+// Cancel user order, identified by order ID.
+func (c *Client) CancelOrder(id int) (order Order, err error) {
+	err = c.call("CancelOrder", true, "POST",
+		"/api/v2/order/delete", Args{{"id", fmt.Sprintf("%d", id)}},
+		func(d *decoder, data []byte) (err error) {
+			order, err = decodeOrder(d, data)
+			return err
+		})
+	return order, err
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Default period of server clock offset measurements
+	DefaultClockRefresh = 10 * time.Minute
+	// Default max allowed difference between local and server
+	// clocks. The exchange rejects tonces differing from its
+	// clock by more than 30 seconds.
+	DefaultMaxClockSkew = 30 * time.Second
+)
+
+// Returned by ServerClock when local clock differs from the server
+// clock too much.
+type ClockSkewError struct {
+	// Server time minus local time
+	Skew time.Duration
+	// Allowed skew
+	Max time.Duration
+}
+
+func (e *ClockSkewError) Error() string {
+	dir := "ahead of"
+	skew := e.Skew
+	if 0 < skew {
+		dir = "behind"
+	} else {
+		skew = -skew
+	}
+	return fmt.Sprintf("local clock is %s %s server clock,"+
+		" max allowed skew is %s", skew, dir, e.Max)
+}
+
+// ServerClock estimates the offset between local and server clocks
+// with GetServerTime and applies it to tonces of private calls.
+// The offset is measured on the first private call and refreshed
+// periodically. Usage:
+//
+//	clock := NewServerClock(client)
+//	client.Use(clock.Middleware())
+//
+// Since the server reports time in seconds, the offset is measured
+// in whole seconds.
+type ServerClock struct {
+	// Client to request server time with. Default is the client
+	// without keys.
+	Client *Client
+	// Period of offset measurements. Default is DefaultClockRefresh.
+	Refresh time.Duration
+	// Private calls fail with ClockSkewError when the skew is
+	// greater. Default is DefaultMaxClockSkew. Negative means no
+	// limit.
+	MaxSkew time.Duration
+	// Called after each measurement.
+	OnMeasure func(skew, rtt time.Duration)
+	lock      sync.Mutex
+	skew      time.Duration
+	measured  time.Time
+	// serializes measurements
+	measuring sync.Mutex
+}
+
+// Create new server clock.
+func NewServerClock(client *Client) *ServerClock {
+	return &ServerClock{
+		Client:  client,
+		Refresh: DefaultClockRefresh,
+		MaxSkew: DefaultMaxClockSkew,
+	}
+}
+
+// Measure the clock offset now. Returns server time minus local
+// time, or ClockSkewError if the skew is too large.
+func (c *ServerClock) Measure() (time.Duration, error) {
+	client := c.Client
+	if client == nil {
+		client = NewClient("", "")
+	}
+	start := time.Now()
+	t, err := client.GetServerTime()
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	// server time is truncated to seconds, so the offset is
+	// rounded to seconds too, keeping milliseconds of local clock
+	// in tonces
+	skew := t.Add(500 * time.Millisecond).Sub(start.Add(rtt / 2))
+	skew = skew.Round(time.Second)
+	c.lock.Lock()
+	c.skew = skew
+	c.measured = time.Now()
+	c.lock.Unlock()
+	debugLog("server clock skew is %s, rtt %s", skew, rtt)
+	if c.OnMeasure != nil {
+		c.OnMeasure(skew, rtt)
+	}
+	return skew, c.check(skew)
+}
+
+// Return last measured offset: server time minus local time.
+// Zero if not measured yet.
+func (c *ServerClock) Skew() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.skew
+}
+
+// Return estimated server time.
+func (c *ServerClock) Now() time.Time {
+	return time.Now().Add(c.Skew())
+}
+
+// Return middleware measuring the offset when it is older than
+// Refresh and applying it to tonces of private calls. Private calls
+// fail with ClockSkewError while the skew is too large.
+func (c *ServerClock) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			if !call.Private {
+				return next(call)
+			}
+			if err := c.refresh(); err != nil {
+				return nil, err
+			}
+			signer := *call.signer
+			signer.Now = c.Now
+			res := *call
+			res.signer = &signer
+			return next(&res)
+		}
+	}
+}
+
+// Measure the offset if it is stale. When the measurement fails,
+// previous offset is used, if any.
+func (c *ServerClock) refresh() error {
+	refresh := c.Refresh
+	if refresh <= 0 {
+		refresh = DefaultClockRefresh
+	}
+	c.measuring.Lock()
+	defer c.measuring.Unlock()
+	c.lock.Lock()
+	measured, skew := c.measured, c.skew
+	c.lock.Unlock()
+	if !measured.IsZero() && time.Since(measured) <= refresh {
+		return c.check(skew)
+	}
+	_, err := c.Measure()
+	if _, ok := err.(*ClockSkewError); err != nil && !ok {
+		if measured.IsZero() {
+			return fmt.Errorf("measure server clock: %s", err)
+		}
+		debugLog("measure server clock: %s", err)
+		return c.check(skew)
+	}
+	return err
+}
+
+func (c *ServerClock) check(skew time.Duration) error {
+	max := c.MaxSkew
+	if max == 0 {
+		max = DefaultMaxClockSkew
+	}
+	if 0 <= max && (max < skew || max < -skew) {
+		return &ClockSkewError{Skew: skew, Max: max}
+	}
+	return nil
+}
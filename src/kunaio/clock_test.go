@@ -0,0 +1,109 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Start fake server with clock shifted by skew and point the package
+// at it. Private calls fail unless their tonces are within
+// fakeserver.TonceWindow of the server clock.
+func startSkewed(t *testing.T, skew time.Duration) func() {
+	t.Helper()
+	s := fakeserver.New()
+	s.Now = func() time.Time { return time.Now().Add(skew) }
+	s.AddAccount("ak", "sk", "user@example.com", nil)
+	ts := httptest.NewServer(s)
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	return func() {
+		kunaio.SetBaseURL(old)
+		ts.Close()
+	}
+}
+
+func TestServerClockMeasure(t *testing.T) {
+	for _, skew := range []time.Duration{0, 90 * time.Second, -time.Hour} {
+		stop := startSkewed(t, skew)
+		clock := kunaio.NewServerClock(nil)
+		clock.MaxSkew = -1
+		got, err := clock.Measure()
+		stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// server reports whole seconds
+		if d := got - skew; d < -time.Second || time.Second < d {
+			t.Errorf("skew %s measured as %s", skew, got)
+		}
+		if clock.Skew() != got {
+			t.Errorf("Skew() = %s, measured %s", clock.Skew(), got)
+		}
+	}
+	defer startSkewed(t, time.Minute)()
+	_, err := kunaio.NewServerClock(nil).Measure()
+	if e, ok := err.(*kunaio.ClockSkewError); !ok || e.Max != kunaio.DefaultMaxClockSkew {
+		t.Errorf("expected ClockSkewError, got %v", err)
+	}
+}
+
+// Private calls of the client with ServerClock must carry tonces
+// corrected by the skew whatever tonce source is used.
+func TestServerClockTonces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kunaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer kunaio.SetNonceSource(nil)
+	for _, c := range []struct {
+		name   string
+		global kunaio.NonceSource
+		own    kunaio.NonceSource
+	}{
+		{"default", nil, nil},
+		{"own monotonic", nil, &kunaio.MonotonicNonce{}},
+		{"own file", nil, kunaio.NewFileNonce(filepath.Join(dir, "own"))},
+		{"global monotonic", &kunaio.MonotonicNonce{}, nil},
+		{"global file", kunaio.NewFileNonce(filepath.Join(dir, "global")), nil},
+	} {
+		restore := kunaio.ResetDefaultNonce()
+		stop := startSkewed(t, time.Hour)
+		kunaio.SetNonceSource(c.global)
+		client := kunaio.NewClient("ak", "sk")
+		if c.own != nil {
+			client.Signer = kunaio.NewSigner("ak", "sk")
+			client.Signer.Nonce = c.own
+		}
+		clock := kunaio.NewServerClock(nil)
+		clock.MaxSkew = -1
+		client.Use(clock.Middleware())
+		_, err := client.GetUserInfo()
+		stop()
+		restore()
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+	}
+}
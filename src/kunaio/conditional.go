@@ -0,0 +1,442 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conditional order types
+const (
+	// Exit when the price moves against the position
+	StopLoss = "stop-loss"
+	// Exit when the price reaches the target
+	TakeProfit = "take-profit"
+	// Stop-loss which follows the price at fixed relative distance
+	TrailingStop = "trailing-stop"
+)
+
+// Conditional order states
+const (
+	// Waiting for the condition to be met
+	CondPending = "pending"
+	// Condition is met, real order is being submitted
+	CondSubmitting = "submitting"
+	// Real order is submitted
+	CondTriggered = "triggered"
+	// Real order submission failed
+	CondFailed = "failed"
+	// Cancelled by user
+	CondCancelled = "cancelled"
+)
+
+// Default interval between price checks
+const DefaultCondPollInterval = 10 * time.Second
+
+// Client-side conditional order. When the condition is met, a real
+// limit or market order is submitted to the exchange.
+type Condition struct {
+	// Local condition ID
+	ID int `json:"id"`
+	// StopLoss, TakeProfit or TrailingStop
+	Type string `json:"type"`
+	// Market identifier
+	Market string `json:"market"`
+	// Side of the order to submit: "sell" to close long position,
+	// "buy" to close short one
+	Side string `json:"side"`
+	// Volume of the order to submit
+	Volume float64 `json:"volume"`
+	// Trigger price for stop-loss and take-profit
+	TriggerPrice float64 `json:"trigger_price,omitempty"`
+	// Relative trailing distance for trailing stop (0.05 = 5%)
+	TrailDelta float64 `json:"trail_delta,omitempty"`
+	// Best price seen by trailing stop: the highest one for sells,
+	// the lowest one for buys
+	Extreme float64 `json:"extreme,omitempty"`
+	// Price of the limit order to submit. Zero means market order.
+	LimitPrice float64 `json:"limit_price,omitempty"`
+	// One of Cond* states
+	State string `json:"state"`
+	// Creation time
+	CreatedAt time.Time `json:"created_at"`
+	// Time when the condition was met
+	TriggeredAt time.Time `json:"triggered_at,omitempty"`
+	// Price which triggered the condition
+	TriggeredBy float64 `json:"triggered_by,omitempty"`
+	// ID of the submitted order
+	OrderID int `json:"order_id,omitempty"`
+	// Error description for failed conditions
+	Error string `json:"error,omitempty"`
+}
+
+// Check conditional order fields.
+func (c Condition) validate() error {
+	if c.Side != "buy" && c.Side != "sell" {
+		return fmt.Errorf("invalid side: %#v", c.Side)
+	}
+	if c.Market == "" {
+		return errors.New("market is not set")
+	}
+	if c.Volume <= 0 {
+		return errors.New("volume must be positive")
+	}
+	if c.LimitPrice < 0 {
+		return errors.New("limit price must not be negative")
+	}
+	switch c.Type {
+	case StopLoss, TakeProfit:
+		if c.TriggerPrice <= 0 {
+			return errors.New("trigger price must be positive")
+		}
+	case TrailingStop:
+		if c.TrailDelta <= 0 || 1 <= c.TrailDelta {
+			return errors.New("trailing distance must be in (0, 1) range")
+		}
+	default:
+		return fmt.Errorf("invalid conditional order type: %#v", c.Type)
+	}
+	return nil
+}
+
+// Return current stop price of the conditional order.
+func (c Condition) StopPrice() float64 {
+	if c.Type != TrailingStop {
+		return c.TriggerPrice
+	}
+	if c.Side == "sell" {
+		return c.Extreme * (1 - c.TrailDelta)
+	}
+	return c.Extreme * (1 + c.TrailDelta)
+}
+
+// Update trailing stop extreme and check if the condition is met
+// by the price.
+func (c *Condition) check(price float64) bool {
+	sell := c.Side == "sell"
+	switch c.Type {
+	case StopLoss:
+		if sell {
+			return price <= c.TriggerPrice
+		}
+		return c.TriggerPrice <= price
+	case TakeProfit:
+		if sell {
+			return c.TriggerPrice <= price
+		}
+		return price <= c.TriggerPrice
+	case TrailingStop:
+		if c.Extreme == 0 || (sell && c.Extreme < price) ||
+			(!sell && price < c.Extreme) {
+			c.Extreme = price
+		}
+		if sell {
+			return price <= c.StopPrice()
+		}
+		return c.StopPrice() <= price
+	}
+	return false
+}
+
+// File-based storage for conditional orders. All the conditions
+// are kept in one JSON file which is replaced atomically on every
+// update, so the storage can be shared between the watching
+// process and CLI commands.
+type ConditionStore struct {
+	path string
+	lock sync.Mutex
+}
+
+// Create conditional orders storage, backed by the file.
+func NewConditionStore(path string) *ConditionStore {
+	return &ConditionStore{path: path}
+}
+
+// Return all stored conditional orders.
+func (s *ConditionStore) Load() ([]Condition, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var conds []Condition
+	if err := json.Unmarshal(data, &conds); err != nil {
+		return nil, fmt.Errorf("%s: %s", s.path, err)
+	}
+	return conds, nil
+}
+
+// Read-modify-write stored conditional orders. The update function
+// is called with exclusive access to the storage. If it returns
+// an error, the storage is left untouched.
+func (s *ConditionStore) Update(update func([]Condition) ([]Condition, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	conds, err := s.Load()
+	if err != nil {
+		return err
+	}
+	conds, err = update(conds)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(conds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Validate and store new conditional order. ID, state and
+// creation time are set by the storage.
+func (s *ConditionStore) Add(c Condition) (Condition, error) {
+	if err := c.validate(); err != nil {
+		return c, err
+	}
+	err := s.Update(func(conds []Condition) ([]Condition, error) {
+		for _, e := range conds {
+			if c.ID <= e.ID {
+				c.ID = e.ID
+			}
+		}
+		c.ID++
+		c.State = CondPending
+		c.CreatedAt = time.Now()
+		return append(conds, c), nil
+	})
+	return c, err
+}
+
+// Cancel pending conditional order.
+func (s *ConditionStore) Cancel(id int) (Condition, error) {
+	var res Condition
+	err := s.Update(func(conds []Condition) ([]Condition, error) {
+		for i := range conds {
+			if conds[i].ID != id {
+				continue
+			}
+			if conds[i].State != CondPending {
+				return nil, fmt.Errorf("conditional order %d is %s",
+					id, conds[i].State)
+			}
+			conds[i].State = CondCancelled
+			res = conds[i]
+			return conds, nil
+		}
+		return nil, fmt.Errorf("no such conditional order: %d", id)
+	})
+	return res, err
+}
+
+// Watches market prices and submits real orders when conditions
+// of pending conditional orders are met.
+type ConditionEngine struct {
+	// API client used to submit orders
+	Client *Client
+	// Conditional orders storage
+	Store *ConditionStore
+	// Interval between price checks. Zero means
+	// DefaultCondPollInterval.
+	PollInterval time.Duration
+	// Price source. Default is the last deal price from
+	// GetLatestStats.
+	Price func(market string) (float64, error)
+	// Optional hook called when conditional order is triggered
+	// or failed
+	OnTrigger func(Condition)
+}
+
+// Create conditional order engine.
+func NewConditionEngine(client *Client, store *ConditionStore) *ConditionEngine {
+	return &ConditionEngine{
+		Client: client,
+		Store:  store,
+	}
+}
+
+// Watch prices until the context is cancelled.
+func (e *ConditionEngine) Run(ctx context.Context) error {
+	if err := e.recover(); err != nil {
+		return err
+	}
+	poll := e.PollInterval
+	if poll <= 0 {
+		poll = DefaultCondPollInterval
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		if err := e.Poll(); err != nil {
+			debugLog("conditional orders: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Conditions left in CondSubmitting state mean the process was
+// interrupted while submitting the order. It is not known whether
+// the order reached the exchange, so they are not retried.
+func (e *ConditionEngine) recover() error {
+	var failed []Condition
+	err := e.Store.Update(func(conds []Condition) ([]Condition, error) {
+		for i := range conds {
+			if conds[i].State == CondSubmitting {
+				conds[i].State = CondFailed
+				conds[i].Error = "interrupted while submitting" +
+					" order; check user orders"
+				failed = append(failed, conds[i])
+			}
+		}
+		return conds, nil
+	})
+	for _, c := range failed {
+		e.notify(c)
+	}
+	return err
+}
+
+// Check all pending conditional orders once and submit orders for
+// the triggered ones.
+func (e *ConditionEngine) Poll() error {
+	conds, err := e.Store.Load()
+	if err != nil {
+		return err
+	}
+	prices := map[string]float64{}
+	for _, c := range conds {
+		if c.State != CondPending {
+			continue
+		}
+		if _, ok := prices[c.Market]; ok {
+			continue
+		}
+		price, err := e.price(c.Market)
+		if err != nil {
+			debugLog("conditional orders: %s price: %s", c.Market, err)
+			continue
+		}
+		prices[c.Market] = price
+	}
+	return e.apply(prices)
+}
+
+// Feed market prices to the engine, e.g. from a trade stream
+// instead of polling.
+func (e *ConditionEngine) Check(market string, price float64) error {
+	return e.apply(map[string]float64{market: price})
+}
+
+func (e *ConditionEngine) apply(prices map[string]float64) error {
+	// mark triggered conditions before submitting the orders, so
+	// the orders won't be submitted twice after a crash
+	var triggered []Condition
+	err := e.Store.Update(func(conds []Condition) ([]Condition, error) {
+		for i := range conds {
+			c := &conds[i]
+			price, ok := prices[c.Market]
+			if c.State != CondPending || !ok {
+				continue
+			}
+			if !c.check(price) {
+				continue
+			}
+			c.State = CondSubmitting
+			c.TriggeredAt = time.Now()
+			c.TriggeredBy = price
+			triggered = append(triggered, *c)
+		}
+		return conds, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range triggered {
+		e.submit(c)
+	}
+	return nil
+}
+
+// Submit real order for the triggered condition and save result.
+func (e *ConditionEngine) submit(c Condition) {
+	var (
+		order Order
+		err   error
+	)
+	ctx, span := StartSpan(context.Background(), "Condition",
+		"condition_id", c.ID, "type", c.Type, "market", c.Market,
+		"side", c.Side, "volume", c.Volume, "triggered_by", c.TriggeredBy)
+	client := e.Client.WithContext(ctx)
+	if c.LimitPrice == 0 {
+		order, err = client.NewMarketOrder(c.Market, c.Side, c.Volume)
+	} else {
+		order, err = client.NewOrder(c.Market, c.Side, c.Volume,
+			c.LimitPrice)
+	}
+	span.SetAttrs("order_id", order.ID)
+	span.Finish(err)
+	if err != nil {
+		c.State = CondFailed
+		c.Error = err.Error()
+	} else {
+		c.State = CondTriggered
+		c.OrderID = order.ID
+	}
+	err = e.Store.Update(func(conds []Condition) ([]Condition, error) {
+		for i := range conds {
+			if conds[i].ID == c.ID {
+				conds[i] = c
+			}
+		}
+		return conds, nil
+	})
+	if err != nil {
+		debugLog("conditional orders: save %d: %s", c.ID, err)
+	}
+	e.notify(c)
+}
+
+func (e *ConditionEngine) notify(c Condition) {
+	if e.OnTrigger != nil {
+		e.OnTrigger(c)
+	}
+}
+
+func (e *ConditionEngine) price(market string) (float64, error) {
+	if e.Price != nil {
+		return e.Price(market)
+	}
+	stats, err := e.Client.GetLatestStats(market)
+	if err != nil {
+		return 0, err
+	}
+	return stats.Last, nil
+}
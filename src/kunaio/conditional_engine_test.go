@@ -0,0 +1,108 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+func TestConditionEngineTrailingStop(t *testing.T) {
+	s := fakeserver.New()
+	s.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"btc": 1})
+	if _, err := s.SeedOrder(kunaio.BTCUAH, "buy", 1, 110); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	defer kunaio.SetBaseURL(old)
+	dir, err := ioutil.TempDir("", "conditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := kunaio.NewConditionStore(filepath.Join(dir, "conditions.json"))
+	_, err = store.Add(kunaio.Condition{Type: kunaio.TrailingStop,
+		Market: kunaio.BTCUAH, Side: "sell", Volume: 0.5, TrailDelta: 0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := kunaio.NewClient("ak", "sk")
+	var notified []kunaio.Condition
+	engine := kunaio.NewConditionEngine(client, store)
+	engine.OnTrigger = func(c kunaio.Condition) { notified = append(notified, c) }
+	sold := func(want float64) {
+		t.Helper()
+		if btc, _ := s.Balance("ak", "btc"); btc != 1-want {
+			t.Fatalf("sold %v BTC, want %v", 1-btc, want)
+		}
+	}
+	// prices of another market are ignored
+	if err := engine.Check("ethuah", 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, price := range []float64{100, 110, 105, 120} {
+		if err := engine.Check(kunaio.BTCUAH, price); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the ratchet is persisted
+	conds, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := conds[0]; c.State != kunaio.CondPending || c.Extreme != 120 ||
+		c.StopPrice() != 114 {
+		t.Fatalf("after rise: %+v", c)
+	}
+	sold(0)
+	if err := engine.Check(kunaio.BTCUAH, 114); err != nil {
+		t.Fatal(err)
+	}
+	sold(0.5)
+	if conds, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	c := conds[0]
+	if c.State != kunaio.CondTriggered || c.TriggeredBy != 114 ||
+		c.Extreme != 120 {
+		t.Errorf("triggered: %+v", c)
+	}
+	order, err := client.GetOrder(c.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Side != "sell" || order.OrdType != "market" ||
+		order.ExecutedVolume != 0.5 {
+		t.Errorf("placed order: %+v", order)
+	}
+	if len(notified) != 1 || notified[0].State != kunaio.CondTriggered {
+		t.Errorf("notified: %+v", notified)
+	}
+	// triggered condition is not checked again
+	if err := engine.Check(kunaio.BTCUAH, 100); err != nil {
+		t.Fatal(err)
+	}
+	sold(0.5)
+}
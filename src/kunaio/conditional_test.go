@@ -0,0 +1,206 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func tempConditionStore(t *testing.T) (*ConditionStore, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "conditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewConditionStore(filepath.Join(dir, "conditions.json"))
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestConditionStore(t *testing.T) {
+	store, cleanup := tempConditionStore(t)
+	defer cleanup()
+	if conds, err := store.Load(); err != nil || conds != nil {
+		t.Fatalf("empty store: %v, %v", conds, err)
+	}
+	stop := Condition{Type: StopLoss, Market: BTCUAH, Side: "sell",
+		Volume: 1, TriggerPrice: 40}
+	for _, c := range []struct {
+		name string
+		f    func(*Condition)
+		err  string
+	}{
+		{"side", func(c *Condition) { c.Side = "hold" }, `invalid side: "hold"`},
+		{"volume", func(c *Condition) { c.Volume = 0 }, "volume must be positive"},
+		{"trigger", func(c *Condition) { c.TriggerPrice = 0 },
+			"trigger price must be positive"},
+		{"trail", func(c *Condition) { c.Type = TrailingStop },
+			"trailing distance must be in (0, 1) range"},
+		{"type", func(c *Condition) { c.Type = "limit" },
+			`invalid conditional order type: "limit"`},
+	} {
+		bad := stop
+		c.f(&bad)
+		if _, err := store.Add(bad); err == nil || err.Error() != c.err {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		c, err := store.Add(stop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ID != i || c.State != CondPending || c.CreatedAt.IsZero() {
+			t.Errorf("added: %+v", c)
+		}
+	}
+	if c, err := store.Cancel(2); err != nil || c.State != CondCancelled {
+		t.Errorf("cancel: %+v, %v", c, err)
+	}
+	if _, err := store.Cancel(2); err == nil ||
+		err.Error() != "conditional order 2 is cancelled" {
+		t.Errorf("cancel twice: %v", err)
+	}
+	if _, err := store.Cancel(4); err == nil ||
+		err.Error() != "no such conditional order: 4" {
+		t.Errorf("cancel unknown: %v", err)
+	}
+	// failed update leaves the storage untouched
+	err := store.Update(func(conds []Condition) ([]Condition, error) {
+		return nil, errors.New("oops")
+	})
+	if err == nil || err.Error() != "oops" {
+		t.Errorf("update: %v", err)
+	}
+	// the conditions are read by another process
+	conds, err := NewConditionStore(store.path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []string
+	for _, c := range conds {
+		states = append(states, c.State)
+	}
+	want := []string{CondPending, CondCancelled, CondPending}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states %v, want %v", states, want)
+	}
+	// IDs are not reused after removal
+	err = store.Update(func(conds []Condition) ([]Condition, error) {
+		return conds[:2], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := store.Add(stop); err != nil || c.ID != 3 {
+		t.Errorf("added after removal: %+v, %v", c, err)
+	}
+}
+
+func TestConditionRecover(t *testing.T) {
+	store, cleanup := tempConditionStore(t)
+	defer cleanup()
+	for i := 0; i < 3; i++ {
+		_, err := store.Add(Condition{Type: TakeProfit, Market: BTCUAH,
+			Side: "sell", Volume: 1, TriggerPrice: 50})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the process was killed while submitting the second order
+	err := store.Update(func(conds []Condition) ([]Condition, error) {
+		conds[1].State = CondSubmitting
+		return conds, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notified []Condition
+	engine := NewConditionEngine(NewClient("ak", "sk"), store)
+	engine.Price = func(string) (float64, error) { return 45, nil }
+	engine.OnTrigger = func(c Condition) { notified = append(notified, c) }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := engine.Run(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+	conds, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notified) != 1 || !reflect.DeepEqual(notified[0], conds[1]) {
+		t.Fatalf("notified: %+v", notified)
+	}
+	c := conds[1]
+	if c.State != CondFailed ||
+		c.Error != "interrupted while submitting order; check user orders" {
+		t.Errorf("recovered: %+v", c)
+	}
+	if conds[0].State != CondPending || conds[2].State != CondPending {
+		t.Errorf("other conditions: %+v", conds)
+	}
+}
+
+func TestTrailingStop(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		side   string
+		prices []float64
+		// index of the triggering price, -1 if none
+		trigger int
+		extreme float64
+	}{
+		{name: "sell, price rises", side: "sell",
+			prices:  []float64{100, 105, 110, 106},
+			trigger: -1, extreme: 110},
+		{name: "sell, stop follows the price up", side: "sell",
+			prices:  []float64{100, 120, 115, 109, 107},
+			trigger: 4, extreme: 120},
+		{name: "sell, stop does not move down", side: "sell",
+			prices:  []float64{100, 95, 91, 89},
+			trigger: 3, extreme: 100},
+		{name: "buy, price falls", side: "buy",
+			prices:  []float64{100, 90, 95, 98},
+			trigger: -1, extreme: 90},
+		{name: "buy, stop follows the price down", side: "buy",
+			prices:  []float64{100, 80, 87, 88},
+			trigger: 3, extreme: 80},
+		{name: "buy, stop does not move up", side: "buy",
+			prices:  []float64{100, 105, 109, 111},
+			trigger: 3, extreme: 100},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cond := Condition{Type: TrailingStop, Side: c.side,
+				TrailDelta: 0.1}
+			trigger := -1
+			for i, price := range c.prices {
+				if cond.check(price) {
+					trigger = i
+					break
+				}
+			}
+			if trigger != c.trigger || cond.Extreme != c.extreme {
+				t.Errorf("triggered by %d with extreme %v, "+
+					"want %d and %v", trigger, cond.Extreme,
+					c.trigger, c.extreme)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source of API keys for private calls, e.g. CredentialStore.
+type CredentialProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// API key pair. It is a provider returning itself.
+type Credentials struct {
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// Return the key pair.
+func (c Credentials) Credentials() (Credentials, error) {
+	return c, nil
+}
+
+var (
+	// Credential store file can't be decrypted.
+	ErrBadPassphrase = errors.New("wrong passphrase or corrupted credential store")
+	// No credentials with the name in the store.
+	ErrCredentialsNotFound = errors.New("credentials not found")
+	// Credentials with the name are already in the store.
+	ErrCredentialsExist = errors.New("credentials already exist")
+)
+
+// Default scrypt CPU/memory cost of CredentialStore: about 32MB
+// of memory and 0.1s to open the store.
+const DefaultScryptN = 1 << 15
+
+// Named API key pair kept in CredentialStore.
+type StoredCredentials struct {
+	Name string `json:"name"`
+	Credentials
+	Added   time.Time `json:"added"`
+	Rotated time.Time `json:"rotated"`
+}
+
+// Credentials the store keeps in an encrypted file, so secret keys
+// are never written in plaintext. The file is encrypted with
+// AES-256-GCM using key derived from passphrase with scrypt. Changes
+// are made under a lock file, so several processes can share the
+// store. Safe for concurrent use.
+type CredentialStore struct {
+	Path string
+	// scrypt CPU/memory cost used when the file is written.
+	// Default is DefaultScryptN.
+	ScryptN    int
+	passphrase []byte
+	lock       sync.Mutex
+	// decrypted contents and modification time of the file
+	entries []StoredCredentials
+	modTime time.Time
+	loaded  bool
+}
+
+// Encrypted credential store file.
+type credentialFile struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Cipher  string `json:"cipher"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Open credential store file, decrypting it with the passphrase.
+// The file is created on first change, if missing.
+func OpenCredentialStore(path string, passphrase []byte) (*CredentialStore, error) {
+	s := &CredentialStore{
+		Path:       path,
+		ScryptN:    DefaultScryptN,
+		passphrase: append([]byte{}, passphrase...),
+	}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Return stored credentials sorted by name.
+func (s *CredentialStore) List() ([]StoredCredentials, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entries, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return append([]StoredCredentials{}, entries...), nil
+}
+
+// Return credentials with the name.
+func (s *CredentialStore) Get(name string) (Credentials, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entries, err := s.load()
+	if err != nil {
+		return Credentials{}, err
+	}
+	if i := findCredentials(entries, name); 0 <= i {
+		return entries[i].Credentials, nil
+	}
+	return Credentials{}, fmt.Errorf("%s: %w", name, ErrCredentialsNotFound)
+}
+
+// Add new credentials.
+func (s *CredentialStore) Add(name string, c Credentials) error {
+	if name == "" {
+		return errors.New("empty credentials name")
+	}
+	return s.modify(func(entries []StoredCredentials) ([]StoredCredentials, error) {
+		if 0 <= findCredentials(entries, name) {
+			return nil, fmt.Errorf("%s: %w", name, ErrCredentialsExist)
+		}
+		entries = append(entries, StoredCredentials{
+			Name:        name,
+			Credentials: c,
+			Added:       time.Now().UTC(),
+		})
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name < entries[j].Name
+		})
+		return entries, nil
+	})
+}
+
+// Replace existing credentials with new key pair, e.g. after
+// the keys are regenerated at the exchange.
+func (s *CredentialStore) Rotate(name string, c Credentials) error {
+	return s.modify(func(entries []StoredCredentials) ([]StoredCredentials, error) {
+		i := findCredentials(entries, name)
+		if i < 0 {
+			return nil, fmt.Errorf("%s: %w", name, ErrCredentialsNotFound)
+		}
+		entries[i].Credentials = c
+		entries[i].Rotated = time.Now().UTC()
+		return entries, nil
+	})
+}
+
+// Remove credentials.
+func (s *CredentialStore) Remove(name string) error {
+	return s.modify(func(entries []StoredCredentials) ([]StoredCredentials, error) {
+		i := findCredentials(entries, name)
+		if i < 0 {
+			return nil, fmt.Errorf("%s: %w", name, ErrCredentialsNotFound)
+		}
+		return append(entries[:i], entries[i+1:]...), nil
+	})
+}
+
+// Re-encrypt the store with new passphrase.
+func (s *CredentialStore) ChangePassphrase(passphrase []byte) error {
+	return s.rewrite(append([]byte{}, passphrase...),
+		func(entries []StoredCredentials) ([]StoredCredentials, error) {
+			return entries, nil
+		})
+}
+
+// Return provider of credentials with the name. The provider
+// sees changes made to the store file, e.g. rotated keys.
+func (s *CredentialStore) Provider(name string) CredentialProvider {
+	return &storeCredentials{store: s, name: name}
+}
+
+type storeCredentials struct {
+	store *CredentialStore
+	name  string
+}
+
+func (p *storeCredentials) Credentials() (Credentials, error) {
+	return p.store.Get(p.name)
+}
+
+func findCredentials(entries []StoredCredentials, name string) int {
+	for i, e := range entries {
+		if e.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Change the store under the file lock and write it.
+func (s *CredentialStore) modify(f func([]StoredCredentials) ([]StoredCredentials, error)) error {
+	return s.rewrite(nil, f)
+}
+
+// Same as modify, but the file is encrypted with the new
+// passphrase, which is used from now on. Nil means keep the
+// current one.
+func (s *CredentialStore) rewrite(passphrase []byte, f func([]StoredCredentials) ([]StoredCredentials, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unlock, err := lockFile(s.Path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	entries, err = f(append([]StoredCredentials{}, entries...))
+	if err != nil {
+		return err
+	}
+	if passphrase == nil {
+		passphrase = s.passphrase
+	}
+	if err := s.save(entries, passphrase); err != nil {
+		return err
+	}
+	s.passphrase = passphrase
+	// reload on next access to get the new modification time
+	s.loaded = false
+	return nil
+}
+
+// Return decrypted contents of the store file. The file is
+// decrypted again only when changed.
+func (s *CredentialStore) load() ([]StoredCredentials, error) {
+	fi, err := os.Stat(s.Path)
+	if os.IsNotExist(err) {
+		s.entries, s.loaded = nil, true
+		s.modTime = time.Time{}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if s.loaded && fi.ModTime().Equal(s.modTime) {
+		return s.entries, nil
+	}
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var file credentialFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, err)
+	}
+	if file.Version != 1 || file.KDF != "scrypt" || file.Cipher != "aes-256-gcm" {
+		return nil, fmt.Errorf("%s: unsupported format %d/%s/%s",
+			s.Path, file.Version, file.KDF, file.Cipher)
+	}
+	aead, err := credentialCipher(s.passphrase, &file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, err)
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%s: %w", s.Path, ErrBadPassphrase)
+	}
+	plain, err := aead.Open(nil, file.Nonce, file.Data, file.header())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, ErrBadPassphrase)
+	}
+	var entries []StoredCredentials
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, err)
+	}
+	s.entries, s.modTime, s.loaded = entries, fi.ModTime(), true
+	return entries, nil
+}
+
+// Encrypt entries with the passphrase, fresh salt and nonce and
+// write the file.
+func (s *CredentialStore) save(entries []StoredCredentials, passphrase []byte) error {
+	if entries == nil {
+		entries = []StoredCredentials{}
+	}
+	plain, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	n := s.ScryptN
+	if n == 0 {
+		n = DefaultScryptN
+	}
+	file := credentialFile{
+		Version: 1,
+		KDF:     "scrypt",
+		N:       n,
+		R:       8,
+		P:       1,
+		Salt:    make([]byte, 16),
+		Cipher:  "aes-256-gcm",
+	}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	aead, err := credentialCipher(passphrase, &file)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Data = aead.Seal(nil, file.Nonce, plain, file.header())
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Path, append(data, '\n'))
+}
+
+// Return cipher keyed by the passphrase with file's KDF parameters.
+func credentialCipher(passphrase []byte, file *credentialFile) (cipher.AEAD, error) {
+	key, err := scrypt(passphrase, file.Salt, file.N, file.R, file.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Return additional authenticated data binding the ciphertext to
+// the format and KDF parameters.
+func (f *credentialFile) header() []byte {
+	return []byte(fmt.Sprintf("kunaio-credentials/%d/%s/%d/%d/%d/%s",
+		f.Version, f.KDF, f.N, f.R, f.P, f.Cipher))
+}
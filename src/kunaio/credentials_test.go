@@ -0,0 +1,167 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test vectors of RFC 7914.
+func TestScrypt(t *testing.T) {
+	for _, c := range []struct {
+		password, salt string
+		N, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497" +
+			"f16b4844e3074ae8dfdffa3fede21442" +
+			"fcd0069ded0948f8326a753a0fc81f17" +
+			"e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe" +
+			"7c6ad7cbc8237830e77376634b373162" +
+			"2eaf30d92e22a3886ff109279d9830da" +
+			"c727afb94a83ee6d8360cbdfa2cc0640"},
+	} {
+		key, err := scrypt([]byte(c.password), []byte(c.salt), c.N, c.r, c.p, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(key); got != c.want {
+			t.Errorf("scrypt(%q, %q): %s", c.password, c.salt, got)
+		}
+	}
+	if _, err := scrypt(nil, nil, 1000, 8, 1, 32); err == nil {
+		t.Error("N not power of two accepted")
+	}
+}
+
+func TestCredentialStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kunaio-creds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials.json")
+	open := func(passphrase string) *CredentialStore {
+		s, err := OpenCredentialStore(path, []byte(passphrase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ScryptN = 1024
+		return s
+	}
+	s := open("secret")
+	if err := s.Add("main", Credentials{"ak1", "sk1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("bot", Credentials{"ak2", "sk2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("bot", Credentials{"ak3", "sk3"}); !errors.Is(err, ErrCredentialsExist) {
+		t.Errorf("add existing: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("sk1")) || bytes.Contains(data, []byte("ak2")) {
+		t.Errorf("keys in plaintext: %s", data)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("file mode: %v %v", fi.Mode(), err)
+	}
+
+	// other process sees the changes and rotated keys
+	other := open("secret")
+	provider := other.Provider("main")
+	if c, err := provider.Credentials(); err != nil || c != (Credentials{"ak1", "sk1"}) {
+		t.Errorf("main: %v %v", c, err)
+	}
+	if err := s.Rotate("main", Credentials{"ak4", "sk4"}); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := provider.Credentials(); err != nil || c != (Credentials{"ak4", "sk4"}) {
+		t.Errorf("rotated main: %v %v", c, err)
+	}
+	if err := s.Remove("bot"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := other.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "main" || list[0].Rotated.IsZero() {
+		t.Errorf("list: %+v", list)
+	}
+	if err := s.Remove("bot"); !errors.Is(err, ErrCredentialsNotFound) {
+		t.Errorf("remove missing: %v", err)
+	}
+
+	if _, err := OpenCredentialStore(path, []byte("wrong")); !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("wrong passphrase: %v", err)
+	}
+	// failed write leaves the old passphrase in use: make the file
+	// a directory looking unchanged, so the cached entries are used
+	// but cannot be written back
+	if _, err := s.List(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChangePassphrase([]byte("lost")); err == nil {
+		t.Error("passphrase changed without writing the file")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := fi.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.Get("main"); err != nil || c.SecretKey != "sk4" {
+		t.Errorf("after failed passphrase change: %v %v", c, err)
+	}
+
+	if err := s.ChangePassphrase([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := open("new").Get("main"); err != nil || c.SecretKey != "sk4" {
+		t.Errorf("after passphrase change: %v %v", c, err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule describes a recurring job timetable.
+type Schedule interface {
+	// Return the first activation time strictly after t.
+	// Zero time means the schedule will never fire again.
+	Next(t time.Time) time.Time
+}
+
+// Schedule which fires with constant interval.
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Truncate(time.Second).Add(s.interval)
+}
+
+// Classic five-field cron schedule. Each field is a bit set
+// of allowed values.
+type cronSchedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// true if day-of-month or day-of-week field starts with "*"
+	domStar bool
+	dowStar bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse schedule specification. Supported forms are:
+//
+//	MIN HOUR DOM MONTH DOW  - standard crontab(5) line;
+//	@hourly, @daily, @weekly, @monthly, @yearly - shortcuts;
+//	@every DURATION         - fixed interval, e.g. "@every 1h30m".
+//
+// Times are matched in the location of the time passed to Next.
+func ParseSchedule(spec string) (Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	if fields[0] == "@every" {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad schedule: %#v", spec)
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad schedule interval: %s", err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("schedule interval is too small: %s", d)
+		}
+		return everySchedule{d}, nil
+	}
+	if strings.HasPrefix(fields[0], "@") {
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("bad schedule: %#v", spec)
+		}
+		s, ok := cronDescriptors[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown schedule: %#v", spec)
+		}
+		fields = strings.Fields(s)
+	}
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("bad schedule: %#v: expected %d"+
+			" fields but %d found", spec, len(cronFields), len(fields))
+	}
+	sets := make([]uint64, len(fields))
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	// Sunday can be specified both as 0 and 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	// as in cron(8), "*/STEP" counts as a wildcard too
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// Parse one crontab field: "*", "*/STEP", "N", "N-M", "N-M/STEP"
+// or comma separated list of them.
+func parseCronField(s string, f cronField) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad %s step: %#v", f.name, item)
+			}
+			step = n
+			item = item[:i]
+		}
+		lo, hi := f.min, f.max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			i := strings.Index(item, "-")
+			a, err1 := strconv.Atoi(item[:i])
+			b, err2 := strconv.Atoi(item[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("bad %s range: %#v", f.name, item)
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(item)
+			if err != nil {
+				return 0, fmt.Errorf("bad %s: %#v", f.name, item)
+			}
+			lo, hi = n, n
+			if step != 1 {
+				// "N/STEP" means "from N to the max with STEP"
+				hi = f.max
+			}
+		}
+		if lo < f.min || f.max < hi || hi < lo {
+			return 0, fmt.Errorf("%s is out of range %d-%d: %#v",
+				f.name, f.min, f.max, item)
+		}
+		for i := lo; i <= hi; i += step {
+			set |= 1 << uint(i)
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	// start from the next whole minute
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// no valid time can be farther than few years ahead
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Check day of month and day of week fields. As in cron(8),
+// when both fields are restricted, the day matches if any of
+// them matches.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,439 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default time to wait for DCA limit order to fill
+	DefaultDCATimeout = 10 * time.Minute
+	// Default interval between order state checks
+	DefaultDCAPollInterval = 15 * time.Second
+)
+
+// DCA execution statuses
+const (
+	// Limit order was filled completely
+	DCAFilled = "filled"
+	// Limit order timed out or was cancelled by the exchange, rest
+	// was traded with market order
+	DCAMarket = "market"
+	// Execution failed, see Error field
+	DCAFailed = "failed"
+)
+
+// Dollar-cost-averaging plan: trade a fixed amount of funds
+// on a recurring schedule.
+type DCAPlan struct {
+	// Plan name, used in journal records
+	Name string
+	// Market identifier
+	Market string
+	// "buy" (default) or "sell"
+	Side string
+	// Amount of funds (UAH) to trade on every run
+	Amount float64
+	// Schedule specification, see ParseSchedule
+	Schedule string
+	// Limit price offset relative to the best price on the same
+	// side of the order book. Positive offset moves the price
+	// towards the opposite side (up for buys, down for sells),
+	// so 0.001 means "0.1% better than the best bid" for buys.
+	Offset float64
+	// Time to wait for the limit order to fill before falling back
+	// to market order. Zero means DefaultDCATimeout.
+	Timeout time.Duration
+}
+
+// One DCA plan execution result.
+type DCARecord struct {
+	// Execution start time
+	Time time.Time `json:"time"`
+	// Plan name
+	Plan string `json:"plan"`
+	// Market identifier
+	Market string `json:"market"`
+	// "buy" or "sell"
+	Side string `json:"side"`
+	// Planned amount of funds
+	Amount float64 `json:"amount"`
+	// Limit order price
+	Price float64 `json:"price"`
+	// Limit order volume
+	Volume float64 `json:"volume"`
+	// Limit order ID
+	OrderID int `json:"order_id,omitempty"`
+	// Volume executed by the limit order
+	LimitVolume float64 `json:"limit_volume"`
+	// Fallback market order ID
+	MarketOrderID int `json:"market_order_id,omitempty"`
+	// Volume sent with the fallback market order
+	MarketVolume float64 `json:"market_volume"`
+	// One of DCAFilled, DCAMarket, DCAFailed
+	Status string `json:"status"`
+	// Error description for failed executions
+	Error string `json:"error,omitempty"`
+}
+
+// DCA scheduler. Runs every plan according to its schedule
+// and records every execution to the journal.
+type DCA struct {
+	// API client used to place orders
+	Client *Client
+	// Execution journal. Can be nil.
+	Journal *DCAJournal
+	// Interval between order state checks. Zero means
+	// DefaultDCAPollInterval.
+	PollInterval time.Duration
+	// Optional hook called after every execution
+	OnRecord  func(DCARecord)
+	plans     []DCAPlan
+	schedules []Schedule
+	lock      sync.Mutex
+}
+
+// Create new DCA scheduler. All plans are validated here.
+func NewDCA(client *Client, journal *DCAJournal, plans []DCAPlan) (*DCA, error) {
+	d := &DCA{
+		Client:  client,
+		Journal: journal,
+	}
+	for i, p := range plans {
+		if p.Side == "" {
+			p.Side = "buy"
+		}
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("%s-%d", p.Market, i+1)
+		}
+		if p.Side != "buy" && p.Side != "sell" {
+			return nil, fmt.Errorf("plan %s: invalid side: %#v",
+				p.Name, p.Side)
+		}
+		if p.Market == "" {
+			return nil, fmt.Errorf("plan %s: market is not set", p.Name)
+		}
+		if p.Amount <= 0 {
+			return nil, fmt.Errorf("plan %s: amount must be positive",
+				p.Name)
+		}
+		s, err := ParseSchedule(p.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("plan %s: %s", p.Name, err)
+		}
+		d.plans = append(d.plans, p)
+		d.schedules = append(d.schedules, s)
+	}
+	return d, nil
+}
+
+// Return validated plans.
+func (d *DCA) Plans() []DCAPlan {
+	return d.plans
+}
+
+// Run all plans until the context is cancelled.
+func (d *DCA) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := range d.plans {
+		wg.Add(1)
+		go func(plan DCAPlan, s Schedule) {
+			defer wg.Done()
+			d.runPlan(ctx, plan, s)
+		}(d.plans[i], d.schedules[i])
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (d *DCA) runPlan(ctx context.Context, plan DCAPlan, s Schedule) {
+	for {
+		next := s.Next(time.Now())
+		if next.IsZero() {
+			debugLog("DCA plan %s: schedule exhausted", plan.Name)
+			return
+		}
+		debugLog("DCA plan %s: next run at %s", plan.Name, next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		d.Execute(ctx, plan)
+	}
+}
+
+// Execute plan once: place limit order, wait for it to fill and
+// trade the unexecuted rest with market order on timeout. The
+// result is written to the journal and returned.
+func (d *DCA) Execute(ctx context.Context, plan DCAPlan) DCARecord {
+	rec := DCARecord{
+		Time:   time.Now(),
+		Plan:   plan.Name,
+		Market: plan.Market,
+		Side:   plan.Side,
+		Amount: plan.Amount,
+	}
+	ctx, span := StartSpan(ctx, "DCA", "plan", plan.Name,
+		"market", plan.Market, "side", plan.Side, "amount", plan.Amount)
+	err := d.execute(ctx, plan, &rec)
+	if err != nil {
+		rec.Status = DCAFailed
+		rec.Error = err.Error()
+	}
+	span.SetAttrs("status", rec.Status, "price", rec.Price,
+		"order_id", rec.OrderID, "market_order_id", rec.MarketOrderID)
+	span.Finish(err)
+	d.record(rec)
+	return rec
+}
+
+func (d *DCA) execute(ctx context.Context, plan DCAPlan, rec *DCARecord) error {
+	client := d.Client.WithContext(ctx)
+	obook, err := client.GetOrderBook(plan.Market)
+	if err != nil {
+		return fmt.Errorf("get order book: %s", err)
+	}
+	price, err := dcaPrice(obook, plan)
+	if err != nil {
+		return err
+	}
+	rec.Price = price
+	rec.Volume = plan.Amount / price
+	order, err := client.NewOrder(plan.Market, plan.Side,
+		rec.Volume, rec.Price)
+	if err != nil {
+		return fmt.Errorf("new order: %s", err)
+	}
+	rec.OrderID = order.ID
+	timeout := plan.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDCATimeout
+	}
+	order, err = d.waitForFill(ctx, client, order.ID, timeout)
+	if err != nil {
+		return err
+	}
+	if order.State == OrderWait {
+		_, cerr := client.CancelOrder(order.ID)
+		// the order could be filled right before cancellation, and
+		// it keeps filling until the cancellation takes effect
+		order, err = d.settle(ctx, client, order.ID)
+		if err != nil {
+			return err
+		}
+		if order.State == OrderWait {
+			if cerr != nil {
+				return fmt.Errorf("cancel order: %s", cerr)
+			}
+			return fmt.Errorf("order %d is still active after cancellation",
+				order.ID)
+		}
+	}
+	rec.LimitVolume = order.ExecutedVolume
+	rest := rec.Volume - order.ExecutedVolume
+	if order.State == OrderDone || rest <= rec.Volume*1e-9 {
+		rec.Status = DCAFilled
+		return nil
+	}
+	morder, err := client.NewMarketOrder(plan.Market, plan.Side, rest)
+	if err != nil {
+		return fmt.Errorf("new market order: %s", err)
+	}
+	rec.MarketOrderID = morder.ID
+	rec.MarketVolume = rest
+	rec.Status = DCAMarket
+	return nil
+}
+
+// Calculate limit order price for the plan.
+func dcaPrice(obook OrderBook, plan DCAPlan) (float64, error) {
+	if plan.Side == "buy" {
+		bid, ok := obook.BestBid()
+		if !ok {
+			return 0, fmt.Errorf("no bids in %s order book", plan.Market)
+		}
+		return bid * (1 + plan.Offset), nil
+	}
+	ask, ok := obook.BestAsk()
+	if !ok {
+		return 0, fmt.Errorf("no asks in %s order book", plan.Market)
+	}
+	return ask * (1 - plan.Offset), nil
+}
+
+// Wait until the order is finished: filled, cancelled or rejected
+// by the exchange. Returns last known order state, still active
+// after timeout.
+func (d *DCA) waitForFill(ctx context.Context, client *Client, id int, timeout time.Duration) (Order, error) {
+	order := Order{ID: id, State: OrderWait}
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(d.pollInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return order, ctx.Err()
+		case <-ticker.C:
+		}
+		o, err := client.GetOrder(id)
+		if err != nil {
+			debugLog("DCA: get order %d: %s", id, err)
+		} else if order = o; o.State != OrderWait {
+			return order, nil
+		}
+		if time.Now().After(deadline) {
+			return order, nil
+		}
+	}
+}
+
+// Number of order state checks after cancellation.
+const dcaSettleChecks = 3
+
+// Return order state after cancellation, waiting a bit for it
+// to take effect.
+func (d *DCA) settle(ctx context.Context, client *Client, id int) (Order, error) {
+	var (
+		order Order
+		err   error
+	)
+	for i := 0; i < dcaSettleChecks; i++ {
+		if 0 < i {
+			select {
+			case <-ctx.Done():
+				return order, ctx.Err()
+			case <-time.After(d.pollInterval()):
+			}
+		}
+		order, err = client.GetOrder(id)
+		if err == nil && order.State != OrderWait {
+			return order, nil
+		}
+	}
+	if err != nil {
+		return order, fmt.Errorf("get order: %s", err)
+	}
+	return order, nil
+}
+
+func (d *DCA) pollInterval() time.Duration {
+	if d.PollInterval <= 0 {
+		return DefaultDCAPollInterval
+	}
+	return d.PollInterval
+}
+
+func (d *DCA) record(rec DCARecord) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.Journal != nil {
+		if err := d.Journal.Append(rec); err != nil {
+			debugLog("DCA: journal: %s", err)
+		}
+	}
+	if d.OnRecord != nil {
+		d.OnRecord(rec)
+	}
+}
+
+// Read DCA plans in crontab-like format. Each non-empty line,
+// not starting with '#', describes one plan:
+//
+//	SCHEDULE MARKET AMOUNT [KEY=VALUE ...]
+//
+// where SCHEDULE is accepted by ParseSchedule and optional KEYs
+// are: name, side, offset, timeout. Example:
+//
+//	# buy BTC for 500 UAH every Monday at 09:00
+//	0 9 * * 1     btcuah 500 offset=0.001 timeout=15m
+//	@every 24h    ethuah 200 name=eth-daily
+func ReadDCAPlans(r io.Reader) ([]DCAPlan, error) {
+	var plans []DCAPlan
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		plan, err := parseDCAPlan(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		plans = append(plans, plan)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+func parseDCAPlan(line string) (DCAPlan, error) {
+	fields := strings.Fields(line)
+	n := 5
+	if fields[0] == "@every" {
+		n = 2
+	} else if strings.HasPrefix(fields[0], "@") {
+		n = 1
+	}
+	if len(fields) < n+2 {
+		return DCAPlan{}, fmt.Errorf("expected SCHEDULE MARKET AMOUNT")
+	}
+	plan := DCAPlan{
+		Schedule: strings.Join(fields[:n], " "),
+		Market:   fields[n],
+	}
+	amount, err := strconv.ParseFloat(fields[n+1], 64)
+	if err != nil {
+		return DCAPlan{}, fmt.Errorf("invalid amount: %s", err)
+	}
+	plan.Amount = amount
+	for _, kv := range fields[n+2:] {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return DCAPlan{}, fmt.Errorf("expected KEY=VALUE: %#v", kv)
+		}
+		key, value := kv[:i], kv[i+1:]
+		switch key {
+		case "name":
+			plan.Name = value
+		case "side":
+			plan.Side = value
+		case "offset":
+			if plan.Offset, err = strconv.ParseFloat(value, 64); err != nil {
+				return DCAPlan{}, fmt.Errorf("invalid offset: %s", err)
+			}
+		case "timeout":
+			if plan.Timeout, err = time.ParseDuration(value); err != nil {
+				return DCAPlan{}, fmt.Errorf("invalid timeout: %s", err)
+			}
+		default:
+			return DCAPlan{}, fmt.Errorf("unknown key: %#v", key)
+		}
+	}
+	return plan, nil
+}
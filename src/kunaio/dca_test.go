@@ -0,0 +1,266 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+func TestParseSchedule(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC) // Monday
+	for _, c := range []struct {
+		spec string
+		next []string
+	}{
+		{"@every 90m", []string{"2024-01-01 14:00", "2024-01-01 15:30"}},
+		{"@hourly", []string{"2024-01-01 13:00", "2024-01-01 14:00"}},
+		{"@daily", []string{"2024-01-02 00:00", "2024-01-03 00:00"}},
+		{"@weekly", []string{"2024-01-07 00:00", "2024-01-14 00:00"}},
+		{"*/20 9-17 * * 1-5", []string{"2024-01-01 12:40", "2024-01-01 13:00"}},
+		{"0 10 * * 7", []string{"2024-01-07 10:00", "2024-01-14 10:00"}},
+		{"0 0 29 2 *", []string{"2024-02-29 00:00", "2028-02-29 00:00"}},
+		// both day fields restricted: either one matches
+		{"0 0 15 * 3", []string{"2024-01-03 00:00", "2024-01-10 00:00",
+			"2024-01-15 00:00", "2024-01-17 00:00"}},
+		// "*/N" is a wildcard: both day fields must match
+		{"0 0 */2 * 3", []string{"2024-01-03 00:00", "2024-01-17 00:00"}},
+		{"0 0 15 * */3", []string{"2024-05-15 00:00", "2024-06-15 00:00"}},
+	} {
+		s, err := kunaio.ParseSchedule(c.spec)
+		if err != nil {
+			t.Errorf("%s: %s", c.spec, err)
+			continue
+		}
+		cur := start
+		for _, want := range c.next {
+			cur = s.Next(cur)
+			if got := cur.Format("2006-01-02 15:04"); got != want {
+				t.Errorf("%s: expected %s, got %s", c.spec, want, got)
+				break
+			}
+		}
+	}
+	for _, spec := range []string{
+		"", "@every", "@every 10ms", "@sometimes", "@daily 1",
+		"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "x * * * *",
+	} {
+		if _, err := kunaio.ParseSchedule(spec); err == nil {
+			t.Errorf("%#v: expected error", spec)
+		}
+	}
+}
+
+func TestDCAJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kunaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	recs := []kunaio.DCARecord{
+		{Time: time.Unix(1700000000, 0).UTC(), Plan: "btc", Market: "btcuah",
+			Side: "buy", Amount: 100, Price: 40, Volume: 2.5,
+			OrderID: 1, LimitVolume: 2.5, Status: kunaio.DCAFilled},
+		{Time: time.Unix(1700086400, 0).UTC(), Plan: "btc", Market: "btcuah",
+			Side: "buy", Amount: 100, Status: kunaio.DCAFailed, Error: "no bids"},
+	}
+	for i := range recs {
+		j, err := kunaio.OpenDCAJournal(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Append(recs[i]); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+	}
+	// simulate crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2023-11-16T22:13:20Z","plan":"b`)
+	f.Close()
+	got, err := kunaio.ReadDCAJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(recs) {
+		t.Fatalf("expected %d records, got %d", len(recs), len(got))
+	}
+	for i := range recs {
+		if !got[i].Time.Equal(recs[i].Time) {
+			t.Errorf("#%d: time %s, expected %s", i, got[i].Time, recs[i].Time)
+		}
+		got[i].Time = recs[i].Time
+		if got[i] != recs[i] {
+			t.Errorf("#%d: expected %+v, got %+v", i, recs[i], got[i])
+		}
+	}
+}
+
+// Start fake server with an account holding 1000 UAH and order book
+// of 1 BTC bid at 40 and 10 BTC ask at 41. The hook is called before
+// every request; the request fails with 503 if it returns an error.
+func startDCA(t *testing.T, hook func(r *http.Request) error) (*fakeserver.Server, func()) {
+	t.Helper()
+	s := fakeserver.New()
+	s.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"uah": 1000})
+	if _, err := s.SeedOrder(kunaio.BTCUAH, "buy", 1, 40); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SeedOrder(kunaio.BTCUAH, "sell", 10, 41); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := hook(r); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		s.ServeHTTP(w, r)
+	}))
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	return s, func() {
+		kunaio.SetBaseURL(old)
+		ts.Close()
+	}
+}
+
+func TestDCAExecute(t *testing.T) {
+	const (
+		getOrder    = "/api/v2/order"
+		cancelOrder = "/api/v2/order/delete"
+	)
+	for _, c := range []struct {
+		name string
+		// on the first request to the path the limit order gets
+		// filled for the volume, then it is cancelled by the
+		// exchange or the request fails
+		on     string
+		fill   float64
+		cancel bool
+		fail   bool
+		// expected record fields
+		status  string
+		limit   float64
+		market  float64
+		cancels int
+		err     string
+	}{
+		{name: "filled", on: getOrder, fill: 2.5,
+			status: kunaio.DCAFilled, limit: 2.5},
+		{name: "cancelled by exchange", on: getOrder, fill: 1, cancel: true,
+			status: kunaio.DCAMarket, limit: 1, market: 1.5},
+		{name: "cancelled by exchange, not executed", on: getOrder,
+			cancel: true, status: kunaio.DCAMarket, market: 2.5},
+		{name: "timeout", on: getOrder, fill: 0.5,
+			status: kunaio.DCAMarket, limit: 0.5, market: 2, cancels: 1},
+		{name: "filled during cancellation", on: cancelOrder, fill: 2.5,
+			status: kunaio.DCAFilled, limit: 2.5, cancels: 1},
+		{name: "partially filled, cancel failed", on: cancelOrder,
+			fill: 1.5, cancel: true,
+			status: kunaio.DCAMarket, limit: 1.5, market: 1, cancels: 1},
+		{name: "cancel failed", on: cancelOrder, fail: true,
+			status: kunaio.DCAFailed, cancels: 1, err: "cancel order"},
+	} {
+		var (
+			s       *fakeserver.Server
+			done    bool
+			cancels int
+		)
+		s, stop := startDCA(t, func(r *http.Request) error {
+			if r.URL.Path == cancelOrder {
+				cancels++
+			}
+			if r.URL.Path != c.on || done {
+				return nil
+			}
+			done = true
+			if 0 < c.fill {
+				// the seeded bid at the same price is filled first
+				if _, err := s.SeedOrder(kunaio.BTCUAH, "sell",
+					1+c.fill, 40); err != nil {
+					return err
+				}
+			}
+			if c.cancel {
+				id, _ := strconv.Atoi(r.FormValue("id"))
+				return s.CancelOrder(id)
+			}
+			if c.fail {
+				return errors.New("try later")
+			}
+			return nil
+		})
+		d, err := kunaio.NewDCA(kunaio.NewClient("ak", "sk"), nil,
+			[]kunaio.DCAPlan{{
+				Name: "btc", Market: kunaio.BTCUAH, Amount: 100,
+				Schedule: "@daily", Timeout: 20 * time.Millisecond,
+			}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.PollInterval = time.Millisecond
+		var hooked kunaio.DCARecord
+		d.OnRecord = func(rec kunaio.DCARecord) { hooked = rec }
+		rec := d.Execute(context.Background(), d.Plans()[0])
+		btc, _ := s.Balance("ak", "btc")
+		stop()
+		if rec != hooked {
+			t.Errorf("%s: OnRecord got %+v", c.name, hooked)
+		}
+		if rec.Status != c.status || !strings.Contains(rec.Error, c.err) {
+			t.Errorf("%s: expected %s (%s), got %s (%s)", c.name,
+				c.status, c.err, rec.Status, rec.Error)
+		}
+		if rec.Price != 40 || rec.Volume != 2.5 || rec.OrderID == 0 {
+			t.Errorf("%s: bad limit order: %+v", c.name, rec)
+		}
+		if math.Abs(rec.LimitVolume-c.limit) > 1e-9 {
+			t.Errorf("%s: limit volume %v, expected %v",
+				c.name, rec.LimitVolume, c.limit)
+		}
+		if cancels != c.cancels {
+			t.Errorf("%s: %d cancel calls, expected %d",
+				c.name, cancels, c.cancels)
+		}
+		if math.Abs(rec.MarketVolume-c.market) > 1e-9 ||
+			(rec.MarketOrderID != 0) != (c.market != 0) {
+			t.Errorf("%s: expected market order for %v, got %+v",
+				c.name, c.market, rec)
+		}
+		if math.Abs(btc-c.limit-c.market) > 1e-6 {
+			t.Errorf("%s: bought %v BTC, expected %v", c.name,
+				btc, c.limit+c.market)
+		}
+	}
+}
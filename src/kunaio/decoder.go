@@ -15,340 +15,304 @@
 package kunaio
 
 import (
-	"fmt"
-	"io"
+	"encoding/json"
+	"time"
 )
 
-// Convert decoded JSON object to Stats struct.
-func decodeLatestStats(v interface{}) (s Stats, err error) {
-	m, err := jsonGetMap(v)
-	if err != nil {
-		return s, err
-	}
-	timestamp, err := jsonGetTime(m["at"])
-	if err != nil {
-		return s, err
-	}
-	m, err = jsonGetMap(m["ticker"])
-	if err != nil {
-		return s, err
-	}
-	buy, err := jsonGetFloat(m["buy"])
-	if err != nil {
-		return s, err
+// Intermediate structs matching exchange responses.
+
+type jsonTicker struct {
+	At     *int64                     `json:"at"`
+	Ticker *jsonStats                 `json:"ticker"`
+	Extra  map[string]json.RawMessage `json:"-"`
+}
+
+type jsonStats struct {
+	Buy    *flexFloat                 `json:"buy"`
+	Sell   *flexFloat                 `json:"sell"`
+	Low    *flexFloat                 `json:"low"`
+	High   *flexFloat                 `json:"high"`
+	Last   *flexFloat                 `json:"last"`
+	Vol    *flexFloat                 `json:"vol"`
+	Amount *flexFloat                 `json:"amount,omitempty"`
+	Extra  map[string]json.RawMessage `json:"-"`
+}
+
+type jsonOrderBook struct {
+	Asks  []jsonOrder                `json:"asks"`
+	Bids  []jsonOrder                `json:"bids"`
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type jsonOrder struct {
+	ID      *flexInt `json:"id"`
+	Side    *string  `json:"side"`
+	OrdType *string  `json:"ord_type"`
+	// market orders have no price
+	Price           *flexFloat                 `json:"price,omitempty"`
+	AvgPrice        *flexFloat                 `json:"avg_price"`
+	State           *string                    `json:"state"`
+	Market          *string                    `json:"market"`
+	CreatedAt       *textTime                  `json:"created_at"`
+	Volume          *flexFloat                 `json:"volume"`
+	RemainingVolume *flexFloat                 `json:"remaining_volume"`
+	ExecutedVolume  *flexFloat                 `json:"executed_volume"`
+	TradesCount     *flexInt                   `json:"trades_count"`
+	Extra           map[string]json.RawMessage `json:"-"`
+}
+
+type jsonHistoryEntry struct {
+	ID        *flexInt                   `json:"id"`
+	Price     *flexFloat                 `json:"price"`
+	Volume    *flexFloat                 `json:"volume"`
+	Funds     *flexFloat                 `json:"funds"`
+	Market    *string                    `json:"market"`
+	CreatedAt *textTime                  `json:"created_at"`
+	Extra     map[string]json.RawMessage `json:"-"`
+}
+
+type jsonUserInfo struct {
+	Email     *string                    `json:"email"`
+	Activated *bool                      `json:"activated"`
+	Accounts  []jsonAccount              `json:"accounts"`
+	Extra     map[string]json.RawMessage `json:"-"`
+}
+
+type jsonAccount struct {
+	Currency *string                    `json:"currency"`
+	Balance  *flexFloat                 `json:"balance"`
+	Locked   *flexFloat                 `json:"locked"`
+	Extra    map[string]json.RawMessage `json:"-"`
+}
+
+type jsonTrade struct {
+	ID        *flexInt                   `json:"id"`
+	Price     *flexFloat                 `json:"price"`
+	Volume    *flexFloat                 `json:"volume"`
+	Funds     *flexFloat                 `json:"funds"`
+	Market    *string                    `json:"market"`
+	CreatedAt *textTime                  `json:"created_at"`
+	Side      *string                    `json:"side"`
+	OrderID   *flexInt                   `json:"order_id,omitempty"`
+	Extra     map[string]json.RawMessage `json:"-"`
+}
+
+type jsonError struct {
+	Error *struct {
+		Code    *flexInt `json:"code"`
+		Message *string  `json:"message"`
+	} `json:"error"`
+}
+
+// Values of optional fields, zero when missing.
+
+func optFloat(f *flexFloat) float64 {
+	if f == nil {
+		return 0
 	}
-	sell, err := jsonGetFloat(m["sell"])
-	if err != nil {
-		return s, err
+	return float64(*f)
+}
+
+func optInt(i *flexInt) int {
+	if i == nil {
+		return 0
 	}
-	low, err := jsonGetFloat(m["low"])
-	if err != nil {
-		return s, err
+	return int(*i)
+}
+
+func optString(s *string) string {
+	if s == nil {
+		return ""
 	}
-	high, err := jsonGetFloat(m["high"])
-	if err != nil {
-		return s, err
+	return *s
+}
+
+func optTime(t *textTime) time.Time {
+	if t == nil {
+		return time.Time{}
 	}
-	last, err := jsonGetFloat(m["last"])
-	if err != nil {
-		return s, err
+	return time.Time(*t)
+}
+
+// Merge unknown fields of nested object.
+func mergeExtra(dst *map[string]json.RawMessage, src map[string]json.RawMessage) {
+	for k, v := range src {
+		if *dst == nil {
+			*dst = map[string]json.RawMessage{}
+		}
+		(*dst)[k] = v
 	}
-	vol, err := jsonGetFloat(m["vol"])
-	if err != nil {
-		return s, err
+}
+
+// Decode JSON number to time in seconds since Unix epoch.
+func decodeUnixTime(d *decoder, data []byte) (time.Time, error) {
+	var v int64
+	if err := d.decode(data, &v); err != nil {
+		return time.Time{}, err
 	}
-	amount, err := jsonGetFloatDef(m["amount"], 0)
-	if err != nil {
+	return time.Unix(v, 0), nil
+}
+
+// Decode JSON object to Stats struct.
+func decodeLatestStats(d *decoder, data []byte) (s Stats, err error) {
+	var j jsonTicker
+	if err = d.decode(data, &j); err != nil {
 		return s, err
 	}
-	return Stats{
-		Time:   timestamp,
-		Buy:    buy,
-		Sell:   sell,
-		Low:    low,
-		High:   high,
-		Last:   last,
-		Vol:    vol,
-		Amount: amount,
-	}, nil
+	if j.At != nil {
+		s.Time = time.Unix(*j.At, 0)
+	}
+	s.Extra = j.Extra
+	if t := j.Ticker; t != nil {
+		s.Buy = optFloat(t.Buy)
+		s.Sell = optFloat(t.Sell)
+		s.Low = optFloat(t.Low)
+		s.High = optFloat(t.High)
+		s.Last = optFloat(t.Last)
+		s.Vol = optFloat(t.Vol)
+		s.Amount = optFloat(t.Amount)
+		mergeExtra(&s.Extra, t.Extra)
+	}
+	return s, nil
 }
 
-// Convert decoded JSON object to Order Book.
-func decodeOrderBook(v interface{}) (OrderBook, error) {
-	m, err := jsonGetMap(v)
-	if err != nil {
-		return OrderBook{}, err
-	}
-	asks, err := decodeOrders(m["asks"])
-	if err != nil {
-		return OrderBook{}, err
-	}
-	bids, err := decodeOrders(m["bids"])
-	if err != nil {
-		return OrderBook{}, err
+// Decode JSON object to Order Book.
+func decodeOrderBook(d *decoder, data []byte) (book OrderBook, err error) {
+	var j jsonOrderBook
+	if err = d.decode(data, &j); err != nil {
+		return book, err
 	}
 	return OrderBook{
-		Asks: asks,
-		Bids: bids,
+		Asks:  convertOrders(j.Asks),
+		Bids:  convertOrders(j.Bids),
+		Extra: j.Extra,
 	}, nil
 }
 
-// Convert decoded JSON object to list of orders.
-func decodeOrders(v interface{}) (Orders, error) {
-	orderList, err := jsonGetList(v)
-	if err != nil {
+// Decode JSON array to list of orders.
+func decodeOrders(d *decoder, data []byte) (Orders, error) {
+	var j []jsonOrder
+	if err := d.decode(data, &j); err != nil {
 		return nil, err
 	}
-	res := Orders{}
-	for _, v := range orderList {
-		order, err := decodeOrder(v)
-		if err != nil {
-			return nil, err
-		}
-		res = append(res, order)
-	}
-	return res, nil
+	return convertOrders(j), nil
 }
 
-// Convert decoded JSON object to Order struct.
-func decodeOrder(v interface{}) (Order, error) {
-	m, err := jsonGetMap(v)
-	if err != nil {
-		return Order{}, err
+func convertOrders(list []jsonOrder) Orders {
+	if list == nil {
+		return nil
 	}
-	id, err := jsonGetInt(m["id"])
-	if err != nil {
-		return Order{}, err
+	res := make(Orders, len(list))
+	for i := range list {
+		res[i] = convertOrder(&list[i])
 	}
-	side, err := jsonGetString(m["side"])
-	if err != nil {
-		return Order{}, err
-	}
-	ord_type, err := jsonGetString(m["ord_type"])
-	if err != nil {
-		return Order{}, err
-	}
-	price, err := jsonGetFloat(m["price"])
-	if err != nil {
-		return Order{}, err
-	}
-	avg_price, err := jsonGetFloat(m["avg_price"])
-	if err != nil {
-		return Order{}, err
-	}
-	state, err := jsonGetString(m["state"])
-	if err != nil {
-		return Order{}, err
-	}
-	market, err := jsonGetString(m["market"])
-	if err != nil {
-		return Order{}, err
-	}
-	created_at, err := jsonGetTimeFromText(m["created_at"])
-	if err != nil {
-		return Order{}, err
-	}
-	volume, err := jsonGetFloat(m["volume"])
-	if err != nil {
-		return Order{}, err
-	}
-	remaining_volume, err := jsonGetFloat(m["remaining_volume"])
-	if err != nil {
-		return Order{}, err
-	}
-	executed_volume, err := jsonGetFloat(m["executed_volume"])
-	if err != nil {
-		return Order{}, err
-	}
-	trades_count, err := jsonGetInt(m["trades_count"])
-	if err != nil {
+	return res
+}
+
+// Decode JSON object to Order struct.
+func decodeOrder(d *decoder, data []byte) (Order, error) {
+	var j jsonOrder
+	if err := d.decode(data, &j); err != nil {
 		return Order{}, err
 	}
+	return convertOrder(&j), nil
+}
+
+func convertOrder(j *jsonOrder) Order {
 	return Order{
-		ID:              id,
-		Side:            side,
-		OrdType:         ord_type,
-		Price:           price,
-		AvgPrice:        avg_price,
-		State:           state,
-		Market:          market,
-		CreatedAt:       created_at,
-		Volume:          volume,
-		RemainingVolume: remaining_volume,
-		ExecutedVolume:  executed_volume,
-		TradesCount:     trades_count,
-	}, nil
+		ID:              optInt(j.ID),
+		Side:            optString(j.Side),
+		OrdType:         optString(j.OrdType),
+		Price:           optFloat(j.Price),
+		AvgPrice:        optFloat(j.AvgPrice),
+		State:           optString(j.State),
+		Market:          optString(j.Market),
+		CreatedAt:       optTime(j.CreatedAt),
+		Volume:          optFloat(j.Volume),
+		RemainingVolume: optFloat(j.RemainingVolume),
+		ExecutedVolume:  optFloat(j.ExecutedVolume),
+		TradesCount:     optInt(j.TradesCount),
+		Extra:           j.Extra,
+	}
 }
 
-// Convert decoded JSON object to History list.
-func decodeHistory(v interface{}) (History, error) {
-	entries, err := jsonGetList(v)
-	if err != nil {
+// Decode JSON array to History list.
+func decodeHistory(d *decoder, data []byte) (History, error) {
+	var j []jsonHistoryEntry
+	if err := d.decode(data, &j); err != nil {
 		return nil, err
 	}
-	history := History{}
-	for _, v := range entries {
-		m, err := jsonGetMap(v)
-		if err != nil {
-			return nil, err
-		}
-		id, err := jsonGetInt(m["id"])
-		if err != nil {
-			return nil, err
-		}
-		price, err := jsonGetFloat(m["price"])
-		if err != nil {
-			return nil, err
-		}
-		volume, err := jsonGetFloat(m["volume"])
-		if err != nil {
-			return nil, err
-		}
-		funds, err := jsonGetFloat(m["funds"])
-		if err != nil {
-			return nil, err
-		}
-		market, err := jsonGetString(m["market"])
-		if err != nil {
-			return nil, err
+	history := make(History, len(j))
+	for i, e := range j {
+		history[i] = HistoryEntry{
+			ID:        optInt(e.ID),
+			Price:     optFloat(e.Price),
+			Volume:    optFloat(e.Volume),
+			Funds:     optFloat(e.Funds),
+			Market:    optString(e.Market),
+			CreatedAt: optTime(e.CreatedAt),
+			Extra:     e.Extra,
 		}
-		created_at, err := jsonGetTimeFromText(m["created_at"])
-		if err != nil {
-			return nil, err
-		}
-		history = append(history, HistoryEntry{
-			ID:        id,
-			Price:     price,
-			Volume:    volume,
-			Funds:     funds,
-			Market:    market,
-			CreatedAt: created_at,
-		})
 	}
 	return history, nil
 }
 
-// Convert decoded JSON to user info struct.
-func decodeUserInfo(v interface{}) (*UserInfo, error) {
-	m, err := jsonGetMap(v)
-	if err != nil {
+// Decode JSON object to user info struct.
+func decodeUserInfo(d *decoder, data []byte) (*UserInfo, error) {
+	var j jsonUserInfo
+	if err := d.decode(data, &j); err != nil {
 		return nil, err
 	}
-	email, err := jsonGetString(m["email"])
-	if err != nil {
-		return nil, err
+	info := &UserInfo{
+		Email:    optString(j.Email),
+		Accounts: []Account{},
+		Extra:    j.Extra,
 	}
-	activated, err := jsonGetBool(m["activated"])
-	if err != nil {
-		return nil, err
+	if j.Activated != nil {
+		info.Activated = *j.Activated
 	}
-	accList, err := jsonGetList(m["accounts"])
-	if err != nil {
-		return nil, err
-	}
-	accounts := []Account{}
-	for _, e := range accList {
-		m, err := jsonGetMap(e)
-		if err != nil {
-			return nil, err
-		}
-		currency, err := jsonGetString(m["currency"])
-		if err != nil {
-			return nil, err
-		}
-		balance, err := jsonGetFloat(m["balance"])
-		if err != nil {
-			return nil, err
-		}
-		locked, err := jsonGetFloat(m["locked"])
-		if err != nil {
-			return nil, err
-		}
-		accounts = append(accounts, Account{
-			Currency: currency,
-			Balance:  balance,
-			Locked:   locked,
+	for _, a := range j.Accounts {
+		info.Accounts = append(info.Accounts, Account{
+			Currency: optString(a.Currency),
+			Balance:  optFloat(a.Balance),
+			Locked:   optFloat(a.Locked),
+			Extra:    a.Extra,
 		})
 	}
-	return &UserInfo{
-		Email:     email,
-		Activated: activated,
-		Accounts:  accounts,
-	}, nil
+	return info, nil
 }
 
-func decodeUserTrades(v interface{}) (Trades, error) {
-	tradeList, err := jsonGetList(v)
-	if err != nil {
+// Decode JSON array to list of user deals.
+func decodeUserTrades(d *decoder, data []byte) (Trades, error) {
+	var j []jsonTrade
+	if err := d.decode(data, &j); err != nil {
 		return nil, err
 	}
-	res := Trades{}
-	for _, e := range tradeList {
-		m, err := jsonGetMap(e)
-		if err != nil {
-			return nil, err
-		}
-		id, err := jsonGetInt(m["id"])
-		if err != nil {
-			return nil, err
-		}
-		price, err := jsonGetFloat(m["price"])
-		if err != nil {
-			return nil, err
-		}
-		volume, err := jsonGetFloat(m["volume"])
-		if err != nil {
-			return nil, err
+	res := make(Trades, len(j))
+	for i, t := range j {
+		res[i] = Trade{
+			ID:        optInt(t.ID),
+			Price:     optFloat(t.Price),
+			Volume:    optFloat(t.Volume),
+			Funds:     optFloat(t.Funds),
+			Market:    optString(t.Market),
+			CreatedAt: optTime(t.CreatedAt),
+			Side:      optString(t.Side),
+			OrderID:   optInt(t.OrderID),
+			Extra:     t.Extra,
 		}
-		funds, err := jsonGetFloat(m["funds"])
-		if err != nil {
-			return nil, err
-		}
-		market, err := jsonGetString(m["market"])
-		if err != nil {
-			return nil, err
-		}
-		created_at, err := jsonGetTimeFromText(m["created_at"])
-		if err != nil {
-			return nil, err
-		}
-		side, err := jsonGetString(m["side"])
-		if err != nil {
-			return nil, err
-		}
-		res = append(res, Trade{
-			ID:        id,
-			Price:     price,
-			Volume:    volume,
-			Funds:     funds,
-			Market:    market,
-			CreatedAt: created_at,
-			Side:      side,
-		})
 	}
 	return res, nil
 }
 
-func decodeError(r io.Reader) (error, bool) {
-	j, err := DecodeJSON(r)
-	if err != nil {
-		return nil, false
-	}
-	m, err := jsonGetMap(j)
-	if err != nil {
-		return nil, false
-	}
-	m, err = jsonGetMap(m["error"])
-	if err != nil {
-		return nil, false
-	}
-	code, err := jsonGetInt(m["code"])
-	if err != nil {
-		return nil, false
-	}
-	msg, err := jsonGetString(m["message"])
-	if err != nil {
+// Decode exchange error response.
+func decodeError(data []byte) (*APIError, bool) {
+	var j jsonError
+	if (&decoder{}).decode(data, &j) != nil {
 		return nil, false
 	}
-	return fmt.Errorf("%d: %s", code, msg), true
+	return &APIError{
+		Code:    optInt(j.Error.Code),
+		Message: optString(j.Error.Message),
+	}, true
 }
@@ -0,0 +1,294 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testOrderJSON = `{"id": 12, "side": "sell", "ord_type": "limit",
+	"price": "150000.5", "avg_price": "0.0", "state": "wait",
+	"market": "btcuah", "created_at": "2018-01-02T03:04:05+02:00",
+	"volume": "0.5", "remaining_volume": "0.25",
+	"executed_volume": 0.25, "trades_count": 1, "new_field": [{}]}`
+
+func TestDecodeOrder(t *testing.T) {
+	o, err := decodeOrder(&decoder{}, []byte(testOrderJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Order{
+		ID:              12,
+		Side:            "sell",
+		OrdType:         "limit",
+		Price:           150000.5,
+		State:           OrderWait,
+		Market:          BTCUAH,
+		CreatedAt:       time.Date(2018, 1, 2, 1, 4, 5, 0, time.UTC),
+		Volume:          0.5,
+		RemainingVolume: 0.25,
+		ExecutedVolume:  0.25,
+		TradesCount:     1,
+		Extra:           map[string]json.RawMessage{"new_field": []byte("[{}]")},
+	}
+	if !o.CreatedAt.Equal(want.CreatedAt) {
+		t.Errorf("created_at %s, want %s", o.CreatedAt, want.CreatedAt)
+	}
+	o.CreatedAt = want.CreatedAt
+	if !reflect.DeepEqual(o, want) {
+		t.Errorf("got %+v\nwant %+v", o, want)
+	}
+}
+
+func TestDecodeStrings(t *testing.T) {
+	info, err := decodeUserInfo(&decoder{}, []byte(`{"email": "a\"\\\/б😀\n",
+		"activated": true, "accounts": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a\"\\/б😀\n"; info.Email != want {
+		t.Errorf("email %q, want %q", info.Email, want)
+	}
+	// invalid UTF-8 is replaced
+	info, err = decodeUserInfo(&decoder{}, []byte("{\"email\": \"a\xffb\",\n"+
+		`"activated": true, "accounts": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a\uFFFDb"; info.Email != want {
+		t.Errorf("email %q, want %q", info.Email, want)
+	}
+}
+
+func TestDecodeErrorPath(t *testing.T) {
+	order := func(price string) string {
+		return strings.Replace(testOrderJSON, `"150000.5"`, price, 1)
+	}
+	book := func(asks ...string) string {
+		return `{"bids": [], "asks": [` + strings.Join(asks, ",") + `]}`
+	}
+	for _, test := range []struct {
+		data string
+		err  string
+	}{
+		{book(order(`"abc"`)),
+			`json: asks[0].price: expected float but "abc" found`},
+		{book(testOrderJSON, testOrderJSON, order("{}")),
+			`json: asks[2].price: expected float but object found`},
+		{book(testOrderJSON, strings.Replace(testOrderJSON,
+			`"avg_price": "0.0",`, "", 1)),
+			`json: asks[1]: missing field "avg_price"`},
+		{book(testOrderJSON)[:100],
+			`json: unexpected end of JSON input at offset 100`},
+		{`[]`, `json: expected object but array found`},
+		{`{"asks": [], "bids": []} x`,
+			`json: invalid character 'x' after top-level value at offset 26`},
+	} {
+		_, err := decodeOrderBook(&decoder{}, []byte(test.data))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v, want %s", test.data, err, test.err)
+		}
+	}
+	_, err := decodeOrderBook(&decoder{}, []byte(book(order(`"abc"`))))
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		t.Errorf("got error %#v, want wrapped *json.UnmarshalTypeError", err)
+	}
+}
+
+// Order book with n asks and n bids as returned by the exchange.
+func benchOrderBook(n int) []byte {
+	var b strings.Builder
+	list := func(side string) {
+		b.WriteString("[")
+		for i := 0; i < n; i++ {
+			if 0 < i {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, `{"id":%d,"side":"%s","ord_type":"limit",`+
+				`"price":"%d.5","avg_price":"0.0","state":"wait",`+
+				`"market":"btcuah","created_at":"2018-01-02T03:04:05+02:00",`+
+				`"volume":"0.%d","remaining_volume":"0.%d",`+
+				`"executed_volume":"0.0","trades_count":0}`,
+				i, side, 150000+i, i+1, i+1)
+		}
+		b.WriteString("]")
+	}
+	b.WriteString(`{"asks":`)
+	list("sell")
+	b.WriteString(`,"bids":`)
+	list("buy")
+	b.WriteString("}")
+	return []byte(b.String())
+}
+
+func BenchmarkDecodeOrderBook(b *testing.B) {
+	data := benchOrderBook(500)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeOrderBook(&decoder{}, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Generic decoding into interface{} values which the previous
+// decoder did before walking the maps, for comparison.
+func BenchmarkDecodeOrderBookGeneric(b *testing.B) {
+	data := benchOrderBook(500)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.UseNumber()
+		var v interface{}
+		if err := decoder.Decode(&v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Order book with unknown field in each order, which is decoded
+// value by value.
+func BenchmarkDecodeOrderBookExtra(b *testing.B) {
+	data := bytes.ReplaceAll(benchOrderBook(500),
+		[]byte(`"trades_count":0`), []byte(`"trades_count":0,"fee":"0.0"`))
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeOrderBook(&decoder{}, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Plain encoding/json decoding without checking fields, for
+// comparison.
+func BenchmarkDecodeOrderBookReflect(b *testing.B) {
+	type order struct {
+		ID              int         `json:"id"`
+		Side            string      `json:"side"`
+		OrdType         string      `json:"ord_type"`
+		Price           json.Number `json:"price"`
+		AvgPrice        json.Number `json:"avg_price"`
+		State           string      `json:"state"`
+		Market          string      `json:"market"`
+		CreatedAt       string      `json:"created_at"`
+		Volume          json.Number `json:"volume"`
+		RemainingVolume json.Number `json:"remaining_volume"`
+		ExecutedVolume  json.Number `json:"executed_volume"`
+		TradesCount     int         `json:"trades_count"`
+	}
+	data := benchOrderBook(500)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var book struct {
+			Asks []order `json:"asks"`
+			Bids []order `json:"bids"`
+		}
+		if err := json.Unmarshal(data, &book); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeModes(t *testing.T) {
+	data := `{"asks": [` + strings.Replace(testOrderJSON,
+		`"avg_price": "0.0",`, `"avg_price": "x",`, 1) + `,
+		{"id": 13}], "bids": 5}`
+	decode := func(mode DecodeMode) (OrderBook, []*DecodeError, error) {
+		d := &decoder{mode: mode}
+		book, err := decodeOrderBook(d, []byte(data))
+		return book, d.warnings, err
+	}
+	_, _, err := decode(DecodeDefault)
+	if want := `json: asks[0].avg_price: expected float but "x" found`; err == nil || err.Error() != want {
+		t.Errorf("default: got error %v, want %s", err, want)
+	}
+	book, warnings, err := decode(DecodeLenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Asks) != 2 || book.Asks[0].Price != 150000.5 ||
+		book.Asks[1].ID != 13 || book.Bids != nil {
+		t.Errorf("lenient: got %+v", book)
+	}
+	var got []string
+	for _, w := range warnings {
+		got = append(got, w.Error())
+	}
+	want := []string{
+		`json: asks[0].avg_price: expected float but "x" found`,
+		`json: asks[1]: missing field "side"`,
+		`json: bids: expected array but 5 found`,
+	}
+	if len(got) != 12 || got[0] != want[0] || got[1] != want[1] ||
+		got[11] != want[2] {
+		t.Errorf("lenient warnings:\n%s", strings.Join(got, "\n"))
+	}
+
+	// strict mode rejects unknown fields
+	known := strings.Replace(testOrderJSON, `, "new_field": [{}]`, "", 1)
+	for _, test := range []struct {
+		data string
+		err  string
+	}{
+		{`[` + testOrderJSON + `]`, `json: [0].new_field: unknown field`},
+		{`[` + known + `]`, ""},
+		{`[` + strings.Replace(known, `"avg_price": "0.0",`, "", 1) +
+			`]`, `json: [0]: missing field "avg_price"`},
+	} {
+		_, err := decodeOrders(&decoder{mode: DecodeStrict}, []byte(test.data))
+		if err == nil && test.err != "" || err != nil && err.Error() != test.err {
+			t.Errorf("strict: got error %v, want %q", err, test.err)
+		}
+	}
+}
+
+// Market orders have no price and trades of other users have no
+// order_id, which strict mode accepts.
+func TestDecodeStrictOptional(t *testing.T) {
+	known := strings.Replace(testOrderJSON, `, "new_field": [{}]`, "", 1)
+	market := strings.Replace(known, `"ord_type": "limit"`, `"ord_type": "market"`, 1)
+	orders := `[` + strings.Replace(market, `"150000.5"`, "null", 1) + `,` +
+		strings.Replace(market, `"price": "150000.5",`, "", 1) + `]`
+	d := &decoder{mode: DecodeStrict}
+	list, err := decodeOrders(d, []byte(orders))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Price != 0 || list[1].Price != 0 ||
+		list[1].OrdType != "market" {
+		t.Errorf("got orders %+v", list)
+	}
+	trades, err := decodeUserTrades(d, []byte(`[{"id": 1, "price": "150000",
+		"volume": "0.1", "funds": "15000", "market": "btcuah",
+		"created_at": "2018-01-02T03:04:05+02:00", "side": "buy"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 1 || trades[0].OrderID != 0 || trades[0].Funds != 15000 {
+		t.Errorf("got trades %+v", trades)
+	}
+}
@@ -0,0 +1,573 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Execution algorithms
+const (
+	// Equal slices evenly distributed over time
+	AlgoTWAP = "twap"
+	// Only small part of the volume is shown in the book at a time
+	AlgoIceberg = "iceberg"
+	// Slices follow historical trade volume profile
+	AlgoVWAP = "vwap"
+)
+
+// Execution states
+const (
+	ExecRunning   = "running"
+	ExecDone      = "done"
+	ExecCancelled = "cancelled"
+	ExecFailed    = "failed"
+)
+
+// Default interval between child order state checks
+const DefaultExecPollInterval = 5 * time.Second
+
+// Iceberg child orders cancelled by the exchange are placed again
+// with growing delay, starting at the poll interval and limited by
+// icebergMaxBackoff. The execution fails after icebergReplacements
+// consecutive cancellations without any volume executed.
+const (
+	icebergReplacements = 5
+	icebergMaxBackoff   = time.Minute
+)
+
+// Parent order execution parameters.
+type ExecutionParams struct {
+	// AlgoTWAP, AlgoIceberg or AlgoVWAP
+	Algo string
+	// Market identifier
+	Market string
+	// "buy" or "sell"
+	Side string
+	// Total volume to trade
+	Volume float64
+	// Worst acceptable price. Child orders never cross it. Required
+	// for iceberg, optional for TWAP and VWAP.
+	LimitPrice float64
+	// Total execution time for TWAP and VWAP. Optional time limit
+	// for iceberg.
+	Duration time.Duration
+	// Number of slices for TWAP and VWAP
+	Slices int
+	// Visible volume of iceberg child orders
+	VisibleVolume float64
+	// How long TWAP and VWAP child order stays in the book. Unfilled
+	// rest moves to the next slice. Zero means half of the slice.
+	ChildTimeout time.Duration
+	// Trade history for VWAP volume profile. If not set, the history
+	// is requested with GetTradeHistory.
+	History History
+	// Interval between child order state checks. Default is
+	// DefaultExecPollInterval.
+	PollInterval time.Duration
+}
+
+func (p ExecutionParams) validate() error {
+	if p.Side != "buy" && p.Side != "sell" {
+		return fmt.Errorf("invalid side: %#v", p.Side)
+	}
+	if p.Market == "" {
+		return errors.New("market is not set")
+	}
+	if p.Volume <= 0 {
+		return errors.New("volume must be positive")
+	}
+	if p.LimitPrice < 0 {
+		return errors.New("limit price must not be negative")
+	}
+	switch p.Algo {
+	case AlgoTWAP, AlgoVWAP:
+		if p.Duration <= 0 {
+			return errors.New("duration must be positive")
+		}
+		if p.Slices <= 0 {
+			return errors.New("slices count must be positive")
+		}
+	case AlgoIceberg:
+		if p.LimitPrice == 0 {
+			return errors.New("iceberg requires limit price")
+		}
+		if p.VisibleVolume <= 0 {
+			return errors.New("visible volume must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown execution algorithm: %#v", p.Algo)
+	}
+	return nil
+}
+
+// Execution progress report.
+type ExecutionProgress struct {
+	// Algorithm name
+	Algo string `json:"algo"`
+	// One of Exec* states
+	State string `json:"state"`
+	// Total volume to trade
+	Volume float64 `json:"volume"`
+	// Executed volume
+	Executed float64 `json:"executed"`
+	// Funds spent (for buys) or received (for sells)
+	Funds float64 `json:"funds"`
+	// Average execution price
+	AvgPrice float64 `json:"avg_price"`
+	// Mid price of the order book at execution start
+	ArrivalPrice float64 `json:"arrival_price"`
+	// Relative execution cost against the arrival price. Positive
+	// value means the average price is worse than the arrival one.
+	Slippage float64 `json:"slippage"`
+	// Number of child orders placed
+	ChildOrders int `json:"child_orders"`
+	// Execution start time
+	Started time.Time `json:"started"`
+	// Last update time
+	Updated time.Time `json:"updated"`
+	// Error description for failed execution
+	Error string `json:"error"`
+}
+
+// Parent order execution. Created with StartExecution.
+type Execution struct {
+	params       ExecutionParams
+	client       *Client
+	poll         time.Duration
+	onProgress   func(ExecutionProgress)
+	cancel       context.CancelFunc
+	done         chan struct{}
+	lock         sync.Mutex
+	state        string
+	err          error
+	arrival      float64
+	started      time.Time
+	updated      time.Time
+	children     []Order
+	childIndices map[int]int
+}
+
+// Start parent order execution in background. Progress hook, if
+// set, is called after every child order update. Cancelling the
+// context has the same effect as calling Cancel.
+func StartExecution(ctx context.Context, client *Client, params ExecutionParams,
+	onProgress func(ExecutionProgress)) (*Execution, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	obook, err := client.GetOrderBook(params.Market)
+	if err != nil {
+		return nil, fmt.Errorf("get order book: %s", err)
+	}
+	arrival, ok := obook.MidPrice()
+	if !ok {
+		return nil, fmt.Errorf("%s order book is empty", params.Market)
+	}
+	poll := params.PollInterval
+	if poll <= 0 {
+		poll = DefaultExecPollInterval
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	e := &Execution{
+		params:       params,
+		client:       client,
+		poll:         poll,
+		onProgress:   onProgress,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		state:        ExecRunning,
+		arrival:      arrival,
+		started:      time.Now(),
+		updated:      time.Now(),
+		childIndices: map[int]int{},
+	}
+	go e.run(ctx)
+	return e, nil
+}
+
+// Stop the execution. Working child order is cancelled.
+func (e *Execution) Cancel() {
+	e.cancel()
+}
+
+// Wait for the execution to finish and return final report.
+func (e *Execution) Wait() ExecutionProgress {
+	<-e.done
+	return e.Progress()
+}
+
+// Return current execution progress.
+func (e *Execution) Progress() ExecutionProgress {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	p := ExecutionProgress{
+		Algo:         e.params.Algo,
+		State:        e.state,
+		Volume:       e.params.Volume,
+		ArrivalPrice: e.arrival,
+		ChildOrders:  len(e.children),
+		Started:      e.started,
+		Updated:      e.updated,
+	}
+	for _, o := range e.children {
+		price := o.AvgPrice
+		if price == 0 {
+			price = o.Price
+		}
+		p.Executed += o.ExecutedVolume
+		p.Funds += o.ExecutedVolume * price
+	}
+	if 0 < p.Executed {
+		p.AvgPrice = p.Funds / p.Executed
+		p.Slippage = (p.AvgPrice - p.ArrivalPrice) / p.ArrivalPrice
+		if e.params.Side == "sell" {
+			p.Slippage = -p.Slippage
+		}
+	}
+	if e.err != nil {
+		p.Error = e.err.Error()
+	}
+	return p
+}
+
+func (e *Execution) run(ctx context.Context) {
+	defer close(e.done)
+	defer e.cancel()
+	var err error
+	switch e.params.Algo {
+	case AlgoTWAP:
+		err = e.runSlices(ctx, nil)
+	case AlgoVWAP:
+		err = e.runVWAP(ctx)
+	case AlgoIceberg:
+		err = e.runIceberg(ctx)
+	}
+	e.lock.Lock()
+	switch {
+	case err == context.Canceled:
+		e.state = ExecCancelled
+	case err == context.DeadlineExceeded && e.params.Algo == AlgoIceberg:
+		// time limit of the iceberg is reached
+		e.state = ExecDone
+	case err != nil:
+		e.state = ExecFailed
+		e.err = err
+	default:
+		e.state = ExecDone
+	}
+	e.updated = time.Now()
+	e.lock.Unlock()
+	e.notify()
+}
+
+func (e *Execution) runVWAP(ctx context.Context) error {
+	history := e.params.History
+	if history == nil {
+		h, err := e.client.GetTradeHistory(e.params.Market)
+		if err != nil {
+			return fmt.Errorf("get trade history: %s", err)
+		}
+		history = h
+	}
+	slice := e.params.Duration / time.Duration(e.params.Slices)
+	weights := VolumeProfile(history, e.started, slice, e.params.Slices)
+	return e.runSlices(ctx, weights)
+}
+
+// Execute the volume in time slices. Slice sizes are proportional
+// to the weights, equal if weights are nil. If a slice is not
+// filled completely, the rest is added to the next one.
+func (e *Execution) runSlices(ctx context.Context, weights []float64) error {
+	n := e.params.Slices
+	if weights == nil {
+		weights = make([]float64, n)
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	slice := e.params.Duration / time.Duration(n)
+	timeout := e.params.ChildTimeout
+	if timeout <= 0 {
+		timeout = slice / 2
+	}
+	var target float64
+	for i := 0; i < n; i++ {
+		if i != 0 {
+			wait := time.Until(e.started.Add(time.Duration(i) * slice))
+			if err := sleep(ctx, wait); err != nil {
+				return err
+			}
+		}
+		target += e.params.Volume * weights[i] / total
+		if i == n-1 {
+			target = e.params.Volume
+		}
+		volume := target - e.executed()
+		if volume <= 0 {
+			continue
+		}
+		if err := e.runSlice(ctx, volume, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Execute the slice volume with child order priced to sweep the
+// order book. The slice is skipped if the order book is not
+// available.
+func (e *Execution) runSlice(ctx context.Context, volume float64, timeout time.Duration) error {
+	ctx, span := StartSpan(ctx, "ExecutionSlice", "algo", e.params.Algo,
+		"market", e.params.Market, "side", e.params.Side,
+		"volume", volume)
+	obook, err := e.client.WithContext(ctx).GetOrderBook(e.params.Market)
+	if err != nil {
+		debugLog("execution: get order book: %s", err)
+		span.Finish(err)
+		return nil
+	}
+	price, ok := obook.SweepPrice(e.params.Side, volume)
+	if !ok {
+		debugLog("execution: %s order book is empty", e.params.Market)
+		span.Finish(errors.New("order book is empty"))
+		return nil
+	}
+	price = e.limit(price)
+	span.SetAttrs("price", price)
+	_, err = e.runChild(ctx, volume, price, timeout)
+	span.Finish(err)
+	return err
+}
+
+// Show only visible volume in the book, place next child order
+// when the previous one is filled.
+func (e *Execution) runIceberg(ctx context.Context) error {
+	if 0 < e.params.Duration {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.params.Duration)
+		defer cancel()
+	}
+	var cancelled int
+	for {
+		rest := e.params.Volume - e.executed()
+		if rest <= 0 {
+			return nil
+		}
+		volume := e.params.VisibleVolume
+		if rest < volume {
+			volume = rest
+		}
+		cctx, span := StartSpan(ctx, "ExecutionSlice",
+			"algo", e.params.Algo, "market", e.params.Market,
+			"side", e.params.Side, "volume", volume,
+			"price", e.params.LimitPrice)
+		order, err := e.runChild(cctx, volume, e.params.LimitPrice, 0)
+		span.Finish(err)
+		if err != nil {
+			return err
+		}
+		switch {
+		case order.State != OrderCancel:
+			cancelled = 0
+			continue
+		case 0 < order.ExecutedVolume:
+			cancelled = 0
+		default:
+			cancelled++
+		}
+		if icebergReplacements <= cancelled {
+			return fmt.Errorf("%d child orders in a row were "+
+				"cancelled by the exchange", cancelled)
+		}
+		backoff := e.poll
+		for i := 1; i < cancelled && backoff < icebergMaxBackoff; i++ {
+			backoff *= 2
+		}
+		if icebergMaxBackoff < backoff {
+			backoff = icebergMaxBackoff
+		}
+		debugLog("execution: order %d is cancelled by the exchange, "+
+			"placing the next one in %s", order.ID, backoff)
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+	}
+}
+
+// Do not let the price cross the parent order limit price.
+func (e *Execution) limit(price float64) float64 {
+	p := e.params
+	if p.LimitPrice == 0 {
+		return price
+	}
+	if (p.Side == "buy" && p.LimitPrice < price) ||
+		(p.Side == "sell" && price < p.LimitPrice) {
+		return p.LimitPrice
+	}
+	return price
+}
+
+// Place child order and watch it until it is finished. The order
+// is cancelled after timeout (if set) or when the context is done.
+// Return the last known order state.
+func (e *Execution) runChild(ctx context.Context, volume, price float64, timeout time.Duration) (Order, error) {
+	client := e.client.WithContext(ctx)
+	order, err := client.NewOrder(e.params.Market,
+		e.params.Side, volume, price)
+	if err != nil {
+		return order, fmt.Errorf("new order: %s", err)
+	}
+	SpanFromContext(ctx).SetAttrs("order_id", order.ID)
+	e.update(order)
+	var expired <-chan time.Time
+	if 0 < timeout {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	ticker := time.NewTicker(e.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// the order must be cancelled even though the
+			// context is done
+			e.cancelChild(e.client, order.ID)
+			return order, ctx.Err()
+		case <-expired:
+			e.cancelChild(client, order.ID)
+			return order, nil
+		case <-ticker.C:
+		}
+		o, err := client.GetOrder(order.ID)
+		if err != nil {
+			debugLog("execution: get order %d: %s", order.ID, err)
+			continue
+		}
+		e.update(o)
+		order = o
+		if o.State != OrderWait {
+			return order, nil
+		}
+	}
+}
+
+// Cancel child order and wait for the cancellation to complete,
+// so executed volume is known for sure.
+func (e *Execution) cancelChild(client *Client, id int) {
+	order, err := client.CancelOrder(id)
+	if err != nil {
+		debugLog("execution: cancel order %d: %s", id, err)
+	} else {
+		e.update(order)
+	}
+	for i := 0; i < 10; i++ {
+		order, err := client.GetOrder(id)
+		if err == nil {
+			e.update(order)
+			if order.State != OrderWait {
+				return
+			}
+		}
+		time.Sleep(e.poll / 5)
+	}
+	debugLog("execution: order %d is still not cancelled", id)
+}
+
+// Save latest child order state.
+func (e *Execution) update(order Order) {
+	e.lock.Lock()
+	if i, ok := e.childIndices[order.ID]; ok {
+		e.children[i] = order
+	} else {
+		e.childIndices[order.ID] = len(e.children)
+		e.children = append(e.children, order)
+	}
+	e.updated = time.Now()
+	e.lock.Unlock()
+	e.notify()
+}
+
+func (e *Execution) executed() float64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var sum float64
+	for _, o := range e.children {
+		sum += o.ExecutedVolume
+	}
+	return sum
+}
+
+func (e *Execution) notify() {
+	if e.onProgress != nil {
+		e.onProgress(e.Progress())
+	}
+}
+
+// Build relative trade volume profile for n consecutive time slices
+// starting at start. Volume of each slice is taken from trades made
+// at the same time of day in the history. If the history has no
+// trades for any of the slices, uniform profile is returned.
+func VolumeProfile(h History, start time.Time, slice time.Duration, n int) []float64 {
+	if slice < time.Minute {
+		slice = time.Minute
+	}
+	bucket := func(t time.Time) int64 {
+		t = t.In(start.Location())
+		y, m, d := t.Date()
+		midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+		return int64(t.Sub(midnight) / slice)
+	}
+	volumes := map[int64]float64{}
+	for _, e := range h {
+		volumes[bucket(e.CreatedAt)] += e.Volume
+	}
+	res := make([]float64, n)
+	var total float64
+	for i := range res {
+		res[i] = volumes[bucket(start.Add(time.Duration(i)*slice))]
+		total += res[i]
+	}
+	if total == 0 {
+		for i := range res {
+			res[i] = 1
+		}
+	}
+	return res
+}
+
+// Sleep for duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
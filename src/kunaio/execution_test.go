@@ -0,0 +1,277 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Fake exchange for execution tests with 100 BTC ask at 41. Child
+// orders are filled for the fill part of their volume unless dropped
+// returns true for their number (counting from 1): these are
+// cancelled by the exchange unfilled.
+type execServer struct {
+	*fakeserver.Server
+	fill    float64
+	dropped func(n int) bool
+	lock    sync.Mutex
+	volumes []float64
+	// cancel the order on the next GetOrder call
+	drop bool
+}
+
+func (x *execServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	x.lock.Lock()
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/api/v2/orders":
+		volume, _ := strconv.ParseFloat(r.FormValue("volume"), 64)
+		price, _ := strconv.ParseFloat(r.FormValue("price"), 64)
+		x.volumes = append(x.volumes, math.Round(volume*1e6)/1e6)
+		if x.dropped != nil && x.dropped(len(x.volumes)) {
+			x.drop = true
+			break
+		}
+		side := "buy"
+		if r.FormValue("side") == "buy" {
+			side = "sell"
+		}
+		x.SeedOrder(kunaio.BTCUAH, side, volume*x.fill, price)
+	case r.URL.Path == "/api/v2/order" && x.drop:
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		x.CancelOrder(id)
+		x.drop = false
+	}
+	x.lock.Unlock()
+	x.Server.ServeHTTP(w, r)
+}
+
+// Return volumes of placed child orders.
+func (x *execServer) childVolumes() []float64 {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return append([]float64(nil), x.volumes...)
+}
+
+// Start execServer and point the package at it.
+func startExec(t *testing.T, x *execServer) func() {
+	t.Helper()
+	x.Server = fakeserver.New()
+	x.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"uah": 1000, "btc": 10})
+	if _, err := x.SeedOrder(kunaio.BTCUAH, "sell", 100, 41); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(x)
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	return func() {
+		kunaio.SetBaseURL(old)
+		ts.Close()
+	}
+}
+
+// Return trade history with 1:3:0:4 volume profile of the minutes
+// starting with the current one. VolumeProfile makes slices at least
+// one minute long, so the execution must start within the minute.
+func minuteProfile() kunaio.History {
+	now := time.Now()
+	next := now.Truncate(time.Minute).Add(time.Minute)
+	if next.Sub(now) < time.Second {
+		time.Sleep(next.Sub(now))
+	}
+	start := time.Now().Truncate(time.Minute)
+	return kunaio.History{
+		{Volume: 1, CreatedAt: start.Add(30 * time.Second)},
+		{Volume: 2, CreatedAt: start.Add(90 * time.Second)},
+		// the same time of another day
+		{Volume: 1, CreatedAt: start.Add(-24*time.Hour + 90*time.Second)},
+		{Volume: 4, CreatedAt: start.Add(210 * time.Second)},
+	}
+}
+
+func TestExecutionSlices(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		algo   string
+		slices int
+		fill   float64
+		// use minuteProfile instead of trades of the exchange
+		history bool
+		volumes []float64
+	}{
+		{name: "twap", algo: kunaio.AlgoTWAP, slices: 4, fill: 1,
+			volumes: []float64{2, 2, 2, 2}},
+		{name: "twap partial fills", algo: kunaio.AlgoTWAP, slices: 4,
+			fill:    0.5,
+			volumes: []float64{2, 3, 3.5, 3.75}},
+		{name: "vwap", algo: kunaio.AlgoVWAP, slices: 4, fill: 1,
+			history: true,
+			// 1:3:0:4, empty slice is skipped
+			volumes: []float64{1, 3, 4}},
+		{name: "vwap partial fills", algo: kunaio.AlgoVWAP, slices: 4,
+			fill: 0.5, history: true,
+			volumes: []float64{1, 3.5, 1.75, 4.875}},
+		{name: "vwap without trades", algo: kunaio.AlgoVWAP, slices: 2,
+			fill: 1, volumes: []float64{4, 4}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			x := &execServer{fill: c.fill}
+			defer startExec(t, x)()
+			var history kunaio.History
+			if c.history {
+				history = minuteProfile()
+			}
+			// the limit keeps child orders off the standing ask
+			e, err := kunaio.StartExecution(context.Background(),
+				kunaio.NewClient("ak", "sk"), kunaio.ExecutionParams{
+					Algo: c.algo, Market: kunaio.BTCUAH,
+					Side: "buy", Volume: 8, LimitPrice: 40,
+					Duration: 4 * time.Millisecond,
+					Slices:   c.slices, History: history,
+					ChildTimeout: 5 * time.Millisecond,
+					PollInterval: time.Millisecond}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := e.Wait()
+			if p.State != kunaio.ExecDone {
+				t.Fatalf("state %s: %s", p.State, p.Error)
+			}
+			if got := x.childVolumes(); !reflect.DeepEqual(got, c.volumes) {
+				t.Errorf("child volumes %v, want %v", got, c.volumes)
+			}
+		})
+	}
+}
+
+func TestExecutionIceberg(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		dropped func(n int) bool
+		state   string
+		orders  int
+		// minimum duration of backoffs
+		backoff time.Duration
+		err     string
+	}{
+		{name: "filled", state: kunaio.ExecDone, orders: 3},
+		{name: "replaced",
+			dropped: func(n int) bool { return n == 2 || n == 3 },
+			state:   kunaio.ExecDone, orders: 5, backoff: 3 * time.Millisecond},
+		{name: "always cancelled",
+			dropped: func(int) bool { return true },
+			state:   kunaio.ExecFailed, orders: 5,
+			backoff: 15 * time.Millisecond,
+			err:     "5 child orders in a row were cancelled by the exchange"},
+		{name: "filled between cancellations",
+			dropped: func(n int) bool { return n != 1 && n%5 != 1 },
+			state:   kunaio.ExecDone, orders: 11, backoff: 30 * time.Millisecond},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			x := &execServer{fill: 1, dropped: c.dropped}
+			defer startExec(t, x)()
+			started := time.Now()
+			e, err := kunaio.StartExecution(context.Background(),
+				kunaio.NewClient("ak", "sk"), kunaio.ExecutionParams{
+					Algo: kunaio.AlgoIceberg, Market: kunaio.BTCUAH,
+					Side: "sell", Volume: 2.5, LimitPrice: 40,
+					VisibleVolume: 1,
+					PollInterval:  time.Millisecond}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := e.Wait()
+			if p.State != c.state || p.Error != c.err {
+				t.Fatalf("state %s (%q), want %s (%q)",
+					p.State, p.Error, c.state, c.err)
+			}
+			if got := x.childVolumes(); len(got) != c.orders {
+				t.Errorf("%d child orders, want %d: %v",
+					len(got), c.orders, got)
+			}
+			if elapsed := time.Since(started); elapsed < c.backoff {
+				t.Errorf("finished in %s, want at least %s",
+					elapsed, c.backoff)
+			}
+		})
+	}
+}
+
+func TestVolumeProfile(t *testing.T) {
+	loc := time.FixedZone("EET", 2*60*60)
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, loc)
+	at := func(day int, hm string) time.Time {
+		var h, m int
+		fmt.Sscanf(hm, "%d:%d", &h, &m)
+		return time.Date(2024, 2, day, h, m, 0, 0, loc)
+	}
+	history := kunaio.History{
+		{Volume: 1, CreatedAt: at(28, "10:05")},
+		{Volume: 2, CreatedAt: at(29, "10:15")},
+		{Volume: 3, CreatedAt: at(29, "10:20")},
+		{Volume: 4, CreatedAt: at(27, "10:59")},
+		// other time of day
+		{Volume: 100, CreatedAt: at(29, "09:59")},
+		{Volume: 100, CreatedAt: at(29, "11:00")},
+		// 10:30 in UTC+2
+		{Volume: 5, CreatedAt: at(29, "10:30").UTC()},
+	}
+	for _, c := range []struct {
+		name    string
+		history kunaio.History
+		slice   time.Duration
+		n       int
+		want    []float64
+	}{
+		{name: "quarters", history: history,
+			slice: 15 * time.Minute, n: 4,
+			want: []float64{1, 5, 5, 4}},
+		{name: "halves", history: history,
+			slice: 30 * time.Minute, n: 2,
+			want: []float64{6, 9}},
+		{name: "empty slices", history: history,
+			slice: 10 * time.Minute, n: 3,
+			want: []float64{1, 2, 3}},
+		{name: "no trades in range", history: history,
+			slice: time.Hour, n: 1, want: []float64{15}},
+		{name: "empty history", slice: time.Minute, n: 3,
+			want: []float64{1, 1, 1}},
+		{name: "short slice", history: kunaio.History{
+			{Volume: 1, CreatedAt: start.Add(10 * time.Second)},
+			{Volume: 2, CreatedAt: start.Add(70 * time.Second)}},
+			slice: time.Second, n: 2,
+			// slices are at least one minute long
+			want: []float64{1, 2}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got := kunaio.VolumeProfile(c.history, start, c.slice, c.n)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -14,21 +14,11 @@
 
 package kunaio
 
-import (
-	"log"
-	"os"
-)
-
-var (
-	gDebug bool
-)
-
-func init() {
-	gDebug = os.Getenv("KUNAIO_DEBUG") != ""
-}
-
-func debugLog(format string, args ...interface{}) {
-	if gDebug {
-		log.Printf("DEBUG: "+format, args...)
-	}
+// Replace the default tonce source with a fresh one, so that tonces
+// issued for a skewed clock do not leak into other tests. Returns
+// function restoring the previous source.
+func ResetDefaultNonce() func() {
+	old := gNonce
+	gNonce = &MonotonicNonce{}
+	return func() { gNonce = old }
 }
@@ -0,0 +1,902 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakeserver implements in-memory Kuna.io API v2 server for
+// integration testing. The Server is a http.Handler, so it can be
+// started with httptest.NewServer or served by net/http directly:
+//
+//	s := fakeserver.New()
+//	s.AddAccount("akey", "skey", "user@example.com",
+//	    map[string]float64{"uah": 100000})
+//	s.SeedOrder(kunaio.BTCUAH, "sell", 1, 150000)
+//	ts := httptest.NewServer(s)
+//	defer ts.Close()
+//	kunaio.SetBaseURL(ts.URL)
+//
+// Private requests are authenticated exactly as the real exchange
+// does: the access key must exist, the tonce must be fresh and not
+// reused, and the HMAC-SHA256 signature must match. Orders are
+// matched against each other, so balances, order states and trades
+// change as they would on the exchange (without fees).
+package fakeserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kunaio"
+)
+
+const (
+	// Access key of the internal account owning seeded orders
+	MakerAccessKey = "fakeserver-maker"
+	// Allowed difference between tonce and server time
+	TonceWindow = 30 * time.Second
+	// Layout of time fields
+	timeLayout = "2006-01-02T15:04:05Z"
+	// Volumes below this are treated as zero
+	epsilon = 1e-9
+)
+
+// Fault injection settings. Probabilities are in [0, 1] range.
+type Faults struct {
+	// Delay before every response
+	Latency time.Duration
+	// Random extra delay in [0, Jitter) range
+	Jitter time.Duration
+	// Probability of "500 Internal Server Error" or
+	// "503 Service Unavailable" response
+	ErrorRate float64
+	// Probability of truncated JSON in 200 response
+	MalformedRate float64
+	// Max requests per second. Zero means no limit. Excess
+	// requests get "429 Too Many Requests" response.
+	RateLimit int
+}
+
+type balance struct {
+	balance float64
+	locked  float64
+}
+
+type account struct {
+	accessKey string
+	secretKey string
+	email     string
+	balances  map[string]*balance
+	tonces    map[int64]bool
+}
+
+func (a *account) get(currency string) *balance {
+	b, ok := a.balances[currency]
+	if !ok {
+		b = &balance{}
+		a.balances[currency] = b
+	}
+	return b
+}
+
+type order struct {
+	id          int
+	account     *account
+	market      string
+	side        string
+	ordType     string
+	price       float64
+	volume      float64
+	remaining   float64
+	executed    float64
+	funds       float64
+	state       string
+	createdAt   time.Time
+	tradesCount int
+	// amount of currency still locked by the order
+	locked float64
+}
+
+type trade struct {
+	id        int
+	market    string
+	price     float64
+	volume    float64
+	createdAt time.Time
+	bid       *order
+	ask       *order
+	// taker side
+	side string
+}
+
+type book struct {
+	// ascending price, then time
+	asks []*order
+	// descending price, then time
+	bids []*order
+}
+
+// Fake Kuna.io API server.
+type Server struct {
+	// Check tonce freshness and uniqueness, as the real exchange
+	// does. Enabled by New.
+	CheckTonce bool
+	// Time source. Default is time.Now.
+	Now         func() time.Time
+	lock        sync.Mutex
+	accounts    map[string]*account
+	books       map[string]*book
+	orders      map[int]*order
+	trades      []*trade
+	nextOrderID int
+	nextTradeID int
+	faults      Faults
+	rnd         *rand.Rand
+	// rate limiter state
+	window   int64
+	requests int
+}
+
+// Create new server with all supported markets and the maker
+// account.
+func New() *Server {
+	s := &Server{
+		CheckTonce: true,
+		Now:        time.Now,
+		accounts:   map[string]*account{},
+		books:      map[string]*book{},
+		orders:     map[int]*order{},
+		rnd:        rand.New(rand.NewSource(1)),
+	}
+	for _, m := range kunaio.SupportedMarkets() {
+		s.books[m] = &book{}
+	}
+	s.AddAccount(MakerAccessKey, MakerAccessKey, "maker@fakeserver", nil)
+	return s
+}
+
+// Change fault injection settings.
+func (s *Server) SetFaults(f Faults) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = f
+}
+
+// Seed random generator used for fault injection.
+func (s *Server) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rnd = rand.New(rand.NewSource(seed))
+}
+
+// Add user account with initial balances.
+func (s *Server) AddAccount(accessKey, secretKey, email string, balances map[string]float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a := &account{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		email:     email,
+		balances:  map[string]*balance{},
+		tonces:    map[int64]bool{},
+	}
+	for currency, amount := range balances {
+		a.get(currency).balance = amount
+	}
+	s.accounts[accessKey] = a
+}
+
+// Return available and locked account balance.
+func (s *Server) Balance(accessKey, currency string) (float64, float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.accounts[accessKey]
+	if !ok {
+		return 0, 0
+	}
+	b := a.get(currency)
+	return b.balance, b.locked
+}
+
+// Place limit order on behalf of the maker account, which has
+// unlimited funds. Used to provide liquidity. Returns order ID.
+func (s *Server) SeedOrder(market, side string, volume, price float64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	maker := s.accounts[MakerAccessKey]
+	base, quote := currencies(market)
+	if side == "buy" {
+		maker.get(quote).balance += volume * price
+	} else {
+		maker.get(base).balance += volume
+	}
+	o, err := s.newOrder(maker, market, side, "limit", volume, price)
+	if err != nil {
+		return 0, err
+	}
+	return o.id, nil
+}
+
+// Split market name into base and quote currencies.
+func currencies(market string) (string, string) {
+	if len(market) < 6 {
+		return market, ""
+	}
+	return market[:len(market)-3], market[len(market)-3:]
+}
+
+// API error with Kuna.io error code.
+type apiError struct {
+	status  int
+	code    int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func errorf(status, code int, format string, args ...interface{}) *apiError {
+	return &apiError{status, code, fmt.Sprintf(format, args...)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	f := s.faults
+	delay := f.Latency
+	if 0 < f.Jitter {
+		delay += time.Duration(s.rnd.Int63n(int64(f.Jitter)))
+	}
+	limited := s.rateLimited()
+	failed := 0 < f.ErrorRate && s.rnd.Float64() < f.ErrorRate
+	failStatus := http.StatusInternalServerError
+	if s.rnd.Intn(2) == 0 {
+		failStatus = http.StatusServiceUnavailable
+	}
+	malformed := 0 < f.MalformedRate && s.rnd.Float64() < f.MalformedRate
+	s.lock.Unlock()
+	if 0 < delay {
+		time.Sleep(delay)
+	}
+	switch {
+	case limited:
+		writeError(w, errorf(http.StatusTooManyRequests, 3001,
+			"Too many requests"))
+		return
+	case failed:
+		http.Error(w, http.StatusText(failStatus), failStatus)
+		return
+	}
+	v, err := s.handle(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data, _ := json.Marshal(v)
+	if malformed {
+		data = data[:len(data)/2]
+		if json.Valid(data) {
+			// truncated number is still valid JSON
+			data = append([]byte{'"'}, data...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Count the request against the rate limit. Must be called with
+// the lock held.
+func (s *Server) rateLimited() bool {
+	if s.faults.RateLimit <= 0 {
+		return false
+	}
+	now := s.Now().Unix()
+	if now != s.window {
+		s.window = now
+		s.requests = 0
+	}
+	s.requests++
+	return s.faults.RateLimit < s.requests
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = errorf(http.StatusInternalServerError, 1000, "%s", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    e.code,
+			"message": e.message,
+		},
+	})
+}
+
+func (s *Server) handle(r *http.Request) (interface{}, error) {
+	path := r.URL.Path
+	if err := r.ParseForm(); err != nil {
+		return nil, errorf(http.StatusBadRequest, 1001, "%s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case r.Method == "GET" && path == "/api/v2/timestamp":
+		return s.Now().Unix(), nil
+	case r.Method == "GET" && strings.HasPrefix(path, "/api/v2/tickers/"):
+		return s.ticker(strings.TrimPrefix(path, "/api/v2/tickers/"))
+	case r.Method == "GET" && path == "/api/v2/order_book":
+		return s.orderBook(r.Form.Get("market"))
+	case r.Method == "GET" && path == "/api/v2/trades":
+		return s.publicTrades(r.Form.Get("market"))
+	}
+	a, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case r.Method == "GET" && path == "/api/v2/members/me":
+		return s.userInfo(a), nil
+	case r.Method == "GET" && path == "/api/v2/orders":
+		return s.userOrders(a, r.Form.Get("market"))
+	case r.Method == "POST" && path == "/api/v2/orders":
+		return s.createOrder(a, r.Form)
+	case r.Method == "GET" && path == "/api/v2/order":
+		o, err := s.userOrder(a, r.Form.Get("id"))
+		if err != nil {
+			return nil, err
+		}
+		return orderJSON(o), nil
+	case r.Method == "POST" && path == "/api/v2/order/delete":
+		return s.cancelOrder(a, r.Form.Get("id"))
+	case r.Method == "GET" && path == "/api/v2/trades/my":
+		return s.userTrades(a, r.Form.Get("market"))
+	}
+	return nil, errorf(http.StatusNotFound, 1002, "%s %s not found",
+		r.Method, path)
+}
+
+// Check access key, tonce and signature of private request.
+func (s *Server) authenticate(r *http.Request) (*account, error) {
+	params := r.Form
+	accessKey := params.Get("access_key")
+	a, ok := s.accounts[accessKey]
+	if !ok {
+		return nil, errorf(http.StatusUnauthorized, 2008,
+			"The access key %s does not exist.", accessKey)
+	}
+	tonce, err := strconv.ParseInt(params.Get("tonce"), 10, 64)
+	if err != nil {
+		return nil, errorf(http.StatusUnauthorized, 2007,
+			"The tonce %s is invalid.", params.Get("tonce"))
+	}
+	if s.CheckTonce {
+		now := s.Now()
+		t := time.Unix(0, tonce*int64(time.Millisecond))
+		if TonceWindow < now.Sub(t) || TonceWindow < t.Sub(now) {
+			return nil, errorf(http.StatusUnauthorized, 2007,
+				"The tonce %d is invalid, current timestamp is %d.",
+				tonce, now.UnixNano()/int64(time.Millisecond))
+		}
+		if a.tonces[tonce] {
+			return nil, errorf(http.StatusUnauthorized, 2006,
+				"The tonce %d has already been used by access key %s.",
+				tonce, accessKey)
+		}
+	}
+	expected := Sign(r.Method, r.URL.Path, params, a.secretKey)
+	if !hmac.Equal([]byte(expected), []byte(params.Get("signature"))) {
+		return nil, errorf(http.StatusUnauthorized, 2005,
+			"Signature %s is incorrect.", params.Get("signature"))
+	}
+	if s.CheckTonce {
+		a.tonces[tonce] = true
+	}
+	return a, nil
+}
+
+// Calculate request signature the way the exchange does: HMAC-SHA256
+// of "METHOD|PATH|QUERY" where QUERY is made of all the parameters
+// except the signature, sorted by name and URL-encoded. The query
+// is built here from scratch rather than with the encoders used by
+// the client, so the server catches client canonicalization bugs.
+func Sign(method, path string, params url.Values, secretKey string) string {
+	var names []string
+	for k := range params {
+		if k != "signature" {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	var query []string
+	for _, k := range names {
+		for _, v := range params[k] {
+			query = append(query, escape(k)+"="+escape(v))
+		}
+	}
+	h := hmac.New(sha256.New, []byte(secretKey))
+	h.Write([]byte(method + "|" + path + "|" + strings.Join(query, "&")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Encode string for the signed query as Ruby's CGI.escape does:
+// letters, digits and "-_.~" are kept, space becomes "+", the rest
+// is percent-encoded.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z',
+			'0' <= c && c <= '9', strings.IndexByte("-_.~", c) >= 0:
+			b.WriteByte(c)
+		case c == ' ':
+			b.WriteByte('+')
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *Server) market(name string) (*book, error) {
+	b, ok := s.books[name]
+	if !ok {
+		return nil, errorf(http.StatusBadRequest, 1001,
+			"market does not have a valid value")
+	}
+	return b, nil
+}
+
+func fstr(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func orderJSON(o *order) map[string]interface{} {
+	var avgPrice float64
+	if 0 < o.executed {
+		avgPrice = o.funds / o.executed
+	}
+	var price interface{}
+	if o.ordType == "limit" {
+		price = fstr(o.price)
+	}
+	return map[string]interface{}{
+		"id":               o.id,
+		"side":             o.side,
+		"ord_type":         o.ordType,
+		"price":            price,
+		"avg_price":        fstr(avgPrice),
+		"state":            o.state,
+		"market":           o.market,
+		"created_at":       o.createdAt.UTC().Format(timeLayout),
+		"volume":           fstr(o.volume),
+		"remaining_volume": fstr(o.remaining),
+		"executed_volume":  fstr(o.executed),
+		"trades_count":     o.tradesCount,
+	}
+}
+
+func ordersJSON(orders []*order) []interface{} {
+	res := []interface{}{}
+	for _, o := range orders {
+		res = append(res, orderJSON(o))
+	}
+	return res
+}
+
+func (s *Server) ticker(market string) (interface{}, error) {
+	b, err := s.market(market)
+	if err != nil {
+		return nil, err
+	}
+	now := s.Now()
+	var buy, sell, low, high, last, vol, amount float64
+	if 0 < len(b.bids) {
+		buy = b.bids[0].price
+	}
+	if 0 < len(b.asks) {
+		sell = b.asks[0].price
+	}
+	for _, t := range s.trades {
+		if t.market != market {
+			continue
+		}
+		last = t.price
+		if now.Sub(t.createdAt) > 24*time.Hour {
+			continue
+		}
+		if low == 0 || t.price < low {
+			low = t.price
+		}
+		high = math.Max(high, t.price)
+		vol += t.volume
+		amount += t.volume * t.price
+	}
+	return map[string]interface{}{
+		"at": now.Unix(),
+		"ticker": map[string]interface{}{
+			"buy":    fstr(buy),
+			"sell":   fstr(sell),
+			"low":    fstr(low),
+			"high":   fstr(high),
+			"last":   fstr(last),
+			"vol":    fstr(vol),
+			"amount": fstr(amount),
+		},
+	}, nil
+}
+
+func (s *Server) orderBook(market string) (interface{}, error) {
+	b, err := s.market(market)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"asks": ordersJSON(b.asks),
+		"bids": ordersJSON(b.bids),
+	}, nil
+}
+
+func tradeJSON(t *trade) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         t.id,
+		"price":      fstr(t.price),
+		"volume":     fstr(t.volume),
+		"funds":      fstr(t.price * t.volume),
+		"market":     t.market,
+		"created_at": t.createdAt.UTC().Format(timeLayout),
+		"side":       t.side,
+	}
+}
+
+// Public trades, the newest first.
+func (s *Server) publicTrades(market string) (interface{}, error) {
+	if _, err := s.market(market); err != nil {
+		return nil, err
+	}
+	res := []interface{}{}
+	for i := len(s.trades) - 1; 0 <= i; i-- {
+		if s.trades[i].market == market {
+			res = append(res, tradeJSON(s.trades[i]))
+		}
+	}
+	return res, nil
+}
+
+// User trades, the newest first.
+func (s *Server) userTrades(a *account, market string) (interface{}, error) {
+	if _, err := s.market(market); err != nil {
+		return nil, err
+	}
+	res := []interface{}{}
+	for i := len(s.trades) - 1; 0 <= i; i-- {
+		t := s.trades[i]
+		if t.market != market {
+			continue
+		}
+		for _, o := range []*order{t.bid, t.ask} {
+			if o.account != a {
+				continue
+			}
+			j := tradeJSON(t)
+			j["side"] = map[string]string{"buy": "bid", "sell": "ask"}[o.side]
+			j["order_id"] = o.id
+			res = append(res, j)
+		}
+	}
+	return res, nil
+}
+
+func (s *Server) userInfo(a *account) interface{} {
+	var names []string
+	for c := range a.balances {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	accounts := []interface{}{}
+	for _, c := range names {
+		accounts = append(accounts, map[string]interface{}{
+			"currency": c,
+			"balance":  fstr(a.balances[c].balance),
+			"locked":   fstr(a.balances[c].locked),
+		})
+	}
+	return map[string]interface{}{
+		"email":     a.email,
+		"activated": true,
+		"accounts":  accounts,
+	}
+}
+
+// Active user orders.
+func (s *Server) userOrders(a *account, market string) (interface{}, error) {
+	b, err := s.market(market)
+	if err != nil {
+		return nil, err
+	}
+	var res []*order
+	for _, side := range [][]*order{b.asks, b.bids} {
+		for _, o := range side {
+			if o.account == a {
+				res = append(res, o)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].id < res[j].id })
+	return ordersJSON(res), nil
+}
+
+func (s *Server) userOrder(a *account, id string) (*order, error) {
+	i, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, 1001,
+			"id does not have a valid value")
+	}
+	o, ok := s.orders[i]
+	if !ok || o.account != a {
+		return nil, errorf(http.StatusNotFound, 2004,
+			"Order#%d doesn't exist.", i)
+	}
+	return o, nil
+}
+
+func (s *Server) createOrder(a *account, params url.Values) (interface{}, error) {
+	ordType := params.Get("ord_type")
+	if ordType == "" {
+		ordType = "limit"
+	}
+	volume, err := strconv.ParseFloat(params.Get("volume"), 64)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, 1001,
+			"volume does not have a valid value")
+	}
+	var price float64
+	if ordType == "limit" {
+		price, err = strconv.ParseFloat(params.Get("price"), 64)
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, 1001,
+				"price does not have a valid value")
+		}
+	}
+	o, err := s.newOrder(a, params.Get("market"), params.Get("side"),
+		ordType, volume, price)
+	if err != nil {
+		return nil, err
+	}
+	return orderJSON(o), nil
+}
+
+// Validate order, lock funds and match it against the book.
+// Must be called with the lock held.
+func (s *Server) newOrder(a *account, market, side, ordType string, volume, price float64) (*order, error) {
+	b, err := s.market(market)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(reason string) error {
+		return errorf(http.StatusBadRequest, 2002,
+			"Failed to create order. Reason: %s", reason)
+	}
+	if side != "buy" && side != "sell" {
+		return nil, fail("side is invalid")
+	}
+	if ordType != "limit" && ordType != "market" {
+		return nil, fail("ord_type is invalid")
+	}
+	if volume <= 0 || (ordType == "limit" && price <= 0) {
+		return nil, fail("volume and price must be positive")
+	}
+	base, quote := currencies(market)
+	o := &order{
+		account:   a,
+		market:    market,
+		side:      side,
+		ordType:   ordType,
+		price:     price,
+		volume:    volume,
+		remaining: volume,
+		state:     kunaio.OrderWait,
+		createdAt: s.Now(),
+	}
+	// market buys pay as they go, everything else is locked
+	switch {
+	case side == "sell":
+		o.locked = volume
+	case ordType == "limit":
+		o.locked = volume * price
+	}
+	currency := base
+	if side == "buy" {
+		currency = quote
+	}
+	bal := a.get(currency)
+	if bal.balance < o.locked-epsilon {
+		return nil, fail("cannot lock funds")
+	}
+	bal.balance -= o.locked
+	bal.locked += o.locked
+	s.nextOrderID++
+	o.id = s.nextOrderID
+	s.orders[o.id] = o
+	s.match(b, o)
+	return o, nil
+}
+
+// Match taker order against the opposite side of the book and put
+// the rest into the book (limit orders) or cancel it (market ones).
+func (s *Server) match(b *book, o *order) {
+	opposite := &b.asks
+	if o.side == "sell" {
+		opposite = &b.bids
+	}
+	_, quote := currencies(o.market)
+	for epsilon < o.remaining && 0 < len(*opposite) {
+		maker := (*opposite)[0]
+		if o.ordType == "limit" &&
+			((o.side == "buy" && o.price < maker.price) ||
+				(o.side == "sell" && maker.price < o.price)) {
+			break
+		}
+		volume := math.Min(o.remaining, maker.remaining)
+		if o.side == "buy" && o.ordType == "market" {
+			// market buy is limited by available funds
+			funds := o.account.get(quote).balance
+			volume = math.Min(volume, funds/maker.price)
+			if volume < epsilon {
+				break
+			}
+		}
+		s.fill(o, maker, volume, maker.price)
+		if maker.remaining < epsilon {
+			maker.state = kunaio.OrderDone
+			*opposite = (*opposite)[1:]
+		}
+	}
+	switch {
+	case o.remaining < epsilon:
+		o.state = kunaio.OrderDone
+	case o.ordType == "market":
+		s.release(o)
+		o.state = kunaio.OrderCancel
+	default:
+		s.insert(b, o)
+	}
+}
+
+// Execute volume of the taker and maker orders at the price.
+func (s *Server) fill(taker, maker *order, volume, price float64) {
+	base, quote := currencies(taker.market)
+	funds := volume * price
+	bid, ask := taker, maker
+	if taker.side == "sell" {
+		bid, ask = maker, taker
+	}
+	// buyer pays funds and gets base currency
+	bq := bid.account.get(quote)
+	if bid.ordType == "limit" {
+		reserved := volume * bid.price
+		bq.locked -= reserved
+		bid.locked -= reserved
+		bq.balance += reserved - funds
+	} else {
+		bq.balance -= funds
+	}
+	bid.account.get(base).balance += volume
+	// seller pays base currency and gets funds
+	ab := ask.account.get(base)
+	ab.locked -= volume
+	ask.locked -= volume
+	ask.account.get(quote).balance += funds
+	for _, o := range []*order{taker, maker} {
+		o.remaining -= volume
+		o.executed += volume
+		o.funds += funds
+		o.tradesCount++
+	}
+	s.nextTradeID++
+	s.trades = append(s.trades, &trade{
+		id:        s.nextTradeID,
+		market:    taker.market,
+		price:     price,
+		volume:    volume,
+		createdAt: s.Now(),
+		bid:       bid,
+		ask:       ask,
+		side:      taker.side,
+	})
+}
+
+// Put limit order into the book keeping price-time priority.
+func (s *Server) insert(b *book, o *order) {
+	side := &b.bids
+	better := func(x, y *order) bool { return x.price > y.price }
+	if o.side == "sell" {
+		side = &b.asks
+		better = func(x, y *order) bool { return x.price < y.price }
+	}
+	i := sort.Search(len(*side), func(i int) bool {
+		return better(o, (*side)[i])
+	})
+	*side = append(*side, nil)
+	copy((*side)[i+1:], (*side)[i:])
+	(*side)[i] = o
+}
+
+// Unlock funds still locked by the order.
+func (s *Server) release(o *order) {
+	base, quote := currencies(o.market)
+	currency := base
+	if o.side == "buy" {
+		currency = quote
+	}
+	bal := o.account.get(currency)
+	bal.locked -= o.locked
+	bal.balance += o.locked
+	o.locked = 0
+}
+
+func (s *Server) cancelOrder(a *account, id string) (interface{}, error) {
+	o, err := s.userOrder(a, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cancel(o); err != nil {
+		return nil, err
+	}
+	return orderJSON(o), nil
+}
+
+// Cancel order on behalf of the exchange, e.g. to simulate order
+// expiration. The order may belong to any account.
+func (s *Server) CancelOrder(id int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	o, ok := s.orders[id]
+	if !ok {
+		return errorf(http.StatusNotFound, 2004,
+			"Order#%d doesn't exist.", id)
+	}
+	return s.cancel(o)
+}
+
+// Remove active order from the book and unlock its funds.
+func (s *Server) cancel(o *order) error {
+	if o.state != kunaio.OrderWait {
+		return errorf(http.StatusBadRequest, 2003,
+			"Failed to cancel order. Reason: order is %s", o.state)
+	}
+	b := s.books[o.market]
+	for _, side := range []*[]*order{&b.asks, &b.bids} {
+		for i, e := range *side {
+			if e == o {
+				*side = append((*side)[:i], (*side)[i+1:]...)
+				break
+			}
+		}
+	}
+	s.release(o)
+	o.state = kunaio.OrderCancel
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakeserver
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"kunaio"
+)
+
+// Reference signatures calculated outside of Go. The first one is
+// the example from the exchange API documentation.
+func TestSign(t *testing.T) {
+	for _, c := range []struct {
+		method, path, query, secret, want string
+	}{
+		{"GET", "/api/v2/markets",
+			"tonce=123456789&foo=bar&access_key=xxx", "yyy",
+			"e324059be4491ed8e528aa7b8735af1e96547fbec96db962d51feb7bf1b64dee"},
+		{"POST", "/api/v2/orders",
+			"volume=0.500000&side=buy&price=150000.000000&market=btcuah" +
+				"&access_key=ak&tonce=1700000000000&signature=xxx", "sk",
+			"e2488ae9c923df7dc9a194ff7fd8669b42ff1ca4a86e7be60b7892751ad7743d"},
+		{"GET", "/api/v2/order",
+			"tonce=1700000000000&comment=a%20b/c%26d%3De~f.g_h-i*&access_key=ak", "sk",
+			"deeefd0aa6884ab636a33ce3ba145113c7fd93867cce1da0d2c6cedf2e75f768"},
+	} {
+		params, err := url.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Sign(c.method, c.path, params, c.secret); got != c.want {
+			t.Errorf("%s %s?%s: expected %s, got %s",
+				c.method, c.path, c.query, c.want, got)
+		}
+	}
+}
+
+// Start server with one user account and point the library at it.
+func start(t *testing.T) (*Server, *kunaio.Client, func()) {
+	t.Helper()
+	s := New()
+	s.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"uah": 100000, "btc": 1})
+	ts := httptest.NewServer(s)
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	return s, kunaio.NewClient("ak", "sk"), func() {
+		kunaio.SetBaseURL(old)
+		ts.Close()
+	}
+}
+
+func checkBalance(t *testing.T, s *Server, currency string, balance, locked float64) {
+	t.Helper()
+	b, l := s.Balance("ak", currency)
+	if 1e-9 < math.Abs(b-balance) || 1e-9 < math.Abs(l-locked) {
+		t.Errorf("%s: expected %v (locked %v), got %v (locked %v)",
+			currency, balance, locked, b, l)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	s, client, stop := start(t)
+	defer stop()
+	if _, err := s.SeedOrder(kunaio.BTCUAH, "sell", 1, 150000); err != nil {
+		t.Fatal(err)
+	}
+	// crosses the seeded ask
+	bought, err := client.NewOrder(kunaio.BTCUAH, "buy", 0.5, 150000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bought.State != kunaio.OrderDone || bought.ExecutedVolume != 0.5 {
+		t.Errorf("expected executed order, got %+v", bought)
+	}
+	checkBalance(t, s, "uah", 25000, 0)
+	checkBalance(t, s, "btc", 1.5, 0)
+	// rests in the book and locks the funds
+	ask, err := client.NewOrder(kunaio.BTCUAH, "sell", 0.5, 200000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ask.State != kunaio.OrderWait || ask.RemainingVolume != 0.5 {
+		t.Errorf("expected active order, got %+v", ask)
+	}
+	checkBalance(t, s, "btc", 1, 0.5)
+	orders, err := client.GetUserOrders(kunaio.BTCUAH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 || orders[0].ID != ask.ID {
+		t.Errorf("expected order %d only, got %+v", ask.ID, orders)
+	}
+	info, err := client.GetUserInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, a := range info.Accounts {
+		if a.Currency == "btc" {
+			found = a.Balance == 1 && a.Locked == 0.5
+		}
+	}
+	if !found {
+		t.Errorf("bad btc account: %+v", info.Accounts)
+	}
+	cancelled, err := client.CancelOrder(ask.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.State != kunaio.OrderCancel {
+		t.Errorf("expected cancelled order, got %+v", cancelled)
+	}
+	checkBalance(t, s, "btc", 1.5, 0)
+	if _, err := client.CancelOrder(ask.ID); err == nil {
+		t.Error("cancelled twice")
+	}
+	order, err := client.GetOrder(ask.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.State != kunaio.OrderCancel || order.ExecutedVolume != 0 {
+		t.Errorf("bad cancelled order: %+v", order)
+	}
+	orders, err = client.GetUserOrders(kunaio.BTCUAH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 0 {
+		t.Errorf("expected no active orders, got %+v", orders)
+	}
+	// market sell eats the seeded bid
+	if _, err := s.SeedOrder(kunaio.BTCUAH, "buy", 1, 100000); err != nil {
+		t.Fatal(err)
+	}
+	sold, err := client.NewMarketOrder(kunaio.BTCUAH, "sell", 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sold.State != kunaio.OrderCancel || sold.ExecutedVolume != 1 {
+		t.Errorf("expected partially executed order, got %+v", sold)
+	}
+	checkBalance(t, s, "uah", 125000, 0)
+	checkBalance(t, s, "btc", 0.5, 0)
+	if _, err := client.NewOrder(kunaio.BTCUAH, "buy", 1, 200000); err == nil {
+		t.Error("order exceeding the balance accepted")
+	}
+	// cancelled by the exchange
+	bid, err := client.NewOrder(kunaio.BTCUAH, "buy", 0.1, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CancelOrder(bid.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, s, "uah", 125000, 0)
+	if err := s.CancelOrder(bid.ID); err == nil {
+		t.Error("cancelled twice")
+	}
+}
+
+// Send signed GET /api/v2/members/me request with the tonce and
+// return Kuna.io error code of the response, 0 on success.
+func getMe(t *testing.T, s *Server, accessKey, secretKey string, tonce int64) int {
+	t.Helper()
+	params := url.Values{
+		"access_key": {accessKey},
+		"tonce":      {strconv.FormatInt(tonce, 10)},
+	}
+	params.Set("signature", Sign("GET", "/api/v2/members/me", params, secretKey))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET",
+		"/api/v2/members/me?"+params.Encode(), nil))
+	if w.Code == http.StatusOK {
+		return 0
+	}
+	var reply struct {
+		Error struct {
+			Code int
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("%d %s: %s", w.Code, w.Body, err)
+	}
+	return reply.Error.Code
+}
+
+func TestAuthentication(t *testing.T) {
+	s := New()
+	s.AddAccount("ak", "sk", "user@example.com", nil)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, c := range []struct {
+		name                 string
+		accessKey, secretKey string
+		tonce                int64
+		code                 int
+	}{
+		{"unknown access key", "xx", "sk", now, 2008},
+		{"bad signature", "ak", "xx", now, 2005},
+		// requests with bad signature don't burn the tonce
+		{"valid", "ak", "sk", now, 0},
+		{"reused tonce", "ak", "sk", now, 2006},
+		{"tonce in the past", "ak", "sk", now - time.Minute.Milliseconds(), 2007},
+		{"tonce in the future", "ak", "sk", now + time.Minute.Milliseconds(), 2007},
+	} {
+		if code := getMe(t, s, c.accessKey, c.secretKey, c.tonce); code != c.code {
+			t.Errorf("%s: expected error %d, got %d", c.name, c.code, code)
+		}
+	}
+}
@@ -15,14 +15,11 @@
 package kunaio
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"sort"
-	"strings"
+	"net/url"
 	"time"
 )
 
@@ -50,39 +47,45 @@ func init() {
 	}
 }
 
-// Send a GET request to the server.
-func doGet(url string) (interface{}, error) {
-	resp, err := gClient.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	return readResp(resp)
+// Replace HTTP transport used for all API requests, e.g. with
+// RecordingTransport or ReplayTransport.
+func SetTransport(t http.RoundTripper) {
+	gClient.Transport = t
 }
 
-// Send a POST request to the server.
-func doPost(url string) (interface{}, error) {
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return Order{}, err
-	}
-	resp, err := gClient.Do(req)
-	if err != nil {
-		return Order{}, err
-	}
-	return readResp(resp)
+// Return HTTP transport used for API requests.
+func Transport() http.RoundTripper {
+	return gClient.Transport
+}
+
+// Error reported by the exchange.
+type APIError struct {
+	// HTTP status code and status line, e.g. "401 Unauthorized"
+	StatusCode int
+	Status     string
+	// Exchange error code and message
+	Code    int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s; %d: %s", e.Status, e.Code, e.Message)
 }
 
-// Check HTTP response and decode JSON object.
-func readResp(r *http.Response) (interface{}, error) {
+// Check HTTP response and return its body.
+func readResp(r *http.Response) ([]byte, error) {
 	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
 	if r.StatusCode/100 != 2 {
-		if err, ok := decodeError(r.Body); ok {
-			return nil, fmt.Errorf("%s; %s", r.Status, err)
+		if err, ok := decodeError(body); ok {
+			err.StatusCode = r.StatusCode
+			err.Status = r.Status
+			return nil, err
 		}
 		return nil, fmt.Errorf("server returned HTTP"+
 			" response code %s", r.Status)
 	}
-	return DecodeJSON(r.Body)
+	return body, err
 }
 
 type Args []struct {
@@ -104,24 +107,11 @@ func (a Args) Swap(i, j int) {
 	a[j] = t
 }
 
-// Generate URL for private API request.
-func privURL(method, url, access_key, secret_key string, args Args) string {
-	if args == nil {
-		args = Args{}
-	}
-	args = append(args, Args{
-		{"access_key", access_key},
-		{"tonce", fmt.Sprintf("%d000", time.Now().Unix())},
-	}...)
-	sort.Sort(args)
-	query := ""
-	for _, e := range args {
-		query += fmt.Sprintf("&%s=%s", e.Key, e.Value)
+// Convert arguments to URL values.
+func (a Args) values() url.Values {
+	res := url.Values{}
+	for _, e := range a {
+		res.Add(e.Key, e.Value)
 	}
-	query = strings.Trim(query, "&")
-	h := hmac.New(sha256.New, []byte(secret_key))
-	h.Write([]byte(fmt.Sprintf("%s|%s|%s", method, url, query)))
-	secret := hex.EncodeToString(h.Sum(nil))
-	url = fmt.Sprintf("%s?%s&signature=%s", url, query, secret)
-	return fmt.Sprintf("%s%s", gBaseURL, url)
+	return res
 }
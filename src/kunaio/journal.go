@@ -0,0 +1,87 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// Append-only DCA execution journal. Each record is stored as
+// one JSON object per line and synced to disk right away, so
+// a crash can lose at most the record being written.
+type DCAJournal struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+// Open journal file for appending. The file is created if
+// not exists.
+func OpenDCAJournal(path string) (*DCAJournal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &DCAJournal{file: f}, nil
+}
+
+// Append record to the journal.
+func (j *DCAJournal) Append(rec DCARecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close the journal.
+func (j *DCAJournal) Close() error {
+	return j.file.Close()
+}
+
+// Read all records from the journal file. Truncated last line
+// (left after a crash) is ignored.
+func ReadDCAJournal(path string) ([]DCARecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res []DCARecord
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// incomplete last line is dropped too
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var rec DCARecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+	return res, nil
+}
@@ -15,160 +15,410 @@
 package kunaio
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-func DecodeJSON(r io.Reader) (interface{}, error) {
-	decoder := json.NewDecoder(r)
-	decoder.UseNumber()
-	var v interface{}
-	if err := decoder.Decode(&v); err != nil {
-		return nil, err
+// How decoders treat responses not matching the expected format
+type DecodeMode int
+
+const (
+	// Fail on missing required fields, keep unknown fields in the
+	// Extra field of decoded struct
+	DecodeDefault DecodeMode = iota
+	// Like DecodeDefault but also fail on unknown fields. Useful
+	// for contract testing.
+	DecodeStrict
+	// Substitute zero values for missing and invalid fields and
+	// report them as warnings
+	DecodeLenient
+)
+
+var (
+	// Decode mode of new clients
+	gDecodeMode DecodeMode
+)
+
+// Set decode mode of package level API functions and new clients.
+// Not safe to call concurrently with API calls.
+func SetDecodeMode(mode DecodeMode) {
+	gDecodeMode = mode
+}
+
+// Error decoding API response.
+type DecodeError struct {
+	// Path of the bad value, e.g. "asks[12].price". Empty for the
+	// top level value.
+	Path string
+	// Error description
+	Msg string
+	// Underlying encoding/json error, if any
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Path == "" {
+		return "json: " + e.Msg
 	}
-	debugLog("decoded JSON: %#v", v)
-	return v, nil
+	return "json: " + e.Path + ": " + e.Msg
 }
 
-func jsonGetTime(v interface{}) (time.Time, error) {
-	if v == nil {
-		return time.Time{}, errors.New(
-			"expected int but NIL found")
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// decoder decodes API responses into intermediate structs whose
+// json tags describe the expected fields. Fields tagged omitempty
+// are optional. Presence of other fields is tracked by making them
+// pointers or slices. Unknown fields are kept in the Extra field of
+// the struct, if any.
+type decoder struct {
+	mode DecodeMode
+	// Errors ignored in DecodeLenient mode
+	warnings []*DecodeError
+}
+
+// Decode JSON response into intermediate struct pointed to by v.
+// Well formed responses are decoded in one pass. Others are decoded
+// again value by value to report problems with their paths.
+func (d *decoder) decode(data []byte, v interface{}) error {
+	if d.fast(data, v) {
+		return nil
 	}
-	switch v.(type) {
-	case json.Number:
-		t, err := v.(json.Number).Int64()
-		if err != nil {
-			return time.Time{}, err
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	return d.value(data, "", rv)
+}
+
+// Decode data in one pass. Fails on unknown, missing and invalid
+// fields.
+func (d *decoder) fast(data []byte, v interface{}) bool {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if dec.Decode(v) != nil {
+		return false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return false
+	}
+	return d.complete(reflect.ValueOf(v).Elem())
+}
+
+// Check that required fields are present.
+func (d *decoder) complete(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer:
+		return v.IsNil() || d.complete(v.Elem())
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if !d.complete(v.Index(i)) {
+				return false
+			}
+		}
+	case reflect.Struct:
+		for _, f := range objectFields(v.Type()) {
+			fv := v.Field(f.index)
+			if (fv.Kind() == reflect.Pointer || fv.Kind() == reflect.Slice) &&
+				fv.IsNil() && f.required {
+				return false
+			}
+			if !d.complete(fv) {
+				return false
+			}
 		}
-		return time.Unix(t, 0), nil
 	}
-	return time.Time{}, fmt.Errorf(
-		"expected int but %#v (%T) found", v, v)
+	return true
 }
 
-var supportedTimeFormats = []string{
-	"2006-01-02T15:04:05Z",
-	"2006-01-02T15:04:05-0700",
-	"2006-01-02T15:04:05-07:00",
+// Field of intermediate struct.
+type objectField struct {
+	name     string
+	index    int
+	required bool
 }
 
-func jsonGetTimeFromText(v interface{}) (time.Time, error) {
-	if v == nil {
-		return time.Time{}, errors.New(
-			"expected int but NIL found")
+// Cached fields of intermediate structs by type
+var gObjectFields sync.Map
+
+// Return fields of intermediate struct type t. Types implementing
+// json.Unmarshaler have no fields.
+func objectFields(t reflect.Type) []objectField {
+	if f, ok := gObjectFields.Load(t); ok {
+		return f.([]objectField)
 	}
-	switch v.(type) {
-	case string:
-		for _, f := range supportedTimeFormats {
-			t, err := time.Parse(f, v.(string))
-			if err == nil {
-				return t, nil
+	var fields []objectField
+	if !reflect.PointerTo(t).Implements(unmarshalerType) {
+		for i := 0; i < t.NumField(); i++ {
+			tag := t.Field(i).Tag.Get("json")
+			if tag == "" || tag == "-" {
+				continue
 			}
+			name, opts, _ := strings.Cut(tag, ",")
+			fields = append(fields, objectField{
+				name:     name,
+				index:    i,
+				required: opts != "omitempty",
+			})
 		}
-		return time.Time{}, fmt.Errorf("can't parse time: %s",
-			v.(string))
 	}
-	return time.Time{}, fmt.Errorf(
-		"expected time but %#v (%T) found", v, v)
+	gObjectFields.Store(t, fields)
+	return fields
 }
 
-func jsonGetString(v interface{}) (string, error) {
-	if v == nil {
-		return "", errors.New(
-			"expected string but NIL found")
+var (
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	timeType        = reflect.TypeOf(time.Time{})
+)
+
+// Decode JSON value of path into v.
+func (d *decoder) value(data []byte, path string, v reflect.Value) error {
+	t := v.Type()
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		return d.leaf(data, path, v)
 	}
-	switch v.(type) {
-	case string:
-		return v.(string), nil
+	switch t.Kind() {
+	case reflect.Pointer:
+		if isNull(data) {
+			return nil
+		}
+		v.Set(reflect.New(t.Elem()))
+		return d.value(data, path, v.Elem())
+	case reflect.Struct:
+		return d.object(data, path, v)
+	case reflect.Slice:
+		return d.array(data, path, v)
 	}
-	return "", fmt.Errorf(
-		"expected string but %#v (%T) found", v, v)
+	return d.leaf(data, path, v)
 }
 
-func jsonGetBool(v interface{}) (bool, error) {
-	if v == nil {
-		return false, errors.New(
-			"expected bool but NIL found")
+func (d *decoder) leaf(data []byte, path string, v reflect.Value) error {
+	if err := json.Unmarshal(data, v.Addr().Interface()); err != nil {
+		return wrapError(path, err)
 	}
-	switch v.(type) {
-	case bool:
-		return v.(bool), nil
+	return nil
+}
+
+// Decode JSON array of path into slice v.
+func (d *decoder) array(data []byte, path string, v reflect.Value) error {
+	var list []json.RawMessage
+	err := json.Unmarshal(data, &list)
+	if _, ok := err.(*json.UnmarshalTypeError); ok || err == nil && list == nil {
+		return &DecodeError{
+			Path: path,
+			Msg:  "expected array but " + found(data) + " found",
+			Err:  err,
+		}
+	}
+	if err != nil {
+		return wrapError(path, err)
+	}
+	v.Set(reflect.MakeSlice(v.Type(), len(list), len(list)))
+	for i, elem := range list {
+		if err := d.value(elem, indexPath(path, i), v.Index(i)); err != nil {
+			return err
+		}
 	}
-	return false, fmt.Errorf(
-		"expected bool but %#v (%T) found", v, v)
+	return nil
 }
 
-func jsonGetFloat(v interface{}) (float64, error) {
-	if v == nil {
-		return 0, errors.New("expected float but NIL found")
+// Decode JSON object of path into intermediate struct v.
+func (d *decoder) object(data []byte, path string, v reflect.Value) error {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if _, ok := err.(*json.UnmarshalTypeError); ok || err == nil && raw == nil {
+		return &DecodeError{
+			Path: path,
+			Msg:  "expected object but " + found(data) + " found",
+			Err:  err,
+		}
+	}
+	if err != nil {
+		return wrapError(path, err)
+	}
+	fields := objectFields(v.Type())
+	extra := v.FieldByName("Extra")
+	for key, value := range raw {
+		known := false
+		for _, f := range fields {
+			known = known || f.name == key
+		}
+		switch {
+		case known:
+		case d.mode == DecodeStrict:
+			return &DecodeError{Path: keyPath(path, key), Msg: "unknown field"}
+		case extra.IsValid():
+			if extra.IsNil() {
+				extra.Set(reflect.MakeMap(extra.Type()))
+			}
+			extra.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(value))
+		}
+	}
+	for _, f := range fields {
+		value, ok := raw[f.name]
+		fv := v.Field(f.index)
+		switch {
+		case !ok && f.required:
+			err = &DecodeError{Path: path, Msg: fmt.Sprintf("missing field %q", f.name)}
+		case !ok:
+			continue
+		case f.required && isNull(value):
+			err = wrapError(path, &json.UnmarshalTypeError{
+				Value: "null",
+				Type:  fv.Type(),
+				Field: f.name,
+			})
+		default:
+			err = d.value(value, keyPath(path, f.name), fv)
+		}
+		if err = d.recover(err); err != nil {
+			return err
+		}
 	}
-	switch v.(type) {
-	case json.Number:
-		return v.(json.Number).Float64()
-	case string:
-		return strconv.ParseFloat(v.(string), 64)
+	return nil
+}
+
+// Record error decoding field as warning in DecodeLenient mode.
+func (d *decoder) recover(err error) error {
+	w, ok := err.(*DecodeError)
+	if !ok || d.mode != DecodeLenient {
+		return err
 	}
-	return 0, fmt.Errorf(
-		"expected float but %#v (%T) found", v, v)
+	d.warnings = append(d.warnings, w)
+	return nil
 }
 
-func jsonGetFloatDef(v interface{}, def float64) (float64, error) {
-	if v == nil {
-		return def, nil
+func isNull(data []byte) bool {
+	return string(bytes.TrimSpace(data)) == "null"
+}
+
+// Append object key to JSON path.
+func keyPath(path, key string) string {
+	if path == "" || key == "" {
+		return path + key
 	}
-	switch v.(type) {
-	case json.Number:
-		return v.(json.Number).Float64()
-	case string:
-		return strconv.ParseFloat(v.(string), 64)
+	return path + "." + key
+}
+
+// Append array index to JSON path.
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+// Describe JSON value for error messages.
+func found(data []byte) string {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0:
+		return "end of input"
+	case data[0] == '{':
+		return "object"
+	case data[0] == '[':
+		return "array"
+	case 32 < len(data):
+		return string(data[:32]) + "..."
 	}
-	return 0, fmt.Errorf(
-		"expected float but %#v (%T) found", v, v)
+	return string(data)
 }
 
-func jsonGetInt(v interface{}) (int, error) {
-	if v == nil {
-		return 0, errors.New("expected int but NIL found")
+// Name of expected type for error messages.
+func typeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return "time"
 	}
-	switch v.(type) {
-	case json.Number:
-		i, err := v.(json.Number).Int64()
-		if err != nil {
-			return 0, err
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Slice:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return t.String()
+}
+
+// Convert encoding/json error to DecodeError. Path of the value
+// where the error occurred is appended to path.
+func wrapError(path string, err error) *DecodeError {
+	switch e := err.(type) {
+	case *DecodeError:
+		return e
+	case *json.UnmarshalTypeError:
+		return &DecodeError{
+			Path: keyPath(path, e.Field),
+			Msg:  fmt.Sprintf("expected %s but %s found", typeName(e.Type), e.Value),
+			Err:  err,
+		}
+	case *json.SyntaxError:
+		return &DecodeError{
+			Path: path,
+			Msg:  fmt.Sprintf("%s at offset %d", e, e.Offset),
+			Err:  err,
 		}
-		return int(i), nil
 	}
-	return 0, fmt.Errorf(
-		"expected int but %#v (%T) found", v, v)
+	return &DecodeError{Path: path, Msg: err.Error(), Err: err}
 }
 
-func jsonGetMap(v interface{}) (map[string]interface{}, error) {
-	if v == nil {
-		return nil, errors.New(
-			"expected dict but NIL found")
+// Float encoded as JSON number or string holding number.
+type flexFloat float64
+
+func (f *flexFloat) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseFloat(string(unquote(data)), 64)
+	if err != nil {
+		return &json.UnmarshalTypeError{Value: found(data), Type: reflect.TypeOf(*f)}
 	}
-	switch v.(type) {
-	case map[string]interface{}:
-		return v.(map[string]interface{}), nil
+	*f = flexFloat(v)
+	return nil
+}
+
+// Integer encoded as JSON number or string holding number.
+type flexInt int
+
+func (i *flexInt) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(string(unquote(data)), 10, 64)
+	if err != nil {
+		return &json.UnmarshalTypeError{Value: found(data), Type: reflect.TypeOf(*i)}
 	}
-	return nil, fmt.Errorf(
-		"expected dict but %#v (%T) found", v, v)
+	*i = flexInt(v)
+	return nil
 }
 
-func jsonGetList(v interface{}) ([]interface{}, error) {
-	if v == nil {
-		return nil, errors.New(
-			"expected list but NIL found")
+// Strip quotes of JSON string without escapes.
+func unquote(data []byte) []byte {
+	if 2 <= len(data) && data[0] == '"' && data[len(data)-1] == '"' {
+		return data[1 : len(data)-1]
 	}
-	switch v.(type) {
-	case []interface{}:
-		return v.([]interface{}), nil
+	return data
+}
+
+var supportedTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05-0700",
+}
+
+// Time encoded as string in one of supportedTimeFormats.
+type textTime time.Time
+
+func (t *textTime) UnmarshalJSON(data []byte) error {
+	s := string(unquote(data))
+	if 0 < len(data) && data[0] == '"' {
+		for _, f := range supportedTimeFormats {
+			if v, err := time.Parse(f, s); err == nil {
+				*t = textTime(v)
+				return nil
+			}
+		}
 	}
-	return nil, fmt.Errorf(
-		"expected list but %#v (%T) found", v, v)
+	return &json.UnmarshalTypeError{Value: found(data), Type: timeType}
 }
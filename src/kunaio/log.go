@@ -0,0 +1,224 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Structured logger. *slog.Logger implements it.
+type Logger interface {
+	Enabled(ctx context.Context, level slog.Level) bool
+	Log(ctx context.Context, level slog.Level, msg string, args ...interface{})
+}
+
+// Replacement of secret and personal values in logs
+const redacted = "REDACTED"
+
+// Names of query arguments and JSON fields redacted in logs unless
+// logging of sensitive data is enabled
+var sensitiveFields = map[string]bool{
+	"access_key": true,
+	"signature":  true,
+	"email":      true,
+	"accounts":   true,
+	"balance":    true,
+	"locked":     true,
+}
+
+var (
+	// Default logger of new clients and internal messages
+	gLogger Logger
+	// Log sensitive data by default
+	gLogSensitive bool
+)
+
+// Module initialization hook. Setting KUNAIO_DEBUG environment
+// variable enables debug logging to stderr.
+func init() {
+	if os.Getenv("KUNAIO_DEBUG") != "" {
+		gLogger = slog.New(slog.NewTextHandler(os.Stderr,
+			&slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+}
+
+// Set default logger for package level API functions, new clients
+// and internal messages of long-running services. Nil disables
+// logging. Not safe to call concurrently with API calls.
+func SetLogger(l Logger) {
+	gLogger = l
+}
+
+// Enable or disable logging of access keys, signatures and account
+// data (emails and balances) by package level API functions and new
+// clients. Not safe to call concurrently with API calls.
+func SetLogSensitive(enabled bool) {
+	gLogSensitive = enabled
+}
+
+// Log problem ignored in DecodeLenient mode. Values of sensitive
+// fields are redacted unless enabled.
+func logDecodeWarning(ctx context.Context, l Logger, sensitive bool, op string, w *DecodeError) {
+	if l == nil {
+		return
+	}
+	msg := w.Msg
+	if !sensitive {
+		for _, k := range strings.FieldsFunc(w.Path, func(c rune) bool {
+			return c == '.' || c == '['
+		}) {
+			if sensitiveFields[k] {
+				msg = redacted
+				break
+			}
+		}
+	}
+	l.Log(ctx, slog.LevelWarn, "api response decoding problem",
+		"operation", op, "path", w.Path, "error", msg)
+}
+
+// Log internal message on debug level.
+func debugLog(format string, args ...interface{}) {
+	ctx := context.Background()
+	if gLogger != nil && gLogger.Enabled(ctx, slog.LevelDebug) {
+		gLogger.Log(ctx, slog.LevelDebug, fmt.Sprintf(format, args...))
+	}
+}
+
+// Return middleware logging every call: operation, method, path,
+// market, status, latency and error. Calls failed with HTTP errors
+// are logged on warning level, with transport errors - on error
+// level, others - on debug level. On debug level the query and
+// response body are logged too, with sensitive data redacted
+// unless enabled.
+func logging(l Logger, sensitive bool) Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			if l == nil {
+				return next(call)
+			}
+			ctx := call.Request.Context()
+			r := call.Request
+			args := []interface{}{
+				"operation", call.Operation,
+				"method", r.Method,
+				"path", r.URL.Path,
+			}
+			if market := r.URL.Query().Get("market"); market != "" {
+				args = append(args, "market", market)
+			}
+			start := time.Now()
+			resp, err := next(call)
+			args = append(args, "latency", time.Since(start))
+			if err != nil {
+				args = append(args, "error", redactError(err, sensitive))
+				l.Log(ctx, slog.LevelError, "api call failed", args...)
+				return resp, err
+			}
+			args = append(args, "status", resp.StatusCode)
+			level := slog.LevelDebug
+			if resp.StatusCode/100 != 2 {
+				level = slog.LevelWarn
+			}
+			if !l.Enabled(ctx, level) {
+				return resp, err
+			}
+			if l.Enabled(ctx, slog.LevelDebug) {
+				body, rerr := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+				if rerr != nil {
+					return resp, rerr
+				}
+				args = append(args,
+					"query", redactQuery(r.URL.Query(), sensitive),
+					"body", redactBody(body, sensitive))
+			}
+			l.Log(ctx, level, "api call", args...)
+			return resp, err
+		}
+	}
+}
+
+// Return query with sensitive arguments redacted.
+func redactQuery(query url.Values, sensitive bool) string {
+	res := url.Values{}
+	for k, v := range query {
+		if !sensitive && sensitiveFields[k] {
+			v = []string{redacted}
+		}
+		res[k] = v
+	}
+	return res.Encode()
+}
+
+// Return error with sensitive URL arguments redacted.
+func redactError(err error, sensitive bool) error {
+	e, ok := err.(*url.Error)
+	if !ok || sensitive {
+		return err
+	}
+	u, perr := url.Parse(e.URL)
+	if perr != nil {
+		return err
+	}
+	u.RawQuery = redactQuery(u.Query(), false)
+	return &url.Error{Op: e.Op, URL: u.String(), Err: e.Err}
+}
+
+// Return JSON body with sensitive fields redacted.
+func redactBody(body []byte, sensitive bool) string {
+	if sensitive {
+		return string(body)
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("(%d bytes of non-JSON data)", len(body))
+	}
+	data, err := json.Marshal(redactJSON(v))
+	if err != nil {
+		return fmt.Sprintf("(%d bytes)", len(body))
+	}
+	return string(data)
+}
+
+// Replace values of sensitive fields of decoded JSON.
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if sensitiveFields[k] {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactJSON(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Values which must not appear in logs unless logging of sensitive
+// data is enabled.
+var sensitiveValues = []string{
+	"AK-SECRET",
+	"private@example.com",
+	// balances and locked volume
+	"1.4375", "0.3125", "98765.43",
+}
+
+// Make private calls with the client logging to the buffer at debug
+// level. Returns the log output.
+func logPrivateCalls(t *testing.T, sensitive bool) string {
+	t.Helper()
+	s := fakeserver.New()
+	s.AddAccount("AK-SECRET", "sk", "private@example.com",
+		map[string]float64{"btc": 1.75, "uah": 98765.43})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	defer kunaio.SetBaseURL(old)
+	var buf bytes.Buffer
+	client := kunaio.NewClient("AK-SECRET", "sk")
+	client.Logger = slog.New(slog.NewTextHandler(&buf,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	client.LogSensitive = sensitive
+	// 0.3125 BTC of 1.75 becomes locked
+	for _, volume := range []float64{0.125, 0.1875} {
+		_, err := client.NewOrder(kunaio.BTCUAH, "sell", volume, 200000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := client.GetUserInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, a := range info.Accounts {
+		if a.Currency == "btc" {
+			found = a.Balance == 1.4375 && a.Locked == 0.3125
+		}
+	}
+	if !found {
+		t.Fatalf("unexpected accounts: %+v", info.Accounts)
+	}
+	// transport error reports the request URL
+	ts.Close()
+	if _, err := client.GetUserInfo(); err == nil {
+		t.Fatal("no error from closed server")
+	}
+	return buf.String()
+}
+
+// Hex-encoded HMAC-SHA256 signature
+var signatureRe = regexp.MustCompile(`\b[0-9a-f]{64}\b`)
+
+func TestLogPrivateCall(t *testing.T) {
+	out := logPrivateCalls(t, false)
+	for _, want := range []string{
+		"operation=NewOrder", "operation=GetUserInfo",
+		"path=/api/v2/members/me", "status=200",
+		"level=ERROR msg=\"api call failed\"",
+		"access_key=REDACTED", "signature=REDACTED",
+		`\"email\":\"REDACTED\"`, `\"accounts\":\"REDACTED\"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q not logged:\n%s", want, out)
+		}
+	}
+	for _, v := range sensitiveValues {
+		if strings.Contains(out, v) {
+			t.Errorf("%q logged:\n%s", v, out)
+		}
+	}
+	if sig := signatureRe.FindString(out); sig != "" {
+		t.Errorf("signature %s logged:\n%s", sig, out)
+	}
+}
+
+func TestLogPrivateCallSensitive(t *testing.T) {
+	out := logPrivateCalls(t, true)
+	for _, v := range append(sensitiveValues, "access_key=AK-SECRET") {
+		if !strings.Contains(out, v) {
+			t.Errorf("%q not logged:\n%s", v, out)
+		}
+	}
+	if !signatureRe.MatchString(out) {
+		t.Errorf("no signature logged:\n%s", out)
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of API calls in metrics
+const (
+	OutcomeSuccess        = "success"
+	OutcomeHTTPError      = "http_error"
+	OutcomeRateLimited    = "rate_limited"
+	OutcomeTransportError = "transport_error"
+	OutcomeCanceled       = "canceled"
+	OutcomeDecodeError    = "decode_error"
+	OutcomeClockSkew      = "clock_skew"
+	OutcomeCircuitOpen    = "circuit_open"
+)
+
+// Default latency histogram buckets, in seconds
+var DefaultLatencyBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// Metric types
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// Metrics collects metrics of API calls and bot activity and serves
+// them in Prometheus text format. Usage:
+//
+//	metrics := NewMetrics()
+//	client.Use(metrics.Middleware())
+//	http.Handle("/metrics", metrics)
+//
+// Collected metrics are:
+//
+//	kunaio_requests_total{operation,outcome}
+//	kunaio_request_duration_seconds{operation}
+//	kunaio_api_errors_total{operation,code}
+//	kunaio_nonce_errors_total{operation}
+//	kunaio_clock_skew_seconds
+//	kunaio_clock_rtt_seconds
+//	kunaio_circuit_state{group}
+//	kunaio_circuit_transitions_total{group,state}
+//
+// Bot activity metrics are collected by Observe* methods set as
+// hooks of the services:
+//
+//	kunaio_order_events_total{type}
+//	kunaio_group_transitions_total{state}
+//	kunaio_conditions_total{type,state}
+//	kunaio_execution_executed_ratio{algo}
+//	kunaio_dca_executions_total{plan,status}
+//	kunaio_archived_trades_total{market}
+//	kunaio_snapshots_total{market}
+//
+// plus custom counters and gauges (see Inc, Add and Set).
+type Metrics struct {
+	// Latency histogram buckets. Default is DefaultLatencyBuckets.
+	// Changes apply to histograms created afterwards.
+	Buckets  []float64
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+// Metric with all its label sets.
+type family struct {
+	help   string
+	typ    string
+	series map[string]*series
+}
+
+// Metric with particular label set.
+type series struct {
+	value float64
+	// histogram only
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Create new metrics collector.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Buckets:  DefaultLatencyBuckets,
+		families: map[string]*family{},
+	}
+}
+
+// Return middleware collecting metrics of API calls. Put it before
+// ServerClock and CircuitBreaker middlewares to count clock skew
+// and open circuit errors.
+func (m *Metrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			op := call.Operation
+			start := time.Now()
+			resp, err := next(call)
+			m.Observe("kunaio_request_duration_seconds",
+				"API call latency.",
+				time.Since(start).Seconds(), "operation", op)
+			if err != nil {
+				outcome := OutcomeTransportError
+				switch err.(type) {
+				case *ClockSkewError:
+					outcome = OutcomeClockSkew
+				case *CircuitOpenError:
+					outcome = OutcomeCircuitOpen
+				}
+				// cancelled by the caller, not a failure
+				if errors.Is(err, context.Canceled) &&
+					call.Request.Context().Err() != nil {
+					outcome = OutcomeCanceled
+				}
+				m.countRequest(op, outcome)
+				return resp, err
+			}
+			if resp.StatusCode/100 == 2 {
+				call.OnDecoded(func(err error) {
+					if err != nil {
+						m.countRequest(op, OutcomeDecodeError)
+					} else {
+						m.countRequest(op, OutcomeSuccess)
+					}
+				})
+				return resp, err
+			}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				m.countRequest(op, OutcomeRateLimited)
+			} else {
+				m.countRequest(op, OutcomeHTTPError)
+			}
+			return m.countAPIError(op, resp), nil
+		}
+	}
+}
+
+func (m *Metrics) countRequest(op, outcome string) {
+	m.Inc("kunaio_requests_total", "API calls by outcome.",
+		"operation", op, "outcome", outcome)
+}
+
+// Count exchange error code of failed call. Returns response with
+// the body restored.
+func (m *Metrics) countAPIError(op string, resp *http.Response) *http.Response {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return resp
+	}
+	apiErr, ok := decodeError(body)
+	if !ok {
+		return resp
+	}
+	code := strconv.Itoa(apiErr.Code)
+	m.Inc("kunaio_api_errors_total", "API errors by exchange error code.",
+		"operation", op, "code", code)
+	switch apiErr.Code {
+	case 2006, 2007:
+		m.Inc("kunaio_nonce_errors_total",
+			"Calls rejected because of used or invalid tonce.",
+			"operation", op)
+	}
+	return resp
+}
+
+// Record server clock measurement. Can be used as
+// ServerClock.OnMeasure.
+func (m *Metrics) ObserveClock(skew, rtt time.Duration) {
+	m.Set("kunaio_clock_skew_seconds",
+		"Server clock minus local clock.", skew.Seconds())
+	m.Set("kunaio_clock_rtt_seconds",
+		"Round trip time of the last server time request.", rtt.Seconds())
+}
+
+// Record circuit state change. Can be used as
+// CircuitBreaker.OnStateChange.
+func (m *Metrics) ObserveCircuit(group string, from, to CircuitState) {
+	m.Set("kunaio_circuit_state",
+		"Circuit state: 0 closed, 1 open, 2 half-open.", float64(to),
+		"group", group)
+	m.Inc("kunaio_circuit_transitions_total",
+		"Circuit state changes by new state.",
+		"group", group, "state", to.String())
+}
+
+// Count order lifecycle event. Can be used as OrderTracker.OnEvent.
+func (m *Metrics) ObserveOrderEvent(ev OrderEvent) {
+	m.Inc("kunaio_order_events_total", "Order lifecycle events.",
+		"type", ev.Type)
+}
+
+// Count order group or leg state transition. Can be used as
+// OCOTracker.OnEvent.
+func (m *Metrics) ObserveGroupEvent(group int, ev GroupEvent) {
+	m.Inc("kunaio_group_transitions_total",
+		"State transitions of order groups and their legs.",
+		"state", ev.To)
+}
+
+// Count triggered or failed conditional order. Can be used as
+// ConditionEngine.OnTrigger.
+func (m *Metrics) ObserveCondition(c Condition) {
+	m.Inc("kunaio_conditions_total", "Triggered conditional orders.",
+		"type", c.Type, "state", c.State)
+}
+
+// Record executed part of algorithmic order. Can be used as
+// StartExecution progress hook.
+func (m *Metrics) ObserveExecution(p ExecutionProgress) {
+	m.Set("kunaio_execution_executed_ratio",
+		"Executed part of the algorithmic order.",
+		p.Executed/p.Volume, "algo", p.Algo)
+}
+
+// Count DCA plan execution. Can be used as DCA.OnRecord.
+func (m *Metrics) ObserveDCA(rec DCARecord) {
+	m.Inc("kunaio_dca_executions_total", "DCA plan executions.",
+		"plan", rec.Plan, "status", rec.Status)
+}
+
+// Count trades appended to the archive. Can be used as
+// Collector.OnAppend.
+func (m *Metrics) ObserveAppend(market string, count int) {
+	m.Add("kunaio_archived_trades_total",
+		"Trades appended to the archive.", float64(count),
+		"market", market)
+}
+
+// Count recorded market snapshot. Can be used as
+// Recorder.OnSnapshot.
+func (m *Metrics) ObserveSnapshot(snap Snapshot) {
+	m.Inc("kunaio_snapshots_total", "Recorded market snapshots.",
+		"market", snap.Market)
+}
+
+// Increment counter. Labels are name and value pairs.
+func (m *Metrics) Inc(name, help string, labels ...string) {
+	m.Add(name, help, 1, labels...)
+}
+
+// Add value to counter. Labels are name and value pairs.
+func (m *Metrics) Add(name, help string, value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.series(name, help, counterType, labels).value += value
+}
+
+// Set gauge value. Labels are name and value pairs.
+func (m *Metrics) Set(name, help string, value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.series(name, help, gaugeType, labels).value = value
+}
+
+// Add value to histogram. Labels are name and value pairs.
+func (m *Metrics) Observe(name, help string, value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := m.series(name, help, histogramType, labels)
+	if s.counts == nil {
+		s.buckets = append([]float64(nil), m.buckets()...)
+		s.counts = make([]uint64, len(s.buckets))
+	}
+	for i, le := range s.buckets {
+		if value <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (m *Metrics) buckets() []float64 {
+	if len(m.Buckets) == 0 {
+		return DefaultLatencyBuckets
+	}
+	return m.Buckets
+}
+
+// Find or create series. Must be called with the lock held.
+func (m *Metrics) series(name, help, typ string, labels []string) *series {
+	if m.families == nil {
+		m.families = map[string]*family{}
+	}
+	f, ok := m.families[name]
+	if !ok {
+		f = &family{help: help, typ: typ, series: map[string]*series{}}
+		m.families[name] = f
+	}
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Escapes label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Format label pairs as Prometheus label set without braces.
+func formatLabels(labels []string) string {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+
+			labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Write metric name with labels.
+func writeName(b *bytes.Buffer, name string, labels ...string) {
+	b.WriteString(name)
+	var nonEmpty []string
+	for _, l := range labels {
+		if l != "" {
+			nonEmpty = append(nonEmpty, l)
+		}
+	}
+	if 0 < len(nonEmpty) {
+		fmt.Fprintf(b, "{%s}", strings.Join(nonEmpty, ","))
+	}
+}
+
+// Return all the metrics in Prometheus text format.
+func (m *Metrics) Text() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var names []string
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, f.typ)
+		var keys []string
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			if f.typ != histogramType {
+				writeName(&b, name, k)
+				fmt.Fprintf(&b, " %s\n", formatValue(s.value))
+				continue
+			}
+			for i, le := range s.buckets {
+				writeName(&b, name+"_bucket", k,
+					`le="`+formatValue(le)+`"`)
+				fmt.Fprintf(&b, " %d\n", s.counts[i])
+			}
+			writeName(&b, name+"_bucket", k, `le="+Inf"`)
+			fmt.Fprintf(&b, " %d\n", s.count)
+			writeName(&b, name+"_sum", k)
+			fmt.Fprintf(&b, " %s\n", formatValue(s.sum))
+			writeName(&b, name+"_count", k)
+			fmt.Fprintf(&b, " %d\n", s.count)
+		}
+	}
+	return b.String()
+}
+
+// Serve metrics in Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(m.Text()))
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Update with:
+//
+//	go test kunaio -run MetricsText -update
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+const metricsGolden = "testdata/metrics.golden"
+
+// Start fake server with an account and point the package at it.
+// The server clock stands still, so rate limit window never ends.
+func startMetrics(t *testing.T) (*fakeserver.Server, time.Time, func()) {
+	t.Helper()
+	now := time.Now()
+	s := fakeserver.New()
+	s.Now = func() time.Time { return now }
+	s.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"uah": 1000})
+	ts := httptest.NewServer(s)
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	return s, now, func() {
+		kunaio.SetBaseURL(old)
+		ts.Close()
+	}
+}
+
+// Tonce source returning the tonces in order.
+type scriptedNonce []int64
+
+func (n *scriptedNonce) Next() (int64, error) {
+	tonce := (*n)[0]
+	*n = (*n)[1:]
+	return tonce, nil
+}
+
+// Middleware failing calls of the operation with the error.
+func failing(op string, err error) kunaio.Middleware {
+	return func(next kunaio.Handler) kunaio.Handler {
+		return func(call *kunaio.Call) (*http.Response, error) {
+			if call.Operation == op {
+				return nil, err
+			}
+			return next(call)
+		}
+	}
+}
+
+// Latency sums depend on the machine
+var latencySumRe = regexp.MustCompile(`(?m)^(kunaio_request_duration_seconds_sum\{.*\}) .*$`)
+
+func TestMetricsText(t *testing.T) {
+	s, now, stop := startMetrics(t)
+	defer stop()
+	m := kunaio.NewMetrics()
+	m.Buckets = []float64{60}
+	client := kunaio.NewClient("ak", "sk").Use(m.Middleware(),
+		failing("GetOrder", &kunaio.ClockSkewError{Skew: time.Minute, Max: time.Second}),
+		failing("CancelOrder", &kunaio.CircuitOpenError{Group: "trading"}),
+		failing("GetUserTrades", errors.New("connection reset")))
+	tonce := now.UnixNano() / int64(time.Millisecond)
+	// fresh, used, stale and fresh tonces
+	client.Signer = kunaio.NewSigner("ak", "sk")
+	client.Signer.Nonce = &scriptedNonce{tonce, tonce, tonce - 60000, tonce + 1}
+	client.GetOrderBook(kunaio.BTCUAH)
+	client.GetOrderBook(kunaio.BTCUAH)
+	s.SetFaults(fakeserver.Faults{MalformedRate: 1})
+	client.GetLatestStats(kunaio.BTCUAH)
+	s.SetFaults(fakeserver.Faults{RateLimit: 1})
+	client.GetTradeHistory(kunaio.BTCUAH)
+	client.GetTradeHistory(kunaio.BTCUAH)
+	s.SetFaults(fakeserver.Faults{ErrorRate: 1})
+	client.GetServerTime()
+	s.SetFaults(fakeserver.Faults{})
+	client.GetUserInfo()
+	client.GetUserInfo()
+	client.GetUserInfo()
+	client.NewOrder(kunaio.BTCUAH, "buy", 1, 2000)
+	client.GetOrder(1)
+	client.CancelOrder(1)
+	client.GetUserTrades(kunaio.BTCUAH)
+	m.ObserveClock(-1500*time.Millisecond, 250*time.Millisecond)
+	m.ObserveCircuit("trading", kunaio.CircuitClosed, kunaio.CircuitOpen)
+	m.ObserveCircuit("trading", kunaio.CircuitOpen, kunaio.CircuitHalfOpen)
+	m.ObserveOrderEvent(kunaio.OrderEvent{Type: kunaio.OrderFilled})
+	m.ObserveGroupEvent(1, kunaio.GroupEvent{Leg: "stop",
+		From: kunaio.LegPending, To: kunaio.LegSubmitting})
+	m.ObserveCondition(kunaio.Condition{Type: kunaio.StopLoss,
+		State: kunaio.CondTriggered})
+	m.ObserveExecution(kunaio.ExecutionProgress{Algo: kunaio.AlgoTWAP,
+		Volume: 2, Executed: 0.5})
+	m.ObserveDCA(kunaio.DCARecord{Plan: "weekly", Status: kunaio.DCAFilled})
+	m.ObserveAppend(kunaio.BTCUAH, 25)
+	m.ObserveAppend(kunaio.BTCUAH, 5)
+	m.ObserveSnapshot(kunaio.Snapshot{Market: `eth"uah`})
+	m.Inc("mybot_signals_total", "Trading signals.", "kind", "buy")
+	got := latencySumRe.ReplaceAllString(m.Text(), "$1 0")
+	if *update {
+		if err := ioutil.WriteFile(metricsGolden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(metricsGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// Histograms keep the buckets they are created with.
+func TestMetricsBuckets(t *testing.T) {
+	m := kunaio.NewMetrics()
+	m.Buckets = []float64{1}
+	m.Observe("a_seconds", "A.", 0.5)
+	m.Buckets = append(m.Buckets, 2, 3)
+	m.Observe("a_seconds", "A.", 2.5)
+	m.Observe("b_seconds", "B.", 2.5)
+	text := m.Text()
+	for _, line := range []string{
+		`a_seconds_bucket{le="1"} 1`,
+		`a_seconds_bucket{le="+Inf"} 2`,
+		`b_seconds_bucket{le="3"} 1`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("no %s in:\n%s", line, text)
+		}
+	}
+	if strings.Contains(text, `a_seconds_bucket{le="2"}`) {
+		t.Errorf("buckets changed:\n%s", text)
+	}
+}
+
+// Calls cancelled by the caller are not transport errors.
+func TestMetricsCanceled(t *testing.T) {
+	_, _, stop := startMetrics(t)
+	defer stop()
+	m := kunaio.NewMetrics()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	kunaio.NewClient("", "").Use(m.Middleware()).WithContext(ctx).
+		GetOrderBook(kunaio.BTCUAH)
+	want := `kunaio_requests_total{operation="GetOrderBook",outcome="canceled"} 1`
+	if text := m.Text(); !strings.Contains(text, want+"\n") {
+		t.Errorf("no %s in:\n%s", want, text)
+	}
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := kunaio.NewMetrics()
+	m.Set("kunaio_clock_skew_seconds", "Skew.", 0.5)
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	if !strings.HasSuffix(string(body), "\nkunaio_clock_skew_seconds 0.5\n") {
+		t.Errorf("body:\n%s", body)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Call is a single API call passing through the middleware chain.
+type Call struct {
+	// Logical operation name, the same as the name of the API
+	// function, e.g. "GetOrderBook"
+	Operation string
+	// Private calls are signed with the client's keys
+	Private bool
+	// HTTP request. For private calls the URL query has no
+	// access_key, tonce and signature arguments yet; they are
+	// added by the signing step at the end of the chain.
+	Request *http.Request
+	// signer of the client which made the call
+	signer *Signer
+	// shared by copies of the call
+	state *callState
+}
+
+type callState struct {
+	onDecoded []func(err error)
+	attempts  int
+}
+
+// Register function to be called when a successful (2xx) response
+// of the call is decoded, with the decoding error or nil. Lets
+// middlewares find out if the response is usable, e.g. before
+// caching it.
+func (c *Call) OnDecoded(f func(err error)) {
+	c.state.onDecoded = append(c.state.onDecoded, f)
+}
+
+// Return number of times the call was sent to the server so far.
+// Greater than one if the call was retried.
+func (c *Call) Attempts() int {
+	return c.state.attempts
+}
+
+// Run functions registered with OnDecoded.
+func (c *Call) decoded(err error) {
+	for _, f := range c.state.onDecoded {
+		f(err)
+	}
+}
+
+// Handler performs the call and returns raw HTTP response.
+type Handler func(call *Call) (*http.Response, error)
+
+// Middleware wraps the round trip of every API call. It can
+// inspect or alter the call before passing it to next handler,
+// short-circuit the call without calling next at all, retry it
+// or inspect the response. Middlewares must not modify the call
+// in place: make a copy (and clone the request) instead, because
+// outer middlewares may reuse it.
+//
+// Every call passes the chain in this order: package-wide
+// middlewares (see Use), client middlewares (see Client.Use),
+// request signing, logging (see Client.Logger) and the HTTP
+// transport (see SetTransport). Since signing is done at the end,
+// retried private calls always get fresh tonce.
+type Middleware func(next Handler) Handler
+
+// Middlewares applied to package level API functions and copied
+// to new clients
+var gMiddlewares []Middleware
+
+// Append middlewares to the package-wide chain. The chain is used by
+// package level API functions and by all clients created with
+// NewClient afterwards. Not safe to call concurrently with API calls.
+func Use(mw ...Middleware) {
+	gMiddlewares = append(gMiddlewares, mw...)
+}
+
+// Compose middlewares into one. The first middleware is the
+// outermost one.
+func Chain(mw ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mw) - 1; 0 <= i; i-- {
+			next = mw[i](next)
+		}
+		return next
+	}
+}
+
+// Make a shallow copy of the call with new request.
+func (c *Call) WithRequest(r *http.Request) *Call {
+	res := *c
+	res.Request = r
+	return &res
+}
+
+// Return middleware resending calls which failed with transport
+// error or got 429 or 5xx response, up to attempts times in total.
+// The first retry is done after backoff, which is doubled for every
+// next one. Only GET requests are retried, since the exchange may
+// have placed or cancelled the order of a failed POST request.
+func Retry(attempts int, backoff time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			ctx := call.Request.Context()
+			for i := 1; ; i++ {
+				resp, err := next(call)
+				if attempts <= i || call.Request.Method != "GET" ||
+					!retryable(resp, err) || ctx.Err() != nil {
+					return resp, err
+				}
+				if resp != nil {
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				timer := time.NewTimer(backoff << uint(i-1))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var urlErr *url.Error
+		return errors.As(err, &urlErr)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode/100 == 5
+}
+
+// Final handler, sending the request.
+func send(call *Call) (*http.Response, error) {
+	call.state.attempts++
+	return gClient.Do(call.Request)
+}
+
+// Add access key, tonce and signature to private calls.
+func signing(next Handler) Handler {
+	return func(call *Call) (*http.Response, error) {
+		if !call.Private {
+			return next(call)
+		}
+		r := call.Request.Clone(call.Request.Context())
+		if call.Request.GetBody != nil {
+			body, err := call.Request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		if err := call.signer.Sign(r); err != nil {
+			return nil, err
+		}
+		return next(call.WithRequest(r))
+	}
+}
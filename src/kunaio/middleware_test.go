@@ -0,0 +1,212 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Start fake server with an account and point the package at it.
+// The handler wrapping the server fails the first failures
+// requests with 503 and records tonces of all private requests.
+func startMiddlewareServer(t *testing.T, failures int) (*fakeserver.Server, *[]string, func()) {
+	t.Helper()
+	s := fakeserver.New()
+	s.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"btc": 1, "uah": 1000})
+	var (
+		lock   sync.Mutex
+		tonces []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		if tonce := r.URL.Query().Get("tonce"); tonce != "" {
+			tonces = append(tonces, tonce)
+		}
+		fail := 0 < failures
+		failures--
+		lock.Unlock()
+		if fail {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		s.ServeHTTP(w, r)
+	}))
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	return s, &tonces, func() {
+		kunaio.SetBaseURL(old)
+		ts.Close()
+	}
+}
+
+// Middleware recording its name to the log before and after the
+// next handler.
+func recording(log *[]string, name string) kunaio.Middleware {
+	return func(next kunaio.Handler) kunaio.Handler {
+		return func(call *kunaio.Call) (*http.Response, error) {
+			*log = append(*log, name+" "+call.Operation)
+			resp, err := next(call)
+			*log = append(*log, "/"+name)
+			return resp, err
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var log []string
+	h := kunaio.Chain(recording(&log, "a"), recording(&log, "b"),
+		kunaio.Chain(recording(&log, "c")))(
+		func(call *kunaio.Call) (*http.Response, error) {
+			log = append(log, "send")
+			return nil, nil
+		})
+	h(&kunaio.Call{Operation: "GetOrderBook"})
+	want := []string{"a GetOrderBook", "b GetOrderBook", "c GetOrderBook",
+		"send", "/c", "/b", "/a"}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("got %v, want %v", log, want)
+	}
+}
+
+func TestClientMiddlewareOrder(t *testing.T) {
+	_, _, stop := startMiddlewareServer(t, 0)
+	defer stop()
+	var log []string
+	client := kunaio.NewClient("ak", "sk").Use(recording(&log, "a"))
+	other := client.Use(recording(&log, "b"))
+	if _, err := other.GetUserInfo(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a GetUserInfo", "b GetUserInfo", "/b", "/a"}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("got %v, want %v", log, want)
+	}
+}
+
+// Inner middleware changes the copy of the call, which outer
+// middlewares don't see. Functions registered with OnDecoded on
+// the copy are called.
+func TestCallWithRequest(t *testing.T) {
+	_, _, stop := startMiddlewareServer(t, 0)
+	defer stop()
+	var decoded []error
+	outer := func(next kunaio.Handler) kunaio.Handler {
+		return func(call *kunaio.Call) (*http.Response, error) {
+			r := call.Request
+			resp, err := next(call)
+			if call.Request != r || r.Header.Get("X-Test") != "" {
+				t.Errorf("call is modified in place")
+			}
+			return resp, err
+		}
+	}
+	inner := func(next kunaio.Handler) kunaio.Handler {
+		return func(call *kunaio.Call) (*http.Response, error) {
+			r := call.Request.Clone(call.Request.Context())
+			r.Header.Set("X-Test", "1")
+			c := call.WithRequest(r)
+			if c.Operation != call.Operation || c.Private != call.Private {
+				t.Errorf("bad call copy: %+v", c)
+			}
+			c.OnDecoded(func(err error) { decoded = append(decoded, err) })
+			return next(c)
+		}
+	}
+	client := kunaio.NewClient("ak", "sk").Use(outer, inner)
+	if _, err := client.GetUserInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0] != nil {
+		t.Errorf("decoded: %v", decoded)
+	}
+}
+
+func TestOnDecodedError(t *testing.T) {
+	s, _, stop := startMiddlewareServer(t, 0)
+	defer stop()
+	s.SetFaults(fakeserver.Faults{MalformedRate: 1})
+	var decoded []error
+	client := kunaio.NewClient("ak", "sk").Use(func(next kunaio.Handler) kunaio.Handler {
+		return func(call *kunaio.Call) (*http.Response, error) {
+			call.OnDecoded(func(err error) { decoded = append(decoded, err) })
+			return next(call)
+		}
+	})
+	_, err := client.GetOrderBook(kunaio.BTCUAH)
+	if err == nil {
+		t.Fatal("malformed response decoded")
+	}
+	if len(decoded) != 1 || decoded[0] != err {
+		t.Errorf("decoded: %v, want %v", decoded, err)
+	}
+}
+
+// Signing is done after client middlewares, so every retry of a
+// private call is signed with fresh tonce.
+func TestRetry(t *testing.T) {
+	_, tonces, stop := startMiddlewareServer(t, 2)
+	defer stop()
+	var attempts int
+	client := kunaio.NewClient("ak", "sk").Use(
+		func(next kunaio.Handler) kunaio.Handler {
+			return func(call *kunaio.Call) (*http.Response, error) {
+				resp, err := next(call)
+				attempts = call.Attempts()
+				return resp, err
+			}
+		},
+		kunaio.Retry(3, time.Millisecond))
+	info, err := client.GetUserInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Email != "user@example.com" || attempts != 3 {
+		t.Errorf("got %+v after %d attempts", info, attempts)
+	}
+	if len(*tonces) != 3 || (*tonces)[0] == (*tonces)[1] ||
+		(*tonces)[1] == (*tonces)[2] {
+		t.Errorf("tonces: %v", *tonces)
+	}
+}
+
+func TestRetryLimits(t *testing.T) {
+	_, tonces, stop := startMiddlewareServer(t, 5)
+	defer stop()
+	client := kunaio.NewClient("ak", "sk").Use(kunaio.Retry(2, time.Millisecond))
+	if _, err := client.GetUserInfo(); err == nil ||
+		!strings.Contains(err.Error(), "503") {
+		t.Errorf("got error %v", err)
+	}
+	if len(*tonces) != 2 {
+		t.Errorf("sent %d times, want 2", len(*tonces))
+	}
+	// order placement is not retried
+	if _, err := client.NewOrder(kunaio.BTCUAH, "sell", 0.1, 160000); err == nil {
+		t.Error("order placed")
+	}
+	if len(*tonces) != 3 {
+		t.Errorf("sent %d times, want 3", len(*tonces))
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source of tonces for private requests. The exchange accepts
+// tonce in milliseconds, not older than 30 seconds, and rejects
+// tonces already used with the same access key.
+type NonceSource interface {
+	// Return next tonce, strictly greater than all the tonces
+	// returned before.
+	Next() (int64, error)
+}
+
+// Tonce source generating tonces for the given time. Signers with
+// own clock, e.g. corrected by ServerClock, use it instead of Next.
+// MonotonicNonce and FileNonce implement it.
+type TimedNonceSource interface {
+	NonceSource
+	// Return next tonce for the time, strictly greater than all
+	// the tonces returned before.
+	NextAt(t time.Time) (int64, error)
+}
+
+// Function returning tonces.
+type NonceFunc func() (int64, error)
+
+// Return next tonce.
+func (f NonceFunc) Next() (int64, error) {
+	return f()
+}
+
+var (
+	// Default tonce source, shared by all signers
+	gNonce = &MonotonicNonce{}
+	// Replacement of the default tonce source, see SetNonceSource
+	gNonceSource NonceSource
+)
+
+// Replace default tonce source of all signers without own source,
+// e.g. with FileNonce to share tonces between processes. Nil
+// restores the default. Not safe to call concurrently with API calls.
+func SetNonceSource(src NonceSource) {
+	gNonceSource = src
+}
+
+// In-process tonce source: current time in milliseconds, or the
+// previous tonce plus one when called more than once a millisecond.
+// Safe for concurrent use.
+type MonotonicNonce struct {
+	// Clock. Default is time.Now.
+	Now  func() time.Time
+	lock sync.Mutex
+	last int64
+}
+
+// Return next tonce.
+func (n *MonotonicNonce) Next() (int64, error) {
+	now := time.Now
+	if n.Now != nil {
+		now = n.Now
+	}
+	return n.after(now()), nil
+}
+
+// Return next tonce for the time.
+func (n *MonotonicNonce) NextAt(t time.Time) (int64, error) {
+	return n.after(t), nil
+}
+
+// Return next tonce for the time.
+func (n *MonotonicNonce) after(t time.Time) int64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.last = nextNonce(n.last, t)
+	return n.last
+}
+
+// Tonce source shared between processes by means of the file
+// keeping the last issued tonce. All the processes using the same
+// access key must use the same file.
+type FileNonce struct {
+	Path string
+	// Clock. Default is time.Now.
+	Now  func() time.Time
+	lock sync.Mutex
+}
+
+// Create file tonce source.
+func NewFileNonce(path string) *FileNonce {
+	return &FileNonce{Path: path}
+}
+
+// Return next tonce.
+func (n *FileNonce) Next() (int64, error) {
+	now := time.Now
+	if n.Now != nil {
+		now = n.Now
+	}
+	return n.NextAt(now())
+}
+
+// Return next tonce for the time.
+func (n *FileNonce) NextAt(t time.Time) (int64, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	unlock, err := lockFile(n.Path + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	var last int64
+	data, err := ioutil.ReadFile(n.Path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return 0, err
+	default:
+		s := strings.TrimSpace(string(data))
+		if last, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, fmt.Errorf("%s: bad tonce %#v", n.Path, s)
+		}
+	}
+	next := nextNonce(last, t)
+	err = writeFileAtomic(n.Path, []byte(strconv.FormatInt(next, 10)+"\n"))
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// Return time in milliseconds, or last+1 if it's not greater
+// than last.
+func nextNonce(last int64, t time.Time) int64 {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	if ms <= last {
+		return last + 1
+	}
+	return ms
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collect tonces from concurrent goroutines and check they are unique
+// and increasing within every goroutine.
+func checkNonces(t *testing.T, sources []NonceSource, perSource int) {
+	var (
+		lock sync.Mutex
+		seen = map[int64]bool{}
+		wg   sync.WaitGroup
+	)
+	for _, src := range sources {
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(src NonceSource) {
+				defer wg.Done()
+				var last int64
+				for i := 0; i < perSource; i++ {
+					n, err := src.Next()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if n <= last {
+						t.Errorf("tonce %d after %d", n, last)
+					}
+					last = n
+					lock.Lock()
+					if seen[n] {
+						t.Errorf("tonce %d reused", n)
+					}
+					seen[n] = true
+					lock.Unlock()
+				}
+			}(src)
+		}
+	}
+	wg.Wait()
+}
+
+func TestMonotonicNonce(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	n := &MonotonicNonce{Now: func() time.Time { return now }}
+	for i, expected := range []int64{1500000000000, 1500000000001} {
+		if v, _ := n.Next(); v != expected {
+			t.Errorf("#%d: tonce %d, expected %d", i, v, expected)
+		}
+	}
+	now = now.Add(time.Second)
+	if v, _ := n.Next(); v != 1500000001000 {
+		t.Errorf("tonce %d, expected 1500000001000", v)
+	}
+	// clock going backwards
+	now = now.Add(-time.Minute)
+	if v, _ := n.Next(); v != 1500000001001 {
+		t.Errorf("tonce %d, expected 1500000001001", v)
+	}
+	checkNonces(t, []NonceSource{&MonotonicNonce{}}, 1000)
+}
+
+func TestFileNonce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kunaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tonce")
+	// independent sources imitate different processes
+	checkNonces(t, []NonceSource{
+		NewFileNonce(path),
+		NewFileNonce(path),
+	}, 50)
+	n := NewFileNonce(path)
+	n.Now = func() time.Time { return time.Unix(1500000000, 0) }
+	first, err := n.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// state survives restart
+	n = NewFileNonce(path)
+	n.Now = func() time.Time { return time.Unix(1500000000, 0) }
+	if v, _ := n.Next(); v != first+1 {
+		t.Errorf("tonce %d, expected %d", v, first+1)
+	}
+}
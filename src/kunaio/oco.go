@@ -0,0 +1,847 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Order group kinds
+const (
+	// Two orders where execution of one cancels the other
+	GroupOCO = "oco"
+	// Entry order followed by take-profit and stop OCO pair
+	GroupBracket = "bracket"
+)
+
+// Order group states. The group state machine is:
+//
+//	entry  -> active | cancelled | failed   (brackets only)
+//	active -> done | cancelled | failed
+const (
+	// Bracket entry order is working
+	GroupEntry = "entry"
+	// OCO legs are working
+	GroupActive = "active"
+	// All legs are finished, at least one of them is executed
+	GroupDone = "done"
+	// Cancelled before any leg was executed
+	GroupCancelled = "cancelled"
+	// Order placement failed
+	GroupFailed = "failed"
+)
+
+// Order leg states
+const (
+	// Stop leg waiting for the trigger or exit leg waiting for
+	// the bracket entry to fill
+	LegPending = "pending"
+	// Order is being placed. Left after a crash, such legs are
+	// failed by Restore, since it is not known whether the order
+	// reached the exchange.
+	LegSubmitting = "submitting"
+	// Order is placed and nothing is executed yet
+	LegOpen = "open"
+	// Order is partially executed
+	LegPartial = "partial"
+	// Cancellation is requested but not confirmed yet
+	LegCancelling = "cancelling"
+	// Order is executed completely
+	LegFilled = "filled"
+	// Order is cancelled, possibly after partial execution
+	LegCancelled = "cancelled"
+	// Order placement failed
+	LegFailed = "failed"
+)
+
+// Default interval between order state checks
+const DefaultOCOPollInterval = 5 * time.Second
+
+// One order of an order group.
+type OrderLeg struct {
+	// Leg name: "a" and "b" for OCO, "entry", "take-profit"
+	// and "stop" for brackets
+	Name string `json:"name"`
+	// "buy" or "sell"
+	Side string `json:"side"`
+	// Order volume
+	Volume float64 `json:"volume"`
+	// Limit price. Zero means market order (allowed for bracket
+	// entry and stop legs only).
+	Price float64 `json:"price,omitempty"`
+	// If set, the leg is a client-side stop: the order is placed
+	// only when the last deal price crosses the stop price.
+	StopPrice float64 `json:"stop_price,omitempty"`
+	// Price which triggered the stop leg
+	TriggeredBy float64 `json:"triggered_by,omitempty"`
+	// One of Leg* states
+	State string `json:"state"`
+	// Exchange order ID
+	OrderID int `json:"order_id,omitempty"`
+	// Executed volume
+	Executed float64 `json:"executed"`
+}
+
+func (l *OrderLeg) finished() bool {
+	return l.State == LegFilled || l.State == LegCancelled ||
+		l.State == LegFailed
+}
+
+// Order group state transition record.
+type GroupEvent struct {
+	// Transition time
+	Time time.Time `json:"time"`
+	// Leg name or empty string for the group itself
+	Leg string `json:"leg"`
+	// Previous state
+	From string `json:"from"`
+	// New state
+	To string `json:"to"`
+	// Transition reason
+	Note string `json:"note"`
+}
+
+// OCO pair or bracket order.
+type OrderGroup struct {
+	// Local group ID
+	ID int `json:"id"`
+	// GroupOCO or GroupBracket
+	Kind string `json:"kind"`
+	// Market identifier
+	Market string `json:"market"`
+	// One of Group* states
+	State string `json:"state"`
+	// Bracket entry order, nil for OCO
+	Entry *OrderLeg `json:"entry,omitempty"`
+	// OCO legs. For brackets these are take-profit and stop.
+	Legs []*OrderLeg `json:"legs"`
+	// All state transitions, for audit
+	Events []GroupEvent `json:"events"`
+	notify func(group int, ev GroupEvent)
+	// serializes operations on the group
+	busy *sync.Mutex
+}
+
+// Return true if the group reached its final state.
+func (g *OrderGroup) Finished() bool {
+	return g.State == GroupDone || g.State == GroupCancelled ||
+		g.State == GroupFailed
+}
+
+// Return deep copy of the group.
+func (g *OrderGroup) copy() OrderGroup {
+	c := *g
+	if g.Entry != nil {
+		entry := *g.Entry
+		c.Entry = &entry
+	}
+	c.Legs = make([]*OrderLeg, len(g.Legs))
+	for i, l := range g.Legs {
+		leg := *l
+		c.Legs[i] = &leg
+	}
+	c.Events = append([]GroupEvent(nil), g.Events...)
+	return c
+}
+
+// File-based storage for order groups. All the groups are kept in
+// one JSON file which is replaced atomically on every update.
+type GroupStore struct {
+	path string
+	lock sync.Mutex
+}
+
+// Create order group storage, backed by the file.
+func NewGroupStore(path string) *GroupStore {
+	return &GroupStore{path: path}
+}
+
+// Return all stored order groups.
+func (s *GroupStore) Load() ([]OrderGroup, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var groups []OrderGroup
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("%s: %s", s.path, err)
+	}
+	return groups, nil
+}
+
+// Read-modify-write stored order groups. The update function is
+// called with exclusive access to the storage. If it returns an
+// error, the storage is left untouched.
+func (s *GroupStore) Update(update func([]OrderGroup) ([]OrderGroup, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	groups, err := s.Load()
+	if err != nil {
+		return err
+	}
+	groups, err = update(groups)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Places OCO and bracket orders and watches their execution. When
+// one leg of OCO pair is executed completely, the other leg is
+// cancelled. Partial execution reduces the volume of the pending
+// stop leg. Stop legs are kept on the client side until the price
+// crosses the stop price. Tracker state is kept in memory and, if
+// Store is set, saved on every change.
+type OCOTracker struct {
+	// API client used to place and watch orders
+	Client *Client
+	// Interval between order state checks. Zero means
+	// DefaultOCOPollInterval.
+	PollInterval time.Duration
+	// Price source for stop legs. Default is the last deal price
+	// from GetLatestStats.
+	Price func(market string) (float64, error)
+	// Optional hook called on every state transition
+	OnEvent func(group int, ev GroupEvent)
+	// Group storage. Groups saved by previous runs are resumed with
+	// Restore, which must be called before placing new groups. The
+	// store must not be shared by several trackers.
+	Store    *GroupStore
+	groups   []*OrderGroup
+	restored bool
+	lock     sync.Mutex
+}
+
+// Create new OCO tracker.
+func NewOCOTracker(client *Client) *OCOTracker {
+	return &OCOTracker{Client: client}
+}
+
+// Place OCO pair. Stop legs are not placed until triggered.
+func (t *OCOTracker) PlaceOCO(market string, a, b OrderLeg) (OrderGroup, error) {
+	a.Name, b.Name = "a", "b"
+	for _, l := range []*OrderLeg{&a, &b} {
+		if err := validateLeg(*l, false); err != nil {
+			return OrderGroup{}, err
+		}
+		l.State, l.TriggeredBy = "", 0
+	}
+	id, err := t.newGroup(GroupOCO, market, nil, []*OrderLeg{&a, &b})
+	if err != nil {
+		return OrderGroup{}, err
+	}
+	g, _ := t.update(id, t.placeLegs)
+	return g, groupError(&g)
+}
+
+// Place bracket order: entry order first, then, when it is filled,
+// take-profit limit order and client-side stop for the executed
+// volume. Side and volume of the exit legs are set by the tracker.
+func (t *OCOTracker) PlaceBracket(market string, entry, takeProfit, stop OrderLeg) (OrderGroup, error) {
+	entry.Name = "entry"
+	takeProfit.Name = "take-profit"
+	takeProfit.StopPrice = 0
+	stop.Name = "stop"
+	if err := validateLeg(entry, true); err != nil {
+		return OrderGroup{}, err
+	}
+	exitSide := "sell"
+	if entry.Side == "sell" {
+		exitSide = "buy"
+	}
+	for _, l := range []*OrderLeg{&takeProfit, &stop} {
+		l.Side = exitSide
+		l.Volume = entry.Volume
+		if err := validateLeg(*l, false); err != nil {
+			return OrderGroup{}, err
+		}
+	}
+	if stop.StopPrice <= 0 {
+		return OrderGroup{}, errors.New("stop: stop price must be positive")
+	}
+	entry.State, entry.TriggeredBy = "", 0
+	for _, l := range []*OrderLeg{&takeProfit, &stop} {
+		l.State, l.TriggeredBy = LegPending, 0
+	}
+	id, err := t.newGroup(GroupBracket, market, &entry,
+		[]*OrderLeg{&takeProfit, &stop})
+	if err != nil {
+		return OrderGroup{}, err
+	}
+	g, _ := t.update(id, func(g *OrderGroup) {
+		g.setLegState(g.Entry, LegPending, "")
+		t.placeLeg(g, g.Entry)
+		if g.Entry.State == LegFailed {
+			g.setState(GroupFailed, "entry order placement failed")
+		} else {
+			g.setState(GroupEntry, "entry order placed")
+		}
+	})
+	return g, groupError(&g)
+}
+
+func validateLeg(l OrderLeg, marketAllowed bool) error {
+	if l.Side != "buy" && l.Side != "sell" {
+		return fmt.Errorf("%s: invalid side: %#v", l.Name, l.Side)
+	}
+	if l.Volume <= 0 {
+		return fmt.Errorf("%s: volume must be positive", l.Name)
+	}
+	if l.Price < 0 || l.StopPrice < 0 {
+		return fmt.Errorf("%s: price must not be negative", l.Name)
+	}
+	if l.Price == 0 && l.StopPrice == 0 && !marketAllowed {
+		return fmt.Errorf("%s: price must be positive", l.Name)
+	}
+	return nil
+}
+
+func groupError(g *OrderGroup) error {
+	if g.State != GroupFailed {
+		return nil
+	}
+	return fmt.Errorf("group %d: %s", g.ID, g.Events[len(g.Events)-1].Note)
+}
+
+// Register new group. Returns the group ID. Group IDs continue
+// the ones in the store, so the store must be restored first.
+func (t *OCOTracker) newGroup(kind, market string, entry *OrderLeg, legs []*OrderLeg) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.Store != nil && !t.restored {
+		return 0, errors.New("order group store is not restored")
+	}
+	id := 1
+	if 0 < len(t.groups) {
+		id = t.groups[len(t.groups)-1].ID + 1
+	}
+	t.groups = append(t.groups, &OrderGroup{
+		ID:     id,
+		Kind:   kind,
+		Market: market,
+		Entry:  entry,
+		Legs:   legs,
+		notify: t.notify,
+		busy:   &sync.Mutex{},
+	})
+	return id, nil
+}
+
+// Return the group with the ID or nil. Must be called with the
+// lock held.
+func (t *OCOTracker) find(id int) *OrderGroup {
+	for _, g := range t.groups {
+		if g.ID == id {
+			return g
+		}
+	}
+	return nil
+}
+
+// Apply the function to a working copy of the group and publish
+// the result. The tracker is not locked while the function does
+// API calls; operations on the same group are serialized though.
+// The result is saved to the store.
+func (t *OCOTracker) update(id int, f func(g *OrderGroup)) (OrderGroup, bool) {
+	t.lock.Lock()
+	g := t.find(id)
+	t.lock.Unlock()
+	if g == nil {
+		return OrderGroup{}, false
+	}
+	g.busy.Lock()
+	defer g.busy.Unlock()
+	t.lock.Lock()
+	work := g.copy()
+	t.lock.Unlock()
+	f(&work)
+	t.lock.Lock()
+	*g = work.copy()
+	t.lock.Unlock()
+	t.save(&work)
+	return work, true
+}
+
+// Save the group to the store, if any.
+func (t *OCOTracker) save(g *OrderGroup) {
+	if t.Store == nil {
+		return
+	}
+	err := t.Store.Update(func(groups []OrderGroup) ([]OrderGroup, error) {
+		for i := range groups {
+			if groups[i].ID == g.ID {
+				groups[i] = *g
+				return groups, nil
+			}
+		}
+		return append(groups, *g), nil
+	})
+	if err != nil {
+		debugLog("order group %d: save: %s", g.ID, err)
+	}
+}
+
+// Load groups saved to the store by previous runs, so Run goes on
+// watching the unfinished ones. Legs left in LegSubmitting state
+// are failed, with the group, and their siblings are cancelled.
+// Must be called before placing new groups.
+func (t *OCOTracker) Restore() error {
+	if t.Store == nil {
+		return errors.New("order group store is not set")
+	}
+	groups, err := t.Store.Load()
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	if 0 < len(t.groups) || t.restored {
+		t.lock.Unlock()
+		return errors.New("order groups are placed already")
+	}
+	t.restored = true
+	for i := range groups {
+		g := groups[i].copy()
+		g.notify = t.notify
+		g.busy = &sync.Mutex{}
+		t.groups = append(t.groups, &g)
+	}
+	t.lock.Unlock()
+	for _, g := range groups {
+		if !g.Finished() {
+			t.update(g.ID, t.recover)
+		}
+	}
+	return nil
+}
+
+// Fail legs interrupted while placing the order.
+func (t *OCOTracker) recover(g *OrderGroup) {
+	const note = "interrupted while placing order; check user orders"
+	if g.Entry != nil && g.Entry.State == LegSubmitting {
+		g.setLegState(g.Entry, LegFailed, note)
+		g.setState(GroupFailed, "entry order placement interrupted")
+		return
+	}
+	for _, l := range g.Legs {
+		if l.State != LegSubmitting {
+			continue
+		}
+		g.setLegState(l, LegFailed, note)
+		for _, other := range g.Legs {
+			if other == l {
+				continue
+			}
+			if err := t.cancelLeg(g, other, "sibling placement interrupted"); err != nil {
+				debugLog("order group %d: %s", g.ID, err)
+			}
+		}
+		g.setState(GroupFailed,
+			fmt.Sprintf("%s order placement interrupted", l.Name))
+		return
+	}
+}
+
+// Return copy of the group.
+func (t *OCOTracker) Group(id int) (OrderGroup, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	g := t.find(id)
+	if g == nil {
+		return OrderGroup{}, false
+	}
+	return g.copy(), true
+}
+
+// Return copies of all groups.
+func (t *OCOTracker) Groups() []OrderGroup {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	res := make([]OrderGroup, len(t.groups))
+	for i, g := range t.groups {
+		res[i] = g.copy()
+	}
+	return res
+}
+
+// Cancel all working orders of the group.
+func (t *OCOTracker) Cancel(id int) error {
+	var err error
+	_, found := t.update(id, func(g *OrderGroup) {
+		if g.Finished() {
+			err = fmt.Errorf("order group %d is %s", id, g.State)
+			return
+		}
+		legs := g.Legs
+		if g.Entry != nil {
+			legs = append([]*OrderLeg{g.Entry}, legs...)
+		}
+		var executed bool
+		for _, l := range legs {
+			if err = t.cancelLeg(g, l, "cancelled by user"); err != nil {
+				return
+			}
+			// the volume executed until cancellation
+			t.refresh(g, l)
+			executed = executed || 0 < l.Executed
+		}
+		if executed {
+			g.setState(GroupDone, "cancelled by user after execution")
+		} else {
+			g.setState(GroupCancelled, "cancelled by user")
+		}
+	})
+	if !found {
+		return fmt.Errorf("no such order group: %d", id)
+	}
+	return err
+}
+
+// Watch order groups until the context is cancelled.
+func (t *OCOTracker) Run(ctx context.Context) error {
+	poll := t.PollInterval
+	if poll <= 0 {
+		poll = DefaultOCOPollInterval
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		t.Poll()
+	}
+}
+
+// Check all unfinished groups once.
+func (t *OCOTracker) Poll() {
+	var ids []int
+	t.lock.Lock()
+	for _, g := range t.groups {
+		if !g.Finished() {
+			ids = append(ids, g.ID)
+		}
+	}
+	t.lock.Unlock()
+	for _, id := range ids {
+		t.update(id, func(g *OrderGroup) {
+			switch g.State {
+			case GroupEntry:
+				t.pollEntry(g)
+			case GroupActive:
+				t.pollLegs(g)
+			}
+		})
+	}
+}
+
+func (t *OCOTracker) pollEntry(g *OrderGroup) {
+	t.refresh(g, g.Entry)
+	switch {
+	case g.Entry.State == LegFilled:
+		t.placeExits(g, "entry order filled")
+	case g.Entry.State == LegCancelled && 0 < g.Entry.Executed:
+		t.placeExits(g, "entry order cancelled after partial fill")
+	case g.Entry.State == LegCancelled:
+		g.setState(GroupCancelled, "entry order cancelled")
+	}
+}
+
+// Place bracket exit legs for the executed entry volume.
+func (t *OCOTracker) placeExits(g *OrderGroup, note string) {
+	for _, l := range g.Legs {
+		l.Volume = g.Entry.Executed
+	}
+	g.setState(GroupActive, note)
+	t.placeLegs(g)
+}
+
+// Place all non-stop legs. If any of them fails, the others are
+// cancelled.
+func (t *OCOTracker) placeLegs(g *OrderGroup) {
+	for _, l := range g.Legs {
+		if l.StopPrice != 0 {
+			g.setLegState(l, LegPending, "waiting for stop price")
+			continue
+		}
+		t.placeLeg(g, l)
+		if l.State != LegFailed {
+			continue
+		}
+		for _, other := range g.Legs {
+			if other != l {
+				t.cancelLeg(g, other, "sibling placement failed")
+			}
+		}
+		g.setState(GroupFailed, fmt.Sprintf("%s order placement failed", l.Name))
+		return
+	}
+	g.setState(GroupActive, "orders placed")
+}
+
+// Place leg order: limit one or market if no price given.
+func (t *OCOTracker) placeLeg(g *OrderGroup, l *OrderLeg) {
+	var (
+		order Order
+		err   error
+	)
+	// saved before placing the order, so the leg is not placed
+	// twice after a crash
+	g.setLegState(l, LegSubmitting, "placing order")
+	t.save(g)
+	if l.Price == 0 {
+		order, err = t.Client.NewMarketOrder(g.Market, l.Side, l.Volume)
+	} else {
+		order, err = t.Client.NewOrder(g.Market, l.Side, l.Volume, l.Price)
+	}
+	if err != nil {
+		g.setLegState(l, LegFailed, err.Error())
+		return
+	}
+	l.OrderID = order.ID
+	g.setLegState(l, LegOpen, fmt.Sprintf("order %d placed", order.ID))
+}
+
+// Cancel leg order if it is working. Pending legs are just marked
+// as cancelled.
+func (t *OCOTracker) cancelLeg(g *OrderGroup, l *OrderLeg, note string) error {
+	switch l.State {
+	case LegPending:
+		g.setLegState(l, LegCancelled, note)
+	case LegOpen, LegPartial:
+		// executed volume in the response is not final: the order
+		// can be executed until the cancellation takes effect,
+		// so it is taken from refresh afterwards
+		if _, err := t.Client.CancelOrder(l.OrderID); err != nil {
+			return fmt.Errorf("%s: cancel order %d: %s", l.Name,
+				l.OrderID, err)
+		}
+		g.setLegState(l, LegCancelling, note)
+	}
+	return nil
+}
+
+// Update leg state from the exchange.
+func (t *OCOTracker) refresh(g *OrderGroup, l *OrderLeg) {
+	if l.State != LegOpen && l.State != LegPartial &&
+		l.State != LegCancelling {
+		return
+	}
+	order, err := t.Client.GetOrder(l.OrderID)
+	if err != nil {
+		debugLog("order group %d: %s: get order %d: %s",
+			g.ID, l.Name, l.OrderID, err)
+		return
+	}
+	executed := l.Executed
+	l.Executed = order.ExecutedVolume
+	state := l.State
+	switch {
+	case order.State == OrderDone:
+		state = LegFilled
+	case order.State == OrderCancel:
+		state = LegCancelled
+	case l.State == LegCancelling:
+	case 0 < order.ExecutedVolume:
+		state = LegPartial
+	}
+	note := fmt.Sprintf("executed %f of %f",
+		order.ExecutedVolume, order.Volume)
+	if state == l.State && executed != l.Executed {
+		// record progress of partially executed order
+		g.addEvent(l.Name, state, state, note)
+	}
+	g.setLegState(l, state, note)
+}
+
+func (t *OCOTracker) pollLegs(g *OrderGroup) {
+	for _, l := range g.Legs {
+		t.refresh(g, l)
+	}
+	for _, l := range g.Legs {
+		if l.Executed == 0 {
+			continue
+		}
+		for _, other := range g.Legs {
+			switch {
+			case other == l:
+			case l.State == LegFilled && other.TriggeredBy == 0:
+				// complete execution cancels the others, except
+				// triggered stops, which are sized by checkStop
+				note := fmt.Sprintf("%s leg executed", l.Name)
+				if err := t.cancelLeg(g, other, note); err != nil {
+					debugLog("order group %d: %s", g.ID, err)
+				}
+			case other.State == LegPending && other.StopPrice != 0:
+				// partial execution leaves the stop for the rest
+				resizeStop(g, other, l.Volume-l.Executed)
+			}
+		}
+	}
+	for _, l := range g.Legs {
+		if l.State == LegPending && l.StopPrice != 0 {
+			t.checkStop(g, l)
+		}
+	}
+	t.checkFinished(g)
+}
+
+// Reduce volume of pending stop leg to the volume left by its
+// partially executed sibling.
+func resizeStop(g *OrderGroup, l *OrderLeg, volume float64) {
+	if l.Volume <= volume {
+		return
+	}
+	g.addEvent(l.Name, l.State, l.State,
+		fmt.Sprintf("volume reduced from %f to %f", l.Volume, volume))
+	l.Volume = volume
+}
+
+// Place stop leg order if the price crossed the stop price.
+func (t *OCOTracker) checkStop(g *OrderGroup, l *OrderLeg) {
+	if l.TriggeredBy == 0 {
+		price, err := t.price(g.Market)
+		if err != nil {
+			debugLog("order group %d: %s price: %s", g.ID, g.Market, err)
+			return
+		}
+		if (l.Side == "sell" && l.StopPrice < price) ||
+			(l.Side == "buy" && price < l.StopPrice) {
+			return
+		}
+		// the trigger is kept even if the price goes back
+		l.TriggeredBy = price
+		g.addEvent(l.Name, l.State, l.State,
+			fmt.Sprintf("triggered at %f", price))
+		t.save(g)
+	}
+	// cancel the siblings first and wait for the cancellation to
+	// be confirmed, so the position is never closed twice
+	note := fmt.Sprintf("%s leg triggered at %f", l.Name, l.TriggeredBy)
+	volume := l.Volume
+	for _, other := range g.Legs {
+		if other == l {
+			continue
+		}
+		if err := t.cancelLeg(g, other, note); err != nil {
+			debugLog("order group %d: %s", g.ID, err)
+			return
+		}
+		t.refresh(g, other)
+		if !other.finished() {
+			// check again on the next poll
+			return
+		}
+		volume = math.Min(volume, other.Volume-other.Executed)
+	}
+	if volume <= 0 {
+		g.setLegState(l, LegCancelled, "volume is covered by sibling")
+		return
+	}
+	l.Volume = volume
+	t.placeLeg(g, l)
+	if l.State == LegFailed {
+		g.setState(GroupFailed, "stop order placement failed")
+	}
+}
+
+func (t *OCOTracker) checkFinished(g *OrderGroup) {
+	executed := 0
+	for _, l := range g.Legs {
+		if !l.finished() {
+			return
+		}
+		if 0 < l.Executed {
+			executed++
+		}
+	}
+	switch {
+	case executed == 0:
+		g.setState(GroupCancelled, "all legs cancelled")
+	case 1 < executed:
+		g.setState(GroupDone, "more than one leg executed")
+	default:
+		g.setState(GroupDone, "one leg executed")
+	}
+}
+
+func (t *OCOTracker) price(market string) (float64, error) {
+	if t.Price != nil {
+		return t.Price(market)
+	}
+	stats, err := t.Client.GetLatestStats(market)
+	if err != nil {
+		return 0, err
+	}
+	return stats.Last, nil
+}
+
+func (t *OCOTracker) notify(group int, ev GroupEvent) {
+	if t.OnEvent != nil {
+		t.OnEvent(group, ev)
+	}
+}
+
+// Change group state and record the transition.
+func (g *OrderGroup) setState(state, note string) {
+	if g.State == state {
+		return
+	}
+	g.addEvent("", g.State, state, note)
+	g.State = state
+}
+
+// Change leg state and record the transition.
+func (g *OrderGroup) setLegState(l *OrderLeg, state, note string) {
+	if l.State == state {
+		return
+	}
+	g.addEvent(l.Name, l.State, state, note)
+	l.State = state
+}
+
+func (g *OrderGroup) addEvent(leg, from, to, note string) {
+	ev := GroupEvent{
+		Time: time.Now(),
+		Leg:  leg,
+		From: from,
+		To:   to,
+		Note: note,
+	}
+	g.Events = append(g.Events, ev)
+	if g.notify != nil {
+		g.notify(g.ID, ev)
+	}
+}
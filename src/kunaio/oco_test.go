@@ -0,0 +1,302 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Start fake server with an account holding 1 BTC and create OCO
+// tracker for it. The tracker takes prices from the returned
+// variable.
+func startOCO(t *testing.T) (*fakeserver.Server, *kunaio.OCOTracker, *float64, func()) {
+	t.Helper()
+	s := fakeserver.New()
+	s.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"btc": 1, "uah": 0})
+	ts := httptest.NewServer(s)
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	tracker := kunaio.NewOCOTracker(kunaio.NewClient("ak", "sk"))
+	price := 150000.0
+	tracker.Price = func(string) (float64, error) { return price, nil }
+	// hooks are called without the tracker lock held
+	tracker.OnEvent = func(int, kunaio.GroupEvent) { tracker.Groups() }
+	return s, tracker, &price, func() {
+		kunaio.SetBaseURL(old)
+		ts.Close()
+	}
+}
+
+func seed(t *testing.T, s *fakeserver.Server, side string, volume, price float64) {
+	t.Helper()
+	if _, err := s.SeedOrder(kunaio.BTCUAH, side, volume, price); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Place OCO pair selling 0.5 BTC at 160000 or at market when the
+// price drops to 140000.
+func placeOCO(t *testing.T, tracker *kunaio.OCOTracker) int {
+	t.Helper()
+	g, err := tracker.PlaceOCO(kunaio.BTCUAH,
+		kunaio.OrderLeg{Side: "sell", Volume: 0.5, Price: 160000},
+		kunaio.OrderLeg{Side: "sell", Volume: 0.5, StopPrice: 140000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGroup(t, tracker, g.ID, kunaio.GroupActive,
+		kunaio.LegOpen, 0, kunaio.LegPending, 0)
+	return g.ID
+}
+
+func checkGroup(t *testing.T, tracker *kunaio.OCOTracker, id int, state, a string, ea float64, b string, eb float64) {
+	t.Helper()
+	g, ok := tracker.Group(id)
+	if !ok {
+		t.Fatalf("group %d not found", id)
+	}
+	if g.State != state || g.Legs[0].State != a || g.Legs[1].State != b ||
+		1e-9 < math.Abs(g.Legs[0].Executed-ea) ||
+		1e-9 < math.Abs(g.Legs[1].Executed-eb) {
+		t.Errorf("expected %s, a %s (%v), b %s (%v), got %s, a %+v, b %+v",
+			state, a, ea, b, eb, g.State, *g.Legs[0], *g.Legs[1])
+	}
+}
+
+func checkBTC(t *testing.T, s *fakeserver.Server, balance float64) {
+	t.Helper()
+	b, l := s.Balance("ak", "btc")
+	if 1e-9 < math.Abs(b+l-balance) {
+		t.Errorf("expected %v BTC, got %v (locked %v)", balance, b, l)
+	}
+}
+
+func TestOCOFill(t *testing.T) {
+	s, tracker, _, stop := startOCO(t)
+	defer stop()
+	id := placeOCO(t, tracker)
+	tracker.Poll()
+	checkGroup(t, tracker, id, kunaio.GroupActive,
+		kunaio.LegOpen, 0, kunaio.LegPending, 0)
+	seed(t, s, "buy", 0.5, 160000)
+	tracker.Poll()
+	checkGroup(t, tracker, id, kunaio.GroupDone,
+		kunaio.LegFilled, 0.5, kunaio.LegCancelled, 0)
+	checkBTC(t, s, 0.5)
+}
+
+func TestOCOPartialFill(t *testing.T) {
+	s, tracker, _, stop := startOCO(t)
+	defer stop()
+	id := placeOCO(t, tracker)
+	seed(t, s, "buy", 0.2, 160000)
+	tracker.Poll()
+	// the stop is kept for the rest of the volume
+	checkGroup(t, tracker, id, kunaio.GroupActive,
+		kunaio.LegPartial, 0.2, kunaio.LegPending, 0)
+	g, _ := tracker.Group(id)
+	if 1e-9 < math.Abs(g.Legs[1].Volume-0.3) {
+		t.Errorf("bad stop leg: %+v", *g.Legs[1])
+	}
+	seed(t, s, "buy", 0.3, 160000)
+	tracker.Poll()
+	checkGroup(t, tracker, id, kunaio.GroupDone,
+		kunaio.LegFilled, 0.5, kunaio.LegCancelled, 0)
+	checkBTC(t, s, 0.5)
+}
+
+// Cancellation responses report the order as active and not
+// executed, as the exchange does before the cancellation takes
+// effect.
+func staleCancel(next kunaio.Handler) kunaio.Handler {
+	return func(call *kunaio.Call) (*http.Response, error) {
+		resp, err := next(call)
+		if err != nil || call.Operation != "CancelOrder" {
+			return resp, err
+		}
+		var order map[string]interface{}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err := json.Unmarshal(data, &order); err == nil {
+			order["state"] = kunaio.OrderWait
+			order["executed_volume"] = "0.0"
+			data, _ = json.Marshal(order)
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		resp.ContentLength = int64(len(data))
+		return resp, nil
+	}
+}
+
+// The stop leg is sized by the volume the sibling executed until
+// its cancellation was confirmed.
+func TestOCOStop(t *testing.T) {
+	s, tracker, price, stop := startOCO(t)
+	defer stop()
+	tracker.Client.Use(staleCancel)
+	id := placeOCO(t, tracker)
+	seed(t, s, "buy", 1, 130000)
+	*price = 140001
+	tracker.Poll()
+	checkGroup(t, tracker, id, kunaio.GroupActive,
+		kunaio.LegOpen, 0, kunaio.LegPending, 0)
+	// the limit leg is partially executed while the stop triggers
+	tracker.Price = func(string) (float64, error) {
+		seed(t, s, "buy", 0.2, 160000)
+		tracker.Price = func(string) (float64, error) { return 135000, nil }
+		return 135000, nil
+	}
+	tracker.Poll()
+	checkGroup(t, tracker, id, kunaio.GroupActive,
+		kunaio.LegCancelled, 0.2, kunaio.LegOpen, 0)
+	g, _ := tracker.Group(id)
+	if g.Legs[1].Volume != 0.3 || g.Legs[1].TriggeredBy != 135000 {
+		t.Errorf("bad stop leg: %+v", *g.Legs[1])
+	}
+	tracker.Poll()
+	checkGroup(t, tracker, id, kunaio.GroupDone,
+		kunaio.LegCancelled, 0.2, kunaio.LegFilled, 0.3)
+	checkBTC(t, s, 0.5)
+}
+
+func TestOCOCancel(t *testing.T) {
+	s, tracker, _, stop := startOCO(t)
+	defer stop()
+	id := placeOCO(t, tracker)
+	if err := tracker.Cancel(id); err != nil {
+		t.Fatal(err)
+	}
+	checkGroup(t, tracker, id, kunaio.GroupCancelled,
+		kunaio.LegCancelled, 0, kunaio.LegCancelled, 0)
+	checkBTC(t, s, 1)
+	if b, l := s.Balance("ak", "btc"); b != 1 || l != 0 {
+		t.Errorf("funds are locked: %v %v", b, l)
+	}
+	if err := tracker.Cancel(id); err == nil {
+		t.Error("finished group cancelled")
+	}
+	if err := tracker.Cancel(id + 1); err == nil {
+		t.Error("unknown group cancelled")
+	}
+	// partially executed group is done
+	id = placeOCO(t, tracker)
+	seed(t, s, "buy", 0.1, 160000)
+	if err := tracker.Cancel(id); err != nil {
+		t.Fatal(err)
+	}
+	checkGroup(t, tracker, id, kunaio.GroupDone,
+		kunaio.LegCancelled, 0.1, kunaio.LegCancelled, 0)
+}
+
+func TestOCORestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kunaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := kunaio.NewGroupStore(filepath.Join(dir, "groups.json"))
+	s, tracker, _, stop := startOCO(t)
+	defer stop()
+	tracker.Store = store
+	if _, err := tracker.PlaceOCO(kunaio.BTCUAH,
+		kunaio.OrderLeg{Side: "sell", Volume: 0.5, Price: 160000},
+		kunaio.OrderLeg{Side: "sell", Volume: 0.5, Price: 170000}); err == nil {
+		t.Error("group placed before restoring the store")
+	}
+	if err := tracker.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	first := placeOCO(t, tracker)
+	second := placeOCO(t, tracker)
+	if second != first+1 {
+		t.Errorf("expected group %d, got %d", first+1, second)
+	}
+	// crash while placing the first leg of the second group
+	err = store.Update(func(groups []kunaio.OrderGroup) ([]kunaio.OrderGroup, error) {
+		groups[1].Legs[0].State = kunaio.LegSubmitting
+		return groups, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := kunaio.NewOCOTracker(tracker.Client)
+	restarted.Store = store
+	restarted.Price = tracker.Price
+	if err := restarted.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Restore(); err == nil {
+		t.Error("restored twice")
+	}
+	checkGroup(t, restarted, first, kunaio.GroupActive,
+		kunaio.LegOpen, 0, kunaio.LegPending, 0)
+	checkGroup(t, restarted, second, kunaio.GroupFailed,
+		kunaio.LegFailed, 0, kunaio.LegCancelled, 0)
+	g, _ := restarted.Group(second)
+	if !strings.Contains(g.Events[len(g.Events)-1].Note, "interrupted") {
+		t.Errorf("bad events: %+v", g.Events)
+	}
+	seed(t, s, "buy", 0.5, 160000)
+	restarted.Poll()
+	checkGroup(t, restarted, first, kunaio.GroupDone,
+		kunaio.LegFilled, 0.5, kunaio.LegCancelled, 0)
+	groups, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0].State != kunaio.GroupDone ||
+		groups[1].State != kunaio.GroupFailed {
+		t.Errorf("bad stored groups: %+v", groups)
+	}
+	// the order of the interrupted leg is left on the exchange
+	if _, err := restarted.Client.CancelOrder(g.Legs[0].OrderID); err != nil {
+		t.Fatal(err)
+	}
+	third := placeOCO(t, restarted)
+	if third != second+1 {
+		t.Errorf("expected group %d, got %d", second+1, third)
+	}
+}
+
+// Partially executed limit leg reduces the stop, which closes the
+// rest of the position when triggered.
+func TestOCOPartialFillStop(t *testing.T) {
+	s, tracker, price, stop := startOCO(t)
+	defer stop()
+	id := placeOCO(t, tracker)
+	seed(t, s, "buy", 0.2, 160000)
+	tracker.Poll()
+	seed(t, s, "buy", 1, 130000)
+	*price = 135000
+	tracker.Poll()
+	tracker.Poll()
+	checkGroup(t, tracker, id, kunaio.GroupDone,
+		kunaio.LegCancelled, 0.2, kunaio.LegFilled, 0.3)
+	checkBTC(t, s, 0.5)
+}
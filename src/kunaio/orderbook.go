@@ -0,0 +1,96 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"sort"
+)
+
+// Return the highest bid price. Second value is false if
+// there are no bids in the book.
+func (b OrderBook) BestBid() (float64, bool) {
+	if len(b.Bids) == 0 {
+		return 0, false
+	}
+	max := b.Bids[0].Price
+	for _, e := range b.Bids {
+		if max < e.Price {
+			max = e.Price
+		}
+	}
+	return max, true
+}
+
+// Return the lowest ask price. Second value is false if
+// there are no asks in the book.
+func (b OrderBook) BestAsk() (float64, bool) {
+	if len(b.Asks) == 0 {
+		return 0, false
+	}
+	min := b.Asks[0].Price
+	for _, e := range b.Asks {
+		if e.Price < min {
+			min = e.Price
+		}
+	}
+	return min, true
+}
+
+// Return the worst price needed to trade the volume immediately
+// against the book: walk asks for "buy" side and bids for "sell".
+// If the book is too thin, the price of the last level is returned.
+// Second value is false if the opposite side of the book is empty.
+func (b OrderBook) SweepPrice(side string, volume float64) (float64, bool) {
+	levels := make(Orders, 0, len(b.Asks))
+	if side == "buy" {
+		levels = append(levels, b.Asks...)
+		sort.Slice(levels, func(i, j int) bool {
+			return levels[i].Price < levels[j].Price
+		})
+	} else {
+		levels = append(levels, b.Bids...)
+		sort.Slice(levels, func(i, j int) bool {
+			return levels[j].Price < levels[i].Price
+		})
+	}
+	if len(levels) == 0 {
+		return 0, false
+	}
+	var sum float64
+	for _, e := range levels {
+		sum += e.RemainingVolume
+		if volume <= sum {
+			return e.Price, true
+		}
+	}
+	return levels[len(levels)-1].Price, true
+}
+
+// Return middle price between the best bid and the best ask. If one
+// side of the book is empty, the best price of the other side is
+// returned.
+func (b OrderBook) MidPrice() (float64, bool) {
+	bid, okBid := b.BestBid()
+	ask, okAsk := b.BestAsk()
+	switch {
+	case okBid && okAsk:
+		return (bid + ask) / 2, true
+	case okBid:
+		return bid, true
+	case okAsk:
+		return ask, true
+	}
+	return 0, false
+}
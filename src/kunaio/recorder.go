@@ -0,0 +1,370 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Default number of order book levels kept in snapshots
+	DefaultSnapshotDepth = 10
+	// Default recording schedule
+	DefaultRecordSchedule = "@every 1m"
+	// Snapshot file name suffix
+	snapshotSuffix = ".snap.gz"
+)
+
+// Order book price level.
+type BookLevel struct {
+	Price  float64 `json:"price"`
+	Volume float64 `json:"volume"`
+}
+
+// Market state at a moment of time.
+type Snapshot struct {
+	// Snapshot time (local)
+	Time time.Time `json:"time"`
+	// Market identifier
+	Market string `json:"market"`
+	// Latest market stats
+	Stats Stats `json:"stats"`
+	// Top asks, the best first
+	Asks []BookLevel `json:"asks"`
+	// Top bids, the best first
+	Bids []BookLevel `json:"bids"`
+}
+
+// Return the best ask and bid price difference. Zero if any side
+// of the book is empty.
+func (s Snapshot) Spread() float64 {
+	if len(s.Asks) == 0 || len(s.Bids) == 0 {
+		return 0
+	}
+	return s.Asks[0].Price - s.Bids[0].Price
+}
+
+// Return top levels of the order book side sorted by price:
+// ascending for asks, descending for bids.
+func topLevels(orders Orders, depth int, asks bool) []BookLevel {
+	levels := make([]BookLevel, 0, len(orders))
+	for _, o := range orders {
+		levels = append(levels, BookLevel{o.Price, o.RemainingVolume})
+	}
+	sort.SliceStable(levels, func(i, j int) bool {
+		if asks {
+			return levels[i].Price < levels[j].Price
+		}
+		return levels[j].Price < levels[i].Price
+	})
+	if depth < len(levels) {
+		levels = levels[:depth]
+	}
+	return levels
+}
+
+// Records market stats and order book snapshots on schedule into
+// gzip-compressed files, partitioned by market and day (UTC):
+//
+//	DIR/MARKET/YYYY-MM-DD-HHMMSS.snap.gz
+//
+// Every snapshot is written as a separate gzip member, so the file
+// stays readable if the process is killed. Each recorder run starts
+// new files, so nothing is appended after a torn member.
+type Recorder struct {
+	// API client
+	Client *Client
+	// Target directory
+	Dir string
+	// Markets to record. Default is all supported markets.
+	Markets []string
+	// Number of order book levels to keep. Zero means
+	// DefaultSnapshotDepth.
+	Depth int
+	// Recording schedule. Default is DefaultRecordSchedule.
+	Schedule Schedule
+	// Optional hook called after every recorded snapshot
+	OnSnapshot func(Snapshot)
+	// current file name per market
+	files map[string]string
+}
+
+// Create new recorder.
+func NewRecorder(client *Client, dir string) *Recorder {
+	return &Recorder{
+		Client: client,
+		Dir:    dir,
+	}
+}
+
+// Record snapshots until the context is cancelled.
+func (r *Recorder) Run(ctx context.Context) error {
+	schedule := r.Schedule
+	if schedule == nil {
+		s, err := ParseSchedule(DefaultRecordSchedule)
+		if err != nil {
+			return err
+		}
+		schedule = s
+	}
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			return nil
+		}
+		if err := sleep(ctx, time.Until(next)); err != nil {
+			return err
+		}
+		if err := r.Record(); err != nil {
+			debugLog("recorder: %s", err)
+		}
+	}
+}
+
+// Record snapshot of every market once. A failed market does not
+// stop recording of the others; the last error is returned.
+func (r *Recorder) Record() error {
+	markets := r.Markets
+	if len(markets) == 0 {
+		markets = SupportedMarkets()
+	}
+	depth := r.Depth
+	if depth <= 0 {
+		depth = DefaultSnapshotDepth
+	}
+	var lastErr error
+	for _, market := range markets {
+		snap := Snapshot{
+			Time:   time.Now(),
+			Market: market,
+		}
+		stats, err := r.Client.GetLatestStats(market)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: get stats: %s", market, err)
+			continue
+		}
+		obook, err := r.Client.GetOrderBook(market)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: get order book: %s", market, err)
+			continue
+		}
+		snap.Stats = stats
+		snap.Asks = topLevels(obook.Asks, depth, true)
+		snap.Bids = topLevels(obook.Bids, depth, false)
+		if err := r.write(snap); err != nil {
+			lastErr = fmt.Errorf("%s: write snapshot: %s", market, err)
+			continue
+		}
+		if r.OnSnapshot != nil {
+			r.OnSnapshot(snap)
+		}
+	}
+	return lastErr
+}
+
+// Return snapshot files of the market for the day, in time order.
+func snapshotFiles(dir, market string, day time.Time) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, market,
+		day.UTC().Format(archiveDayLayout)+"-*"+snapshotSuffix))
+	sort.Strings(files)
+	return files, err
+}
+
+// Append snapshot to the current file as a new gzip member.
+func (r *Recorder) write(snap Snapshot) error {
+	if r.files == nil {
+		r.files = map[string]string{}
+	}
+	day := snap.Time.UTC().Format(archiveDayLayout)
+	path := r.files[snap.Market]
+	if !strings.HasPrefix(filepath.Base(path), day) {
+		path = filepath.Join(r.Dir, snap.Market,
+			snap.Time.UTC().Format(archiveDayLayout+"-150405")+snapshotSuffix)
+		r.files[snap.Market] = path
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(f)
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Time-ordered iterator over recorded snapshots. Usage:
+//
+//	it, err := kunaio.OpenSnapshots(dir, market, from, to)
+//	defer it.Close()
+//	for it.Next() {
+//	    snap := it.Snapshot()
+//	    ...
+//	}
+//	err = it.Err()
+//
+// Snapshots which cannot be decoded and the rest of files failing
+// gzip checksum are skipped and counted, see Skipped.
+type SnapshotIterator struct {
+	files   []string
+	from    time.Time
+	to      time.Time
+	file    *os.File
+	reader  *gzip.Reader
+	scanner *bufio.Scanner
+	current Snapshot
+	err     error
+	skipped int
+}
+
+// Open iterator over snapshots of the market recorded in the
+// [from, to) time range.
+func OpenSnapshots(dir, market string, from, to time.Time) (*SnapshotIterator, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	it := &SnapshotIterator{from: from, to: to}
+	y, m, d := from.UTC().Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC); day.Before(to); day = day.AddDate(0, 0, 1) {
+		files, err := snapshotFiles(dir, market, day)
+		if err != nil {
+			return nil, err
+		}
+		it.files = append(it.files, files...)
+	}
+	return it, nil
+}
+
+// Advance to the next snapshot. Returns false when there are no
+// more snapshots or an error occurred.
+func (it *SnapshotIterator) Next() bool {
+	for it.err == nil {
+		if it.scanner == nil {
+			if len(it.files) == 0 {
+				return false
+			}
+			if it.err = it.open(it.files[0]); it.err != nil {
+				return false
+			}
+			it.files = it.files[1:]
+		}
+		if !it.scanner.Scan() {
+			err := it.scanner.Err()
+			if err == gzip.ErrChecksum {
+				// the rest of the file cannot be trusted
+				debugLog("snapshots: %s: %s", it.file.Name(), err)
+				it.skipped++
+				it.closeFile()
+				continue
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				it.err = fmt.Errorf("%s: %s", it.file.Name(), err)
+				return false
+			}
+			// truncated last member is a torn write
+			it.closeFile()
+			continue
+		}
+		var snap Snapshot
+		if err := json.Unmarshal(it.scanner.Bytes(), &snap); err != nil {
+			debugLog("snapshots: %s: %s", it.file.Name(), err)
+			it.skipped++
+			continue
+		}
+		if snap.Time.Before(it.from) || !snap.Time.Before(it.to) {
+			continue
+		}
+		it.current = snap
+		return true
+	}
+	return false
+}
+
+func (it *SnapshotIterator) open(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	it.file = f
+	it.reader = r
+	it.scanner = bufio.NewScanner(r)
+	it.scanner.Buffer(nil, 16<<20)
+	return nil
+}
+
+func (it *SnapshotIterator) closeFile() {
+	if it.file != nil {
+		it.reader.Close()
+		it.file.Close()
+	}
+	it.file = nil
+	it.reader = nil
+	it.scanner = nil
+}
+
+// Return current snapshot.
+func (it *SnapshotIterator) Snapshot() Snapshot {
+	return it.current
+}
+
+// Return the error which stopped the iteration, if any.
+func (it *SnapshotIterator) Err() error {
+	return it.err
+}
+
+// Return number of snapshots skipped so far because they could
+// not be decoded, plus number of files cut short by a checksum
+// error.
+func (it *SnapshotIterator) Skipped() int {
+	return it.skipped
+}
+
+// Release the iterator resources.
+func (it *SnapshotIterator) Close() error {
+	it.closeFile()
+	it.files = nil
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+func TestRecorderRecord(t *testing.T) {
+	s := fakeserver.New()
+	for _, o := range []struct {
+		side          string
+		volume, price float64
+	}{{"buy", 1, 40}, {"buy", 2, 39}, {"sell", 0.5, 41}} {
+		if _, err := s.SeedOrder(kunaio.BTCUAH, o.side, o.volume, o.price); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	defer kunaio.SetBaseURL(old)
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := kunaio.NewRecorder(kunaio.NewClient("", ""), dir)
+	r.Markets = []string{kunaio.ETHUAH, kunaio.BTCUAH}
+	r.Depth = 1
+	// directory of the first market cannot be created
+	if err := ioutil.WriteFile(filepath.Join(dir, kunaio.ETHUAH), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var recorded []string
+	r.OnSnapshot = func(snap kunaio.Snapshot) {
+		recorded = append(recorded, snap.Market)
+	}
+	start := time.Now()
+	err = r.Record()
+	if err == nil || !strings.HasPrefix(err.Error(), "ethuah: write snapshot: ") {
+		t.Errorf("got %v", err)
+	}
+	if want := []string{kunaio.BTCUAH}; !reflect.DeepEqual(recorded, want) {
+		t.Errorf("recorded %v, want %v", recorded, want)
+	}
+	it, err := kunaio.OpenSnapshots(dir, kunaio.BTCUAH, start.Add(-time.Second),
+		time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if !it.Next() {
+		t.Fatalf("no snapshots: %v", it.Err())
+	}
+	snap := it.Snapshot()
+	if snap.Stats.Buy != 40 || snap.Stats.Sell != 41 ||
+		!reflect.DeepEqual(snap.Bids, []kunaio.BookLevel{{Price: 40, Volume: 1}}) ||
+		!reflect.DeepEqual(snap.Asks, []kunaio.BookLevel{{Price: 41, Volume: 0.5}}) {
+		t.Errorf("snapshot: %+v", snap)
+	}
+	if it.Next() {
+		t.Errorf("extra snapshot: %+v", it.Snapshot())
+	}
+}
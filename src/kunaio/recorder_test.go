@@ -0,0 +1,193 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempRecorder(t *testing.T) *Recorder {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRecorder(NewClient("", ""), dir)
+}
+
+// Read all snapshots of the range and return their times.
+func readSnapshots(t *testing.T, dir string, from, to time.Time) ([]time.Time, int) {
+	t.Helper()
+	it, err := OpenSnapshots(dir, BTCUAH, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var res []time.Time
+	for it.Next() {
+		res = append(res, it.Snapshot().Time)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res, it.Skipped()
+}
+
+func TestSnapshotsRange(t *testing.T) {
+	r := tempRecorder(t)
+	defer os.RemoveAll(r.Dir)
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	var times []time.Time
+	for _, d := range []time.Duration{-time.Hour, -time.Second, 0,
+		time.Hour, 23 * time.Hour, 24 * time.Hour, 25 * time.Hour} {
+		times = append(times, day.Add(d))
+	}
+	for _, tm := range times {
+		if err := r.write(Snapshot{Time: tm, Market: BTCUAH}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// snapshot of another market is not read
+	if err := r.write(Snapshot{Time: day, Market: "ethuah"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name     string
+		from, to time.Time
+		want     []time.Time
+	}{
+		{"day", day, day.AddDate(0, 0, 1), times[2:5]},
+		{"two days", day.Add(-time.Hour), day.Add(25 * time.Hour),
+			times[:6]},
+		{"up to the day start", day.Add(-time.Hour), day,
+			times[:2]},
+		{"inside the day", day.Add(time.Minute), day.Add(24 * time.Hour),
+			times[3:5]},
+		{"empty", day.Add(time.Minute), day.Add(time.Hour), nil},
+		{"no files", day.AddDate(0, 1, 0), day.AddDate(0, 2, 0), nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got, _ := readSnapshots(t, r.Dir, c.from, c.to)
+			if len(got) != len(c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if !got[i].Equal(c.want[i]) {
+					t.Fatalf("got %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotsCorrupted(t *testing.T) {
+	r := tempRecorder(t)
+	defer os.RemoveAll(r.Dir)
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		snap := Snapshot{Time: start.Add(time.Duration(i) * time.Minute),
+			Market: BTCUAH, Asks: []BookLevel{{41, 1}}}
+		if err := r.write(snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := r.files[BTCUAH]
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// undecodable snapshot in the middle of the file
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	w.Write([]byte("{\"time\":\n"))
+	w.Close()
+	f.Close()
+	snap := Snapshot{Time: start.Add(3 * time.Minute), Market: BTCUAH}
+	if err := r.write(snap); err != nil {
+		t.Fatal(err)
+	}
+	// process killed while writing the last member
+	full, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Time = start.Add(4 * time.Minute)
+	if err := r.write(snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, int64(len(full))+20); err != nil {
+		t.Fatal(err)
+	}
+	got, skipped := readSnapshots(t, r.Dir, start, start.Add(time.Hour))
+	want := []time.Time{start, start.Add(time.Minute),
+		start.Add(2 * time.Minute), start.Add(3 * time.Minute)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if skipped != 1 {
+		t.Errorf("%d snapshots skipped, want 1", skipped)
+	}
+	// the file is torn in the first member
+	if err := ioutil.WriteFile(path, data[:len(data)/6], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readSnapshots(t, r.Dir, start, start.Add(time.Hour)); len(got) != 0 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestSnapshotsChecksum(t *testing.T) {
+	r := tempRecorder(t)
+	defer os.RemoveAll(r.Dir)
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		snap := Snapshot{Time: start.Add(time.Duration(i) * time.Minute),
+			Market: BTCUAH}
+		if err := r.write(snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := r.files[BTCUAH]
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CRC-32 of the last member precedes its 4 byte size
+	data[len(data)-8] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the next recorder run starts a new file
+	r.files = nil
+	last := start.Add(time.Hour)
+	if err := r.write(Snapshot{Time: last, Market: BTCUAH}); err != nil {
+		t.Fatal(err)
+	}
+	got, skipped := readSnapshots(t, r.Dir, start, start.AddDate(0, 0, 1))
+	if len(got) == 0 || !got[len(got)-1].Equal(last) {
+		t.Errorf("got %v, want snapshots up to %v", got, last)
+	}
+	if skipped != 1 {
+		t.Errorf("%d skipped, want 1", skipped)
+	}
+}
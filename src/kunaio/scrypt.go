@@ -0,0 +1,125 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// Derive key from password with scrypt (RFC 7914). N is CPU/memory
+// cost (power of two), r is block size and p is parallelization.
+// Memory used is 128*N*r bytes.
+func scrypt(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+	if N <= 1 || N&(N-1) != 0 {
+		return nil, errors.New("scrypt: N must be power of two greater than 1")
+	}
+	if r <= 0 || p <= 0 || 1<<30 <= r*p || 1<<22 < N*r {
+		return nil, errors.New("scrypt: parameters are too large")
+	}
+	b := pbkdf2SHA256(password, salt, p*128*r)
+	x := make([]uint32, 32*r)
+	y := make([]uint32, 32*r)
+	v := make([]uint32, 32*r*N)
+	for i := 0; i < p; i++ {
+		block := b[i*128*r : (i+1)*128*r]
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(block[4*j:])
+		}
+		roMix(x, y, v, N, r)
+		for j, w := range x {
+			binary.LittleEndian.PutUint32(block[4*j:], w)
+		}
+	}
+	return pbkdf2SHA256(password, b, keyLen), nil
+}
+
+// PBKDF2-HMAC-SHA256 with single iteration, as used by scrypt.
+func pbkdf2SHA256(password, salt []byte, keyLen int) []byte {
+	h := hmac.New(sha256.New, password)
+	res := make([]byte, 0, keyLen+sha256.Size)
+	var n [4]byte
+	for i := uint32(1); len(res) < keyLen; i++ {
+		binary.BigEndian.PutUint32(n[:], i)
+		h.Reset()
+		h.Write(salt)
+		h.Write(n[:])
+		res = h.Sum(res)
+	}
+	return res[:keyLen]
+}
+
+// Sequential memory-hard mixing of block x in place. y is the
+// scratch block, v is space for N blocks.
+func roMix(x, y, v []uint32, N, r int) {
+	size := 32 * r
+	for i := 0; i < N; i++ {
+		copy(v[i*size:], x)
+		blockMix(x, y, r)
+	}
+	for i := 0; i < N; i++ {
+		j := int(x[size-16] & uint32(N-1))
+		for k, w := range v[j*size : (j+1)*size] {
+			x[k] ^= w
+		}
+		blockMix(x, y, r)
+	}
+}
+
+// Mix block b of 2*r 64-byte chunks in place with salsa20/8.
+// y is the scratch block of the same size.
+func blockMix(b, y []uint32, r int) {
+	var t [16]uint32
+	copy(t[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for k := range t {
+			t[k] ^= b[i*16+k]
+		}
+		salsa208(&t)
+		// even chunks go to the first half, odd ones to the second
+		copy(y[(i/2+(i%2)*r)*16:], t[:])
+	}
+	copy(b, y)
+}
+
+// Salsa20/8 core.
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		// columns
+		quarterRound(&x[0], &x[4], &x[8], &x[12])
+		quarterRound(&x[5], &x[9], &x[13], &x[1])
+		quarterRound(&x[10], &x[14], &x[2], &x[6])
+		quarterRound(&x[15], &x[3], &x[7], &x[11])
+		// rows
+		quarterRound(&x[0], &x[1], &x[2], &x[3])
+		quarterRound(&x[5], &x[6], &x[7], &x[4])
+		quarterRound(&x[10], &x[11], &x[8], &x[9])
+		quarterRound(&x[15], &x[12], &x[13], &x[14])
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
+
+func quarterRound(a, b, c, d *uint32) {
+	*b ^= bits.RotateLeft32(*a+*d, 7)
+	*c ^= bits.RotateLeft32(*b+*a, 9)
+	*d ^= bits.RotateLeft32(*c+*b, 13)
+	*a ^= bits.RotateLeft32(*d+*c, 18)
+}
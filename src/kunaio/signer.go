@@ -0,0 +1,173 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signer signs private API requests with HMAC-SHA256. The signed
+// payload is "METHOD|PATH|QUERY", where QUERY is the canonical form
+// of the request parameters (see CanonicalQuery) including access_key
+// and tonce.
+type Signer struct {
+	AccessKey string
+	SecretKey string
+	// Clock. Default is clock of the tonce source.
+	Now func() time.Time
+	// Tonce source. Default is the one set with SetNonceSource or
+	// MonotonicNonce shared by all the signers. Sources implementing
+	// TimedNonceSource use the clock above, if set.
+	Nonce NonceSource
+}
+
+// Create new signer with default clock and tonce source.
+func NewSigner(access_key, secret_key string) *Signer {
+	return &Signer{
+		AccessKey: access_key,
+		SecretKey: secret_key,
+	}
+}
+
+// Return canonical form of request parameters: sorted by name,
+// URL-encoded, without the signature.
+func CanonicalQuery(params url.Values) string {
+	if _, ok := params["signature"]; ok {
+		copied := url.Values{}
+		for k, v := range params {
+			if k != "signature" {
+				copied[k] = v
+			}
+		}
+		params = copied
+	}
+	return params.Encode()
+}
+
+// Return hex-encoded signature of request parameters.
+func (s *Signer) Signature(method, path string, params url.Values) string {
+	h := hmac.New(sha256.New, []byte(s.SecretKey))
+	h.Write([]byte(method + "|" + path + "|" + CanonicalQuery(params)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Return copy of request parameters with access key, tonce and
+// signature added.
+func (s *Signer) SignParams(method, path string, params url.Values) (url.Values, error) {
+	tonce, err := s.nonce()
+	if err != nil {
+		return nil, err
+	}
+	res := url.Values{}
+	for k, v := range params {
+		res[k] = append([]string{}, v...)
+	}
+	res.Set("access_key", s.AccessKey)
+	res.Set("tonce", strconv.FormatInt(tonce, 10))
+	res.Del("signature")
+	res.Set("signature", s.Signature(method, path, res))
+	return res, nil
+}
+
+// Sign HTTP request in place. Parameters are taken from the form body
+// of POST and PUT requests with "application/x-www-form-urlencoded"
+// content type, and from the URL query otherwise.
+func (s *Signer) Sign(r *http.Request) error {
+	if isForm(r) {
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		params, err := url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+		signed, err := s.SignParams(r.Method, r.URL.Path, params)
+		if err != nil {
+			return err
+		}
+		body = []byte(encodeSigned(signed))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		return nil
+	}
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	signed, err := s.SignParams(r.Method, r.URL.Path, params)
+	if err != nil {
+		return err
+	}
+	r.URL.RawQuery = encodeSigned(signed)
+	return nil
+}
+
+// Encode signed parameters in canonical order with the signature
+// at the end.
+func encodeSigned(params url.Values) string {
+	return CanonicalQuery(params) + "&signature=" +
+		url.QueryEscape(params.Get("signature"))
+}
+
+// Check if request parameters are passed in the form body.
+func isForm(r *http.Request) bool {
+	if r.Method != "POST" && r.Method != "PUT" {
+		return false
+	}
+	ct := r.Header.Get("Content-Type")
+	return strings.HasPrefix(ct, "application/x-www-form-urlencoded")
+}
+
+func (s *Signer) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// Return next tonce. Own clock of the signer, if set, is passed to
+// tonce sources implementing TimedNonceSource.
+func (s *Signer) nonce() (int64, error) {
+	src := s.Nonce
+	if src == nil {
+		src = gNonceSource
+	}
+	if src == nil {
+		return gNonce.after(s.now()), nil
+	}
+	if timed, ok := src.(TimedNonceSource); ok && s.Now != nil {
+		return timed.NextAt(s.Now())
+	}
+	return src.Next()
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Golden vectors computed independently of this package.
+var signerVectors = []struct {
+	method    string
+	path      string
+	params    url.Values
+	query     string
+	signature string
+}{
+	{
+		"GET", "/api/v2/members/me",
+		url.Values{},
+		"access_key=AKEY&tonce=1500000000000",
+		"9d7612949ccf4c8603121b86ccc9647fd5fbfc10fe31777fb65644d69eb68547",
+	},
+	{
+		"GET", "/api/v2/orders",
+		url.Values{"market": {"btcuah"}},
+		"access_key=AKEY&market=btcuah&tonce=1500000000000",
+		"7ca074ed91a40a244699f9ae129ee1675d127167b081c75267546aa5ac7443c1",
+	},
+	{
+		"POST", "/api/v2/orders",
+		url.Values{
+			"market": {"btcuah"},
+			"price":  {"150000.000000"},
+			"side":   {"buy"},
+			"volume": {"0.010000"},
+		},
+		"access_key=AKEY&market=btcuah&price=150000.000000&side=buy" +
+			"&tonce=1500000000000&volume=0.010000",
+		"dd4a3ef526706c011981662f615bd48ec27b9ee4ed66edb5c3c4ed6b342392c6",
+	},
+	{
+		"POST", "/api/v2/order/delete",
+		url.Values{"id": {"42"}},
+		"access_key=AKEY&id=42&tonce=1500000000000",
+		"344db00eac67b40b1a5ab0c021309e3ac2f51fe14e4a10936a450456fe980a62",
+	},
+	{
+		"GET", "/api/v2/orders",
+		url.Values{"market": {"btc uah"}, "note": {"a&b=c+d/é~"}},
+		"access_key=AKEY&market=btc+uah&note=a%26b%3Dc%2Bd%2F%C3%A9~" +
+			"&tonce=1500000000000",
+		"4dafdc2ed84baeda8384b21ca058ab5397d4a6199a03ced3649fa36378840134",
+	},
+}
+
+func testSigner() *Signer {
+	s := NewSigner("AKEY", "SKEY")
+	s.Nonce = NonceFunc(func() (int64, error) {
+		return 1500000000000, nil
+	})
+	return s
+}
+
+func TestSignParams(t *testing.T) {
+	s := testSigner()
+	for _, v := range signerVectors {
+		signed, err := s.SignParams(v.method, v.path, v.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q := CanonicalQuery(signed); q != v.query {
+			t.Errorf("%s %s: query %q, expected %q",
+				v.method, v.path, q, v.query)
+		}
+		if sig := signed.Get("signature"); sig != v.signature {
+			t.Errorf("%s %s: signature %s, expected %s",
+				v.method, v.path, sig, v.signature)
+		}
+		if _, ok := v.params["signature"]; ok {
+			t.Errorf("%s %s: original params modified",
+				v.method, v.path)
+		}
+	}
+}
+
+func TestSignQuery(t *testing.T) {
+	s := testSigner()
+	for _, v := range signerVectors {
+		r, err := http.NewRequest(v.method,
+			"https://kuna.io"+v.path+"?"+v.params.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Sign(r); err != nil {
+			t.Fatal(err)
+		}
+		expected := v.query + "&signature=" + v.signature
+		if r.URL.RawQuery != expected {
+			t.Errorf("%s %s: query %q, expected %q",
+				v.method, v.path, r.URL.RawQuery, expected)
+		}
+	}
+}
+
+func TestSignForm(t *testing.T) {
+	s := testSigner()
+	for _, v := range signerVectors {
+		if v.method != "POST" {
+			continue
+		}
+		r, err := http.NewRequest(v.method, "https://kuna.io"+v.path,
+			strings.NewReader(v.params.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := s.Sign(r); err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := v.query + "&signature=" + v.signature
+		if string(body) != expected || r.URL.RawQuery != "" {
+			t.Errorf("%s %s: body %q, query %q, expected body %q",
+				v.method, v.path, body, r.URL.RawQuery, expected)
+		}
+		if r.ContentLength != int64(len(expected)) {
+			t.Errorf("%s %s: content length %d, expected %d",
+				v.method, v.path, r.ContentLength, len(expected))
+		}
+	}
+}
+
+func TestSignerClock(t *testing.T) {
+	s := NewSigner("AKEY", "SKEY")
+	s.Now = func() time.Time { return time.Unix(1500000000, 0) }
+	s.Nonce = &MonotonicNonce{Now: s.Now}
+	v := signerVectors[1]
+	signed, err := s.SignParams(v.method, v.path, v.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Get("tonce") != "1500000000000" {
+		t.Errorf("tonce %s, expected 1500000000000", signed.Get("tonce"))
+	}
+	if signed.Get("signature") != v.signature {
+		t.Errorf("signature %s, expected %s",
+			signed.Get("signature"), v.signature)
+	}
+}
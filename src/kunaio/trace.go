@@ -0,0 +1,379 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tracer creates spans for API calls (see Middleware) and bot
+// decisions (see StartSpan) and passes finished spans to the
+// exporter. Spans are linked through context: API calls made with
+// Client.WithContext(ctx) become children of the span in ctx.
+type Tracer struct {
+	Exporter SpanExporter
+}
+
+// Receives finished spans.
+type SpanExporter interface {
+	ExportSpan(span *Span) error
+}
+
+// Span is a timed operation: API call or bot decision.
+type Span struct {
+	// Hex-encoded 16-byte trace ID
+	TraceID string
+	// Hex-encoded 8-byte span ID
+	SpanID string
+	// Parent span ID or empty string for root span
+	ParentID string
+	Name     string
+	Start    time.Time
+	End      time.Time
+	// Attributes: operation, market, status and so on
+	Attrs map[string]interface{}
+	// Error message if the operation failed
+	Error  string
+	tracer *Tracer
+	lock   sync.Mutex
+	ended  bool
+	// span of outgoing API call
+	client bool
+}
+
+type spanKey struct{}
+
+// Default tracer used by StartSpan when there is no span in context
+var gTracer *Tracer
+
+// Set tracer of bot decisions made by DCA scheduler, conditional
+// order engine and execution algorithms, and of StartSpan calls
+// without parent span. Nil disables tracing. Not safe to call
+// concurrently with API calls.
+func SetTracer(t *Tracer) {
+	gTracer = t
+}
+
+// Create new tracer.
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{Exporter: exporter}
+}
+
+// Return span stored in context or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start span as a child of the span in context, with attributes
+// given as key and value pairs. Returns the context with the new
+// span. End the span with Span.Finish.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...interface{}) (context.Context, *Span) {
+	s := &Span{
+		SpanID: randomHex(8),
+		Name:   name,
+		Start:  time.Now(),
+		Attrs:  map[string]interface{}{},
+		tracer: t,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	s.SetAttrs(attrs...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Start span with the tracer of the span in context, or the tracer
+// set with SetTracer. Returns nil span, which is safe to use, when
+// tracing is disabled.
+func StartSpan(ctx context.Context, name string, attrs ...interface{}) (context.Context, *Span) {
+	t := gTracer
+	if parent := SpanFromContext(ctx); parent != nil {
+		t = parent.tracer
+	}
+	if t == nil {
+		return ctx, nil
+	}
+	return t.Start(ctx, name, attrs...)
+}
+
+// Set span attributes given as key and value pairs.
+func (s *Span) SetAttrs(attrs ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.Attrs[fmt.Sprint(attrs[i])] = attrs[i+1]
+	}
+}
+
+// Return copy of the span attributes, safe to use while the span
+// is being changed.
+func (s *Span) attrs() map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make(map[string]interface{}, len(s.Attrs))
+	for k, v := range s.Attrs {
+		res[k] = v
+	}
+	return res
+}
+
+// End the span, marking it failed if err is not nil, and export it.
+// Subsequent calls do nothing.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.lock.Unlock()
+	if s.tracer.Exporter == nil {
+		return
+	}
+	if err := s.tracer.Exporter.ExportSpan(s); err != nil {
+		debugLog("export span: %s", err)
+	}
+}
+
+// Return middleware creating span for every API call, with
+// operation, market, HTTP status and retry count attributes. Trace
+// context is passed to the server in W3C "traceparent" header.
+func (t *Tracer) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			r := call.Request
+			ctx, span := t.Start(r.Context(), call.Operation,
+				"operation", call.Operation,
+				"private", call.Private,
+				"http.method", r.Method,
+				"http.path", r.URL.Path)
+			if market := r.URL.Query().Get("market"); market != "" {
+				span.SetAttrs("market", market)
+			}
+			span.client = true
+			r = r.Clone(ctx)
+			r.Header.Set("traceparent",
+				"00-"+span.TraceID+"-"+span.SpanID+"-01")
+			resp, err := next(call.WithRequest(r))
+			span.SetAttrs("retries", call.Attempts()-1)
+			if err != nil {
+				span.Finish(err)
+				return resp, err
+			}
+			span.SetAttrs("http.status_code", resp.StatusCode)
+			if resp.StatusCode/100 != 2 {
+				span.Finish(fmt.Errorf("%s", resp.Status))
+				return resp, err
+			}
+			call.OnDecoded(span.Finish)
+			return resp, err
+		}
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Exporter writing spans as JSON lines.
+type StdoutExporter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// Create exporter writing spans as JSON lines to w.
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	return &StdoutExporter{w: w}
+}
+
+// Write the span.
+func (e *StdoutExporter) ExportSpan(s *Span) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"trace_id":  s.TraceID,
+		"span_id":   s.SpanID,
+		"parent_id": s.ParentID,
+		"name":      s.Name,
+		"start":     s.Start,
+		"end":       s.End,
+		"duration":  s.End.Sub(s.Start).String(),
+		"attrs":     s.attrs(),
+		"error":     s.Error,
+	})
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
+
+// Default number of spans sent by OTLPExporter at once
+const DefaultOTLPBatchSize = 64
+
+// Exporter sending spans to OpenTelemetry collector with OTLP/HTTP
+// JSON protocol, e.g. to "http://localhost:4318/v1/traces". Spans
+// are sent in batches; call Flush before exit.
+type OTLPExporter struct {
+	URL string
+	// Service name. Default is "kunaio".
+	Service string
+	// Default is DefaultOTLPBatchSize.
+	BatchSize int
+	// HTTP client. Default is http.DefaultClient, so spans are not
+	// sent through API transport.
+	Client *http.Client
+	lock   sync.Mutex
+	spans  []*Span
+}
+
+// Create OTLP exporter.
+func NewOTLPExporter(url string) *OTLPExporter {
+	return &OTLPExporter{
+		URL:       url,
+		Service:   "kunaio",
+		BatchSize: DefaultOTLPBatchSize,
+	}
+}
+
+// Queue the span and send the batch if it is full.
+func (e *OTLPExporter) ExportSpan(s *Span) error {
+	e.lock.Lock()
+	e.spans = append(e.spans, s)
+	full := e.BatchSize <= len(e.spans)
+	e.lock.Unlock()
+	if full {
+		return e.Flush()
+	}
+	return nil
+}
+
+// Send all the queued spans.
+func (e *OTLPExporter) Flush() error {
+	e.lock.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.lock.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(otlpRequest(e.Service, spans))
+	if err != nil {
+		return err
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(e.URL, "application/json",
+		bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Make ExportTraceServiceRequest in OTLP JSON encoding.
+func otlpRequest(service string, spans []*Span) interface{} {
+	type m = map[string]interface{}
+	attr := func(k string, v interface{}) m {
+		var value m
+		switch v := v.(type) {
+		case string:
+			value = m{"stringValue": v}
+		case bool:
+			value = m{"boolValue": v}
+		case int:
+			value = m{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = m{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = m{"doubleValue": v}
+		default:
+			value = m{"stringValue": fmt.Sprint(v)}
+		}
+		return m{"key": k, "value": value}
+	}
+	var res []m
+	for _, s := range spans {
+		attrs := []m{}
+		for k, v := range s.attrs() {
+			attrs = append(attrs, attr(k, v))
+		}
+		kind := 1 // internal
+		if s.client {
+			kind = 3
+		}
+		status := m{"code": 1}
+		if s.Error != "" {
+			status = m{"code": 2, "message": s.Error}
+		}
+		res = append(res, m{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"parentSpanId":      s.ParentID,
+			"name":              s.Name,
+			"kind":              kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		})
+	}
+	if service == "" {
+		service = "kunaio"
+	}
+	return m{"resourceSpans": []m{{
+		"resource": m{"attributes": []m{
+			attr("service.name", service),
+		}},
+		"scopeSpans": []m{{
+			"scope": m{"name": "kunaio"},
+			"spans": res,
+		}},
+	}}}
+}
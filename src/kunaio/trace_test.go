@@ -0,0 +1,178 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Start fake server and point the package at it. The intercept
+// function sees every request first and tells whether it has
+// answered it itself.
+func startTraced(t *testing.T, intercept func(w http.ResponseWriter, r *http.Request) bool) func() {
+	t.Helper()
+	s := fakeserver.New()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !intercept(w, r) {
+			s.ServeHTTP(w, r)
+		}
+	}))
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	return func() {
+		kunaio.SetBaseURL(old)
+		ts.Close()
+	}
+}
+
+// Exporter keeping finished spans in memory.
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []*kunaio.Span
+}
+
+func (r *spanRecorder) ExportSpan(s *kunaio.Span) error {
+	r.lock.Lock()
+	r.spans = append(r.spans, s)
+	r.lock.Unlock()
+	return nil
+}
+
+var traceparentRe = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-01$`)
+
+func TestTraceparent(t *testing.T) {
+	var headers []string
+	defer startTraced(t, func(w http.ResponseWriter, r *http.Request) bool {
+		headers = append(headers, r.Header.Get("traceparent"))
+		return false
+	})()
+	exporter := &spanRecorder{}
+	tracer := kunaio.NewTracer(exporter)
+	client := kunaio.NewClient("", "").Use(tracer.Middleware())
+	ctx, decision := tracer.Start(context.Background(), "Decision",
+		"market", kunaio.BTCUAH)
+	if _, err := client.WithContext(ctx).GetOrderBook(kunaio.BTCUAH); err != nil {
+		t.Fatal(err)
+	}
+	decision.Finish(nil)
+	// call without parent span starts new trace
+	if _, err := client.GetOrderBook(kunaio.BTCUAH); err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || len(exporter.spans) != 3 {
+		t.Fatalf("headers %q, spans %d", headers, len(exporter.spans))
+	}
+	child, root, other := exporter.spans[0], exporter.spans[1],
+		exporter.spans[2]
+	if root != decision || root.ParentID != "" {
+		t.Fatalf("root span: %+v", root)
+	}
+	for i, c := range []struct {
+		span   *kunaio.Span
+		trace  string
+		parent string
+	}{
+		{child, decision.TraceID, decision.SpanID},
+		{other, other.TraceID, ""},
+	} {
+		m := traceparentRe.FindStringSubmatch(headers[i])
+		if m == nil {
+			t.Errorf("invalid traceparent %q", headers[i])
+			continue
+		}
+		s := c.span
+		if s.Name != "GetOrderBook" || s.TraceID != c.trace ||
+			s.ParentID != c.parent || s.SpanID == c.parent {
+			t.Errorf("span %d: %+v", i, s)
+		}
+		// the server sees the API call span as the parent
+		if m[1] != s.TraceID || m[2] != s.SpanID {
+			t.Errorf("traceparent %q of span %s/%s",
+				headers[i], s.TraceID, s.SpanID)
+		}
+		if s.Attrs["http.status_code"] != 200 || s.Attrs["market"] != kunaio.BTCUAH {
+			t.Errorf("span %d attributes: %v", i, s.Attrs)
+		}
+	}
+	if other.TraceID == decision.TraceID {
+		t.Errorf("trace ID reused: %s", other.TraceID)
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := kunaio.NewTracer(kunaio.NewStdoutExporter(&buf))
+	ctx, parent := tracer.Start(context.Background(), "Parent")
+	_, span := kunaio.StartSpan(ctx, "Child", "volume", 0.5)
+	done := make(chan struct{})
+	go func() {
+		// attributes set while the span is exported
+		for i := 0; i < 100; i++ {
+			span.SetAttrs("i", i)
+		}
+		close(done)
+	}()
+	span.Finish(nil)
+	<-done
+	var out struct {
+		TraceID  string                 `json:"trace_id"`
+		SpanID   string                 `json:"span_id"`
+		ParentID string                 `json:"parent_id"`
+		Name     string                 `json:"name"`
+		Attrs    map[string]interface{} `json:"attrs"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("%s: %q", err, buf.String())
+	}
+	if out.TraceID != parent.TraceID || out.ParentID != parent.SpanID ||
+		out.SpanID != span.SpanID || out.Name != "Child" ||
+		out.Attrs["volume"] != 0.5 {
+		t.Errorf("exported: %+v", out)
+	}
+}
+
+// Retries made inside the span are counted.
+func TestTraceRetries(t *testing.T) {
+	failures := 1
+	defer startTraced(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if 0 < failures {
+			failures--
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})()
+	exporter := &spanRecorder{}
+	tracer := kunaio.NewTracer(exporter)
+	client := kunaio.NewClient("", "").Use(tracer.Middleware(),
+		kunaio.Retry(2, time.Millisecond))
+	if _, err := client.GetOrderBook(kunaio.BTCUAH); err != nil {
+		t.Fatal(err)
+	}
+	if len(exporter.spans) != 1 || exporter.spans[0].Attrs["retries"] != 1 {
+		t.Errorf("spans: %+v", exporter.spans)
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Order lifecycle event types
+const (
+	OrderPartiallyFilled = "partially-filled"
+	OrderFilled          = "filled"
+	OrderCancelled       = "cancelled"
+	OrderRejected        = "rejected"
+)
+
+// Default interval between order state checks of PollingFeed
+const DefaultTrackerPollInterval = 5 * time.Second
+
+// Number of extra order updates to wait for deals of a finished
+// order to be attributed before reporting it without them.
+const trackerAttributionRetries = 3
+
+// Volumes below this are treated as zero
+const volumeEpsilon = 1e-9
+
+var (
+	// Returned by WaitForFill when the order is cancelled
+	ErrOrderCancelled = errors.New("order cancelled")
+	// Returned by WaitForFill when the order is rejected
+	ErrOrderRejected = errors.New("order rejected")
+)
+
+// Order lifecycle event.
+type OrderEvent struct {
+	// One of Order* event types
+	Type string `json:"type"`
+	// Latest order state
+	Order Order `json:"order"`
+	// User deals made since the previous event of the order
+	Fills Trades `json:"fills"`
+	// Rejection reason
+	Err error `json:"-"`
+	// Event time
+	Time time.Time `json:"time"`
+}
+
+// Source of order state updates for OrderTracker.
+type OrderFeed interface {
+	// Send states of the watched orders to out until the context
+	// is done. The watched function returns IDs of orders the
+	// tracker is interested in at the moment.
+	Run(ctx context.Context, watched func() []int, out chan<- Order) error
+}
+
+// Order feed which requests watched orders with GetOrder.
+type PollingFeed struct {
+	Client *Client
+	// Zero means DefaultTrackerPollInterval
+	Interval time.Duration
+}
+
+func (f *PollingFeed) Run(ctx context.Context, watched func() []int, out chan<- Order) error {
+	ticker := time.NewTicker(f.interval())
+	defer ticker.Stop()
+	for {
+		for _, id := range watched() {
+			order, err := f.Client.GetOrder(id)
+			if err != nil {
+				debugLog("order feed: get order %d: %s", id, err)
+				continue
+			}
+			select {
+			case out <- order:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *PollingFeed) interval() time.Duration {
+	if f.Interval <= 0 {
+		return DefaultTrackerPollInterval
+	}
+	return f.Interval
+}
+
+// Order feed which passes order updates from a streaming transport
+// (e.g. websocket client). Updates for not watched orders are
+// dropped.
+type StreamFeed struct {
+	Updates <-chan Order
+}
+
+func (f *StreamFeed) Run(ctx context.Context, watched func() []int, out chan<- Order) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case order, ok := <-f.Updates:
+			if !ok {
+				return errors.New("order stream closed")
+			}
+			if !containsInt(watched(), order.ID) {
+				continue
+			}
+			select {
+			case out <- order:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func containsInt(list []int, v int) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+type trackedOrder struct {
+	order Order
+	known bool
+	// executed volume covered by attributed deals
+	attributed float64
+	// updates of the finished order spent waiting for its deals
+	retries  int
+	finished bool
+	// final event type
+	result  string
+	err     error
+	waiters []chan struct{}
+}
+
+// Watches user orders and reports their lifecycle events with
+// deals attributed from GetUserTrades.
+type OrderTracker struct {
+	// API client used for fill attribution and order placement
+	Client *Client
+	// Order state source. Default is PollingFeed.
+	Feed OrderFeed
+	// Optional hook called on every order event
+	OnEvent func(OrderEvent)
+	orders  map[int]*trackedOrder
+	// IDs of deals already attributed to orders
+	seenTrades map[int]bool
+	lock       sync.Mutex
+}
+
+// Create new order tracker with polling feed.
+func NewOrderTracker(client *Client) *OrderTracker {
+	return &OrderTracker{
+		Client: client,
+		Feed:   &PollingFeed{Client: client},
+	}
+}
+
+// Start watching orders.
+func (t *OrderTracker) Watch(ids ...int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.init()
+	for _, id := range ids {
+		if _, ok := t.orders[id]; !ok {
+			t.orders[id] = &trackedOrder{}
+		}
+	}
+}
+
+// Stop watching the order.
+func (t *OrderTracker) Unwatch(id int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if o, ok := t.orders[id]; ok {
+		t.finish(o, "", nil)
+		delete(t.orders, id)
+	}
+}
+
+func (t *OrderTracker) init() {
+	if t.orders == nil {
+		t.orders = map[int]*trackedOrder{}
+		t.seenTrades = map[int]bool{}
+	}
+}
+
+// Create new limit order and start watching it. Failed placement
+// is reported as OrderRejected event.
+func (t *OrderTracker) NewOrder(market, side string, volume, price float64) (Order, error) {
+	order, err := t.Client.NewOrder(market, side, volume, price)
+	if err != nil {
+		t.emit(OrderEvent{
+			Type: OrderRejected,
+			Order: Order{
+				Side:    side,
+				OrdType: "limit",
+				Price:   price,
+				Market:  market,
+				Volume:  volume,
+			},
+			Err:  err,
+			Time: time.Now(),
+		})
+		return order, err
+	}
+	t.Watch(order.ID)
+	return order, nil
+}
+
+// Return IDs of the orders which are not finished yet.
+func (t *OrderTracker) watched() []int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var ids []int
+	for id, o := range t.orders {
+		if !o.finished {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Process order updates until the context is done.
+func (t *OrderTracker) Run(ctx context.Context) error {
+	updates := make(chan Order)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	feedErr := make(chan error, 1)
+	go func() {
+		feedErr <- t.Feed.Run(ctx, t.watched, updates)
+	}()
+	// finished orders waiting for their deals may get no more
+	// updates from the feed
+	interval := DefaultTrackerPollInterval
+	if f, ok := t.Feed.(*PollingFeed); ok {
+		interval = f.interval()
+	}
+	retry := time.NewTicker(interval)
+	defer retry.Stop()
+	for {
+		select {
+		case order := <-updates:
+			t.Update(order)
+		case <-retry.C:
+			for _, order := range t.unattributed() {
+				t.Update(order)
+			}
+		case err := <-feedErr:
+			return err
+		}
+	}
+}
+
+// Return finished orders waiting for their deals.
+func (t *OrderTracker) unattributed() []Order {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var res []Order
+	for _, o := range t.orders {
+		if !o.finished && 0 < o.retries {
+			res = append(res, o.order)
+		}
+	}
+	return res
+}
+
+// Process order state update. Feeds call it through Run, but it
+// can be called directly too. Executed volume not covered by deals
+// yet, e.g. because GetUserTrades failed, is attributed on the next
+// updates.
+func (t *OrderTracker) Update(order Order) {
+	t.lock.Lock()
+	t.init()
+	o, ok := t.orders[order.ID]
+	if !ok || o.finished {
+		t.lock.Unlock()
+		return
+	}
+	prev := o.order
+	if o.known && order.ExecutedVolume < prev.ExecutedVolume {
+		// stale update
+		t.lock.Unlock()
+		return
+	}
+	o.order = order
+	o.known = true
+	unattributed := order.ExecutedVolume - o.attributed
+	t.lock.Unlock()
+
+	var fills Trades
+	if volumeEpsilon < unattributed {
+		fills = t.attribute(order, unattributed)
+	}
+	t.lock.Lock()
+	o.attributed += fills.SumVolume()
+	unattributed = order.ExecutedVolume - o.attributed
+	t.lock.Unlock()
+	ev := OrderEvent{
+		Order: order,
+		Fills: fills,
+		Time:  time.Now(),
+	}
+	switch order.State {
+	case OrderWait:
+		if fills == nil && prev.ExecutedVolume == order.ExecutedVolume {
+			return
+		}
+		ev.Type = OrderPartiallyFilled
+	case OrderDone:
+		ev.Type = OrderFilled
+	case OrderCancel:
+		ev.Type = OrderCancelled
+	default:
+		ev.Type = OrderRejected
+		ev.Err = fmt.Errorf("order state: %s", order.State)
+	}
+	if ev.Type != OrderPartiallyFilled {
+		t.lock.Lock()
+		if volumeEpsilon < unattributed && o.retries < trackerAttributionRetries {
+			// the final event waits for the deals
+			o.retries++
+			t.lock.Unlock()
+			if fills != nil {
+				ev.Type = OrderPartiallyFilled
+				t.emit(ev)
+			}
+			return
+		}
+		if volumeEpsilon < unattributed {
+			debugLog("order tracker: order %d: no deals found for"+
+				" executed volume %f", order.ID, unattributed)
+		}
+		t.finish(o, ev.Type, ev.Err)
+		t.lock.Unlock()
+	}
+	t.emit(ev)
+}
+
+// Find user deals for the executed volume of the order. Deals
+// reported with order ID are matched exactly, others are matched
+// by market, side and time. Returns nil if the deals could not
+// be fetched.
+func (t *OrderTracker) attribute(order Order, volume float64) Trades {
+	trades, err := t.Client.GetUserTrades(order.Market)
+	if err != nil {
+		debugLog("order tracker: get user trades: %s", err)
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var res Trades
+	for _, tr := range trades {
+		if t.seenTrades[tr.ID] {
+			continue
+		}
+		if tr.OrderID != 0 {
+			if tr.OrderID == order.ID {
+				res = append(res, tr)
+			}
+			continue
+		}
+		if volume <= res.SumVolume() || !sameSide(tr.Side, order.Side) ||
+			tr.CreatedAt.Before(order.CreatedAt) {
+			continue
+		}
+		res = append(res, tr)
+	}
+	for _, tr := range res {
+		t.seenTrades[tr.ID] = true
+	}
+	return res
+}
+
+// Compare deal side ("bid"/"ask" or "buy"/"sell") with order side.
+func sameSide(tradeSide, orderSide string) bool {
+	switch tradeSide {
+	case "bid":
+		tradeSide = "buy"
+	case "ask":
+		tradeSide = "sell"
+	}
+	return tradeSide == orderSide
+}
+
+// Mark order finished and wake up waiters. Must be called with
+// the lock held.
+func (t *OrderTracker) finish(o *trackedOrder, result string, err error) {
+	o.finished = true
+	o.result = result
+	o.err = err
+	for _, w := range o.waiters {
+		close(w)
+	}
+	o.waiters = nil
+}
+
+func (t *OrderTracker) emit(ev OrderEvent) {
+	if t.OnEvent != nil {
+		t.OnEvent(ev)
+	}
+}
+
+// Wait until the order is filled. Starts watching the order if it
+// is not watched yet. Run must be active for the order to be
+// updated. Returns ErrOrderCancelled or ErrOrderRejected if the
+// order is finished without being filled completely.
+func (t *OrderTracker) WaitForFill(ctx context.Context, id int) (Order, error) {
+	t.Watch(id)
+	t.lock.Lock()
+	o := t.orders[id]
+	if !o.finished {
+		w := make(chan struct{})
+		o.waiters = append(o.waiters, w)
+		t.lock.Unlock()
+		select {
+		case <-w:
+		case <-ctx.Done():
+			return Order{}, ctx.Err()
+		}
+		t.lock.Lock()
+	}
+	defer t.lock.Unlock()
+	switch o.result {
+	case OrderFilled:
+		return o.order, nil
+	case OrderCancelled:
+		return o.order, ErrOrderCancelled
+	case OrderRejected:
+		return o.order, fmt.Errorf("%w: %v", ErrOrderRejected, o.err)
+	}
+	return o.order, fmt.Errorf("order %d is not watched", id)
+}
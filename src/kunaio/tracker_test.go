@@ -0,0 +1,225 @@
+// Copyright 2017 Aleksey Morarash <tuxofil@gmail.com>
+//
+// Licensed under the BSD 2 Clause License (the "License");
+// you may not use the file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://opensource.org/licenses/BSD-2-Clause
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kunaio_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"kunaio"
+	"kunaio/fakeserver"
+)
+
+// Order update step: make the next deals on the exchange, then
+// update the order state.
+type trackerStep struct {
+	deals    int
+	state    string
+	executed float64
+}
+
+// Track 1 BTC buy order at 100 through the update steps. The deals are made in order: 0.3 BTC of the
+// order (deal 1), 0.5 BTC of another user order (deal 2) and 0.7 BTC
+// of the order (deal 3). The first failures GetUserTrades calls
+// fail. Returns all the events.
+func runTracker(t *testing.T, failures int, steps ...trackerStep) []kunaio.OrderEvent {
+	t.Helper()
+	s := fakeserver.New()
+	s.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"uah": 1000, "btc": 1})
+	var lock sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		fail := r.URL.Path == "/api/v2/trades/my" && 0 < failures
+		if fail {
+			failures--
+		}
+		lock.Unlock()
+		if fail {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	defer kunaio.SetBaseURL(old)
+	client := kunaio.NewClient("ak", "sk")
+	order, err := client.NewOrder(kunaio.BTCUAH, "buy", 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NewOrder(kunaio.BTCUAH, "sell", 0.5, 200); err != nil {
+		t.Fatal(err)
+	}
+	deals := []struct {
+		side          string
+		volume, price float64
+	}{{"sell", 0.3, 100}, {"buy", 0.5, 200}, {"sell", 0.7, 100}}
+	tracker := kunaio.NewOrderTracker(client)
+	var events []kunaio.OrderEvent
+	tracker.OnEvent = func(ev kunaio.OrderEvent) { events = append(events, ev) }
+	tracker.Watch(order.ID)
+	for _, step := range steps {
+		for i := 0; i < step.deals; i++ {
+			d := deals[0]
+			deals = deals[1:]
+			if _, err := s.SeedOrder(kunaio.BTCUAH, d.side, d.volume, d.price); err != nil {
+				t.Fatal(err)
+			}
+		}
+		update := order
+		update.State = step.state
+		update.ExecutedVolume = step.executed
+		update.RemainingVolume = order.Volume - step.executed
+		tracker.Update(update)
+	}
+	return events
+}
+
+// Expected event: type and IDs of the attributed deals.
+type wantEvent struct {
+	typ   string
+	fills []int
+}
+
+func checkEvents(t *testing.T, name string, events []kunaio.OrderEvent, want []wantEvent) {
+	t.Helper()
+	if len(events) != len(want) {
+		t.Errorf("%s: expected %d events, got %d: %+v",
+			name, len(want), len(events), events)
+		return
+	}
+	for i, ev := range events {
+		var ids []int
+		for _, tr := range ev.Fills {
+			ids = append(ids, tr.ID)
+		}
+		if ev.Type != want[i].typ || len(ids) != len(want[i].fills) {
+			t.Errorf("%s: event #%d: expected %v, got %s %v",
+				name, i, want[i], ev.Type, ids)
+			continue
+		}
+		for j := range ids {
+			if ids[j] != want[i].fills[j] {
+				t.Errorf("%s: event #%d: expected %v, got %s %v",
+					name, i, want[i], ev.Type, ids)
+				break
+			}
+		}
+	}
+}
+
+func TestOrderTracker(t *testing.T) {
+	const (
+		wait   = kunaio.OrderWait
+		done   = kunaio.OrderDone
+		cancel = kunaio.OrderCancel
+	)
+	for _, c := range []struct {
+		name     string
+		failures int
+		steps    []trackerStep
+		want     []wantEvent
+	}{
+		{"filled", 0,
+			[]trackerStep{{0, wait, 0}, {2, wait, 0.3}, {0, wait, 0.3},
+				{1, done, 1}},
+			[]wantEvent{
+				{kunaio.OrderPartiallyFilled, []int{1}},
+				{kunaio.OrderFilled, []int{3}},
+			}},
+		// deals are listed newest first, as the exchange returns them
+		{"stale update", 0,
+			[]trackerStep{{3, wait, 0.3}, {0, wait, 0}, {0, done, 1}},
+			[]wantEvent{
+				{kunaio.OrderPartiallyFilled, []int{3, 1}},
+				{kunaio.OrderFilled, nil},
+			}},
+		// fills are kept for the next update if attribution fails
+		{"trades failure", 1,
+			[]trackerStep{{2, wait, 0.3}, {0, wait, 0.3}, {1, done, 1}},
+			[]wantEvent{
+				{kunaio.OrderPartiallyFilled, nil},
+				{kunaio.OrderPartiallyFilled, []int{1}},
+				{kunaio.OrderFilled, []int{3}},
+			}},
+		// final event waits for the deals
+		{"late deals", 1,
+			[]trackerStep{{2, done, 1}, {0, done, 1}, {1, done, 1}},
+			[]wantEvent{
+				{kunaio.OrderPartiallyFilled, []int{1}},
+				{kunaio.OrderFilled, []int{3}},
+			}},
+		{"deals never found", 0,
+			[]trackerStep{{0, done, 1}, {0, done, 1}, {0, done, 1},
+				{0, done, 1}},
+			[]wantEvent{
+				{kunaio.OrderFilled, nil},
+			}},
+		{"cancelled", 0,
+			[]trackerStep{{0, wait, 0}, {2, cancel, 0.3}},
+			[]wantEvent{
+				{kunaio.OrderCancelled, []int{1}},
+			}},
+	} {
+		checkEvents(t, c.name, runTracker(t, c.failures, c.steps...), c.want)
+	}
+}
+
+func TestOrderTrackerRun(t *testing.T) {
+	s := fakeserver.New()
+	s.AddAccount("ak", "sk", "user@example.com",
+		map[string]float64{"uah": 1000})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	old := kunaio.BaseURL()
+	kunaio.SetBaseURL(ts.URL)
+	defer kunaio.SetBaseURL(old)
+	client := kunaio.NewClient("ak", "sk")
+	tracker := kunaio.NewOrderTracker(client)
+	tracker.Feed = &kunaio.PollingFeed{Client: client,
+		Interval: time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go tracker.Run(ctx)
+	filled, err := client.NewOrder(kunaio.BTCUAH, "buy", 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled, err := client.NewOrder(kunaio.BTCUAH, "buy", 1, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SeedOrder(kunaio.BTCUAH, "sell", 1.5, 90); err != nil {
+		t.Fatal(err)
+	}
+	order, err := tracker.WaitForFill(ctx, filled.ID)
+	if err != nil || order.State != kunaio.OrderDone {
+		t.Errorf("filled order: %+v, %v", order, err)
+	}
+	if err := s.CancelOrder(cancelled.ID); err != nil {
+		t.Fatal(err)
+	}
+	order, err = tracker.WaitForFill(ctx, cancelled.ID)
+	if err != kunaio.ErrOrderCancelled || order.ExecutedVolume != 0.5 {
+		t.Errorf("cancelled order: %+v, %v", order, err)
+	}
+}